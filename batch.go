@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/locks"
+	paymentspan "payment-service/internal/payments"
+	"payment-service/internal/telemetry"
+)
+
+// ItemResult reports the outcome of one item of a batch or import request.
+// CorrelationID identifies the item's span as "<trace-id>-<span-id>", so a
+// failed item can be looked up directly in the tracing backend.
+type ItemResult struct {
+	Index         int      `json:"index"`
+	CorrelationID string   `json:"correlation_id"`
+	Status        string   `json:"status"`
+	Payment       *Payment `json:"payment,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	FailureDomain string   `json:"failure_domain,omitempty"`
+}
+
+// Batch outcomes.
+const (
+	batchSucceeded = "succeeded"
+	batchPartial   = "partial"
+	batchFailed    = "failed"
+)
+
+// BatchResponse is the body of a batch or import response. Results has one
+// entry per item in request order; Errors repeats the failed ones so clients
+// can handle them without scanning every result.
+//
+// The response status follows the outcome: 201 when every item was created,
+// 207 Multi-Status when some failed, and when all failed 422 if every failure
+// was the client's fault and 500 otherwise. A partial success is not an error
+// of the batch: the batch span and server span stay unset and only the failed
+// item spans are marked as errors.
+type BatchResponse struct {
+	Outcome   string       `json:"outcome"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []ItemResult `json:"results"`
+	Errors    []ItemResult `json:"errors,omitempty"`
+}
+
+// batchAdmission caps the batch and import items being processed at once,
+// one unit per item, so a few large batches can't flood the lanes. Main
+// sizes it with -batch-capacity.
+var batchAdmission = locks.NewWeighted("batch.admission", 1000)
+
+type batchItem struct {
+	payment Payment
+	err     error
+}
+
+// batchHandler creates every payment in a JSON array body.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var batch []Payment
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid JSON", telemetry.WithFailureDomain(err, telemetry.DomainClient))
+		return
+	}
+
+	items := make([]batchItem, len(batch))
+	for i, p := range batch {
+		items[i].payment = p
+	}
+	release, ok := admitItems(w, r, len(items))
+	if !ok {
+		return
+	}
+	defer release()
+	writeBatchResponse(w, processItems(r, "payment.batch", items))
+}
+
+// importHandler creates one payment per line of an NDJSON body. Lines that
+// fail to decode are reported as failed items instead of failing the import.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var items []batchItem
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var item batchItem
+		if err := json.Unmarshal(line, &item.payment); err != nil {
+			item.err = telemetry.WithFailureDomain(fmt.Errorf("invalid JSON: %w", err), telemetry.DomainClient)
+		}
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid NDJSON", telemetry.WithFailureDomain(err, telemetry.DomainClient))
+		return
+	}
+
+	release, ok := admitItems(w, r, len(items))
+	if !ok {
+		return
+	}
+	defer release()
+	writeBatchResponse(w, processItems(r, "payment.import", items))
+}
+
+// admitItems waits for batchAdmission to admit n items, and otherwise
+// writes the error response. A batch larger than the whole capacity is
+// rejected with 413 rather than waiting forever.
+func admitItems(w http.ResponseWriter, r *http.Request, n int) (release func(), ok bool) {
+	release, err := batchAdmission.Acquire(r.Context(), int64(n))
+	switch {
+	case errors.Is(err, locks.ErrTooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, "Batch has more items than can be processed at once",
+			telemetry.WithFailureDomain(err, telemetry.DomainClient))
+		return nil, false
+	case err != nil:
+		writeError(w, r, http.StatusServiceUnavailable, "Too many batch items pending", err)
+		return nil, false
+	}
+	return release, true
+}
+
+// processItems runs each item under its own child span of a span for the
+// whole request, and logs failed items with their correlation ID.
+func processItems(r *http.Request, name string, items []batchItem) BatchResponse {
+	ctx, span := telemetry.Tracer().Start(r.Context(), name,
+		trace.WithAttributes(attribute.Int("batch.size", len(items))),
+	)
+	defer span.End()
+
+	resp := BatchResponse{Results: make([]ItemResult, len(items))}
+	for i, item := range items {
+		resp.Results[i] = processItem(ctx, name, i, item)
+		if resp.Results[i].Status == "failed" {
+			resp.Errors = append(resp.Errors, resp.Results[i])
+		}
+	}
+	resp.Failed = len(resp.Errors)
+	resp.Succeeded = len(items) - resp.Failed
+
+	switch {
+	case resp.Failed == 0:
+		resp.Outcome = batchSucceeded
+	case resp.Succeeded > 0:
+		resp.Outcome = batchPartial
+	default:
+		resp.Outcome = batchFailed
+		span.SetStatus(codes.Error, fmt.Sprintf("all %d items failed", resp.Failed))
+	}
+	span.SetAttributes(
+		attribute.Int("batch.succeeded", resp.Succeeded),
+		attribute.Int("batch.failed", resp.Failed),
+		attribute.String("batch.outcome", resp.Outcome),
+	)
+
+	op := attribute.String("batch.operation", name)
+	m := batchMetrics()
+	m.requests.Add(ctx, 1, metric.WithAttributes(op, attribute.String("batch.outcome", resp.Outcome)))
+	m.items.Add(ctx, int64(resp.Succeeded), metric.WithAttributes(op, attribute.String("outcome", "succeeded")))
+	m.items.Add(ctx, int64(resp.Failed), metric.WithAttributes(op, attribute.String("outcome", "failed")))
+	return resp
+}
+
+func processItem(ctx context.Context, name string, index int, item batchItem) ItemResult {
+	ctx, span := paymentspan.StartSpan(ctx, name+".item", item.payment.ref(),
+		trace.WithAttributes(attribute.Int("batch.item.index", index)),
+	)
+	defer span.End()
+
+	sc := span.SpanContext()
+	result := ItemResult{
+		Index:         index,
+		CorrelationID: sc.TraceID().String() + "-" + sc.SpanID().String(),
+	}
+	span.SetAttributes(attribute.String("batch.item.correlation_id", result.CorrelationID))
+
+	err := item.err
+	if err == nil {
+		var p Payment
+		p, err = createPayment(ctx, item.payment)
+		if err == nil {
+			result.Status = "created"
+			result.Payment = &p
+			span.SetAttributes(attribute.String("payment.id", p.ID))
+			return result
+		}
+	}
+
+	result.Status = "failed"
+	result.Error = err.Error()
+	result.FailureDomain = telemetry.FailureDomainOf(err)
+	telemetry.RecordError(ctx, err)
+	telemetry.LoggerFor(ctx).Warn("batch item failed",
+		zap.String("batch", name),
+		zap.Int("index", index),
+		zap.String("correlation_id", result.CorrelationID),
+		zap.String("failure_domain", result.FailureDomain),
+		zap.Error(err))
+	return result
+}
+
+func writeBatchResponse(w http.ResponseWriter, resp BatchResponse) {
+	status := http.StatusCreated
+	switch resp.Outcome {
+	case batchPartial:
+		status = http.StatusMultiStatus
+	case batchFailed:
+		status = http.StatusUnprocessableEntity
+		for _, e := range resp.Errors {
+			if e.FailureDomain != telemetry.DomainClient {
+				status = http.StatusInternalServerError
+				break
+			}
+		}
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type batchInstruments struct {
+	requests metric.Int64Counter
+	items    metric.Int64Counter
+}
+
+// batchMetrics creates the batch counters on first use, after telemetry.Setup.
+var batchMetrics = sync.OnceValue(func() batchInstruments {
+	meter := telemetry.Meter()
+	var m batchInstruments
+	var err error
+	m.requests, err = meter.Int64Counter(
+		"batch_requests_total",
+		metric.WithDescription("Number of batch and import requests, by outcome"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		m.requests, _ = meter.Int64Counter("batch_requests_total")
+	}
+	m.items, err = meter.Int64Counter(
+		"batch_items_total",
+		metric.WithDescription("Number of batch and import items processed, by outcome"),
+		metric.WithUnit("{item}"),
+	)
+	if err != nil {
+		m.items, _ = meter.Int64Counter("batch_items_total")
+	}
+	return m
+})
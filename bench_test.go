@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"payment-service/internal/baggageguard"
+	"payment-service/internal/clientip"
+	"payment-service/internal/fault"
+	"payment-service/internal/fraud"
+	"payment-service/internal/lanes"
+	"payment-service/internal/longpoll"
+	"payment-service/internal/outbox"
+	"payment-service/internal/telemetry"
+	"payment-service/internal/tenant"
+)
+
+// These benchmarks drive requests through the full middleware chain. Compare
+// the instrumented and uninstrumented builds with
+//
+//	go test -run '^$' -bench . -benchmem . > on.txt
+//	go test -run '^$' -bench . -benchmem -tags notelemetry . > off.txt
+//	benchstat on.txt off.txt
+
+var benchHandler = sync.OnceValue(func() http.Handler {
+	// Traces and metrics are recorded by the SDK but not exported, so the
+	// benchmarks measure instrumentation rather than the network.
+	dir, err := os.MkdirTemp("", "bench")
+	if err != nil {
+		panic(err)
+	}
+	cfg := filepath.Join(dir, "otel.yaml")
+	os.WriteFile(cfg, []byte("traces:\n  exporter:\n    type: none\nmetrics:\n  exporter:\n    type: none\nlogs:\n  level: error\n"), 0o600)
+	if _, err := telemetry.Setup(context.Background(), telemetry.WithServiceVersion("bench"), telemetry.WithConfigFile(cfg)); err != nil {
+		panic(err)
+	}
+
+	initDependencies()
+	paymentStore.Add(context.Background(), Payment{ID: "pay_bench", Amount: 10, Status: "pending"})
+
+	h, err := newHandler(fault.Config{}, nil, baggageguard.Config{}, clientip.Config{}, tenant.Config{})
+	if err != nil {
+		panic(err)
+	}
+	return h
+})
+
+func BenchmarkGetPayment(b *testing.B) {
+	h := benchHandler()
+	b.ReportAllocs()
+	for b.Loop() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/payment/pay_bench", nil))
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d", w.Code)
+		}
+	}
+}
+
+func BenchmarkCreatePayment(b *testing.B) {
+	h := benchHandler()
+	b.ReportAllocs()
+	for b.Loop() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/payment", strings.NewReader(`{"amount": 42}`)))
+		if w.Code != http.StatusCreated && w.Code != http.StatusUnprocessableEntity && w.Code != http.StatusBadGateway {
+			b.Fatalf("status %d", w.Code)
+		}
+	}
+}
+
+// initDependencies creates the service's dependencies once per test binary,
+// with a fraud service that answers instantly and never fails. Instruments
+// bind to the MeterProvider installed when it first runs.
+var initDependencies = sync.OnceFunc(func() {
+	var err error
+	router, err = lanes.NewRouter(lanes.Config{Threshold: 1000, StandardWorkers: 4, PriorityWorkers: 2, QueueSize: 1000})
+	if err != nil {
+		panic(err)
+	}
+	fraudClient, err = fraud.NewClient(fraud.Config{MedianLatency: time.Nanosecond})
+	if err != nil {
+		panic(err)
+	}
+	events, err = outbox.New(outbox.Config{}, outbox.LogPublisher{})
+	if err != nil {
+		panic(err)
+	}
+	statusWaits, err = longpoll.New()
+	if err != nil {
+		panic(err)
+	}
+})
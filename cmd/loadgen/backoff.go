@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Results of a request sent while its target had asked the generator to
+// back off.
+const (
+	backoffHonored = "honored"
+	backoffIgnored = "ignored"
+	// backoffSkipped counts ticks that started no work for a target that
+	// asked to back off.
+	backoffSkipped = "skipped"
+)
+
+// backoffs holds the Retry-After of each target that answered 429 or 503,
+// and counts how the generator dealt with them.
+type backoffs struct {
+	// honor makes requests wait out a target's Retry-After; otherwise they
+	// are sent anyway and counted as ignored.
+	honor bool
+
+	mu     sync.Mutex
+	until  map[string]time.Time
+	counts map[string]int
+}
+
+func newBackoffs(honor bool) *backoffs {
+	return &backoffs{
+		honor:  honor,
+		until:  make(map[string]time.Time),
+		counts: make(map[string]int),
+	}
+}
+
+// observe records the Retry-After of a throttled or shedding response
+// from base.
+func (b *backoffs) observe(base string, resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	secs, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Retry-After")))
+	if err != nil || secs < 0 {
+		return
+	}
+	until := time.Now().Add(time.Duration(secs) * time.Second)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.until[base]) {
+		b.until[base] = until
+	}
+}
+
+// remaining returns how long base asked the generator to wait.
+func (b *backoffs) remaining(base string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Until(b.until[base])
+}
+
+// skip reports whether a tick should start no work for base, because base
+// asked to back off and the generator honors it.
+func (b *backoffs) skip(base string) bool {
+	if !b.honor || b.remaining(base) <= 0 {
+		return false
+	}
+	b.count(backoffSkipped)
+	return true
+}
+
+// wait is called before a request to base. If base asked to back off, it
+// waits until it may send again, or notes on span that the hint was ignored.
+// It reports false if ctx ended while waiting.
+func (b *backoffs) wait(ctx context.Context, base string, span trace.Span) bool {
+	wait := b.remaining(base)
+	if wait <= 0 {
+		return true
+	}
+	result := backoffIgnored
+	if b.honor {
+		result = backoffHonored
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	span.SetAttributes(
+		attribute.String("backoff.result", result),
+		attribute.Float64("backoff.wait_seconds", wait.Seconds()),
+	)
+	b.count(result)
+	return true
+}
+
+func (b *backoffs) count(result string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.counts[result]++
+}
+
+func (b *backoffs) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return fmt.Sprintf("backoff: %d honored, %d ignored, %d ticks skipped",
+		b.counts[backoffHonored], b.counts[backoffIgnored], b.counts[backoffSkipped])
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// runBaggageKey carries the run ID to the service on every request, so the
+// spans of a run can be found even when it was interrupted and resumed.
+const runBaggageKey = "loadgen.run.id"
+
+// maxCheckpointPayments caps the payment IDs kept in a checkpoint; the
+// oldest are dropped first.
+const maxCheckpointPayments = 10000
+
+// checkpoint is the progress of a run, saved to the -state file so an
+// interrupted or crashed run can resume where it stopped.
+type checkpoint struct {
+	RunID   string        `json:"run_id"`
+	Started time.Time     `json:"started"`
+	Elapsed time.Duration `json:"elapsed"`
+	// Sent is the number of requests, or sessions in session mode, started.
+	Sent    int `json:"sent"`
+	Resumes int `json:"resumes"`
+	// Ramp is the state of the -target-p95 ramp, if any.
+	Ramp *rampState `json:"ramp,omitempty"`
+	// Payments are the IDs of the payments the run created, oldest first.
+	Payments []string `json:"payments"`
+}
+
+type rampState struct {
+	RPS     float64 `json:"rps"`
+	Best    float64 `json:"best"`
+	Holding bool    `json:"holding"`
+}
+
+// progress tracks a run and, with a path, saves it as a checkpoint.
+type progress struct {
+	path  string
+	start time.Time
+
+	mu sync.Mutex
+	cp checkpoint
+}
+
+// loadProgress resumes the run saved in path, or starts a new one if path
+// is empty or there is no such file.
+func loadProgress(path string) (*progress, error) {
+	p := &progress{path: path, start: time.Now()}
+	fresh := checkpoint{RunID: fmt.Sprintf("run_%016x", rand.Uint64()), Started: p.start}
+	if path == "" {
+		p.cp = fresh
+		return p, nil
+	}
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		p.cp = fresh
+		return p, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &p.cp); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	p.cp.Resumes++
+	return p, nil
+}
+
+// resumed reports whether the run continues a checkpoint.
+func (p *progress) resumed() bool {
+	return p.cp.Resumes > 0
+}
+
+// runID returns the run's ID, the same across resumes.
+func (p *progress) runID() string {
+	return p.cp.RunID
+}
+
+// elapsed returns how long the run has been going, over all resumes.
+func (p *progress) elapsed() time.Duration {
+	return p.cp.Elapsed + time.Since(p.start)
+}
+
+func (p *progress) sent() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cp.Sent++
+}
+
+func (p *progress) created(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cp.Payments = append(p.cp.Payments, id)
+	if n := len(p.cp.Payments) - maxCheckpointPayments; n > 0 {
+		p.cp.Payments = p.cp.Payments[n:]
+	}
+}
+
+// save writes the checkpoint, with the state of r if it is set. The file is
+// replaced atomically, so a crash while saving leaves the previous one.
+func (p *progress) save(r *ramp) error {
+	if p.path == "" {
+		return nil
+	}
+	p.mu.Lock()
+	cp := p.cp
+	cp.Elapsed = p.elapsed()
+	if r != nil {
+		cp.Ramp = &rampState{RPS: r.rps, Best: r.best, Holding: r.holding}
+	}
+	b, err := json.MarshalIndent(cp, "", "  ")
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// finish removes the checkpoint of a completed run, so the next run starts
+// afresh.
+func (p *progress) finish() error {
+	if p.path == "" {
+		return nil
+	}
+	return os.Remove(p.path)
+}
+
+// restore applies the checkpointed ramp state to r.
+func (p *progress) restore(r *ramp) {
+	if p.cp.Ramp == nil || r == nil {
+		return
+	}
+	r.rps, r.best, r.holding = p.cp.Ramp.RPS, p.cp.Ramp.Best, p.cp.Ramp.Holding
+}
+
+// logResume reports a resumed run on stderr and as a loadgen.resume span.
+func (p *progress) logResume(ctx context.Context, tracer trace.Tracer) {
+	cp := p.cp
+	log.Printf("resuming run %s (resume %d): %d sent, %d payments created, %v elapsed",
+		cp.RunID, cp.Resumes, cp.Sent, len(cp.Payments), cp.Elapsed.Round(time.Second))
+	_, span := tracer.Start(ctx, "loadgen.resume", trace.WithNewRoot(), trace.WithAttributes(
+		attribute.String(runBaggageKey, cp.RunID),
+		attribute.Int("loadgen.resumes", cp.Resumes),
+		attribute.Int("loadgen.sent", cp.Sent),
+		attribute.Int("loadgen.payments_created", len(cp.Payments)),
+		attribute.Float64("loadgen.elapsed_seconds", cp.Elapsed.Seconds()),
+	))
+	span.End()
+}
+
+// withMember adds a baggage member to the baggage in ctx.
+func withMember(ctx context.Context, key, value string) context.Context {
+	member, err := baggage.NewMember(key, value)
+	if err != nil {
+		return ctx
+	}
+	bag, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, bag)
+}
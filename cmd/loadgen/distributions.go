@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// currencyScale converts an amount in USD-like units to a currency whose
+// minor unit is worth much less, so generated amounts look plausible.
+var currencyScale = map[string]float64{"JPY": 150, "KRW": 1300, "INR": 83}
+
+// zeroDecimal currencies have no minor unit.
+var zeroDecimal = map[string]bool{"JPY": true, "KRW": true}
+
+// paymentShape generates payment bodies whose amounts and currencies follow
+// production-like distributions: log-normal amounts (many small payments, a
+// long tail of large ones) and Zipf-distributed currencies (a few dominate).
+type paymentShape struct {
+	uniform    bool
+	median     float64
+	sigma      float64
+	currencies []string
+
+	mu   sync.Mutex
+	zipf *rand.Zipf
+}
+
+func newPaymentShape(dist string, median, sigma float64, currencies string, zipfS float64) (*paymentShape, error) {
+	s := &paymentShape{median: median, sigma: sigma}
+	switch dist {
+	case "uniform":
+		s.uniform = true
+	case "lognormal":
+	default:
+		return nil, fmt.Errorf("unknown amount distribution %q", dist)
+	}
+	if median <= 0 || sigma < 0 {
+		return nil, fmt.Errorf("amount median must be positive and sigma non-negative")
+	}
+
+	for _, c := range strings.Split(currencies, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			s.currencies = append(s.currencies, c)
+		}
+	}
+	if len(s.currencies) > 1 {
+		if zipfS <= 1 {
+			return nil, fmt.Errorf("currency Zipf exponent must be greater than 1")
+		}
+		s.zipf = rand.NewZipf(rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())), zipfS, 1, uint64(len(s.currencies)-1))
+	}
+	return s, nil
+}
+
+func (s *paymentShape) currency() string {
+	switch {
+	case len(s.currencies) == 0:
+		return ""
+	case s.zipf == nil:
+		return s.currencies[0]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.currencies[s.zipf.Uint64()]
+}
+
+func (s *paymentShape) amount(currency string) float64 {
+	var a float64
+	if s.uniform {
+		a = 1 + rand.Float64()*2000
+	} else {
+		a = s.median * math.Exp(rand.NormFloat64()*s.sigma)
+	}
+	if scale, ok := currencyScale[currency]; ok {
+		a *= scale
+	}
+	if zeroDecimal[currency] {
+		return math.Max(1, math.Round(a))
+	}
+	return math.Max(0.01, math.Round(a*100)/100)
+}
+
+// next returns a JSON payment body.
+func (s *paymentShape) next() string {
+	c := s.currency()
+	if c == "" {
+		return fmt.Sprintf(`{"amount": %.2f}`, s.amount(c))
+	}
+	return fmt.Sprintf(`{"amount": %.2f, "currency": %q}`, s.amount(c), c)
+}
+
+// rateFactor scales the request rate by day of week: weekends see
+// weekendFactor times the weekday traffic.
+func rateFactor(day time.Weekday, weekendFactor float64) float64 {
+	if day == time.Saturday || day == time.Sunday {
+		return weekendFactor
+	}
+	return 1
+}
+
+// parseWeekday parses a day name such as "sat" or "Saturday". An empty name
+// is today.
+func parseWeekday(name string) (time.Weekday, error) {
+	if name == "" {
+		return time.Now().Weekday(), nil
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.HasPrefix(strings.ToLower(d.String()), strings.ToLower(name)) && len(name) >= 3 {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q", name)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTransport returns the transport requests are sent with. ipVersion "4"
+// or "6" only resolves and dials addresses of that family; resolver, a
+// host:port such as 1.1.1.1:53, replaces the system resolver with Go's,
+// asking that server. Without keep-alives every request resolves and dials
+// again, so each one shows the cost of name resolution.
+func newTransport(ipVersion, resolver string, keepAlives bool) (*http.Transport, error) {
+	network := "tcp"
+	switch ipVersion {
+	case "":
+	case "4", "6":
+		network += ipVersion
+	default:
+		return nil, fmt.Errorf("invalid -ip-version %q: want 4, 6 or empty", ipVersion)
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if resolver != "" {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			return nil, fmt.Errorf("invalid -resolver %q: %w", resolver, err)
+		}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, proto, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, proto, resolver)
+			},
+		}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	t.DisableKeepAlives = !keepAlives
+	return t, nil
+}
+
+// dnsStats counts the lookups of the run for the summary.
+type dnsStats struct {
+	duration metric.Float64Histogram
+
+	mu       sync.Mutex
+	lookups  int
+	failures int
+	total    time.Duration
+	max      time.Duration
+	reused   int
+	requests int
+}
+
+func newDNSStats() *dnsStats {
+	s := &dnsStats{}
+	var err error
+	s.duration, err = otel.Meter("loadgen").Float64Histogram(
+		"dns.lookup.duration",
+		metric.WithDescription("Duration of the name resolutions of new connections, by host and error"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 5),
+	)
+	if err != nil {
+		s.duration, _ = otel.Meter("loadgen").Float64Histogram("dns.lookup.duration")
+	}
+	return s
+}
+
+// phases times the connection phases of one request through httptrace.
+type phases struct {
+	host      string
+	dnsStart  time.Time
+	dns       time.Duration
+	dnsErr    error
+	addrs     []net.IPAddr
+	connStart time.Time
+	connect   time.Duration
+	reused    bool
+	wrote     time.Time
+	firstByte time.Duration
+	remote    net.Addr
+}
+
+// trace returns ctx with a ClientTrace recording into p.
+func (p *phases) trace(ctx context.Context) context.Context {
+	var mu sync.Mutex
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			p.host, p.dnsStart = info.Host, time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			p.dns, p.dnsErr, p.addrs = time.Since(p.dnsStart), info.Err, info.Addrs
+		},
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if p.connStart.IsZero() {
+				p.connStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				p.connect = time.Since(p.connStart)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			p.reused, p.remote = info.Reused, info.Conn.RemoteAddr()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			p.wrote = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !p.wrote.IsZero() {
+				p.firstByte = time.Since(p.wrote)
+			}
+		},
+	})
+}
+
+// record notes the phases of a finished request on its client span and in
+// s. Time to first byte, from the request written to the response's first
+// byte, is the server's time plus the network's; the time before the
+// request was written went to resolving, dialing or waiting for a
+// connection.
+func (s *dnsStats) record(ctx context.Context, span trace.Span, p *phases) {
+	span.SetAttributes(attribute.Bool("http.connection.reused", p.reused))
+	if p.remote != nil {
+		if addr, ok := p.remote.(*net.TCPAddr); ok {
+			span.SetAttributes(attribute.String("network.peer.address", addr.IP.String()), attribute.String("network.type", ipType(addr.IP)))
+		}
+	}
+	if p.firstByte > 0 {
+		span.SetAttributes(attribute.Float64("http.time_to_first_byte_seconds", p.firstByte.Seconds()))
+	}
+	if p.connect > 0 {
+		span.SetAttributes(attribute.Float64("network.connect.duration_seconds", p.connect.Seconds()))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if p.reused {
+		s.reused++
+	}
+	if p.dnsStart.IsZero() {
+		return
+	}
+	attrs := []attribute.KeyValue{attribute.String("dns.question.name", p.host)}
+	if p.dnsErr != nil {
+		attrs = append(attrs, attribute.String("error.type", dnsErrorType(p.dnsErr)))
+		span.AddEvent("dns.lookup.failed", trace.WithAttributes(attribute.String("exception.message", p.dnsErr.Error())))
+		s.failures++
+	}
+	span.SetAttributes(attribute.Float64("dns.lookup.duration_seconds", p.dns.Seconds()), attribute.Int("dns.answers", len(p.addrs)))
+	s.duration.Record(ctx, p.dns.Seconds(), metric.WithAttributes(attrs...))
+	s.lookups++
+	s.total += p.dns
+	s.max = max(s.max, p.dns)
+}
+
+func ipType(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// dnsErrorType classifies a lookup failure for error.type.
+func dnsErrorType(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case !errors.As(err, &dnsErr):
+		return fmt.Sprintf("%T", err)
+	case dnsErr.IsNotFound:
+		return "not_found"
+	case dnsErr.IsTimeout:
+		return "timeout"
+	case dnsErr.IsTemporary:
+		return "temporary"
+	}
+	return "other"
+}
+
+func (s *dnsStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mean := time.Duration(0)
+	if s.lookups > 0 {
+		mean = s.total / time.Duration(s.lookups)
+	}
+	return fmt.Sprintf("dns: %d lookups, %d failed, mean %v, max %v; %d of %d requests reused a connection",
+		s.lookups, s.failures, mean.Round(time.Microsecond), s.max.Round(time.Microsecond), s.reused, s.requests)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ingestPath is the service's OTLP/HTTP logs endpoint; see package ingest.
+const ingestPath = "/ingest/v1/logs"
+
+// measurements buffers one OTLP log record per request, by target, and
+// posts them to the target's ingest endpoint, so the client's view of each
+// request (its status and the latency including the network) shows up in
+// the service's own logs next to the request's trace ID.
+type measurements struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	records map[string][]*logspb.LogRecord
+}
+
+func newMeasurements() *measurements {
+	return &measurements{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		records: make(map[string][]*logspb.LogRecord),
+	}
+}
+
+// add records a request to base. A status of 0 means it got no response.
+func (m *measurements) add(base, method, path string, status int, took time.Duration, sc trace.SpanContext) {
+	severity, text := logspb.SeverityNumber_SEVERITY_NUMBER_INFO, "INFO"
+	switch {
+	case status == 0 || status >= 500:
+		severity, text = logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, "ERROR"
+	case status >= 400:
+		severity, text = logspb.SeverityNumber_SEVERITY_NUMBER_WARN, "WARN"
+	}
+	rec := &logspb.LogRecord{
+		TimeUnixNano:   uint64(time.Now().UnixNano()),
+		SeverityNumber: severity,
+		SeverityText:   text,
+		Body:           stringValue("client request"),
+		Attributes: []*commonpb.KeyValue{
+			{Key: "http.request.method", Value: stringValue(method)},
+			{Key: "url.path", Value: stringValue(path)},
+			{Key: "http.response.status_code", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(status)}}},
+			{Key: "http.client.request.duration", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: took.Seconds()}}},
+		},
+	}
+	if sc.IsValid() {
+		traceID, spanID := sc.TraceID(), sc.SpanID()
+		rec.TraceId, rec.SpanId = traceID[:], spanID[:]
+	}
+	m.mu.Lock()
+	m.records[base] = append(m.records[base], rec)
+	m.mu.Unlock()
+}
+
+// run posts the buffered records every interval until ctx is done, then
+// posts what is left.
+func (m *measurements) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.flush()
+		case <-ctx.Done():
+			m.flush()
+			return
+		}
+	}
+}
+
+func (m *measurements) flush() {
+	m.mu.Lock()
+	batches := m.records
+	m.records = make(map[string][]*logspb.LogRecord)
+	m.mu.Unlock()
+
+	for base, records := range batches {
+		if err := m.post(base, records); err != nil {
+			log.Printf("ingest: posting %d measurements to %s: %v", len(records), base, err)
+		}
+	}
+}
+
+func (m *measurements) post(base string, records []*logspb.LogRecord) error {
+	body, err := proto.Marshal(&collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				{Key: "service.name", Value: stringValue("loadgen")},
+			}},
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      &commonpb.InstrumentationScope{Name: "loadgen"},
+				LogRecords: records,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := m.client.Post(base+ingestPath, "application/x-protobuf", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var out collogspb.ExportLogsServiceResponse
+	if err := proto.Unmarshal(respBody, &out); err != nil {
+		return err
+	}
+	if partial := out.GetPartialSuccess(); partial.GetRejectedLogRecords() > 0 {
+		return fmt.Errorf("%d rejected: %s", partial.GetRejectedLogRecords(), partial.GetErrorMessage())
+	}
+	return nil
+}
+
+func stringValue(s string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+}
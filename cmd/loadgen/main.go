@@ -0,0 +1,402 @@
+// Command loadgen sends a steady stream of payment requests to one or more
+// payment-service instances, optionally splitting traffic between them by
+// weight (e.g. 90/10 between a stable and a canary version).
+//
+// In session mode it simulates browser-like user journeys instead of
+// independent requests; see session.go. With -target-p95 it ramps the rate
+// up until latency reaches the target and reports the capacity; see ramp.go.
+// With -state it checkpoints its progress, so a run that was interrupted or
+// crashed resumes under the same run ID; see checkpoint.go.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type target struct {
+	url    string
+	weight int
+}
+
+type stats struct {
+	mu     sync.Mutex
+	counts map[string]map[int]int
+}
+
+func (s *stats) add(url string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts[url] == nil {
+		s.counts[url] = make(map[int]int)
+	}
+	s.counts[url][status]++
+}
+
+type generator struct {
+	client   *http.Client
+	tracer   trace.Tracer
+	stats    *stats
+	window   *latencyWindow
+	payments *paymentShape
+	progress *progress
+	// tenants are the tenant IDs requests are spread over; empty sends no
+	// X-Tenant-ID.
+	tenants []string
+	// measurements, if set, collects the client's view of each request for
+	// the targets' ingest endpoint.
+	measurements *measurements
+	backoffs     *backoffs
+	dns          *dnsStats
+}
+
+type tenantKey struct{}
+
+// withTenant picks the tenant of a request or session, if there are any.
+func (g *generator) withTenant(ctx context.Context) context.Context {
+	if len(g.tenants) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantKey{}, g.tenants[rand.IntN(len(g.tenants))])
+}
+
+func main() {
+	targetsFlag := flag.String("targets", "http://localhost:8080", "comma-separated base URLs of payment-service instances")
+	weightsFlag := flag.String("weights", "", "comma-separated traffic weights per target (default: equal)")
+	rps := flag.Float64("rps", 5, "requests per second (sessions per second in session mode)")
+	duration := flag.Duration("duration", 0, "how long to run (0 runs until interrupted)")
+	postRatio := flag.Float64("post-ratio", 0.5, "fraction of requests that create a payment")
+	mode := flag.String("mode", "requests", `"requests" for independent requests, "session" for user journeys`)
+	thinkTime := flag.Duration("think-time", 300*time.Millisecond, "mean pause between steps of a session")
+	refundRatio := flag.Float64("refund-ratio", 0, "fraction of sessions that capture and refund the payment they created")
+	targetP95 := flag.Duration("target-p95", 0, "ramp the rate up from -rps until p95 latency reaches this target, then hold (0 keeps a fixed rate)")
+	rampInterval := flag.Duration("ramp-interval", 10*time.Second, "how long each ramp step lasts")
+	rampFactor := flag.Float64("ramp-factor", 1.25, "rate multiplier applied after each ramp step under the target")
+	amountDist := flag.String("amount-dist", "lognormal", `payment amount distribution: "lognormal" or "uniform" (1-2001)`)
+	amountMedian := flag.Float64("amount-median", 45, "median payment amount of the log-normal distribution")
+	amountSigma := flag.Float64("amount-sigma", 1.1, "spread of the log-normal distribution; larger means a longer tail")
+	currencies := flag.String("currencies", "USD,EUR,GBP,JPY,CAD,AUD", "comma-separated currencies, most common first (empty sends none)")
+	currencyZipf := flag.Float64("currency-zipf", 1.5, "Zipf exponent of the currency distribution (> 1; larger concentrates on the first)")
+	weekendFactor := flag.Float64("weekend-factor", 0.6, "rate multiplier on Saturdays and Sundays")
+	day := flag.String("day", "", "day of week to simulate for -weekend-factor, e.g. sat (default today)")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP gRPC endpoint for the generator's own spans (empty disables export)")
+	stateFile := flag.String("state", "", "file to checkpoint progress to and resume from (empty disables checkpoints)")
+	tenantsFlag := flag.String("tenants", "", "comma-separated tenant IDs sent as X-Tenant-ID, one picked at random per request or session (empty sends none)")
+	checkpointInterval := flag.Duration("checkpoint-interval", 5*time.Second, "how often progress is saved to -state")
+	honorRetryAfter := flag.Bool("honor-retry-after", true, "wait out the Retry-After of 429 and 503 responses before sending to that target again")
+	ipVersion := flag.String("ip-version", "", `resolve and connect to targets over "4" (IPv4) or "6" (IPv6) only (empty uses either)`)
+	resolver := flag.String("resolver", "", "DNS server, as host:port, to resolve target hosts with instead of the system resolver")
+	keepAlives := flag.Bool("keepalive", true, "reuse connections between requests; false resolves and dials for every request")
+	ingestFlag := flag.Bool("ingest", false, "post a log record per request to the targets' experimental "+ingestPath+" endpoint (run them with -ingest-logs)")
+	flag.Parse()
+
+	targets, err := parseTargets(*targetsFlag, *weightsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shape, err := newPaymentShape(*amountDist, *amountMedian, *amountSigma, *currencies, *currencyZipf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	weekday, err := parseWeekday(*day)
+	if err != nil {
+		log.Fatal(err)
+	}
+	factor := rateFactor(weekday, *weekendFactor)
+	if *targetP95 > 0 {
+		// Capacity is measured at the requested rate.
+		factor = 1
+	}
+	interval := func(rps float64) time.Duration {
+		return time.Duration(float64(time.Second) / (rps * factor))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	shutdown, err := setupTracing(ctx, *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdown(context.Background())
+	shutdownMetrics, err := setupMetrics(ctx, *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownMetrics(context.Background())
+	transport, err := newTransport(*ipVersion, *resolver, *keepAlives)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	prog, err := loadProgress(*stateFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	g := &generator{
+		client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		tracer:   otel.Tracer("loadgen"),
+		stats:    &stats{counts: make(map[string]map[int]int)},
+		payments: shape,
+		progress: prog,
+		backoffs: newBackoffs(*honorRetryAfter),
+		dns:      newDNSStats(),
+	}
+	for _, id := range strings.Split(*tenantsFlag, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			g.tenants = append(g.tenants, id)
+		}
+	}
+	if prog.resumed() {
+		prog.logResume(ctx, g.tracer)
+	} else if *stateFile != "" {
+		log.Printf("starting run %s, checkpointing to %s", prog.runID(), *stateFile)
+	}
+	// Every request carries the run ID, which a resumed run keeps.
+	ctx = withMember(ctx, runBaggageKey, prog.runID())
+
+	if *duration > 0 {
+		remaining := *duration - prog.elapsed()
+		if remaining <= 0 {
+			log.Printf("run %s already ran for -duration %v", prog.runID(), *duration)
+			prog.finish()
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, remaining)
+		defer cancel()
+	}
+	var wg sync.WaitGroup
+
+	// Measurements are posted until every request has finished, so they get
+	// their own context.
+	ingestDone := make(chan struct{})
+	ingestCtx, stopIngest := context.WithCancel(context.Background())
+	if *ingestFlag {
+		g.measurements = newMeasurements()
+		go func() {
+			defer close(ingestDone)
+			g.measurements.run(ingestCtx, 5*time.Second)
+		}()
+	} else {
+		close(ingestDone)
+	}
+
+	var r *ramp
+	var steps <-chan time.Time
+	startRPS := *rps
+	if *targetP95 > 0 {
+		g.window = &latencyWindow{}
+		r = &ramp{target: *targetP95, factor: *rampFactor, rps: *rps, window: g.window, tracer: g.tracer}
+		prog.restore(r)
+		startRPS = r.rps
+		stepTicker := time.NewTicker(*rampInterval)
+		defer stepTicker.Stop()
+		steps = stepTicker.C
+	}
+
+	ticker := time.NewTicker(interval(startRPS))
+	defer ticker.Stop()
+
+	var checkpoints <-chan time.Time
+	if *stateFile != "" {
+		checkpointTicker := time.NewTicker(*checkpointInterval)
+		defer checkpointTicker.Stop()
+		checkpoints = checkpointTicker.C
+	}
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-steps:
+			ticker.Reset(interval(r.step(ctx, *rampInterval)))
+		case <-checkpoints:
+			if err := prog.save(r); err != nil {
+				log.Printf("checkpoint: %v", err)
+			}
+		case <-ticker.C:
+			t := pick(targets)
+			if g.backoffs.skip(t.url) {
+				continue
+			}
+			prog.sent()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx := g.withTenant(ctx)
+				if *mode == "session" {
+					g.runSession(ctx, t.url, *thinkTime, *refundRatio)
+					return
+				}
+				if rand.Float64() < *postRatio {
+					g.send(ctx, http.MethodPost, t.url, "/api/payment", g.payments.next(), "")
+				} else {
+					g.send(ctx, http.MethodGet, t.url, "/api/payment", "", "")
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	stopIngest()
+	<-ingestDone
+
+	// Running out of -duration completes the run; anything else, such as an
+	// interrupt, leaves a checkpoint to resume from.
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		if err := prog.finish(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("checkpoint: %v", err)
+		}
+	} else if err := prog.save(r); err != nil {
+		log.Printf("checkpoint: %v", err)
+	} else if *stateFile != "" {
+		log.Printf("run %s checkpointed to %s; run again with the same -state to resume", prog.runID(), *stateFile)
+	}
+
+	for _, t := range targets {
+		fmt.Printf("%s: %v\n", t.url, g.stats.counts[t.url])
+	}
+	fmt.Println(g.backoffs)
+	fmt.Println(g.dns)
+	if r != nil {
+		fmt.Println(r.capacity())
+	}
+}
+
+func parseTargets(urls, weights string) ([]target, error) {
+	var targets []target
+	for _, u := range strings.Split(urls, ",") {
+		targets = append(targets, target{url: strings.TrimRight(strings.TrimSpace(u), "/"), weight: 1})
+	}
+	if weights == "" {
+		return targets, nil
+	}
+
+	ws := strings.Split(weights, ",")
+	if len(ws) != len(targets) {
+		return nil, fmt.Errorf("got %d weights for %d targets", len(ws), len(targets))
+	}
+	for i, w := range ws {
+		n, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid weight %q", w)
+		}
+		targets[i].weight = n
+	}
+	return targets, nil
+}
+
+func pick(targets []target) target {
+	total := 0
+	for _, t := range targets {
+		total += t.weight
+	}
+	if total == 0 {
+		return targets[0]
+	}
+
+	n := rand.IntN(total)
+	for _, t := range targets {
+		if n < t.weight {
+			return t
+		}
+		n -= t.weight
+	}
+	return targets[len(targets)-1]
+}
+
+// send issues one request under a client span, propagating the trace context
+// and baggage in ctx, and notes its DNS lookup and connection on the span.
+// It returns the status code (0 on transport error) and the response body.
+func (g *generator) send(ctx context.Context, method, base, path, body, referer string) (int, []byte) {
+	ctx, span := g.tracer.Start(ctx, method+" "+path, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", method),
+			attribute.String("url.full", base+path),
+		),
+	)
+	defer span.End()
+
+	if !g.backoffs.wait(ctx, base, span) {
+		return 0, nil
+	}
+	var reader io.Reader
+	if body != "" {
+		reader = bytes.NewBufferString(body)
+	}
+	phases := &phases{}
+	req, err := http.NewRequestWithContext(phases.trace(ctx), method, base+path, reader)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return 0, nil
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+	if id, ok := ctx.Value(tenantKey{}).(string); ok {
+		req.Header.Set("X-Tenant-ID", id)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := g.client.Do(req)
+	g.dns.record(ctx, span, phases)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		g.stats.add(base, 0)
+		if g.window != nil {
+			g.window.add(time.Since(start), 0)
+		}
+		if g.measurements != nil {
+			g.measurements.add(base, method, path, 0, time.Since(start), span.SpanContext())
+		}
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	g.stats.add(base, resp.StatusCode)
+	g.backoffs.observe(base, resp)
+	if g.window != nil {
+		g.window.add(time.Since(start), resp.StatusCode)
+	}
+	if g.measurements != nil {
+		g.measurements.add(base, method, path, resp.StatusCode, time.Since(start), span.SpanContext())
+	}
+	var created paymentRef
+	if method == http.MethodPost && path == "/api/payment" && resp.StatusCode == http.StatusCreated &&
+		json.Unmarshal(respBody, &created) == nil {
+		g.progress.created(created.ID)
+	}
+	return resp.StatusCode, respBody
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxErrorRate is the share of failed requests in a window that counts as
+// saturation, whatever the latency.
+const maxErrorRate = 0.05
+
+// latencyWindow collects request latencies between ramp steps.
+type latencyWindow struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+}
+
+func (w *latencyWindow) add(d time.Duration, status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.latencies = append(w.latencies, d)
+	if status == 0 || status >= 500 {
+		w.errors++
+	}
+}
+
+// drain returns the requests completed since the last call, their p95 and
+// the share that failed.
+func (w *latencyWindow) drain() (n int, p95 time.Duration, errRate float64) {
+	w.mu.Lock()
+	latencies, errors := w.latencies, w.errors
+	w.latencies, w.errors = nil, 0
+	w.mu.Unlock()
+
+	if len(latencies) == 0 {
+		return 0, 0, 0
+	}
+	slices.Sort(latencies)
+	return len(latencies), latencies[(len(latencies)*95)/100], float64(errors) / float64(len(latencies))
+}
+
+// ramp is a closed-loop rate controller. It raises the request rate by
+// factor every step until the p95 latency observed by the generator reaches
+// target, or too many requests fail, then falls back to the last rate that
+// met the target and holds it. That rate is the capacity estimate.
+type ramp struct {
+	target  time.Duration
+	factor  float64
+	rps     float64
+	best    float64
+	holding bool
+	window  *latencyWindow
+	tracer  trace.Tracer
+}
+
+// step evaluates the window that just ended and returns the rate for the
+// next one. Each step is recorded as a span, so capacity results line up
+// with server-side saturation metrics in the same backend.
+func (r *ramp) step(ctx context.Context, interval time.Duration) float64 {
+	n, p95, errRate := r.window.drain()
+	achieved := float64(n) / interval.Seconds()
+
+	_, span := r.tracer.Start(ctx, "ramp.step", trace.WithNewRoot(), trace.WithAttributes(
+		attribute.Float64("loadgen.rps.target", r.rps),
+		attribute.Float64("loadgen.rps.achieved", achieved),
+		attribute.Float64("loadgen.p95_seconds", p95.Seconds()),
+		attribute.Float64("loadgen.error_rate", errRate),
+		attribute.Bool("loadgen.holding", r.holding),
+	))
+	defer span.End()
+
+	fmt.Printf("%s rps=%.1f achieved=%.1f p95=%v errors=%.1f%%\n",
+		time.Now().Format(time.TimeOnly), r.rps, achieved, p95.Round(time.Millisecond), errRate*100)
+
+	if r.holding || n == 0 {
+		return r.rps
+	}
+	if p95 < r.target && errRate <= maxErrorRate {
+		r.best = r.rps
+		r.rps *= r.factor
+		return r.rps
+	}
+
+	r.holding = true
+	if r.best > 0 {
+		r.rps = r.best
+	} else {
+		r.rps /= r.factor
+	}
+	fmt.Printf("target p95 %v reached; holding at %.1f rps\n", r.target, r.rps)
+	return r.rps
+}
+
+// capacity reports the highest rate that met the latency target.
+func (r *ramp) capacity() string {
+	if !r.holding {
+		return fmt.Sprintf("target p95 %v not reached; last rate %.1f rps met it", r.target, r.best)
+	}
+	return fmt.Sprintf("capacity at p95 < %v: %.1f rps", r.target, r.rps)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sessionBaggageKey carries the session ID to the service, so server spans
+// can be grouped into user journeys even across traces.
+const sessionBaggageKey = "session.id"
+
+type paymentRef struct {
+	ID string `json:"id"`
+}
+
+// runSession simulates one user journey: list payments, view one, create one
+// and occasionally capture and refund it, pausing between steps like a person would. All
+// steps share one root span, and each request sends the previous page as its
+// Referer.
+func (g *generator) runSession(ctx context.Context, base string, thinkTime time.Duration, refundRatio float64) {
+	sessionID := fmt.Sprintf("sess_%016x", rand.Uint64())
+	ctx = withMember(ctx, sessionBaggageKey, sessionID)
+
+	ctx, span := g.tracer.Start(ctx, "session", trace.WithNewRoot(), trace.WithAttributes(
+		attribute.String(sessionBaggageKey, sessionID),
+		attribute.String("server.url", base),
+	))
+	defer span.End()
+
+	steps := 0
+	referer := ""
+	step := func(method, path, body string) (int, []byte) {
+		if steps > 0 && !pause(ctx, thinkTime) {
+			return 0, nil
+		}
+		steps++
+		status, resp := g.send(ctx, method, base, path, body, referer)
+		referer = base + path
+		return status, resp
+	}
+
+	_, list := step(http.MethodGet, "/api/payment", "")
+	var payments []paymentRef
+	json.Unmarshal(list, &payments)
+	if len(payments) > 0 {
+		step(http.MethodGet, "/api/payment/"+payments[rand.IntN(len(payments))].ID, "")
+	}
+
+	status, created := step(http.MethodPost, "/api/payment", g.payments.next())
+	var p paymentRef
+	if status == http.StatusCreated && json.Unmarshal(created, &p) == nil && rand.Float64() < refundRatio {
+		// Only captured payments can be refunded.
+		step(http.MethodPut, "/api/payment/"+p.ID+"/status", `{"status":"authorized"}`)
+		step(http.MethodPut, "/api/payment/"+p.ID+"/status", `{"status":"captured"}`)
+		step(http.MethodPost, "/api/payment/"+p.ID+"/refund", "{}")
+	}
+
+	span.SetAttributes(attribute.Int("session.steps", steps))
+}
+
+// pause waits for a random think time around mean. It returns false if ctx
+// is done first.
+func pause(ctx context.Context, mean time.Duration) bool {
+	d := time.Duration(rand.ExpFloat64() * float64(mean))
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,294 @@
+// Command obs-audit statically scans a Go module for HTTP handlers and store
+// methods and reports which of them are covered by spans and metrics.
+//
+// It follows this repo's conventions rather than doing full type analysis:
+//
+//   - a handler is any function taking (http.ResponseWriter, *http.Request);
+//   - a store method is any method whose receiver type name ends in "Store";
+//   - a span is started by a call to Tracer().Start, StartCallerSpan or a
+//     function whose name ends in "StartSpan";
+//   - a metric is recorded by an Add or Record call whose first argument is a
+//     context (ctx, or a call to .Context()).
+//
+// Coverage is "direct" when the function itself does this, and "indirect"
+// when it calls, by plain name or by a method name unique in the module, a
+// function that is covered.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type coverage int
+
+const (
+	none coverage = iota
+	indirect
+	direct
+)
+
+func (c coverage) String() string {
+	return [...]string{"no", "indirect", "direct"}[c]
+}
+
+type function struct {
+	pkg, name, kind string
+	pos             token.Position
+	spans, metrics  bool
+	calls           []string // same-package function names
+	methodCalls     []string // method names called on any receiver
+	span, metric    coverage
+}
+
+func (f *function) key() string { return f.pkg + "." + f.name }
+
+func main() {
+	dir := flag.String("dir", ".", "module root to scan")
+	failUnder := flag.Float64("fail-under", 0, "exit non-zero if span coverage is below this percentage")
+	flag.Parse()
+
+	funcs, err := scan(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	resolve(funcs)
+
+	if pct := report(os.Stdout, *dir, funcs); pct < *failUnder {
+		fmt.Fprintf(os.Stderr, "span coverage %.0f%% is below %.0f%%\n", pct, *failUnder)
+		os.Exit(1)
+	}
+}
+
+func scan(root string) ([]*function, error) {
+	fset := token.NewFileSet()
+	var funcs []*function
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name := d.Name(); path != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		pkg := filepath.Dir(path)
+		for _, decl := range file.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Body == nil {
+				continue
+			}
+			funcs = append(funcs, inspect(fset, pkg, fd))
+		}
+		return nil
+	})
+	return funcs, err
+}
+
+func inspect(fset *token.FileSet, pkg string, fd *ast.FuncDecl) *function {
+	f := &function{pkg: pkg, name: fd.Name.Name, pos: fset.Position(fd.Pos())}
+	if recv := receiverName(fd); recv != "" {
+		f.name = recv + "." + fd.Name.Name
+		if strings.HasSuffix(recv, "Store") {
+			f.kind = "store"
+		}
+	}
+	if isHandler(fd.Type) {
+		f.kind = "handler"
+	}
+
+	ast.Inspect(fd.Body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			f.calls = append(f.calls, fun.Name)
+			if strings.HasSuffix(fun.Name, "StartSpan") {
+				f.spans = true
+			}
+		case *ast.SelectorExpr:
+			name := fun.Sel.Name
+			f.methodCalls = append(f.methodCalls, name)
+			switch {
+			case name == "Start" && isTracerCall(fun.X),
+				name == "StartCallerSpan",
+				strings.HasSuffix(name, "StartSpan"):
+				f.spans = true
+			case (name == "Add" || name == "Record") && len(call.Args) >= 2 && isContextArg(call.Args[0]):
+				f.metrics = true
+			}
+		}
+		return true
+	})
+	return f
+}
+
+func receiverName(fd *ast.FuncDecl) string {
+	if fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return ""
+	}
+	t := fd.Recv.List[0].Type
+	if star, ok := t.(*ast.StarExpr); ok {
+		t = star.X
+	}
+	if idx, ok := t.(*ast.IndexExpr); ok {
+		t = idx.X
+	}
+	if id, ok := t.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+func isHandler(ft *ast.FuncType) bool {
+	params := ft.Params.List
+	var types []string
+	for _, p := range params {
+		n := max(len(p.Names), 1)
+		for range n {
+			types = append(types, exprString(p.Type))
+		}
+	}
+	return len(types) == 2 && types[0] == "http.ResponseWriter" && types[1] == "*http.Request"
+}
+
+func isTracerCall(x ast.Expr) bool {
+	call, ok := x.(*ast.CallExpr)
+	if !ok {
+		return strings.Contains(strings.ToLower(exprString(x)), "tracer")
+	}
+	return strings.HasSuffix(exprString(call.Fun), "Tracer")
+}
+
+func isContextArg(x ast.Expr) bool {
+	switch a := x.(type) {
+	case *ast.Ident:
+		return a.Name == "ctx"
+	case *ast.CallExpr:
+		sel, ok := a.Fun.(*ast.SelectorExpr)
+		return ok && sel.Sel.Name == "Context"
+	}
+	return false
+}
+
+func exprString(x ast.Expr) string {
+	switch e := x.(type) {
+	case *ast.Ident:
+		return e.Name
+	case *ast.SelectorExpr:
+		return exprString(e.X) + "." + e.Sel.Name
+	case *ast.StarExpr:
+		return "*" + exprString(e.X)
+	case *ast.CallExpr:
+		return exprString(e.Fun) + "()"
+	}
+	return ""
+}
+
+// resolve propagates coverage from callees to callers until nothing changes.
+func resolve(funcs []*function) {
+	byKey := make(map[string]*function)
+	byMethod := make(map[string][]*function)
+	for _, f := range funcs {
+		byKey[f.key()] = f
+		if i := strings.LastIndex(f.name, "."); i >= 0 {
+			byMethod[f.name[i+1:]] = append(byMethod[f.name[i+1:]], f)
+		}
+		if f.spans {
+			f.span = direct
+		}
+		if f.metrics {
+			f.metric = direct
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, f := range funcs {
+			var callees []*function
+			for _, c := range f.calls {
+				if g, ok := byKey[f.pkg+"."+c]; ok {
+					callees = append(callees, g)
+				}
+			}
+			for _, m := range f.methodCalls {
+				if gs := byMethod[m]; len(gs) == 1 {
+					callees = append(callees, gs[0])
+				}
+			}
+			for _, g := range callees {
+				if f.span == none && g.span != none {
+					f.span, changed = indirect, true
+				}
+				if f.metric == none && g.metric != none {
+					f.metric, changed = indirect, true
+				}
+			}
+		}
+	}
+}
+
+func report(w io.Writer, root string, funcs []*function) float64 {
+	var audited []*function
+	for _, f := range funcs {
+		if f.kind != "" {
+			audited = append(audited, f)
+		}
+	}
+	sort.Slice(audited, func(i, j int) bool {
+		if audited[i].kind != audited[j].kind {
+			return audited[i].kind < audited[j].kind
+		}
+		return audited[i].key() < audited[j].key()
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tFUNCTION\tLOCATION\tSPAN\tMETRIC")
+	spans, metrics := 0, 0
+	for _, f := range audited {
+		loc, err := filepath.Rel(root, f.pos.Filename)
+		if err != nil {
+			loc = f.pos.Filename
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s:%d\t%s\t%s\n", f.kind, f.name, loc, f.pos.Line, f.span, f.metric)
+		if f.span != none {
+			spans++
+		}
+		if f.metric != none {
+			metrics++
+		}
+	}
+	tw.Flush()
+
+	if len(audited) == 0 {
+		fmt.Fprintln(w, "\nno handlers or store methods found")
+		return 100
+	}
+	pct := func(n int) float64 { return 100 * float64(n) / float64(len(audited)) }
+	fmt.Fprintf(w, "\nspans:   %d/%d (%.0f%%)\nmetrics: %d/%d (%.0f%%)\n",
+		spans, len(audited), pct(spans), metrics, len(audited), pct(metrics))
+	return pct(spans)
+}
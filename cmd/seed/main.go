@@ -0,0 +1,260 @@
+// Command seed fills a running payment-service with realistic historical
+// payments, so the list endpoint and the dashboards have data to show right
+// away. Payment dates spread over the last -days days, busier during the day
+// and on weekdays; amounts are log-normal and currencies Zipf-distributed;
+// older payments are mostly settled, recent ones still pending.
+//
+// Payments are sent in batches to the service's POST /debug/store/seed. The
+// whole run is one seed span with a seed.progress event per batch, and each
+// batch is a client span whose trace context is propagated to the service.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// payment is the service's payment record.
+type payment struct {
+	ID       string  `json:"id"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+	Status   string  `json:"status"`
+	Date     string  `json:"date"`
+}
+
+// hourWeights is the relative traffic of each hour of the day (UTC): quiet at
+// night, peaking around lunch and in the early evening.
+var hourWeights = [24]float64{
+	0.15, 0.1, 0.08, 0.08, 0.1, 0.2, 0.35, 0.55, 0.75, 0.85, 0.9, 0.95,
+	1, 0.95, 0.85, 0.8, 0.8, 0.85, 0.95, 0.9, 0.75, 0.55, 0.4, 0.25,
+}
+
+// currencyScale and zeroDecimal match cmd/loadgen, so seeded and generated
+// payments look alike.
+var (
+	currencyScale = map[string]float64{"JPY": 150, "KRW": 1300, "INR": 83}
+	zeroDecimal   = map[string]bool{"JPY": true, "KRW": true}
+)
+
+type generator struct {
+	rng        *rand.Rand
+	zipf       *rand.Zipf
+	currencies []string
+	median     float64
+	sigma      float64
+	weekend    float64
+}
+
+func main() {
+	target := flag.String("target", "http://localhost:8080", "base URL of the payment-service to seed")
+	count := flag.Int("count", 5000, "number of payments to create")
+	days := flag.Int("days", 90, "how many days back payment dates go")
+	batchSize := flag.Int("batch", 500, "payments per request")
+	seed := flag.Uint64("seed", 1, "random seed; the same seed produces the same payments")
+	currencies := flag.String("currencies", "USD,EUR,GBP,JPY,CAD,AUD", "comma-separated currencies, most common first")
+	currencyZipf := flag.Float64("currency-zipf", 1.5, "Zipf exponent of the currency distribution (> 1)")
+	amountMedian := flag.Float64("amount-median", 45, "median payment amount")
+	amountSigma := flag.Float64("amount-sigma", 1.1, "spread of the log-normal amount distribution")
+	weekendFactor := flag.Float64("weekend-factor", 0.6, "traffic on Saturdays and Sundays relative to weekdays")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP gRPC endpoint for the seeder's own spans (empty disables export)")
+	flag.Parse()
+
+	if *count <= 0 || *days <= 0 || *batchSize <= 0 {
+		log.Fatal("-count, -days and -batch must be positive")
+	}
+	if *currencyZipf <= 1 {
+		log.Fatal("-currency-zipf must be greater than 1")
+	}
+	var cs []string
+	for _, c := range strings.Split(*currencies, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			cs = append(cs, c)
+		}
+	}
+	if len(cs) == 0 {
+		log.Fatal("-currencies is empty")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	shutdown, err := setupTracing(ctx, *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	rng := rand.New(rand.NewPCG(*seed, *seed))
+	g := &generator{
+		rng:        rng,
+		zipf:       rand.NewZipf(rng, *currencyZipf, 1, uint64(len(cs)-1)),
+		currencies: cs,
+		median:     *amountMedian,
+		sigma:      *amountSigma,
+		weekend:    *weekendFactor,
+	}
+	payments := g.generate(*count, time.Now().UTC(), time.Duration(*days)*24*time.Hour)
+
+	tracer := otel.Tracer("seed")
+	ctx, span := tracer.Start(ctx, "seed", trace.WithAttributes(
+		attribute.String("url.full", *target),
+		attribute.Int("seed.count", *count),
+		attribute.Int("seed.days", *days),
+		attribute.Int("seed.batch_size", *batchSize),
+	))
+	defer span.End()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	start := time.Now()
+	sent := 0
+	for batch := range slices.Chunk(payments, *batchSize) {
+		if err := send(ctx, tracer, client, *target, batch); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			log.Fatalf("after %d of %d payments: %v", sent, len(payments), err)
+		}
+		sent += len(batch)
+		span.AddEvent("seed.progress", trace.WithAttributes(
+			attribute.Int("seed.sent", sent),
+			attribute.Int("seed.total", len(payments)),
+		))
+		log.Printf("seeded %d/%d payments (%.0f/s)", sent, len(payments), float64(sent)/time.Since(start).Seconds())
+	}
+	span.SetAttributes(attribute.Int("seed.sent", sent))
+
+	fmt.Printf("statuses: %v\ncurrencies: %v\n", tally(payments, func(p payment) string { return p.Status }),
+		tally(payments, func(p payment) string { return p.Currency }))
+}
+
+// generate returns n payments dated within span before now, oldest first.
+func (g *generator) generate(n int, now time.Time, span time.Duration) []payment {
+	dates := make([]time.Time, n)
+	for i := range dates {
+		dates[i] = g.date(now, span)
+	}
+	slices.SortFunc(dates, time.Time.Compare)
+
+	payments := make([]payment, n)
+	for i, date := range dates {
+		currency := g.currencies[g.zipf.Uint64()]
+		payments[i] = payment{
+			// Dates have second precision, so adding i keeps IDs unique
+			// the way the service's own pay_<unix nanos> IDs are.
+			ID:       fmt.Sprintf("pay_%d", date.UnixNano()+int64(i)),
+			Amount:   g.amount(currency),
+			Currency: currency,
+			Status:   g.status(now.Sub(date)),
+			Date:     date.Format(time.RFC3339),
+		}
+	}
+	return payments
+}
+
+// date picks a time within span before now, following hourWeights and the
+// weekend factor by rejection sampling.
+func (g *generator) date(now time.Time, span time.Duration) time.Time {
+	for {
+		t := now.Add(-time.Duration(g.rng.Int64N(int64(span)))).Truncate(time.Second)
+		weight := hourWeights[t.Hour()]
+		if wd := t.Weekday(); wd == time.Saturday || wd == time.Sunday {
+			weight *= g.weekend
+		}
+		if g.rng.Float64() < weight {
+			return t
+		}
+	}
+}
+
+func (g *generator) amount(currency string) float64 {
+	a := g.median * math.Exp(g.rng.NormFloat64()*g.sigma)
+	if scale, ok := currencyScale[currency]; ok {
+		a *= scale
+	}
+	if zeroDecimal[currency] {
+		return max(1, math.Round(a))
+	}
+	return max(0.01, math.Round(a*100)/100)
+}
+
+// status settles most payments within a day; a few fail.
+func (g *generator) status(age time.Duration) string {
+	r := g.rng.Float64()
+	switch {
+	case age < time.Hour:
+		return "pending"
+	case age < 24*time.Hour && r < 0.35:
+		return "pending"
+	case r > 0.95:
+		return "failed"
+	default:
+		return "settled"
+	}
+}
+
+// send posts batch as NDJSON under a client span.
+func send(ctx context.Context, tracer trace.Tracer, client *http.Client, target string, batch []payment) error {
+	const path = "/debug/store/seed"
+	ctx, span := tracer.Start(ctx, "POST "+path, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", http.MethodPost),
+			attribute.String("url.full", target+path),
+			attribute.Int("seed.batch.size", len(batch)),
+		),
+	)
+	defer span.End()
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, p := range batch {
+		enc.Encode(p)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(respBody))
+		span.SetStatus(codes.Error, resp.Status)
+		return err
+	}
+	return nil
+}
+
+func tally(payments []payment, key func(payment) string) map[string]int {
+	counts := make(map[string]int)
+	for _, p := range payments {
+		counts[key(p)]++
+	}
+	return counts
+}
@@ -0,0 +1,369 @@
+// Command shardrouter is a thin HTTP router that shards payments across
+// several payment-service instances by consistent hash of the payment ID.
+// It assigns IDs to new payments so that later lookups and refunds reach the
+// shard that stored them, and fans payment listings out to every shard.
+//
+// Each hop runs under a server span for the incoming request and a client
+// span per shard, so traces show the router-to-shard topology.
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var shardKey = attribute.Key("shard")
+
+type router struct {
+	ring     *ring
+	shards   []string
+	client   *http.Client
+	tracer   trace.Tracer
+	requests metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+func main() {
+	addr := flag.String("addr", ":8090", "HTTP listen address")
+	shardsFlag := flag.String("shards", "http://localhost:8080,http://localhost:8081", "comma-separated base URLs of payment-service shards")
+	replicas := flag.Int("replicas", 64, "virtual nodes per shard on the hash ring")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP gRPC endpoint for the router's spans and metrics (empty disables export)")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	shutdown, err := setupTelemetry(ctx, *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	var shards []string
+	for _, s := range strings.Split(*shardsFlag, ",") {
+		shards = append(shards, strings.TrimRight(strings.TrimSpace(s), "/"))
+	}
+	rt, err := newRouter(shards, *replicas)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/payment", rt.handleList)
+	mux.HandleFunc("POST /api/payment", rt.handleCreate)
+	mux.HandleFunc("/api/payment/{id}", rt.handleByID)
+	mux.HandleFunc("/api/payment/{id}/{rest...}", rt.handleByID)
+	mux.HandleFunc("POST /api/payment/batch", rt.handleUnsharded)
+	mux.HandleFunc("POST /api/payment/import", rt.handleUnsharded)
+
+	srv := &http.Server{Addr: *addr, Handler: rt.serverSpan(mux)}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	fmt.Printf("Shard router on %s for %v\n", *addr, shards)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func newRouter(shards []string, replicas int) (*router, error) {
+	rt := &router{
+		ring:   newRing(shards, replicas),
+		shards: shards,
+		client: &http.Client{Timeout: 10 * time.Second},
+		tracer: otel.Tracer("shard-router"),
+	}
+
+	meter := otel.Meter("shard-router")
+	var err error
+	rt.requests, err = meter.Int64Counter(
+		"shard_requests_total",
+		metric.WithDescription("Number of requests forwarded to each shard"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	rt.duration, err = meter.Float64Histogram(
+		"shard_request_duration_seconds",
+		metric.WithDescription("Duration of requests forwarded to each shard"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ownership := rt.ring.ownership()
+	_, err = meter.Float64ObservableGauge(
+		"shard_ring_ownership_ratio",
+		metric.WithDescription("Fraction of the hash ring owned by each shard"),
+		metric.WithUnit("1"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			for shard, owned := range ownership {
+				o.Observe(owned, metric.WithAttributes(shardKey.String(shard)))
+			}
+			return nil
+		}),
+	)
+	return rt, err
+}
+
+// serverSpan joins the caller's trace and wraps each request in a server span.
+func (rt *router) serverSpan(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := rt.tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", r.Method)),
+		)
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (rt *router) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var payment map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	id := fmt.Sprintf("pay_%d", time.Now().UnixNano())
+	payment["id"] = id
+	body, _ := json.Marshal(payment)
+
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("payment.id", id))
+	rt.proxy(w, r, rt.ring.get(id), body)
+}
+
+func (rt *router) handleByID(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("payment.id", id))
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid body"})
+		return
+	}
+	rt.proxy(w, r, rt.ring.get(id), body)
+}
+
+// handleUnsharded rejects bulk endpoints: their payments get IDs on the
+// shard, so they could not be found again by hash.
+func (rt *router) handleUnsharded(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "Not supported by the shard router"})
+}
+
+// listLimit is the page size of a listing without a limit, as in the
+// payment service.
+const listLimit = 100
+
+// listed is a payment of a shard's listing, with the fields it can be
+// sorted by.
+type listed struct {
+	raw    json.RawMessage
+	ID     string  `json:"id"`
+	Amount float64 `json:"amount"`
+	Status string  `json:"status"`
+	Date   string  `json:"date"`
+}
+
+// handleList fans the listing out to every shard in parallel and merges the
+// results. Filters are applied by the shards. A page is only known once the
+// shards' listings are merged, so each shard is asked for everything up to
+// the end of the page, which is then sorted and cut here. Shards return at
+// most 1000 payments, so a page that ends further in is cut short.
+func (rt *router) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, offset := listLimit, 0
+	if n, err := strconv.Atoi(query.Get("limit")); err == nil {
+		limit = n
+	}
+	if n, err := strconv.Atoi(query.Get("offset")); err == nil {
+		offset = n
+	}
+	if limit > 0 && offset > 0 {
+		query.Set("limit", strconv.Itoa(offset+limit))
+		query.Del("offset")
+	}
+	uri := r.URL.Path
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		payments []listed
+		failed   bool
+		rejected []byte
+	)
+	for _, shard := range rt.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, body, err := rt.forward(r.Context(), shard, r.Method, uri, nil)
+			var part []json.RawMessage
+			if err == nil && status == http.StatusOK {
+				err = json.Unmarshal(body, &part)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && status == http.StatusBadRequest {
+				// Every shard rejects the same bad query.
+				rejected = body
+				return
+			}
+			if err != nil || status != http.StatusOK {
+				failed = true
+				return
+			}
+			for _, raw := range part {
+				p := listed{raw: raw}
+				json.Unmarshal(raw, &p)
+				payments = append(payments, p)
+			}
+		}()
+	}
+	wg.Wait()
+
+	switch {
+	case failed:
+		trace.SpanFromContext(r.Context()).SetStatus(codes.Error, "shard unavailable")
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Shard unavailable"})
+		return
+	case rejected != nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(rejected)
+		return
+	}
+
+	sortListed(payments, query.Get("sort"))
+	page := []json.RawMessage{}
+	for i := offset; i < len(payments) && len(page) < limit; i++ {
+		page = append(page, payments[i].raw)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// sortListed sorts merged listings like the payment service sorts its own:
+// by the field named by sort, descending if it starts with "-". Without a
+// sort, payments are ordered by date, which is the order each shard stored
+// them in.
+func sortListed(ps []listed, sort string) {
+	field, desc := strings.CutPrefix(sort, "-")
+	compare := func(a, b listed) int {
+		switch field {
+		case "id":
+			return cmp.Compare(a.ID, b.ID)
+		case "amount":
+			return cmp.Compare(a.Amount, b.Amount)
+		case "status":
+			return cmp.Compare(a.Status, b.Status)
+		default:
+			return listedTime(a).Compare(listedTime(b))
+		}
+	}
+	slices.SortStableFunc(ps, func(a, b listed) int {
+		if desc {
+			return compare(b, a)
+		}
+		return compare(a, b)
+	})
+}
+
+func listedTime(p listed) time.Time {
+	t, _ := time.Parse(time.RFC3339, p.Date)
+	return t
+}
+
+// proxy forwards the request to shard and copies its response.
+func (rt *router) proxy(w http.ResponseWriter, r *http.Request, shard string, body []byte) {
+	status, resp, err := rt.forward(r.Context(), shard, r.Method, r.URL.RequestURI(), body)
+	if err != nil {
+		trace.SpanFromContext(r.Context()).SetStatus(codes.Error, err.Error())
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Shard unavailable"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+// forward sends one request to shard under a client span, propagating the
+// trace context, and records per-shard balance metrics.
+func (rt *router) forward(ctx context.Context, shard, method, uri string, body []byte) (int, []byte, error) {
+	ctx, span := rt.tracer.Start(ctx, method+" shard", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			shardKey.String(shard),
+			attribute.String("http.request.method", method),
+			attribute.String("url.full", shard+uri),
+		),
+	)
+	defer span.End()
+
+	start := time.Now()
+	attrs := metric.WithAttributes(shardKey.String(shard))
+	defer func() {
+		rt.requests.Add(ctx, 1, attrs)
+		rt.duration.Record(ctx, time.Since(start).Seconds(), attrs)
+	}()
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, shard+uri, reader)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp.StatusCode, respBody, err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
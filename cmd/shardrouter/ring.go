@@ -0,0 +1,57 @@
+package main
+
+import (
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+// ring is a consistent-hash ring. Each shard is placed at several virtual
+// points so keys spread evenly, and adding or removing a shard only moves
+// the keys next to its points.
+type ring struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func newRing(shards []string, replicas int) *ring {
+	r := &ring{owners: make(map[uint32]string)}
+	for _, s := range shards {
+		for i := range replicas {
+			h := hash(s + "#" + strconv.Itoa(i))
+			r.points = append(r.points, h)
+			r.owners[h] = s
+		}
+	}
+	slices.Sort(r.points)
+	return r
+}
+
+// get returns the shard owning key: the first point at or after its hash.
+func (r *ring) get(key string) string {
+	h := hash(key)
+	i, _ := slices.BinarySearch(r.points, h)
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// ownership returns the fraction of the hash space each shard owns.
+func (r *ring) ownership() map[string]float64 {
+	owned := make(map[string]float64)
+	for i, p := range r.points {
+		prev := r.points[len(r.points)-1]
+		if i > 0 {
+			prev = r.points[i-1]
+		}
+		owned[r.owners[p]] += float64(p-prev) / (1 << 32)
+	}
+	return owned
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/telemetry"
+)
+
+// compactionConfig controls the background compaction of the payment store.
+type compactionConfig struct {
+	Interval time.Duration
+	// Retention prunes payments older than this; zero keeps them forever.
+	Retention time.Duration
+	// Stall lengthens every pause, so it stands out in the request latency
+	// histograms of a store too small to pause noticeably on its own.
+	Stall time.Duration
+}
+
+// compactor periodically rewrites the payment store, dropping duplicate IDs
+// (the last write wins) and payments past their retention. Compaction holds
+// the store lock exclusively, so every request that touches the store while
+// it runs waits: a stop-the-world pause, measured as
+// store_compaction_pause_seconds, that shows up as a latency spike in the
+// server's request histograms.
+type compactor struct {
+	cfg compactionConfig
+
+	pause   metric.Float64Histogram
+	removed metric.Int64Counter
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startCompaction(cfg compactionConfig) (*compactor, error) {
+	c := &compactor{cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+
+	meter := telemetry.Meter()
+	var err error
+	c.pause, err = meter.Float64Histogram(
+		"store_compaction_pause_seconds",
+		metric.WithDescription("Time the payment store was locked by compaction"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.removed, err = meter.Int64Counter(
+		"store_compaction_removed_payments_total",
+		metric.WithDescription("Number of payments removed by compaction, by reason"),
+		metric.WithUnit("{payment}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.run()
+	return c, nil
+}
+
+func (c *compactor) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.compact(context.Background())
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// compact runs one compaction under a store.compact root span.
+func (c *compactor) compact(ctx context.Context) {
+	cutoff := time.Time{}
+	if c.cfg.Retention > 0 {
+		cutoff = time.Now().Add(-c.cfg.Retention)
+	}
+
+	var scanned, duplicates, expired int
+	var pause time.Duration
+	err := telemetry.WithSpan(ctx, "store.compact", func(ctx context.Context) error {
+		var err error
+		pause, err = paymentStore.Rewrite(ctx, func(ps []Payment) []Payment {
+			scanned = len(ps)
+			var kept []Payment
+			kept, duplicates, expired = compactPayments(ps, cutoff)
+			if c.cfg.Stall > 0 {
+				time.Sleep(c.cfg.Stall)
+			}
+			return kept
+		})
+		if err != nil {
+			// The rewrite rolled back, so nothing was removed.
+			telemetry.LoggerFor(ctx).Error("payment store compaction failed", zap.Error(err))
+			return err
+		}
+		c.pause.Record(ctx, pause.Seconds())
+		c.removed.Add(ctx, int64(duplicates), metric.WithAttributes(attribute.String("reason", "duplicate")))
+		c.removed.Add(ctx, int64(expired), metric.WithAttributes(attribute.String("reason", "expired")))
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.Int("store.compaction.scanned", scanned),
+			attribute.Int("store.compaction.duplicates", duplicates),
+			attribute.Int("store.compaction.expired", expired),
+			attribute.Float64("store.compaction.pause_seconds", pause.Seconds()),
+		)
+		return nil
+	}, trace.WithNewRoot())
+	if err == nil && duplicates+expired > 0 {
+		telemetry.Logger().Info("compacted payment store",
+			zap.Int("scanned", scanned),
+			zap.Int("duplicates", duplicates),
+			zap.Int("expired", expired),
+			zap.Duration("pause", pause))
+	}
+}
+
+// compactPayments returns ps without duplicate IDs, keeping the last write
+// of each, and without payments dated before cutoff, if it is set. It never
+// modifies ps.
+func compactPayments(ps []Payment, cutoff time.Time) (kept []Payment, duplicates, expired int) {
+	last := make(map[string]int, len(ps))
+	for i, p := range ps {
+		last[p.ID] = i
+	}
+	kept = make([]Payment, 0, len(last))
+	for i, p := range ps {
+		if last[p.ID] != i {
+			duplicates++
+			continue
+		}
+		if !cutoff.IsZero() {
+			if date, err := time.Parse(time.RFC3339, p.Date); err == nil && date.Before(cutoff) {
+				expired++
+				continue
+			}
+		}
+		kept = append(kept, p)
+	}
+	return kept, duplicates, expired
+}
+
+func (c *compactor) Close() {
+	close(c.stop)
+	<-c.done
+}
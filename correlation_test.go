@@ -0,0 +1,109 @@
+//go:build !notelemetry
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"payment-service/internal/baggageguard"
+	"payment-service/internal/clientip"
+	"payment-service/internal/fault"
+	"payment-service/internal/telemetry"
+	"payment-service/internal/tenant"
+)
+
+// TestCrossSignalCorrelation checks that the three signals of one sampled
+// request can be joined: its log records carry the server span's trace ID,
+// and the request duration exemplar points at the server span.
+func TestCrossSignalCorrelation(t *testing.T) {
+	spans := tracetest.NewInMemoryExporter()
+	reader := sdkmetric.NewManualReader()
+	core, logs := observer.New(zapcore.DebugLevel)
+	p := &telemetry.Providers{
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)),
+		MeterProvider:  sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		Logger:         zap.New(core),
+	}
+	p.Install()
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+	initDependencies()
+
+	h, err := newHandler(fault.Config{}, nil, baggageguard.Config{}, clientip.Config{}, tenant.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/payment", strings.NewReader(`{"amount": 42}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	var server sdktrace.ReadOnlySpan
+	for _, s := range spans.GetSpans().Snapshots() {
+		if s.SpanKind() == trace.SpanKindServer && s.Name() == "POST /api/payment" {
+			server = s
+		}
+	}
+	if server == nil {
+		t.Fatal("no server span for POST /api/payment")
+	}
+	sc := server.SpanContext()
+	if !sc.IsSampled() {
+		t.Fatal("server span not sampled")
+	}
+
+	t.Run("logs", func(t *testing.T) {
+		records := logs.FilterMessage("payment created").All()
+		if len(records) == 0 {
+			t.Fatal(`no "payment created" log record`)
+		}
+		for _, r := range records {
+			if got := r.ContextMap()["trace_id"]; got != sc.TraceID().String() {
+				t.Errorf("log trace_id = %v, want server span trace %s", got, sc.TraceID())
+			}
+		}
+	})
+
+	t.Run("exemplar", func(t *testing.T) {
+		var rm metricdata.ResourceMetrics
+		if err := reader.Collect(context.Background(), &rm); err != nil {
+			t.Fatal(err)
+		}
+		hist, ok := findMetric(rm, "http.server.request.duration").(metricdata.Histogram[float64])
+		if !ok {
+			t.Fatal("no http.server.request.duration histogram")
+		}
+		for _, dp := range hist.DataPoints {
+			for _, ex := range dp.Exemplars {
+				if trace.TraceID(ex.TraceID) == sc.TraceID() && trace.SpanID(ex.SpanID) == sc.SpanID() {
+					return
+				}
+			}
+		}
+		t.Errorf("no exemplar points at server span %s/%s", sc.TraceID(), sc.SpanID())
+	})
+}
+
+func findMetric(rm metricdata.ResourceMetrics, name string) metricdata.Aggregation {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m.Data
+			}
+		}
+	}
+	return nil
+}
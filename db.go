@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/XSAM/otelsql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/outbox"
+)
+
+// paymentsTable, refundsTable and ledgerTable are the tables payments,
+// their refunds and their ledger entries are stored in, eventsTable the
+// outbox's events, and keysTable the idempotency keys; see dboutbox.go and
+// dbidempotency.go.
+const (
+	paymentsTable = "payments"
+	refundsTable  = "refunds"
+	ledgerTable   = "ledger_entries"
+	eventsTable   = "outbox_events"
+	keysTable     = "idempotency_keys"
+)
+
+// dialect is what differs between the supported databases.
+type dialect struct {
+	driver string
+	system attribute.KeyValue
+	schema []string
+	// migrations bring tables created by earlier versions up to date.
+	migrations []migration
+	// explain prefixes a query to have the database answer its plan.
+	explain string
+	// placeholder returns the placeholder of the nth query argument,
+	// counting from 1.
+	placeholder func(n int) string
+}
+
+// migration is a schema change run at startup.
+type migration struct {
+	// applied, if set, is a query that succeeds once the change is made,
+	// which is then skipped.
+	applied string
+	stmt    string
+}
+
+var (
+	sqliteDialect = dialect{
+		driver: "sqlite3",
+		system: semconv.DBSystemNameSQLite,
+		schema: []string{
+			`CREATE TABLE IF NOT EXISTS payments (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				id TEXT NOT NULL,
+				amount REAL NOT NULL,
+				currency TEXT NOT NULL,
+				status TEXT NOT NULL,
+				date TEXT NOT NULL,
+				trace_id TEXT NOT NULL DEFAULT '',
+				span_id TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX IF NOT EXISTS payments_id ON payments (id)`,
+			`CREATE TABLE IF NOT EXISTS refunds (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				id TEXT NOT NULL,
+				payment_id TEXT NOT NULL,
+				amount REAL NOT NULL,
+				currency TEXT NOT NULL,
+				date TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS refunds_payment_id ON refunds (payment_id)`,
+			`CREATE TABLE IF NOT EXISTS ledger_entries (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				payment_id TEXT NOT NULL,
+				kind TEXT NOT NULL,
+				amount REAL NOT NULL,
+				currency TEXT NOT NULL,
+				date TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS ledger_entries_payment_id ON ledger_entries (payment_id)`,
+			`CREATE TABLE IF NOT EXISTS outbox_events (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				id TEXT NOT NULL,
+				type TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				created_at TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				dead INTEGER NOT NULL DEFAULT 0,
+				trace_id TEXT NOT NULL DEFAULT '',
+				span_id TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX IF NOT EXISTS outbox_events_id ON outbox_events (id)`,
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+				idempotency_key TEXT PRIMARY KEY,
+				status INTEGER NOT NULL,
+				content_type TEXT NOT NULL,
+				body TEXT NOT NULL,
+				created INTEGER NOT NULL,
+				expires INTEGER NOT NULL
+			)`,
+		},
+		// SQLite has no ADD COLUMN IF NOT EXISTS.
+		migrations: []migration{
+			{`SELECT trace_id FROM payments LIMIT 0`, `ALTER TABLE payments ADD COLUMN trace_id TEXT NOT NULL DEFAULT ''`},
+			{`SELECT span_id FROM payments LIMIT 0`, `ALTER TABLE payments ADD COLUMN span_id TEXT NOT NULL DEFAULT ''`},
+		},
+		explain:     "EXPLAIN QUERY PLAN ",
+		placeholder: func(int) string { return "?" },
+	}
+	postgresDialect = dialect{
+		driver: "pgx",
+		system: semconv.DBSystemNamePostgreSQL,
+		schema: []string{
+			`CREATE TABLE IF NOT EXISTS payments (
+				seq BIGSERIAL PRIMARY KEY,
+				id TEXT NOT NULL,
+				amount DOUBLE PRECISION NOT NULL,
+				currency TEXT NOT NULL,
+				status TEXT NOT NULL,
+				date TEXT NOT NULL,
+				trace_id TEXT NOT NULL DEFAULT '',
+				span_id TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX IF NOT EXISTS payments_id ON payments (id)`,
+			`CREATE TABLE IF NOT EXISTS refunds (
+				seq BIGSERIAL PRIMARY KEY,
+				id TEXT NOT NULL,
+				payment_id TEXT NOT NULL,
+				amount DOUBLE PRECISION NOT NULL,
+				currency TEXT NOT NULL,
+				date TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS refunds_payment_id ON refunds (payment_id)`,
+			`CREATE TABLE IF NOT EXISTS ledger_entries (
+				seq BIGSERIAL PRIMARY KEY,
+				payment_id TEXT NOT NULL,
+				kind TEXT NOT NULL,
+				amount DOUBLE PRECISION NOT NULL,
+				currency TEXT NOT NULL,
+				date TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS ledger_entries_payment_id ON ledger_entries (payment_id)`,
+			`CREATE TABLE IF NOT EXISTS outbox_events (
+				seq BIGSERIAL PRIMARY KEY,
+				id TEXT NOT NULL,
+				type TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				created_at TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				dead INTEGER NOT NULL DEFAULT 0,
+				trace_id TEXT NOT NULL DEFAULT '',
+				span_id TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX IF NOT EXISTS outbox_events_id ON outbox_events (id)`,
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+				idempotency_key TEXT PRIMARY KEY,
+				status INTEGER NOT NULL,
+				content_type TEXT NOT NULL,
+				body TEXT NOT NULL,
+				created BIGINT NOT NULL,
+				expires BIGINT NOT NULL
+			)`,
+		},
+		migrations: []migration{
+			{stmt: `ALTER TABLE payments ADD COLUMN IF NOT EXISTS trace_id TEXT NOT NULL DEFAULT ''`},
+			{stmt: `ALTER TABLE payments ADD COLUMN IF NOT EXISTS span_id TEXT NOT NULL DEFAULT ''`},
+		},
+		explain:     "EXPLAIN ",
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	}
+)
+
+// sqlPayments keeps payments in a SQL database, so they survive restarts.
+// Every statement is a client span, named after its operation and table
+// (e.g. "SELECT payments") and carrying db.system.name, db.collection.name,
+// db.operation.name, the normalized db.query.text and its
+// db.query.fingerprint, and the rows it returned or changed, as a child of
+// the span that made it; see startStatement. The database is opened through
+// otelsql, which traces transactions and exports the db.sql.* metrics,
+// including connection pool statistics.
+type sqlPayments struct {
+	db *sql.DB
+	d  dialect
+	// slowQuery is the duration above which a statement is reported as
+	// slow; zero disables the reports.
+	slowQuery time.Duration
+}
+
+// openPayments opens the database at dsn and creates the payments table if
+// needed. A postgres:// or postgresql:// URL selects Postgres; anything else
+// is the path of a SQLite database file. Statements slower than slowQuery
+// add a db.query.slow event to their span.
+func openPayments(ctx context.Context, dsn string, slowQuery time.Duration) (*sqlPayments, error) {
+	d := sqliteDialect
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		d = postgresDialect
+	} else if !strings.Contains(dsn, "?") {
+		// WAL lets readers proceed while a write is in progress, and the
+		// busy timeout makes writers from other processes wait rather
+		// than fail.
+		dsn += "?_journal_mode=WAL&_busy_timeout=5000"
+	}
+
+	attrs := []attribute.KeyValue{
+		d.system,
+		semconv.DBCollectionName(paymentsTable),
+		attribute.String("peer.service", "payments-db"),
+	}
+	db, err := otelsql.Open(d.driver, dsn,
+		otelsql.WithAttributes(attrs...),
+		otelsql.WithSpanNameFormatter(spanName),
+		otelsql.WithAttributesGetter(operationName),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			DisableErrSkip:       true,
+			OmitConnResetSession: true,
+			SpanFilter:           hasParent,
+		}),
+	)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	if _, err := otelsql.RegisterDBStatsMetrics(db, otelsql.WithAttributes(d.system)); err != nil {
+		db.Close()
+		return nil, storeError(err)
+	}
+	for _, stmt := range d.schema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, storeError(err)
+		}
+	}
+	for _, m := range d.migrations {
+		if m.applied != "" {
+			if _, err := db.ExecContext(ctx, m.applied); err == nil {
+				continue
+			}
+		}
+		if _, err := db.ExecContext(ctx, m.stmt); err != nil {
+			db.Close()
+			return nil, storeError(err)
+		}
+	}
+	return &sqlPayments{db: db, d: d, slowQuery: slowQuery}, nil
+}
+
+// operation returns the SQL operation of query, such as SELECT, or "" if
+// there is no query.
+func operation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// spanName names otelsql's spans after its method, e.g. sql.conn.prepare,
+// so a prepare isn't mistaken for the store's span of the statement
+// it prepares.
+func spanName(_ context.Context, method otelsql.Method, _ string) string {
+	return string(method)
+}
+
+// operationName sets db.operation.name on query spans. otelsql already
+// sets it to the driver method on its metrics.
+func operationName(_ context.Context, _ otelsql.Method, query string, _ []driver.NamedValue) []attribute.KeyValue {
+	if op := operation(query); op != "" {
+		return []attribute.KeyValue{semconv.DBOperationName(op)}
+	}
+	return nil
+}
+
+// hasParent skips spans for queries made outside any trace, such as the
+// store_payments gauge's count on every metric collection, which would
+// otherwise each be a trace of their own. It also skips the statements the
+// store traces itself.
+func hasParent(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+	if ctx.Value(storeTraced{}) != nil {
+		return false
+	}
+	return trace.SpanContextFromContext(ctx).IsValid()
+}
+
+func (s *sqlPayments) Close() error {
+	return s.db.Close()
+}
+
+const selectPayments = `SELECT id, amount, currency, status, date, trace_id, span_id FROM payments`
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func (s *sqlPayments) query(ctx context.Context, q querier, query string, args ...any) (ps []Payment, err error) {
+	ctx, st := s.startStatement(ctx, paymentsTable, query, args)
+	defer func() { st.end(semconv.DBResponseReturnedRowsKey, int64(len(ps)), err) }()
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.Amount, &p.Currency, &p.Status, &p.Date, &p.TraceID, &p.SpanID); err != nil {
+			return nil, storeError(err)
+		}
+		ps = append(ps, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storeError(err)
+	}
+	return ps, nil
+}
+
+func (s *sqlPayments) all(ctx context.Context) ([]Payment, error) {
+	return s.query(ctx, s.db, selectPayments+` ORDER BY seq`)
+}
+
+func (s *sqlPayments) find(ctx context.Context, id string) (Payment, bool, error) {
+	ps, err := s.query(ctx, s.db, selectPayments+` WHERE id = `+s.d.placeholder(1)+` ORDER BY seq LIMIT 1`, id)
+	if err != nil || len(ps) == 0 {
+		return Payment{}, false, err
+	}
+	return ps[0], true, nil
+}
+
+func (s *sqlPayments) ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return storeError(err)
+	}
+	return nil
+}
+
+func (s *sqlPayments) count(ctx context.Context) (int, error) {
+	const query = `SELECT COUNT(*) FROM payments`
+	ctx, st := s.startStatement(ctx, paymentsTable, query, nil)
+	var n int
+	err := s.db.QueryRowContext(ctx, query).Scan(&n)
+	st.end(semconv.DBResponseReturnedRowsKey, 1, err)
+	if err != nil {
+		return 0, storeError(err)
+	}
+	return n, nil
+}
+
+func (s *sqlPayments) add(ctx context.Context, ps []Payment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storeError(err)
+	}
+	defer tx.Rollback()
+	if err := s.insert(ctx, tx, ps); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return storeError(err)
+	}
+	return nil
+}
+
+// create inserts p, its first ledger entry and its outbox event in the
+// create_payment transaction, so a payment is never stored without its
+// entry and its event.
+func (s *sqlPayments) create(ctx context.Context, p Payment, e LedgerEntry, newEvent outbox.NewEvent) error {
+	event, err := newEvent(p)
+	if err != nil {
+		return err
+	}
+	return s.transaction(ctx, "create_payment", func(ctx context.Context, tx *sql.Tx) error {
+		if err := s.insert(ctx, tx, []Payment{p}); err != nil {
+			return err
+		}
+		ph := s.d.placeholder
+		if err := s.exec(ctx, tx, ledgerTable, `INSERT INTO ledger_entries (payment_id, kind, amount, currency, date) VALUES (`+
+			ph(1)+`, `+ph(2)+`, `+ph(3)+`, `+ph(4)+`, `+ph(5)+`)`,
+			e.PaymentID, e.Kind, e.Amount, e.Currency, e.Date); err != nil {
+			return err
+		}
+		return s.insertEvent(ctx, tx, event)
+	})
+}
+
+// event inserts the event newEvent makes of payload on its own.
+func (s *sqlPayments) event(ctx context.Context, payload any, newEvent outbox.NewEvent) error {
+	e, err := newEvent(payload)
+	if err != nil {
+		return err
+	}
+	return s.insertEvent(ctx, s.db, e)
+}
+
+// insert inserts ps with one prepared statement.
+func (s *sqlPayments) insert(ctx context.Context, tx *sql.Tx, ps []Payment) error {
+	p := s.d.placeholder
+	query := `INSERT INTO payments (id, amount, currency, status, date, trace_id, span_id) VALUES (` +
+		p(1) + `, ` + p(2) + `, ` + p(3) + `, ` + p(4) + `, ` + p(5) + `, ` + p(6) + `, ` + p(7) + `)`
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return storeError(err)
+	}
+	defer stmt.Close()
+	for _, pay := range ps {
+		args := []any{pay.ID, pay.Amount, pay.Currency, pay.Status, pay.Date, pay.TraceID, pay.SpanID}
+		ctx, st := s.startStatement(ctx, paymentsTable, query, args)
+		res, err := stmt.ExecContext(ctx, args...)
+		st.end(affectedRowsKey, affected(res, err), err)
+		if err != nil {
+			return storeError(err)
+		}
+	}
+	return nil
+}
+
+// update changes the payment with id, and inserts its event if newEvent
+// isn't nil, in one transaction. Like the memory backend, it updates every
+// row with the ID.
+func (s *sqlPayments) update(ctx context.Context, id string, update func(Payment) (Payment, error), newEvent outbox.NewEvent) (Payment, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Payment{}, false, storeError(err)
+	}
+	defer tx.Rollback()
+
+	p := s.d.placeholder
+	ps, err := s.query(ctx, tx, selectPayments+` WHERE id = `+p(1)+` ORDER BY seq LIMIT 1`, id)
+	if err != nil || len(ps) == 0 {
+		return Payment{}, false, err
+	}
+	updated, err := update(ps[0])
+	if err != nil {
+		return Payment{}, true, err
+	}
+	if err := s.write(ctx, tx, id, updated); err != nil {
+		return Payment{}, true, err
+	}
+	if newEvent != nil {
+		e, err := newEvent(updated)
+		if err != nil {
+			return Payment{}, true, err
+		}
+		if err := s.insertEvent(ctx, tx, e); err != nil {
+			return Payment{}, true, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Payment{}, true, storeError(err)
+	}
+	return updated, true, nil
+}
+
+// write stores p as every row with id.
+func (s *sqlPayments) write(ctx context.Context, tx *sql.Tx, id string, p Payment) error {
+	ph := s.d.placeholder
+	return s.exec(ctx, tx, paymentsTable, `UPDATE payments SET amount = `+ph(1)+`, currency = `+ph(2)+`, status = `+ph(3)+`, date = `+ph(4)+
+		`, trace_id = `+ph(5)+`, span_id = `+ph(6)+` WHERE id = `+ph(7),
+		p.Amount, p.Currency, p.Status, p.Date, p.TraceID, p.SpanID, id)
+}
+
+// refund records a refund of the payment with id, its effect on the payment
+// and its event, in one transaction.
+func (s *sqlPayments) refund(ctx context.Context, id string, refund refundFunc, newEvent outbox.NewEvent) (Payment, Refund, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Payment{}, Refund{}, false, storeError(err)
+	}
+	defer tx.Rollback()
+
+	p := s.d.placeholder
+	ps, err := s.query(ctx, tx, selectPayments+` WHERE id = `+p(1)+` ORDER BY seq LIMIT 1`, id)
+	if err != nil || len(ps) == 0 {
+		return Payment{}, Refund{}, false, err
+	}
+	refunds, err := s.refunds(ctx, tx, id)
+	if err != nil {
+		return Payment{}, Refund{}, true, err
+	}
+	updated, r, err := refund(ps[0], refunds)
+	if err != nil {
+		return Payment{}, Refund{}, true, err
+	}
+	if err := s.exec(ctx, tx, refundsTable, `INSERT INTO refunds (id, payment_id, amount, currency, date) VALUES (`+
+		p(1)+`, `+p(2)+`, `+p(3)+`, `+p(4)+`, `+p(5)+`)`,
+		r.ID, r.PaymentID, r.Amount, r.Currency, r.Date); err != nil {
+		return Payment{}, Refund{}, true, err
+	}
+	if err := s.write(ctx, tx, id, updated); err != nil {
+		return Payment{}, Refund{}, true, err
+	}
+	e, err := newEvent(r)
+	if err != nil {
+		return Payment{}, Refund{}, true, err
+	}
+	if err := s.insertEvent(ctx, tx, e); err != nil {
+		return Payment{}, Refund{}, true, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Payment{}, Refund{}, true, storeError(err)
+	}
+	return updated, r, true, nil
+}
+
+// refunds returns the refunds of the payment with id, oldest first.
+func (s *sqlPayments) refunds(ctx context.Context, q querier, id string) (rs []Refund, err error) {
+	query := `SELECT id, payment_id, amount, currency, date FROM refunds WHERE payment_id = ` + s.d.placeholder(1) + ` ORDER BY seq`
+	ctx, st := s.startStatement(ctx, refundsTable, query, []any{id})
+	defer func() { st.end(semconv.DBResponseReturnedRowsKey, int64(len(rs)), err) }()
+	rows, err := q.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Refund
+		if err := rows.Scan(&r.ID, &r.PaymentID, &r.Amount, &r.Currency, &r.Date); err != nil {
+			return nil, storeError(err)
+		}
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storeError(err)
+	}
+	return rs, nil
+}
+
+// rewrite replaces the table's contents in one transaction, so a failure
+// leaves the payments as they were. The refunds and ledger entries of the
+// payments it drops go with them.
+func (s *sqlPayments) rewrite(ctx context.Context, rewrite func([]Payment) []Payment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storeError(err)
+	}
+	defer tx.Rollback()
+
+	ps, err := s.query(ctx, tx, selectPayments+` ORDER BY seq`)
+	if err != nil {
+		return err
+	}
+	kept := rewrite(ps)
+	if slices.Equal(kept, ps) {
+		return nil
+	}
+	if err := s.exec(ctx, tx, paymentsTable, `DELETE FROM payments`); err != nil {
+		return err
+	}
+	if err := s.insert(ctx, tx, kept); err != nil {
+		return err
+	}
+	for _, table := range []string{refundsTable, ledgerTable} {
+		if err := s.exec(ctx, tx, table, `DELETE FROM `+table+` WHERE payment_id NOT IN (SELECT id FROM payments)`); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return storeError(err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+
+	"payment-service/internal/idempotency"
+)
+
+// sqlPayments is the idempotency keys' Backend when payments are in a
+// database, so a key outlives a restart exactly when the payment it created
+// does. Each completed key is one row, written on its own.
+var _ idempotency.Backend = (*sqlPayments)(nil)
+
+// LoadRecords returns the stored idempotency records.
+func (s *sqlPayments) LoadRecords(ctx context.Context) (recs []idempotency.Record, err error) {
+	const query = `SELECT idempotency_key, status, content_type, body, created, expires FROM idempotency_keys`
+	ctx, st := s.startStatement(ctx, keysTable, query, nil)
+	defer func() { st.end(semconv.DBResponseReturnedRowsKey, int64(len(recs)), err) }()
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec idempotency.Record
+		var body string
+		var created, expires int64
+		if err := rows.Scan(&rec.Key, &rec.Status, &rec.ContentType, &body, &created, &expires); err != nil {
+			return nil, storeError(err)
+		}
+		rec.Body = []byte(body)
+		rec.Created, rec.Expires = time.Unix(0, created), time.Unix(0, expires)
+		recs = append(recs, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storeError(err)
+	}
+	return recs, nil
+}
+
+// SaveRecord inserts rec, or replaces the record of its key.
+func (s *sqlPayments) SaveRecord(ctx context.Context, rec idempotency.Record) error {
+	p := s.d.placeholder
+	return s.exec(ctx, s.db, keysTable, `INSERT INTO idempotency_keys (idempotency_key, status, content_type, body, created, expires) VALUES (`+
+		p(1)+`, `+p(2)+`, `+p(3)+`, `+p(4)+`, `+p(5)+`, `+p(6)+`) ON CONFLICT (idempotency_key) DO UPDATE SET `+
+		`status = excluded.status, content_type = excluded.content_type, body = excluded.body, created = excluded.created, expires = excluded.expires`,
+		rec.Key, rec.Status, rec.ContentType, string(rec.Body), rec.Created.UnixNano(), rec.Expires.UnixNano())
+}
+
+// DeleteExpired deletes the records that expired by now.
+func (s *sqlPayments) DeleteExpired(ctx context.Context, now time.Time) error {
+	return s.exec(ctx, s.db, keysTable, `DELETE FROM idempotency_keys WHERE expires <= `+s.d.placeholder(1), now.UnixNano())
+}
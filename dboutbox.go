@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+
+	"payment-service/internal/outbox"
+)
+
+// sqlPayments is the outbox's Store when payments are in a database. Its
+// events are inserted by the transactions of the writes that produce them,
+// such as create_payment, so a payment and its event are committed or
+// rolled back together.
+var _ outbox.Store = (*sqlPayments)(nil)
+
+// insertEvent stores e as pending in tx.
+func (s *sqlPayments) insertEvent(ctx context.Context, tx execer, e outbox.Event) error {
+	p := s.d.placeholder
+	return s.exec(ctx, tx, eventsTable, `INSERT INTO outbox_events (id, type, payload, created_at, trace_id, span_id) VALUES (`+
+		p(1)+`, `+p(2)+`, `+p(3)+`, `+p(4)+`, `+p(5)+`, `+p(6)+`)`,
+		e.ID, e.Type, string(e.Payload), e.CreatedAt.Format(time.RFC3339Nano), e.TraceID, e.SpanID)
+}
+
+// LoadEvents returns the stored events, pending and dead, in commit
+// order.
+func (s *sqlPayments) LoadEvents(ctx context.Context) (pending, dead []outbox.Event, err error) {
+	const query = `SELECT id, type, payload, created_at, attempts, dead, trace_id, span_id FROM outbox_events ORDER BY seq`
+	ctx, st := s.startStatement(ctx, eventsTable, query, nil)
+	defer func() { st.end(semconv.DBResponseReturnedRowsKey, int64(len(pending)+len(dead)), err) }()
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, nil, storeError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e outbox.Event
+		var payload, created string
+		var isDead int
+		if err := rows.Scan(&e.ID, &e.Type, &payload, &created, &e.Attempts, &isDead, &e.TraceID, &e.SpanID); err != nil {
+			return nil, nil, storeError(err)
+		}
+		e.Payload = []byte(payload)
+		if e.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, nil, storeError(err)
+		}
+		if isDead != 0 {
+			dead = append(dead, e)
+		} else {
+			pending = append(pending, e)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storeError(err)
+	}
+	return pending, dead, nil
+}
+
+// SaveEvent records e's attempts and whether it is dead.
+func (s *sqlPayments) SaveEvent(ctx context.Context, e outbox.Event, dead bool) error {
+	p := s.d.placeholder
+	isDead := 0
+	if dead {
+		isDead = 1
+	}
+	return s.exec(ctx, s.db, eventsTable, `UPDATE outbox_events SET attempts = `+p(1)+`, dead = `+p(2)+` WHERE id = `+p(3),
+		e.Attempts, isDead, e.ID)
+}
+
+// DeleteEvent removes a published event.
+func (s *sqlPayments) DeleteEvent(ctx context.Context, id string) error {
+	return s.exec(ctx, s.db, eventsTable, `DELETE FROM outbox_events WHERE id = `+s.d.placeholder(1), id)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+
+	"payment-service/internal/telemetry"
+)
+
+// Statement spans are started by the store rather than by otelsql, which
+// ends a query's span before its rows are read and returns no handle to it,
+// so it can't carry what the statement returned. otelsql still records the
+// db.sql.* metrics of every statement, and the spans of transactions and
+// prepares.
+
+const (
+	// fingerprintKey identifies a statement independently of its arguments
+	// and of the dialect's placeholders, to group its spans across both.
+	fingerprintKey = attribute.Key("db.query.fingerprint")
+	// affectedRowsKey is the number of rows an INSERT, UPDATE or DELETE
+	// changed; semconv only defines db.response.returned_rows.
+	affectedRowsKey = attribute.Key("db.response.affected_rows")
+	// planKey is the database's plan of a slow statement.
+	planKey = attribute.Key("db.query.plan")
+	// transactionKey names the store operation a transaction makes, such
+	// as create_payment.
+	transactionKey = attribute.Key("db.transaction.name")
+)
+
+// storeTraced marks the context of a statement the store traces itself,
+// for hasParent to skip otelsql's span of it.
+type storeTraced struct{}
+
+var (
+	placeholders = regexp.MustCompile(`\$\d+|\?`)
+	literals     = regexp.MustCompile(`'(?:[^']|'')*'|\b\d+(?:\.\d+)?\b`)
+	whitespace   = regexp.MustCompile(`\s+`)
+)
+
+// normalizeQuery replaces the placeholders and literals of query with ?
+// and collapses its whitespace, so statements that differ only in their
+// values or their dialect read the same, and no value reaches a span.
+func normalizeQuery(query string) string {
+	query = literals.ReplaceAllString(query, "?")
+	query = placeholders.ReplaceAllString(query, "?")
+	return strings.TrimSpace(whitespace.ReplaceAllString(query, " "))
+}
+
+// fingerprint is the first 8 bytes of the SHA-256 of a normalized query,
+// in hex.
+func fingerprint(normalized string) string {
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:8])
+}
+
+// statement is one traced execution of a query.
+type statement struct {
+	s           *sqlPayments
+	ctx         context.Context
+	span        trace.Span
+	started     bool
+	query       string
+	args        []any
+	table       string
+	op          string
+	fingerprint string
+	start       time.Time
+}
+
+// startStatement starts the client span of query on table, named and
+// attributed the way otelsql names its spans, plus the normalized query and
+// its fingerprint. Like hasParent, it starts no span outside a trace. Pass
+// the returned context to the database call.
+func (s *sqlPayments) startStatement(ctx context.Context, table, query string, args []any) (context.Context, *statement) {
+	normalized := normalizeQuery(query)
+	st := &statement{
+		s:           s,
+		query:       query,
+		args:        args,
+		table:       table,
+		op:          operation(query),
+		fingerprint: fingerprint(normalized),
+		start:       time.Now(),
+	}
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		ctx, st.span = telemetry.Tracer().Start(ctx, st.op+" "+table,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				s.d.system,
+				semconv.DBCollectionName(table),
+				semconv.DBOperationName(st.op),
+				semconv.DBQueryText(normalized),
+				fingerprintKey.String(st.fingerprint),
+				attribute.String("peer.service", "payments-db"),
+			))
+		st.started = true
+	}
+	st.ctx = context.WithValue(ctx, storeTraced{}, true)
+	return st.ctx, st
+}
+
+// end ends the statement's span with rows, the rows it returned or changed
+// as rowsKey, or with err. A traced statement slower than the store's
+// slow-query threshold is also reported; see slow. Untraced ones, such as
+// the store_payments gauge's count, aren't: they run inside metric
+// collection, which can't create the slow-query counter.
+func (st *statement) end(rowsKey attribute.Key, rows int64, err error) {
+	if !st.started {
+		return
+	}
+	defer st.span.End()
+	elapsed := time.Since(st.start)
+	if err != nil {
+		telemetry.SpanError(st.span, err)
+	} else {
+		st.span.SetAttributes(rowsKey.Int64(rows))
+	}
+	if st.s.slowQuery > 0 && elapsed >= st.s.slowQuery {
+		st.slow(elapsed)
+	}
+}
+
+// slow adds a db.query.slow event with the statement's plan to its span,
+// counts it in db_slow_queries_total and logs it.
+func (st *statement) slow(elapsed time.Duration) {
+	plan := st.s.plan(st)
+	attrs := []attribute.KeyValue{
+		attribute.Float64("db.query.duration_seconds", elapsed.Seconds()),
+		attribute.Float64("db.query.slow_threshold_seconds", st.s.slowQuery.Seconds()),
+	}
+	if plan != "" {
+		attrs = append(attrs, planKey.String(plan))
+	}
+	st.span.AddEvent("db.query.slow", trace.WithAttributes(attrs...))
+	slowQueries().Add(st.ctx, 1, metric.WithAttributes(
+		semconv.DBCollectionName(st.table),
+		semconv.DBOperationName(st.op),
+		fingerprintKey.String(st.fingerprint),
+	))
+	telemetry.LoggerFor(st.ctx).Warn("slow query",
+		zap.String("db.query.fingerprint", st.fingerprint),
+		zap.String("db.query.text", normalizeQuery(st.query)),
+		zap.Duration("duration", elapsed),
+		zap.String("db.query.plan", plan))
+}
+
+// plans caches the plan of each statement by fingerprint: the statements
+// are fixed, so their plans only change with the schema or the data's
+// statistics, and explaining every slow execution would add load to a
+// database that is already slow.
+var plans sync.Map
+
+// plan returns the database's plan of st, or "" if it can't be had. It is
+// explained outside st's transaction and trace, with st's arguments; EXPLAIN
+// without ANALYZE doesn't run the statement in either dialect.
+func (s *sqlPayments) plan(st *statement) string {
+	if plan, ok := plans.Load(st.fingerprint); ok {
+		return plan.(string)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	plan, err := s.explain(ctx, st.query, st.args)
+	if err != nil {
+		telemetry.LoggerFor(st.ctx).Debug("explain failed",
+			zap.String("db.query.fingerprint", st.fingerprint), zap.Error(err))
+		return ""
+	}
+	plans.Store(st.fingerprint, plan)
+	return plan
+}
+
+// explain returns the plan of query, one line per step. SQLite's EXPLAIN
+// QUERY PLAN answers id, parent, notused and detail, Postgres's EXPLAIN a
+// single column of text; either way the last column is the step.
+func (s *sqlPayments) explain(ctx context.Context, query string, args []any) (string, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.explain+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	values := make([]any, len(cols))
+	dest := make([]any, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var steps []string
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		step := values[len(values)-1]
+		if b, ok := step.([]byte); ok {
+			step = string(b)
+		}
+		steps = append(steps, fmt.Sprint(step))
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return strings.Join(steps, "\n"), nil
+}
+
+// transaction runs fn in a database transaction under an internal span
+// named after it, such as "TRANSACTION create_payment", which parents the
+// spans of its statements and otelsql's sql.conn.begin_tx and sql.tx.commit.
+// The span ends with a db.transaction.commit event or, if fn or the commit
+// fails, a db.transaction.rollback event; those are also counted in
+// db_transaction_rollbacks_total{db.transaction.name, reason}. Like
+// startStatement, it starts no span outside a trace.
+func (s *sqlPayments) transaction(ctx context.Context, name string, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	var span trace.Span = noop.Span{}
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		ctx, span = telemetry.Tracer().Start(ctx, "TRANSACTION "+name,
+			trace.WithAttributes(s.d.system, transactionKey.String(name)))
+	}
+	defer span.End()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = storeError(err)
+		telemetry.SpanError(span, err)
+		return err
+	}
+	if err := fn(ctx, tx); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			telemetry.LoggerFor(ctx).Debug("rollback failed",
+				zap.String("db.transaction.name", name), zap.Error(rerr))
+		}
+		rolledBack(ctx, span, name, rollbackReason(ctx, "statement"), err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		// The database rolls back a transaction it can't commit.
+		err = storeError(err)
+		rolledBack(ctx, span, name, rollbackReason(ctx, "commit"), err)
+		return err
+	}
+	span.AddEvent("db.transaction.commit")
+	return nil
+}
+
+// rollbackReason is canceled if ctx ended, which fails whatever statement
+// was running, and reason otherwise: statement if one of the transaction's
+// statements failed, commit if its commit did.
+func rollbackReason(ctx context.Context, reason string) string {
+	if ctx.Err() != nil {
+		return "canceled"
+	}
+	return reason
+}
+
+// rolledBack notes on span, and in the rollback counter, that the
+// transaction name was rolled back for reason after err.
+func rolledBack(ctx context.Context, span trace.Span, name, reason string, err error) {
+	span.AddEvent("db.transaction.rollback", trace.WithAttributes(attribute.String("db.transaction.rollback.reason", reason)))
+	telemetry.SpanError(span, err)
+	transactionRollbacks().Add(ctx, 1, metric.WithAttributes(transactionKey.String(name), attribute.String("reason", reason)))
+}
+
+// exec runs query on table with e and records the rows it changed.
+func (s *sqlPayments) exec(ctx context.Context, e execer, table, query string, args ...any) error {
+	ctx, st := s.startStatement(ctx, table, query, args)
+	res, err := e.ExecContext(ctx, query, args...)
+	st.end(affectedRowsKey, affected(res, err), err)
+	if err != nil {
+		return storeError(err)
+	}
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// affected returns the rows res changed, or 0 if err is set or the driver
+// doesn't count them.
+func affected(res sql.Result, err error) int64 {
+	if err != nil {
+		return 0
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// slowQueries creates the slow-query counter on first use, after
+// telemetry.Setup.
+var slowQueries = sync.OnceValue(func() metric.Int64Counter {
+	meter := telemetry.Meter()
+	c, err := meter.Int64Counter(
+		"db_slow_queries_total",
+		metric.WithDescription("Number of store statements slower than the slow-query threshold, by statement fingerprint"),
+		metric.WithUnit("{query}"),
+	)
+	if err != nil {
+		c, _ = meter.Int64Counter("db_slow_queries_total")
+	}
+	return c
+})
+
+// transactionRollbacks creates the rollback counter on first use, after
+// telemetry.Setup.
+var transactionRollbacks = sync.OnceValue(func() metric.Int64Counter {
+	meter := telemetry.Meter()
+	c, err := meter.Int64Counter(
+		"db_transaction_rollbacks_total",
+		metric.WithDescription("Number of store transactions rolled back, by transaction and reason"),
+		metric.WithUnit("{transaction}"),
+	)
+	if err != nil {
+		c, _ = meter.Int64Counter("db_transaction_rollbacks_total")
+	}
+	return c
+})
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"payment-service/internal/telemetry"
+)
+
+// defaultFlushTimeout bounds a flush without a timeout parameter.
+const defaultFlushTimeout = 10 * time.Second
+
+// flushHandler exports the telemetry held in memory before it answers, so
+// an exercise step can rely on its spans and metrics having reached the
+// backend. It answers each signal's flush duration and error, with 200 if
+// every signal flushed and 503 if one failed or ran out of ?timeout=
+// (10s by default). The request's own server span ends after the flush,
+// so it isn't part of it.
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	timeout := defaultFlushTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err == nil && d <= 0 {
+			err = errors.New("timeout must be positive")
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid timeout", telemetry.WithFailureDomain(err, telemetry.DomainClient))
+			return
+		}
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	results := telemetry.Flush(ctx)
+	status := http.StatusOK
+	for _, res := range results {
+		if res.Error != "" {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"flushed": status == http.StatusOK,
+		"signals": results,
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// Kinds of payment history events.
+const (
+	historyCreated  = "payment.created"
+	historyUpdated  = "payment.updated"
+	historyRefunded = "payment.refunded"
+)
+
+// historyMaxEvents bounds the events a payment history keeps. Beyond it,
+// the oldest half is folded into the history's snapshot.
+const historyMaxEvents = 100_000
+
+// errBeforeHistory is returned for a time before the history starts.
+var errBeforeHistory = errors.New("before the payment history")
+
+// paymentEvent is a change to a payment, with the payment as the change
+// left it.
+type paymentEvent struct {
+	At      time.Time
+	Kind    string
+	Payment Payment
+}
+
+// paymentHistory records every change of a PaymentStore's payments, in
+// the order they were made, so the store's contents at an earlier time can
+// be rebuilt by replaying the changes made until then. Compaction isn't a
+// change: the payments it drops are still in the history. The history is
+// kept in memory, and starts when the store is created, from the payments a
+// restored database already holds.
+//
+// PaymentStore holds its lock around record and the start of replay.
+type paymentHistory struct {
+	// snapshot is the state at since, folded from the events dropped to
+	// stay within historyMaxEvents.
+	snapshot []Payment
+	since    time.Time
+	events   []paymentEvent
+}
+
+// newPaymentHistory starts a history at the payments of snapshot.
+func newPaymentHistory(snapshot []Payment) *paymentHistory {
+	return &paymentHistory{snapshot: snapshot, since: time.Now()}
+}
+
+// record appends the change kind made to p.
+func (h *paymentHistory) record(kind string, p Payment) {
+	h.events = append(h.events, paymentEvent{At: time.Now(), Kind: kind, Payment: p})
+	if len(h.events) <= historyMaxEvents {
+		return
+	}
+	folded := h.events[:len(h.events)/2]
+	h.snapshot = replayEvents(h.snapshot, folded)
+	h.since = folded[len(folded)-1].At
+	// Replays may be reading the old slices; they aren't modified.
+	h.events = slices.Clone(h.events[len(folded):])
+}
+
+// until returns the snapshot and the events up to t. Since events are only
+// appended, and folding replaces the slices rather than changing them, the
+// result stays valid after the store lock is released.
+func (h *paymentHistory) until(t time.Time) ([]Payment, []paymentEvent, error) {
+	if t.Before(h.since) {
+		return nil, nil, fmt.Errorf("%w, which starts at %s", errBeforeHistory, h.since.Format(time.RFC3339))
+	}
+	n := sort.Search(len(h.events), func(i int) bool { return h.events[i].At.After(t) })
+	return h.snapshot, h.events[:n], nil
+}
+
+// replayEvents applies events to the payments in snapshot, keeping the
+// order they were first created in.
+func replayEvents(snapshot []Payment, events []paymentEvent) []Payment {
+	ps := slices.Clone(snapshot)
+	index := make(map[string]int, len(ps))
+	for i, p := range ps {
+		index[p.ID] = i
+	}
+	for _, e := range events {
+		if i, ok := index[e.Payment.ID]; ok {
+			ps[i] = e.Payment
+			continue
+		}
+		index[e.Payment.ID] = len(ps)
+		ps = append(ps, e.Payment)
+	}
+	return ps
+}
+
+// AsOf returns the payments as they were at t, oldest first, rebuilt from
+// the store's history under a payment.history.replay span. The number of
+// events replayed is recorded on it and in payment_history_replayed_events,
+// since it is what a query's cost grows with. A t before the history
+// starts is an errBeforeHistory.
+func (s *PaymentStore) AsOf(ctx context.Context, t time.Time) ([]Payment, error) {
+	var ps []Payment
+	err := telemetry.WithSpan(ctx, "payment.history.replay", func(ctx context.Context) error {
+		runlock := s.mu.RLock(ctx)
+		snapshot, events, err := s.history.until(t)
+		runlock()
+		if err != nil {
+			return telemetry.WithFailureDomain(err, telemetry.DomainClient)
+		}
+
+		start := time.Now()
+		ps = replayEvents(snapshot, events)
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("payment.history.as_of", t.Format(time.RFC3339)),
+			attribute.Int("payment.history.snapshot_payments", len(snapshot)),
+			attribute.Int("payment.history.events_replayed", len(events)),
+			attribute.Int("payment.history.payments", len(ps)),
+			attribute.Float64("payment.history.replay_seconds", time.Since(start).Seconds()),
+		)
+		replayedEvents().Record(ctx, int64(len(events)))
+		return nil
+	})
+	return ps, err
+}
+
+// replayedEvents creates the replay histogram on first use, after
+// telemetry.Setup.
+var replayedEvents = sync.OnceValue(func() metric.Int64Histogram {
+	meter := telemetry.Meter()
+	h, err := meter.Int64Histogram(
+		"payment_history_replayed_events",
+		metric.WithDescription("Number of history events replayed to rebuild the payments as of a time"),
+		metric.WithUnit("{event}"),
+		metric.WithExplicitBucketBoundaries(10, 100, 1000, 10_000, 50_000, 100_000),
+	)
+	if err != nil {
+		h, _ = meter.Int64Histogram("payment_history_replayed_events")
+	}
+	return h
+})
@@ -0,0 +1,322 @@
+// Package api declares the service's HTTP endpoints. An Endpoint is a
+// method, a route and a handler, plus options for the behaviour it needs;
+// Register adds endpoints to a mux, each wrapped in the same middlewares,
+// outermost first:
+//
+//   - tracing: the server span, started by telemetry.ServerSpanMiddleware,
+//     gets api.endpoint and the path values named by WithPathAttribute,
+//     and an api.timeout or api.auth.rejected event when those apply;
+//   - metrics: api_requests_total{api.endpoint, outcome} counts requests by
+//     outcome, including the timeouts and rejections http.server.* can't
+//     tell from other responses;
+//   - logging: a "request served" record per request, at Debug, or at Warn
+//     for a 5xx;
+//   - auth, with WithAuth: a bearer token from SetTokens is required;
+//   - timeout, with WithTimeout: the handler's context ends after it;
+//   - the endpoint's own middlewares, from WithMiddleware.
+//
+// Handlers then only handle the request, whatever the number of routes.
+// Handler gives the requests no endpoint matches JSON errors too.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/telemetry"
+)
+
+// EndpointKey names the endpoint that served a request, as declared, e.g.
+// "POST /api/payment".
+const EndpointKey = attribute.Key("api.endpoint")
+
+// Outcomes of api_requests_total.
+const (
+	OutcomeOK              = "ok"
+	OutcomeClientError     = "client_error"
+	OutcomeServerError     = "server_error"
+	OutcomeTimeout         = "timeout"
+	OutcomeUnauthenticated = "unauthenticated"
+)
+
+// ErrUnauthenticated is recorded for requests to an endpoint declared
+// WithAuth that carry no valid token.
+var ErrUnauthenticated = telemetry.WithFailureDomain(errors.New("api: missing or invalid bearer token"), telemetry.DomainClient)
+
+// Endpoint is a declared route. Create one with GET, POST, PUT or DELETE.
+type Endpoint struct {
+	method      string
+	route       string
+	handler     http.Handler
+	timeout     time.Duration
+	auth        bool
+	pathAttrs   []pathAttribute
+	middlewares []func(http.Handler) http.Handler
+}
+
+type pathAttribute struct {
+	name string
+	key  attribute.Key
+}
+
+// Option configures an Endpoint.
+type Option func(*Endpoint)
+
+// GET declares the GET endpoint of route.
+func GET(route string, h http.HandlerFunc, opts ...Option) Endpoint {
+	return newEndpoint(http.MethodGet, route, h, opts)
+}
+
+// POST declares the POST endpoint of route.
+func POST(route string, h http.HandlerFunc, opts ...Option) Endpoint {
+	return newEndpoint(http.MethodPost, route, h, opts)
+}
+
+// PUT declares the PUT endpoint of route.
+func PUT(route string, h http.HandlerFunc, opts ...Option) Endpoint {
+	return newEndpoint(http.MethodPut, route, h, opts)
+}
+
+// DELETE declares the DELETE endpoint of route.
+func DELETE(route string, h http.HandlerFunc, opts ...Option) Endpoint {
+	return newEndpoint(http.MethodDelete, route, h, opts)
+}
+
+func newEndpoint(method, route string, h http.Handler, opts []Option) Endpoint {
+	e := Endpoint{method: method, route: route, handler: h}
+	for _, opt := range opts {
+		opt(&e)
+	}
+	return e
+}
+
+// WithTimeout ends the context of the handler after d. Handlers pass their
+// context on, so the work they start gives up with it; a request that ran
+// out of time is recorded with an api.timeout event and the timeout
+// outcome, whatever the handler answered.
+func WithTimeout(d time.Duration) Option {
+	return func(e *Endpoint) { e.timeout = d }
+}
+
+// WithAuth requires an Authorization: Bearer header with one of the tokens
+// set by SetTokens, answering 401 otherwise. Without tokens, the endpoint
+// is open.
+func WithAuth() Option {
+	return func(e *Endpoint) { e.auth = true }
+}
+
+// WithPathAttribute sets the path value name, a wildcard of the route, as
+// the span attribute key of the server span, e.g. "id" as payment.id.
+func WithPathAttribute(name string, key attribute.Key) Option {
+	return func(e *Endpoint) { e.pathAttrs = append(e.pathAttrs, pathAttribute{name, key}) }
+}
+
+// WithMiddleware wraps the handler in mw, the first outermost, inside the
+// middlewares every endpoint gets.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) Option {
+	return func(e *Endpoint) { e.middlewares = append(e.middlewares, mw...) }
+}
+
+// Name returns the endpoint as recorded in api.endpoint.
+func (e Endpoint) Name() string {
+	return e.method + " " + e.route
+}
+
+// Register adds endpoints to mux, each at its method and route.
+func Register(mux *http.ServeMux, endpoints ...Endpoint) {
+	for _, e := range endpoints {
+		mux.Handle(e.Name(), e.wrap())
+	}
+}
+
+// Handler returns mux with JSON error bodies for the requests no endpoint
+// matches. The mux answers them itself, in plain text: 404 for a path it
+// has no route for, and 405, with an Allow header, for a method the route
+// has no endpoint for. Handler has writeError write its body instead,
+// like any other error of the service.
+func Handler(mux *http.ServeMux, writeError func(w http.ResponseWriter, r *http.Request, status int, message string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&unroutedWriter{ResponseWriter: w, r: r, writeError: writeError}, r)
+	})
+}
+
+// unroutedWriter replaces the mux's plain-text error with writeError's.
+type unroutedWriter struct {
+	http.ResponseWriter
+	r          *http.Request
+	writeError func(w http.ResponseWriter, r *http.Request, status int, message string)
+	wrote      bool
+}
+
+func (w *unroutedWriter) WriteHeader(status int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	message := http.StatusText(status)
+	switch status {
+	case http.StatusNotFound:
+		message = "Not found"
+	case http.StatusMethodNotAllowed:
+		message = "Method not allowed"
+	}
+	w.Header().Del("X-Content-Type-Options")
+	w.Header().Set("Content-Type", "application/json")
+	w.writeError(w.ResponseWriter, w.r, status, message)
+}
+
+// Write drops the mux's plain-text body.
+func (w *unroutedWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// wrap returns the endpoint's handler in its middlewares.
+func (e Endpoint) wrap() http.Handler {
+	h := e.handler
+	for i := len(e.middlewares) - 1; i >= 0; i-- {
+		h = e.middlewares[i](h)
+	}
+	name := EndpointKey.String(e.Name())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := r.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(name)
+		for _, a := range e.pathAttrs {
+			span.SetAttributes(a.key.String(r.PathValue(a.name)))
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		outcome := e.serve(sw, r, h)
+		if outcome == "" {
+			outcome = outcomeOf(sw.status)
+		}
+
+		requests().Add(ctx, 1, metric.WithAttributes(name, attribute.String("outcome", outcome)))
+		log := telemetry.LoggerFor(ctx).Debug
+		if sw.status >= 500 {
+			log = telemetry.LoggerFor(ctx).Warn
+		}
+		log("request served",
+			zap.String(string(EndpointKey), e.Name()),
+			zap.Int("http.response.status_code", sw.status),
+			zap.String("outcome", outcome),
+			zap.Duration("duration", time.Since(start)))
+	})
+}
+
+// serve runs h behind the endpoint's auth and timeout. It returns the
+// outcome of a request they decided, or "" if its response status does.
+func (e Endpoint) serve(w http.ResponseWriter, r *http.Request, h http.Handler) string {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+	if e.auth {
+		if reason := authenticate(r); reason != "" {
+			span.AddEvent("api.auth.rejected", trace.WithAttributes(attribute.String("api.auth.rejection.reason", reason)))
+			telemetry.RecordError(ctx, ErrUnauthenticated)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+			return OutcomeUnauthenticated
+		}
+	}
+	if e.timeout <= 0 {
+		h.ServeHTTP(w, r)
+		return ""
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	h.ServeHTTP(w, r.WithContext(tctx))
+	if errors.Is(tctx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		span.AddEvent("api.timeout", trace.WithAttributes(attribute.Float64("api.timeout_seconds", e.timeout.Seconds())))
+		return OutcomeTimeout
+	}
+	return ""
+}
+
+func outcomeOf(status int) string {
+	switch {
+	case status >= 500:
+		return OutcomeServerError
+	case status >= 400:
+		return OutcomeClientError
+	}
+	return OutcomeOK
+}
+
+var tokens atomic.Pointer[[]string]
+
+// SetTokens sets the bearer tokens endpoints declared WithAuth accept. Empty
+// leaves them open.
+func SetTokens(ts []string) {
+	tokens.Store(&ts)
+}
+
+// authenticate returns why r isn't allowed, missing or invalid, or "" if it
+// is.
+func authenticate(r *http.Request) string {
+	ts := tokens.Load()
+	if ts == nil || len(*ts) == 0 {
+		return ""
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || got == "" {
+		return "missing"
+	}
+	for _, t := range *ts {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(t)) == 1 {
+			return ""
+		}
+	}
+	return "invalid"
+}
+
+// statusWriter records the status of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection's writer, for
+// handlers that flush.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requests creates the request counter on first use, after telemetry.Setup.
+var requests = sync.OnceValue(func() metric.Int64Counter {
+	meter := telemetry.Meter()
+	c, err := meter.Int64Counter(
+		"api_requests_total",
+		metric.WithDescription("Number of requests served by declared endpoints, by endpoint and outcome"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		c, _ = meter.Int64Counter("api_requests_total")
+	}
+	return c
+})
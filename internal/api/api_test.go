@@ -0,0 +1,257 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// serveSpan runs r through h under a recording root span, as the server
+// span middleware would, and returns the span once it ended.
+func serveSpan(t *testing.T, h http.Handler, r *http.Request) (*httptest.ResponseRecorder, tracetest.SpanStub) {
+	t.Helper()
+	spans := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	ctx, span := tp.Tracer("api_test").Start(r.Context(), "server")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r.WithContext(ctx))
+	span.End()
+
+	got := spans.GetSpans()
+	if len(got) != 1 {
+		t.Fatalf("%d spans, want 1", len(got))
+	}
+	return w, got[0]
+}
+
+func eventNames(s tracetest.SpanStub) []string {
+	var names []string
+	for _, e := range s.Events {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func attr(attrs []attribute.KeyValue, key attribute.Key) attribute.Value {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestServeAuth(t *testing.T) {
+	SetTokens([]string{"secret"})
+	t.Cleanup(func() { SetTokens(nil) })
+
+	for _, tc := range []struct {
+		name    string
+		header  string
+		outcome string
+		reason  string
+	}{
+		{"missing", "", OutcomeUnauthenticated, "missing"},
+		{"invalid", "Bearer wrong", OutcomeUnauthenticated, "invalid"},
+		{"not bearer", "Basic secret", OutcomeUnauthenticated, "missing"},
+		{"valid", "Bearer secret", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := POST("/p", nil, WithAuth())
+			var outcome string
+			served := false
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				outcome = e.serve(w, r, http.HandlerFunc(func(http.ResponseWriter, *http.Request) { served = true }))
+			})
+			r := httptest.NewRequest(http.MethodPost, "/p", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w, span := serveSpan(t, h, r)
+
+			if outcome != tc.outcome {
+				t.Errorf("outcome = %q, want %q", outcome, tc.outcome)
+			}
+			if tc.reason == "" {
+				if !served || len(span.Events) != 0 {
+					t.Errorf("served = %v, events %v; want the handler to run and no events", served, eventNames(span))
+				}
+				return
+			}
+			if served {
+				t.Error("handler ran for a rejected request")
+			}
+			if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("response %d, WWW-Authenticate %q; want 401 with Bearer", w.Code, w.Header().Get("WWW-Authenticate"))
+			}
+			i := slices.Index(eventNames(span), "api.auth.rejected")
+			if i < 0 {
+				t.Fatalf("events %v, want api.auth.rejected", eventNames(span))
+			}
+			if reason := attr(span.Events[i].Attributes, "api.auth.rejection.reason"); reason.AsString() != tc.reason {
+				t.Errorf("api.auth.rejection.reason = %q, want %q", reason.AsString(), tc.reason)
+			}
+		})
+	}
+}
+
+func TestServeTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		// parent returns the request's context before the endpoint's
+		// timeout applies, as the client or server left it.
+		parent  func() (context.Context, context.CancelFunc)
+		outcome string
+	}{
+		{
+			name:    "endpoint timeout",
+			timeout: 10 * time.Millisecond,
+			parent:  func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			outcome: OutcomeTimeout,
+		},
+		{
+			name:    "client canceled",
+			timeout: time.Second,
+			parent: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(10*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+		},
+		{
+			// The endpoint's context ends with DeadlineExceeded too, but
+			// from the request's own deadline, not the endpoint's.
+			name:    "request deadline",
+			timeout: time.Second,
+			parent: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 10*time.Millisecond)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := GET("/p", nil, WithTimeout(tc.timeout))
+			var outcome string
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				outcome = e.serve(w, r, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+					<-r.Context().Done()
+				}))
+			})
+			ctx, cancel := tc.parent()
+			defer cancel()
+			_, span := serveSpan(t, h, httptest.NewRequestWithContext(ctx, http.MethodGet, "/p", nil))
+
+			if outcome != tc.outcome {
+				t.Errorf("outcome = %q, want %q", outcome, tc.outcome)
+			}
+			if timedOut := slices.Contains(eventNames(span), "api.timeout"); timedOut != (tc.outcome == OutcomeTimeout) {
+				t.Errorf("events %v, want api.timeout only for the endpoint's timeout", eventNames(span))
+			}
+		})
+	}
+}
+
+func TestRegisterPathAttributes(t *testing.T) {
+	mux := http.NewServeMux()
+	Register(mux, GET("/payments/{id}/refunds/{refund}", func(http.ResponseWriter, *http.Request) {},
+		WithPathAttribute("id", "payment.id"),
+		WithPathAttribute("refund", "refund.id"),
+	))
+	_, span := serveSpan(t, mux, httptest.NewRequest(http.MethodGet, "/payments/pay_1/refunds/ref_2", nil))
+
+	for key, want := range map[attribute.Key]string{
+		EndpointKey:  "GET /payments/{id}/refunds/{refund}",
+		"payment.id": "pay_1",
+		"refund.id":  "ref_2",
+	} {
+		if got := attr(span.Attributes, key); got.AsString() != want {
+			t.Errorf("%s = %q, want %q", key, got.AsString(), want)
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	SetTokens([]string{"secret"})
+	t.Cleanup(func() { SetTokens(nil) })
+
+	var order []string
+	mw := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	const timeout = time.Minute
+	e := POST("/p", func(_ http.ResponseWriter, r *http.Request) {
+		// The timeout applies before the endpoint's middlewares run.
+		if deadline, ok := r.Context().Deadline(); !ok || time.Until(deadline) > timeout {
+			t.Error("handler context has no endpoint timeout")
+		}
+		order = append(order, "handler")
+	}, WithAuth(), WithTimeout(timeout), WithMiddleware(mw("first"), mw("second")))
+	mux := http.NewServeMux()
+	Register(mux, e)
+
+	r := httptest.NewRequest(http.MethodPost, "/p", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	serveSpan(t, mux, r)
+	if want := []string{"first", "second", "handler"}; !slices.Equal(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+
+	// Auth runs outside the endpoint's middlewares, so they don't see
+	// rejected requests.
+	order = nil
+	w, _ := serveSpan(t, mux, httptest.NewRequest(http.MethodPost, "/p", nil))
+	if w.Code != http.StatusUnauthorized || len(order) != 0 {
+		t.Errorf("response %d, ran %v; want 401 without the middlewares", w.Code, order)
+	}
+}
+
+func TestHandlerUnroutedErrorsAreJSON(t *testing.T) {
+	mux := http.NewServeMux()
+	Register(mux, POST("/p", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusCreated) }))
+	h := Handler(mux, func(w http.ResponseWriter, _ *http.Request, status int, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+	})
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		message      string
+		allow        string
+	}{
+		{http.MethodGet, "/p", http.StatusMethodNotAllowed, "Method not allowed", "POST"},
+		{http.MethodGet, "/missing", http.StatusNotFound, "Not found", ""},
+		{http.MethodPost, "/p", http.StatusCreated, "", ""},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.status || w.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s %s = %d, Allow %q; want %d, %q", tc.method, tc.path, w.Code, w.Header().Get("Allow"), tc.status, tc.allow)
+		}
+		if tc.message == "" {
+			continue
+		}
+		var body map[string]string
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s Content-Type = %q, want application/json", tc.method, tc.path, ct)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] != tc.message {
+			t.Errorf("%s %s body = %q, want a JSON error %q", tc.method, tc.path, w.Body.String(), tc.message)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Package backoff checks whether clients honor the Retry-After hints they
+// are sent. Throttled requests (429) and shed load (503) tell the client how
+// long to wait. Backpressure only works if clients cooperate, so Middleware
+// remembers each hint and judges the client's next request by it: honored
+// if it came after the hint expired, ignored if it came before.
+package backoff
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/clientip"
+	"payment-service/internal/telemetry"
+)
+
+// Results of judging a request against its client's hint.
+const (
+	Honored = "honored"
+	Ignored = "ignored"
+)
+
+// Grace is how long after a hint requests are not judged: they were likely
+// sent before the client received it.
+const Grace = 250 * time.Millisecond
+
+// maxHints bounds the hints kept. Client keys come partly from a header, so
+// a client could otherwise grow them without limit.
+const maxHints = 10000
+
+var resultKey = attribute.Key("backoff.result")
+
+// hint is the Retry-After a client was sent.
+type hint struct {
+	sent, until time.Time
+}
+
+type hints struct {
+	mu sync.Mutex
+	m  map[string]hint
+}
+
+// judge returns whether the request of key at now honored or ignored its
+// hint, or false if there is no hint to judge it by. An honored hint is
+// forgotten; an ignored one stays until it expires.
+func (h *hints) judge(key string, now time.Time) (string, time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hn, ok := h.m[key]
+	switch {
+	case !ok || now.Sub(hn.sent) < Grace:
+		return "", 0, false
+	case now.Before(hn.until):
+		return Ignored, hn.until.Sub(now), true
+	}
+	delete(h.m, key)
+	return Honored, 0, true
+}
+
+func (h *hints) add(key string, now time.Time, wait time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.m[key]; !ok && len(h.m) >= maxHints {
+		for k, hn := range h.m {
+			if now.After(hn.until) {
+				delete(h.m, k)
+			}
+		}
+		if len(h.m) >= maxHints {
+			return
+		}
+	}
+	// A client that ignores its hint keeps getting new ones; its grace
+	// starts with the first.
+	sent := now
+	if hn, ok := h.m[key]; ok && now.Before(hn.until) {
+		sent = hn.sent
+	}
+	h.m[key] = hint{sent: sent, until: now.Add(wait)}
+}
+
+// Middleware records the Retry-After hints of 429 and 503 responses by
+// client, as resolved by clientip.Middleware, which must run before it, and
+// tenant header. Hints are counted in backoff_hints_total by status code.
+// A later request of the same client is judged by its hint: the server span
+// gets backoff.result, an ignored hint also adds a backoff.ignored event with
+// backoff.early_seconds, and backoff_requests_total counts judged requests by
+// result.
+func Middleware(tenantHeader string, next http.Handler) http.Handler {
+	h := &hints{m: make(map[string]hint)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		key := r.RemoteAddr
+		if c, ok := clientip.FromContext(ctx); ok {
+			key = c.Addr.String()
+		}
+		key += " " + r.Header.Get(tenantHeader)
+
+		if result, early, ok := h.judge(key, time.Now()); ok {
+			span := trace.SpanFromContext(ctx)
+			span.SetAttributes(resultKey.String(result))
+			if result == Ignored {
+				span.AddEvent("backoff.ignored", trace.WithAttributes(
+					attribute.Float64("backoff.early_seconds", early.Seconds()),
+				))
+			}
+			instruments().requests.Add(ctx, 1, metric.WithAttributes(resultKey.String(result)))
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		if sw.status != http.StatusTooManyRequests && sw.status != http.StatusServiceUnavailable {
+			return
+		}
+		secs, err := strconv.Atoi(strings.TrimSpace(w.Header().Get("Retry-After")))
+		if err != nil || secs < 0 {
+			return
+		}
+		h.add(key, time.Now(), time.Duration(secs)*time.Second)
+		instruments().hints.Add(ctx, 1, metric.WithAttributes(attribute.Int("http.response.status_code", sw.status)))
+	})
+}
+
+// statusWriter records the response status code.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type backoffInstruments struct {
+	hints    metric.Int64Counter
+	requests metric.Int64Counter
+}
+
+// instruments creates the counters on first use, after telemetry.Setup.
+var instruments = sync.OnceValue(func() backoffInstruments {
+	meter := telemetry.Meter()
+	hints, err := meter.Int64Counter(
+		"backoff_hints_total",
+		metric.WithDescription("Number of responses that told the client to back off with Retry-After, by status code"),
+		metric.WithUnit("{response}"),
+	)
+	if err != nil {
+		hints, _ = meter.Int64Counter("backoff_hints_total")
+	}
+	requests, err := meter.Int64Counter(
+		"backoff_requests_total",
+		metric.WithDescription("Number of requests from clients that were told to back off, by whether they waited"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		requests, _ = meter.Int64Counter("backoff_requests_total")
+	}
+	return backoffInstruments{hints: hints, requests: requests}
+})
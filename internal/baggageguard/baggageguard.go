@@ -0,0 +1,189 @@
+// Package baggageguard bounds the W3C baggage a request carries into the
+// service. Baggage is propagated on every downstream call, so an entry a
+// client adds, or one that grows, is copied into every request the service
+// makes on its behalf. Middleware measures the incoming baggage header and
+// keeps only the allowlisted entries that fit the size and count limits.
+package baggageguard
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// Header is the W3C baggage header.
+const Header = "baggage"
+
+// DefaultAllow are the baggage keys the service's callers propagate: the
+// traffic generator's session and run IDs, the tenant and customer IDs,
+// and the customer tier.
+var DefaultAllow = []string{"session.id", "loadgen.run.id", "tenant.id", "customer.id", "customer.tier"}
+
+// Reasons an entry is stripped.
+const (
+	ReasonUnknown   = "unknown"
+	ReasonOversized = "oversized"
+	ReasonTooMany   = "too_many"
+	// ReasonInvalid is recorded once for a header that doesn't parse, which
+	// is dropped entirely.
+	ReasonInvalid = "invalid"
+)
+
+// Config is the baggage allowlist and limits.
+type Config struct {
+	// Allow lists the keys that are kept. When there are more than
+	// MaxEntries of them, the first ones listed are kept.
+	Allow []string
+	// MaxEntryBytes caps the encoded size of an entry, key and properties
+	// included. Zero is unlimited.
+	MaxEntryBytes int
+	// MaxEntries caps the number of entries kept. Zero is unlimited.
+	MaxEntries int
+}
+
+// ParseAllow parses a comma-separated list of baggage keys.
+func ParseAllow(s string) []string {
+	var keys []string
+	for _, key := range strings.Split(s, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Middleware records the size of each request's baggage header in
+// baggage_header_size_bytes and strips the entries cfg doesn't allow, from
+// the baggage in the context and from the header alike. Stripped entries add
+// a baggage.stripped event to the current span, which should be the server
+// span, and are counted in baggage_stripped_entries_total by reason. The
+// entries kept are then copied onto that span as traces.baggage_attributes
+// configures.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.Header.Values(Header)
+		if len(values) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		header := strings.Join(values, ",")
+		instruments().size.Record(ctx, int64(len(header)))
+
+		kept, stripped := Filter(cfg, header)
+		if len(stripped) > 0 {
+			record(ctx, stripped)
+		}
+		ctx = baggage.ContextWithBaggage(ctx, kept)
+		telemetry.CopyBaggage(ctx)
+		inner := r.WithContext(ctx)
+		inner.Header = r.Header.Clone()
+		if kept.Len() > 0 {
+			inner.Header.Set(Header, kept.String())
+		} else {
+			inner.Header.Del(Header)
+		}
+		next.ServeHTTP(w, inner)
+		// Pass the matched route back for the server span, as
+		// clientip.Middleware does.
+		r.Pattern = inner.Pattern
+	})
+}
+
+// Strip is an entry removed from the baggage.
+type Strip struct {
+	Key    string
+	Reason string
+}
+
+// Filter parses a baggage header and returns the entries cfg allows, and
+// those it strips. A header that doesn't parse is stripped entirely.
+func Filter(cfg Config, header string) (baggage.Baggage, []Strip) {
+	in, err := baggage.Parse(header)
+	if err != nil {
+		return baggage.Baggage{}, []Strip{{Reason: ReasonInvalid}}
+	}
+
+	var stripped []Strip
+	for _, m := range in.Members() {
+		if !slices.Contains(cfg.Allow, m.Key()) {
+			stripped = append(stripped, Strip{m.Key(), ReasonUnknown})
+		}
+	}
+	var members []baggage.Member
+	for _, key := range cfg.Allow {
+		m := in.Member(key)
+		switch {
+		case m.Key() == "":
+			continue
+		case cfg.MaxEntryBytes > 0 && len(m.String()) > cfg.MaxEntryBytes:
+			stripped = append(stripped, Strip{key, ReasonOversized})
+		case cfg.MaxEntries > 0 && len(members) >= cfg.MaxEntries:
+			stripped = append(stripped, Strip{key, ReasonTooMany})
+		default:
+			members = append(members, m)
+		}
+	}
+	if len(stripped) == 0 {
+		return in, nil
+	}
+	out, err := baggage.New(members...)
+	if err != nil {
+		// The members parsed from a valid header make a valid baggage.
+		return baggage.Baggage{}, append(stripped, Strip{Reason: ReasonInvalid})
+	}
+	return out, stripped
+}
+
+func record(ctx context.Context, stripped []Strip) {
+	keys := make([]string, 0, len(stripped))
+	reasons := make([]string, 0, len(stripped))
+	for _, s := range stripped {
+		keys = append(keys, s.Key)
+		reasons = append(reasons, s.Reason)
+		instruments().stripped.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", s.Reason)))
+	}
+	trace.SpanFromContext(ctx).AddEvent("baggage.stripped", trace.WithAttributes(
+		attribute.StringSlice("baggage.stripped_keys", keys),
+		attribute.StringSlice("baggage.stripped_reasons", reasons),
+	))
+}
+
+type guardInstruments struct {
+	size     metric.Int64Histogram
+	stripped metric.Int64Counter
+}
+
+// instruments creates the instruments on first use, after telemetry.Setup.
+var instruments = sync.OnceValue(func() guardInstruments {
+	meter := telemetry.Meter()
+	var inst guardInstruments
+	var err error
+	inst.size, err = meter.Int64Histogram(
+		"baggage_header_size_bytes",
+		metric.WithDescription("Size of the baggage header of incoming requests that carry one"),
+		metric.WithUnit("By"),
+		metric.WithExplicitBucketBoundaries(64, 128, 256, 512, 1024, 2048, 4096, 8192),
+	)
+	if err != nil {
+		inst.size, _ = meter.Int64Histogram("baggage_header_size_bytes")
+	}
+	inst.stripped, err = meter.Int64Counter(
+		"baggage_stripped_entries_total",
+		metric.WithDescription("Number of baggage entries stripped from incoming requests, by reason"),
+		metric.WithUnit("{entry}"),
+	)
+	if err != nil {
+		inst.stripped, _ = meter.Int64Counter("baggage_stripped_entries_total")
+	}
+	return inst
+})
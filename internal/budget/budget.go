@@ -0,0 +1,107 @@
+// Package budget carries a latency budget for a unit of work in its context.
+// Each downstream call is given a slice of what is left, so a slow
+// dependency early on leaves less time for the ones after it rather than
+// letting the whole request overrun.
+package budget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// ErrExhausted is matched by errors from calls that ran out of budget.
+var ErrExhausted = errors.New("latency budget exhausted")
+
+var (
+	remainingKey  = attribute.Key("budget.remaining_seconds")
+	dependencyKey = attribute.Key("budget.dependency")
+)
+
+type budget struct {
+	total    time.Duration
+	deadline time.Time
+}
+
+type ctxKey struct{}
+
+// New starts a budget of total for the work in ctx. If ctx already has a
+// budget with less time left, that budget is kept.
+func New(ctx context.Context, total time.Duration) (context.Context, context.CancelFunc) {
+	if remaining, ok := Remaining(ctx); ok && remaining <= total {
+		return context.WithCancel(ctx)
+	}
+	b := &budget{total: total, deadline: time.Now().Add(total)}
+	ctx, cancel := context.WithDeadline(ctx, b.deadline)
+	return context.WithValue(ctx, ctxKey{}, b), cancel
+}
+
+// Remaining returns the time left in ctx's budget, and false if there is none.
+func Remaining(ctx context.Context) (time.Duration, bool) {
+	b, ok := ctx.Value(ctxKey{}).(*budget)
+	if !ok {
+		return 0, false
+	}
+	return max(time.Until(b.deadline), 0), true
+}
+
+// Annotate records the remaining budget on span. Dependencies call it on
+// their own spans so a trace shows how much time each call started with.
+func Annotate(ctx context.Context, span trace.Span) {
+	if remaining, ok := Remaining(ctx); ok {
+		span.SetAttributes(remainingKey.Float64(remaining.Seconds()))
+	}
+}
+
+// Spend gives a call to dependency up to limit of the remaining budget, or
+// all of it if limit is zero. Pass the returned context to the call and its
+// error to end, which releases the context and, if the call ran out of time,
+// counts it in budget_exhausted_total and returns an error matching
+// ErrExhausted, tagged with dependency as its failure domain.
+func Spend(ctx context.Context, dependency string, limit time.Duration) (context.Context, func(error) error) {
+	allotted, ok := Remaining(ctx)
+	if !ok {
+		return ctx, func(err error) error { return err }
+	}
+	if limit > 0 && limit < allotted {
+		allotted = limit
+	}
+	trace.SpanFromContext(ctx).AddEvent("budget.spend", trace.WithAttributes(
+		dependencyKey.String(dependency),
+		remainingKey.Float64(allotted.Seconds()),
+	))
+
+	callCtx, cancel := context.WithTimeout(ctx, allotted)
+	return callCtx, func(err error) error {
+		cancel()
+		if err == nil || !errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.Canceled {
+			return err
+		}
+		exhausted().Add(ctx, 1, metric.WithAttributes(attribute.String("dependency", dependency)))
+		return telemetry.WithFailureDomain(
+			fmt.Errorf("%w: %s after %v: %w", ErrExhausted, dependency, allotted.Round(time.Millisecond), err),
+			dependency,
+		)
+	}
+}
+
+// exhausted creates the counter on first use, after telemetry.Setup.
+var exhausted = sync.OnceValue(func() metric.Int64Counter {
+	c, err := telemetry.Meter().Int64Counter(
+		"budget_exhausted_total",
+		metric.WithDescription("Number of dependency calls that failed because the latency budget ran out"),
+		metric.WithUnit("{call}"),
+	)
+	if err != nil {
+		c, _ = telemetry.Meter().Int64Counter("budget_exhausted_total")
+	}
+	return c
+})
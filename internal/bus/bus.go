@@ -0,0 +1,229 @@
+// Package bus is an in-process event bus. It implements outbox.Publisher, so
+// the outbox relay publishes to it, and fans each event out to every
+// subscriber on the subscriber's own goroutine. Each delivery runs under a
+// consumer span continuing the trace of the publish span.
+//
+// The consumers export the service-level indicators of the async path, by
+// messaging.consumer.group.name: bus_consumer_lag_seconds, the age of the
+// oldest event a subscriber hasn't finished, and bus_consumer_queued_events
+// are the gauges to alert on; bus_process_duration_seconds is the time its
+// handler takes, and bus_redeliveries_total counts the events it only took
+// when the relay published them again.
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/locks"
+	"payment-service/internal/outbox"
+	"payment-service/internal/telemetry"
+)
+
+// ErrBackpressure is returned by Publish when a subscriber's queue is full.
+// The outbox relay retries the event on its next poll.
+var ErrBackpressure = errors.New("bus: subscriber queue full")
+
+// Handler processes one event.
+type Handler func(ctx context.Context, e outbox.Event) error
+
+type subscription struct {
+	name    string
+	handler Handler
+	queue   chan outbox.Event
+
+	// mu guards unfinished, the commit times of the events queued or in
+	// process, oldest first, for the lag and depth gauges.
+	mu         sync.Mutex
+	unfinished []time.Time
+}
+
+// lag returns the age of the oldest unfinished event, or 0 if there is
+// none, and the number of unfinished events.
+func (s *subscription) lag() (time.Duration, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.unfinished) == 0 {
+		return 0, 0
+	}
+	return time.Since(s.unfinished[0]), len(s.unfinished)
+}
+
+// Bus delivers published events to subscribers.
+type Bus struct {
+	queueSize int
+
+	mu   *locks.Mutex
+	subs []*subscription
+	// seen records, per subscriber, the events it already took from a
+	// publish that hit backpressure elsewhere, so the retry doesn't deliver
+	// them twice.
+	seen map[string]map[string]bool
+	wg   sync.WaitGroup
+
+	process     metric.Float64Histogram
+	redelivered metric.Int64Counter
+}
+
+// New returns a Bus whose subscribers buffer up to queueSize events each.
+func New(queueSize int) (*Bus, error) {
+	if queueSize <= 0 {
+		queueSize = 256
+	}
+	b := &Bus{queueSize: queueSize, mu: locks.NewMutex("bus"), seen: make(map[string]map[string]bool)}
+
+	meter := telemetry.Meter()
+	var err error
+	b.process, err = meter.Float64Histogram(
+		"bus_process_duration_seconds",
+		metric.WithDescription("Time subscribers take to process an event, by result"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	b.redelivered, err = meter.Int64Counter(
+		"bus_redeliveries_total",
+		metric.WithDescription("Number of events a subscriber took only when the relay published them again"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	lag, err := meter.Float64ObservableGauge(
+		"bus_consumer_lag_seconds",
+		metric.WithDescription("Age of the oldest event a subscriber hasn't finished processing, since it was committed"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	queued, err := meter.Int64ObservableGauge(
+		"bus_consumer_queued_events",
+		metric.WithDescription("Number of events queued for or being processed by a subscriber"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter.RegisterCallback(func(ctx context.Context, obs metric.Observer) error {
+		unlock := b.mu.Lock(ctx)
+		subs := append([]*subscription(nil), b.subs...)
+		unlock()
+		for _, s := range subs {
+			age, n := s.lag()
+			group := metric.WithAttributes(attribute.String("messaging.consumer.group.name", s.name))
+			obs.ObserveFloat64(lag, age.Seconds(), group)
+			obs.ObserveInt64(queued, int64(n), group)
+		}
+		return nil
+	}, lag, queued)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Subscribe registers handler under name. Subscribers added after an event
+// was published don't receive it.
+func (b *Bus) Subscribe(name string, handler Handler) {
+	s := &subscription{name: name, handler: handler, queue: make(chan outbox.Event, b.queueSize)}
+	unlock := b.mu.Lock(context.Background())
+	b.subs = append(b.subs, s)
+	b.seen[name] = make(map[string]bool)
+	unlock()
+
+	b.wg.Add(1)
+	go b.consume(s)
+}
+
+// Publish enqueues e for every subscriber. If a subscriber is full it
+// returns ErrBackpressure; subscribers that already took the event don't get
+// it again when it is republished.
+func (b *Bus) Publish(ctx context.Context, e outbox.Event) error {
+	unlock := b.mu.Lock(ctx)
+	defer unlock()
+
+	var full []string
+	for _, s := range b.subs {
+		if b.seen[s.name][e.ID] {
+			continue
+		}
+		s.mu.Lock()
+		select {
+		case s.queue <- e:
+			b.seen[s.name][e.ID] = true
+			s.unfinished = append(s.unfinished, e.CreatedAt)
+			s.mu.Unlock()
+			if e.Attempts > 0 {
+				b.redelivered.Add(ctx, 1, metric.WithAttributes(
+					attribute.String("messaging.consumer.group.name", s.name),
+					attribute.String("event.type", e.Type),
+				))
+			}
+		default:
+			s.mu.Unlock()
+			full = append(full, s.name)
+		}
+	}
+	if len(full) > 0 {
+		return fmt.Errorf("%w: %v", ErrBackpressure, full)
+	}
+	for _, s := range b.subs {
+		delete(b.seen[s.name], e.ID)
+	}
+	return nil
+}
+
+func (b *Bus) consume(s *subscription) {
+	defer b.wg.Done()
+	for e := range s.queue {
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(e.Headers))
+		telemetry.WithSpan(ctx, "bus.process "+e.Type, func(ctx context.Context) error {
+			start := time.Now()
+			err := s.handler(ctx, e)
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			b.process.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+				attribute.String("messaging.consumer.group.name", s.name),
+				attribute.String("event.type", e.Type),
+				attribute.String("result", result),
+			))
+			return err
+		},
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.operation.type", "process"),
+				attribute.String("messaging.consumer.group.name", s.name),
+				attribute.String("messaging.message.id", e.ID),
+				attribute.String("event.type", e.Type),
+				attribute.Float64("bus.lag_seconds", time.Since(e.CreatedAt).Seconds()),
+			),
+		)
+
+		s.mu.Lock()
+		s.unfinished = s.unfinished[1:]
+		s.mu.Unlock()
+	}
+}
+
+// Close stops delivering and waits for queued events to be processed.
+func (b *Bus) Close() {
+	unlock := b.mu.Lock(context.Background())
+	for _, s := range b.subs {
+		close(s.queue)
+	}
+	unlock()
+	b.wg.Wait()
+}
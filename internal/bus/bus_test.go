@@ -0,0 +1,126 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"payment-service/internal/outbox"
+)
+
+// recorder is a subscriber that records the IDs of the events it handled.
+// With a gate, it handles none until the gate is closed.
+type recorder struct {
+	gate chan struct{}
+
+	mu  sync.Mutex
+	ids []string
+}
+
+func (r *recorder) handle(_ context.Context, e outbox.Event) error {
+	if r.gate != nil {
+		<-r.gate
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids = append(r.ids, e.ID)
+	return nil
+}
+
+func TestPublish(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// blocked subscribers hold their first event, so a queue of size 1
+		// is full from the second.
+		blocked []bool
+		events  []string
+		// errs are whether each publish reports backpressure.
+		errs []bool
+	}{
+		{
+			name:    "every subscriber gets every event",
+			blocked: []bool{false, false},
+			events:  []string{"evt_1", "evt_2", "evt_3"},
+			errs:    []bool{false, false, false},
+		},
+		{
+			name:    "a full subscriber pushes back",
+			blocked: []bool{false, true},
+			events:  []string{"evt_1", "evt_2", "evt_3"},
+			errs:    []bool{false, false, true},
+		},
+		{
+			// The relay publishes an event again after backpressure; the
+			// subscriber that took it the first time doesn't get it twice.
+			name:    "a republished event is delivered once",
+			blocked: []bool{false, true},
+			events:  []string{"evt_1", "evt_2", "evt_3", "evt_3"},
+			errs:    []bool{false, false, true, true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := New(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subs := make([]*recorder, len(tc.blocked))
+			for i, blocked := range tc.blocked {
+				subs[i] = &recorder{}
+				if blocked {
+					subs[i].gate = make(chan struct{})
+				}
+				b.Subscribe(string(rune('a'+i)), subs[i].handle)
+			}
+
+			for i, id := range tc.events {
+				err := b.Publish(context.Background(), outbox.Event{ID: id, Type: "test.event"})
+				if got := errors.Is(err, ErrBackpressure); got != tc.errs[i] || (err != nil && !got) {
+					t.Fatalf("Publish(%s) = %v, want backpressure %v", id, err, tc.errs[i])
+				}
+				if i == 0 {
+					// Let a blocked subscriber take its first event, so its
+					// queue holds just one more.
+					waitHandling(t, b)
+				}
+			}
+			for _, s := range subs {
+				if s.gate != nil {
+					close(s.gate)
+				}
+			}
+			b.Close()
+
+			// Every subscriber gets each event once, and the ones that
+			// pushed back only the events they had room for.
+			want := slices.Compact(slices.Clone(tc.events))
+			for i, s := range subs {
+				got := s.ids
+				w := want
+				if tc.blocked[i] {
+					w = want[:min(len(want), 2)]
+				}
+				if !slices.Equal(got, w) {
+					t.Errorf("subscriber %d handled %v, want %v", i, got, w)
+				}
+			}
+		})
+	}
+}
+
+// waitHandling waits until every subscriber has taken the events queued for
+// it off its queue.
+func waitHandling(t *testing.T, b *Bus) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for _, s := range b.subs {
+		for len(s.queue) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("subscriber %s never took its events", s.name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Package clientip resolves the address of the client behind a request,
+// honoring X-Forwarded-For only when it was set by a trusted proxy, and
+// records it on the server span together with a coarse region. The region is
+// synthetic: it is derived from a hash of the address block, so client
+// dimensions can be demonstrated without a geo-IP database or real location
+// data. Middleware also enforces an optional allowlist.
+package clientip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// ErrNotAllowed is recorded for requests rejected by the allowlist.
+var ErrNotAllowed = telemetry.WithFailureDomain(errors.New("clientip: client not in allowlist"), telemetry.DomainClient)
+
+// Config controls client resolution and the allowlist.
+type Config struct {
+	// TrustedProxies are the peers whose X-Forwarded-For header is believed.
+	TrustedProxies []netip.Prefix
+	// Allow lists the client networks that may use the service. Empty allows
+	// every client.
+	Allow []netip.Prefix
+}
+
+// Client is the resolved client of a request.
+type Client struct {
+	Addr   netip.Addr
+	Region string
+}
+
+type ctxKey struct{}
+
+// FromContext returns the client resolved by Middleware.
+func FromContext(ctx context.Context) (Client, bool) {
+	c, ok := ctx.Value(ctxKey{}).(Client)
+	return c, ok
+}
+
+// Resolve returns the client address of r. The peer address is used unless
+// the peer is a trusted proxy, in which case X-Forwarded-For is walked from
+// the right, skipping trusted proxies, and the first other address is the
+// client.
+func Resolve(r *http.Request, trusted []netip.Prefix) netip.Addr {
+	peer := peerAddr(r.RemoteAddr)
+	if !contains(trusted, peer) {
+		return peer
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// A malformed hop can't be attributed; the last trusted hop is
+			// the best we know.
+			return peer
+		}
+		addr = addr.Unmap()
+		if !contains(trusted, addr) {
+			return addr
+		}
+		peer = addr
+	}
+	return peer
+}
+
+func peerAddr(remoteAddr string) netip.Addr {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// regions are the synthetic regions public addresses are spread over.
+var regions = []string{"us-east", "us-west", "sa-east", "eu-west", "eu-central", "ap-south", "ap-northeast"}
+
+// Region returns the synthetic region of addr: "local" for loopback,
+// "private" for private and link-local addresses, "unknown" for an invalid
+// address, and otherwise a region chosen by hashing the address's /16 (IPv4)
+// or /32 (IPv6) block, so neighbouring clients share a region.
+func Region(addr netip.Addr) string {
+	switch {
+	case !addr.IsValid():
+		return "unknown"
+	case addr.IsLoopback():
+		return "local"
+	case addr.IsPrivate(), addr.IsLinkLocalUnicast():
+		return "private"
+	}
+	bits := 16
+	if addr.Is6() {
+		bits = 32
+	}
+	block, _ := addr.Prefix(bits)
+	h := fnv.New32a()
+	h.Write(block.Addr().AsSlice())
+	return regions[h.Sum32()%uint32(len(regions))]
+}
+
+// Middleware resolves the client of each request, stores it in the context
+// and records client.address and client.region on the current span, which
+// should be the server span. Requests from clients outside cfg.Allow are
+// rejected with 403.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		c := Client{Addr: Resolve(r, cfg.TrustedProxies)}
+		c.Region = Region(c.Addr)
+
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(
+			attribute.String("client.address", c.Addr.String()),
+			attribute.String("client.region", c.Region),
+			attribute.String("network.peer.address", peerAddr(r.RemoteAddr).String()),
+		)
+		region := attribute.String("client.region", c.Region)
+
+		if len(cfg.Allow) > 0 && !contains(cfg.Allow, c.Addr) {
+			span.AddEvent("client.rejected", trace.WithAttributes(attribute.String("client.rejection.reason", "not_allowlisted")))
+			telemetry.RecordError(ctx, ErrNotAllowed)
+			instruments().rejections.Add(ctx, 1, metric.WithAttributes(region, attribute.String("reason", "not_allowlisted")))
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Forbidden"})
+			return
+		}
+
+		instruments().requests.Add(ctx, 1, metric.WithAttributes(region))
+		inner := r.WithContext(context.WithValue(ctx, ctxKey{}, c))
+		next.ServeHTTP(w, inner)
+		// The mux records the matched route on the request it was given;
+		// pass it back so the server span can be named after it.
+		r.Pattern = inner.Pattern
+	})
+}
+
+type clientInstruments struct {
+	requests   metric.Int64Counter
+	rejections metric.Int64Counter
+}
+
+// instruments creates the counters on first use, after telemetry.Setup.
+var instruments = sync.OnceValue(func() clientInstruments {
+	meter := telemetry.Meter()
+	var inst clientInstruments
+	var err error
+	inst.requests, err = meter.Int64Counter(
+		"client_requests_total",
+		metric.WithDescription("Number of requests accepted, by client region"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		inst.requests, _ = meter.Int64Counter("client_requests_total")
+	}
+	inst.rejections, err = meter.Int64Counter(
+		"client_rejections_total",
+		metric.WithDescription("Number of requests rejected by the client allowlist"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		inst.rejections, _ = meter.Int64Counter("client_rejections_total")
+	}
+	return inst
+})
@@ -0,0 +1,136 @@
+// Package connstats measures the server's TCP connections from
+// http.Server.ConnState: how fast they are accepted, how many are open, and
+// how long they live and how many requests each carries. Request metrics
+// can't show connection reuse. A client with keep-alive sends hundreds of
+// requests over one connection, while a load balancer that closes idle
+// connections early makes every request pay for a new handshake.
+package connstats
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"payment-service/internal/telemetry"
+)
+
+var (
+	portKey       = attribute.Key("server.port")
+	closedFromKey = attribute.Key("connection.closed_from")
+)
+
+// conn is what Tracker knows about an open connection.
+type conn struct {
+	accepted time.Time
+	requests int64
+	state    http.ConnState
+}
+
+// Tracker records connection metrics. Set its ConnState method as the
+// ConnState hook of every http.Server.
+type Tracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*conn
+
+	accepted metric.Int64Counter
+	open     metric.Int64UpDownCounter
+	lifetime metric.Float64Histogram
+	requests metric.Int64Histogram
+}
+
+// New creates a Tracker.
+func New() (*Tracker, error) {
+	t := &Tracker{conns: make(map[net.Conn]*conn)}
+
+	meter := telemetry.Meter()
+	var err error
+	t.accepted, err = meter.Int64Counter(
+		"http_server_connections_accepted_total",
+		metric.WithDescription("Number of TCP connections accepted"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	t.open, err = meter.Int64UpDownCounter(
+		"http_server_open_connections",
+		metric.WithDescription("Number of TCP connections currently open"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	t.lifetime, err = meter.Float64Histogram(
+		"http_server_connection_duration_seconds",
+		metric.WithDescription("Time from accepting a TCP connection to closing it, by the state it was closed from"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600),
+	)
+	if err != nil {
+		return nil, err
+	}
+	t.requests, err = meter.Int64Histogram(
+		"http_server_connection_requests",
+		metric.WithDescription("Number of requests served over a TCP connection, by the state it was closed from"),
+		metric.WithUnit("{request}"),
+		metric.WithExplicitBucketBoundaries(0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ConnState tracks c through its states. A connection closed or hijacked
+// is recorded with the state it was in before: new (closed before its first
+// request), idle (closed between requests, by a keep-alive timeout or the
+// client) or active (closed during a request).
+func (t *Tracker) ConnState(c net.Conn, state http.ConnState) {
+	ctx := context.Background()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch state {
+	case http.StateNew:
+		t.conns[c] = &conn{accepted: time.Now(), state: state}
+		port := portOf(c)
+		t.accepted.Add(ctx, 1, metric.WithAttributes(port))
+		t.open.Add(ctx, 1, metric.WithAttributes(port))
+	case http.StateActive:
+		if cn, ok := t.conns[c]; ok {
+			cn.requests++
+			cn.state = state
+		}
+	case http.StateIdle:
+		if cn, ok := t.conns[c]; ok {
+			cn.state = state
+		}
+	case http.StateClosed, http.StateHijacked:
+		cn, ok := t.conns[c]
+		if !ok {
+			return
+		}
+		delete(t.conns, c)
+		port := portOf(c)
+		attrs := metric.WithAttributes(port, closedFromKey.String(cn.state.String()))
+		t.open.Add(ctx, -1, metric.WithAttributes(port))
+		t.lifetime.Record(ctx, time.Since(cn.accepted).Seconds(), attrs)
+		t.requests.Record(ctx, cn.requests, attrs)
+	}
+}
+
+// portOf returns the local port of c, which tells instances apart.
+func portOf(c net.Conn) attribute.KeyValue {
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		return portKey.Int(addr.Port)
+	}
+	_, port, _ := net.SplitHostPort(c.LocalAddr().String())
+	n, _ := strconv.Atoi(port)
+	return portKey.Int(n)
+}
@@ -0,0 +1,143 @@
+// Package currency holds the ISO 4217 currency table, embedded from
+// iso4217.csv, and counts the unknown codes clients send. Codes are client
+// input, so they are only recorded as a metric attribute while they are
+// among the most frequent; the rest are counted as Other.
+package currency
+
+import (
+	"context"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"payment-service/internal/telemetry"
+)
+
+// Currency is one entry of the ISO 4217 table.
+type Currency struct {
+	Code    string
+	Numeric int
+	// MinorUnits is the number of digits after the decimal separator.
+	MinorUnits int
+	Name       string
+}
+
+//go:embed iso4217.csv
+var tableCSV string
+
+// table holds the active ISO 4217 currencies with minor units, by code.
+// Funds without them, such as precious metals, are left out: payments can't
+// be made in them.
+var table = mustParse(tableCSV)
+
+func mustParse(s string) map[string]Currency {
+	records, err := csv.NewReader(strings.NewReader(s)).ReadAll()
+	if err != nil {
+		panic(fmt.Sprintf("currency: parse table: %v", err))
+	}
+	t := make(map[string]Currency, len(records))
+	for _, rec := range records[1:] {
+		numeric, err := strconv.Atoi(rec[1])
+		if err != nil {
+			panic(fmt.Sprintf("currency: %s: numeric code: %v", rec[0], err))
+		}
+		minor, err := strconv.Atoi(rec[2])
+		if err != nil {
+			panic(fmt.Sprintf("currency: %s: minor units: %v", rec[0], err))
+		}
+		t[rec[0]] = Currency{Code: rec[0], Numeric: numeric, MinorUnits: minor, Name: rec[3]}
+	}
+	return t
+}
+
+// Lookup returns the currency with the alphabetic code, which is upper case.
+func Lookup(code string) (Currency, bool) {
+	c, ok := table[code]
+	return c, ok
+}
+
+// Labels of unknown codes that aren't recorded as themselves.
+const (
+	// Other stands for well-formed codes outside the most frequent.
+	Other = "other"
+	// Malformed stands for anything but three upper-case letters.
+	Malformed = "malformed"
+)
+
+const (
+	// topK is the number of unknown codes recorded as themselves.
+	topK = 10
+	// maxTracked bounds the unknown codes counted to rank them.
+	maxTracked = 1000
+)
+
+// unknownCodes counts the unknown codes seen, to rank them.
+var unknownCodes = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// label counts code and returns it if it is among the topK most frequent
+// unknown codes, ties going to the lower code, and Other if it isn't.
+func label(code string) string {
+	if !wellFormed(code) {
+		return Malformed
+	}
+	unknownCodes.Lock()
+	defer unknownCodes.Unlock()
+	n, ok := unknownCodes.counts[code]
+	if !ok && len(unknownCodes.counts) >= maxTracked {
+		return Other
+	}
+	n++
+	unknownCodes.counts[code] = n
+	above := 0
+	for c, m := range unknownCodes.counts {
+		if m > n || m == n && c < code {
+			if above++; above >= topK {
+				return Other
+			}
+		}
+	}
+	return code
+}
+
+func wellFormed(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for i := range len(code) {
+		if code[i] < 'A' || code[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordUnknown counts a payment attempted in code, which isn't in the
+// table, in currency_unknown_total{currency.code}. currency.code is the code
+// while it is among the 10 most frequent unknown codes, Other outside them,
+// and Malformed if it doesn't look like a code at all.
+func RecordUnknown(ctx context.Context, code string) {
+	unknownCounter().Add(ctx, 1, metric.WithAttributes(attribute.String("currency.code", label(code))))
+}
+
+// unknownCounter creates the counter on first use, after telemetry.Setup.
+var unknownCounter = sync.OnceValue(func() metric.Int64Counter {
+	meter := telemetry.Meter()
+	c, err := meter.Int64Counter(
+		"currency_unknown_total",
+		metric.WithDescription("Number of payments attempted in a currency that isn't in ISO 4217, by the most frequent codes"),
+		metric.WithUnit("{payment}"),
+	)
+	if err != nil {
+		c, _ = meter.Int64Counter("currency_unknown_total")
+	}
+	return c
+})
@@ -0,0 +1,74 @@
+// Package fault injects deterministic failures keyed on the incoming trace ID,
+// so a failing request can be reproduced by re-sending the same traceparent.
+package fault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// errInjected is the error of a fault.inject span.
+var errInjected = telemetry.WithFailureDomain(errors.New("injected fault"), telemetry.DomainInternal)
+
+// Config selects which requests fail.
+type Config struct {
+	// TraceIDSuffix is matched against the hex trace ID of the incoming
+	// request, e.g. "00" fails roughly one request in 256. Empty disables
+	// fault injection.
+	TraceIDSuffix string
+	// Status is the HTTP status returned for matching requests.
+	Status int
+}
+
+// Middleware returns next wrapped with trace-ID-seeded fault injection.
+// Requests without a valid incoming trace context are never failed, since
+// their trace ID is not reproducible by the client.
+func Middleware(cfg Config, next http.Handler) (http.Handler, error) {
+	if cfg.TraceIDSuffix == "" {
+		return next, nil
+	}
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusInternalServerError
+	}
+	suffix := strings.ToLower(cfg.TraceIDSuffix)
+
+	injected, err := telemetry.Meter().Int64Counter(
+		"faults_injected_total",
+		metric.WithDescription("Number of requests failed by trace-ID fault injection"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		sc := trace.SpanContextFromContext(ctx)
+		if !sc.IsValid() || !strings.HasSuffix(sc.TraceID().String(), suffix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		telemetry.WithSpan(ctx, "fault.inject", func(context.Context) error { return errInjected }, trace.WithAttributes(
+			attribute.String("fault.trace_id_suffix", suffix),
+			attribute.Int("http.response.status_code", cfg.Status),
+		))
+
+		injected.Add(ctx, 1, metric.WithAttributes(attribute.String("fault.trace_id_suffix", suffix)))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(cfg.Status)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Injected fault"})
+	}), nil
+}
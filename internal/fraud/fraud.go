@@ -0,0 +1,242 @@
+// Package fraud is a client for the (simulated) fraud-check service. The
+// simulation has a long latency tail, which the client cuts with hedged
+// requests: a second attempt is sent once the first exceeds the observed p95.
+package fraud
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/budget"
+	"payment-service/internal/hedge"
+	"payment-service/internal/payments"
+	"payment-service/internal/telemetry"
+)
+
+// ErrUnavailable is returned when the fraud service fails to answer.
+var ErrUnavailable = telemetry.WithFailureDomain(errors.New("fraud: service unavailable"), telemetry.DomainFraud)
+
+// Verdict is the fraud service's answer for a payment.
+type Verdict struct {
+	Score    float64
+	Approved bool
+}
+
+// Config controls the simulated service and the hedging policy.
+type Config struct {
+	// MedianLatency is the typical response time of the simulated service.
+	MedianLatency time.Duration
+	// SlowRate is the fraction of calls that hit the slow tail.
+	SlowRate float64
+	// ErrorRate is the fraction of calls that fail.
+	ErrorRate float64
+	// Hedge enables hedged requests.
+	Hedge bool
+	// InitialHedgeDelay is used until enough latencies have been observed to
+	// estimate the p95.
+	InitialHedgeDelay time.Duration
+}
+
+const latencyWindow = 256
+
+// Client checks payments against the fraud service.
+type Client struct {
+	cfg Config
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+
+	requests metric.Int64Counter
+	hedges   metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+// NewClient returns a fraud-check client.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.MedianLatency <= 0 {
+		cfg.MedianLatency = 20 * time.Millisecond
+	}
+	if cfg.InitialHedgeDelay <= 0 {
+		cfg.InitialHedgeDelay = 5 * cfg.MedianLatency
+	}
+	c := &Client{cfg: cfg}
+
+	meter := telemetry.Meter()
+	var err error
+	c.requests, err = meter.Int64Counter(
+		"fraud_checks_total",
+		metric.WithDescription("Number of fraud checks performed"),
+		metric.WithUnit("{check}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.hedges, err = meter.Int64Counter(
+		"fraud_hedged_requests_total",
+		metric.WithDescription("Number of fraud checks that sent a hedge attempt, by winner"),
+		metric.WithUnit("{check}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.duration, err = meter.Float64Histogram(
+		"fraud_check_duration_seconds",
+		metric.WithDescription("Duration of fraud checks as seen by the caller, including hedging"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Check asks the fraud service for a verdict on p.
+func (c *Client) Check(ctx context.Context, p payments.Payment) (Verdict, error) {
+	start := time.Now()
+	ctx, span := payments.StartSpan(ctx, payments.OpFraudCheck, p, trace.WithAttributes(
+		attribute.Bool("hedge.enabled", c.cfg.Hedge),
+	))
+	defer span.End()
+	budget.Annotate(ctx, span)
+
+	var (
+		v       Verdict
+		winner  = hedge.Primary
+		err     error
+		delay   time.Duration
+		hedged  bool
+		hedgeMu sync.Mutex
+	)
+	if c.cfg.Hedge {
+		delay = c.hedgeDelay()
+		span.SetAttributes(attribute.Float64("hedge.delay_seconds", delay.Seconds()))
+		v, winner, err = hedge.Do(ctx, delay, func(ctx context.Context, attempt int) (Verdict, error) {
+			if attempt == hedge.Hedge {
+				hedgeMu.Lock()
+				hedged = true
+				hedgeMu.Unlock()
+			}
+			return c.attempt(ctx, p, attempt)
+		})
+	} else {
+		v, err = c.attempt(ctx, p, hedge.Primary)
+	}
+
+	hedgeMu.Lock()
+	wasHedged := hedged
+	hedgeMu.Unlock()
+
+	outcome := "approved"
+	switch {
+	case err != nil:
+		outcome = "error"
+		telemetry.SpanError(span, err)
+	case !v.Approved:
+		outcome = "rejected"
+	}
+	span.SetAttributes(
+		attribute.Bool("hedge.sent", wasHedged),
+		attribute.String("fraud.outcome", outcome),
+	)
+
+	attrs := metric.WithAttributes(attribute.String("outcome", outcome))
+	c.requests.Add(ctx, 1, attrs)
+	c.duration.Record(ctx, time.Since(start).Seconds(), attrs)
+	if wasHedged {
+		w := winnerName(winner, err)
+		span.SetAttributes(attribute.String("hedge.winner", w))
+		c.hedges.Add(ctx, 1, metric.WithAttributes(attribute.String("hedge.winner", w)))
+	}
+	return v, err
+}
+
+func winnerName(attempt int, err error) string {
+	switch {
+	case err != nil:
+		return "none"
+	case attempt == hedge.Hedge:
+		return "hedge"
+	default:
+		return "primary"
+	}
+}
+
+// attempt performs one simulated call to the fraud service.
+func (c *Client) attempt(ctx context.Context, p payments.Payment, attempt int) (Verdict, error) {
+	ctx, span := payments.StartSpan(ctx, payments.OpFraudAttempt, p,
+		trace.WithAttributes(
+			attribute.String("peer.service", "fraud-service"),
+			attribute.Int("hedge.attempt", attempt),
+		),
+	)
+	defer span.End()
+
+	start := time.Now()
+	latency := c.simulatedLatency()
+	telemetry.DebugEvent(ctx, "fraud.latency_drawn", attribute.Float64("fraud.simulated_latency_seconds", latency.Seconds()))
+	select {
+	case <-time.After(latency):
+	case <-ctx.Done():
+		span.AddEvent("attempt cancelled")
+		span.SetAttributes(attribute.Bool("hedge.cancelled", true))
+		return Verdict{}, ctx.Err()
+	}
+
+	if rand.Float64() < c.cfg.ErrorRate {
+		telemetry.SpanError(span, ErrUnavailable)
+		return Verdict{}, ErrUnavailable
+	}
+	c.observe(time.Since(start))
+
+	// Larger amounts are a little riskier.
+	score := math.Min(1, rand.Float64()*0.9+p.Amount/100000)
+	v := Verdict{Score: score, Approved: score < 0.99}
+	span.SetAttributes(
+		attribute.Float64("fraud.score", v.Score),
+		attribute.Bool("fraud.approved", v.Approved),
+	)
+	return v, nil
+}
+
+// simulatedLatency draws from a log-normal body with a slow tail.
+func (c *Client) simulatedLatency() time.Duration {
+	d := time.Duration(float64(c.cfg.MedianLatency) * math.Exp(rand.NormFloat64()*0.4))
+	if rand.Float64() < c.cfg.SlowRate {
+		d += time.Duration(5+rand.Float64()*20) * c.cfg.MedianLatency
+	}
+	return d
+}
+
+func (c *Client) observe(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.latencies) < latencyWindow {
+		c.latencies = append(c.latencies, d)
+		return
+	}
+	c.latencies[c.next] = d
+	c.next = (c.next + 1) % latencyWindow
+}
+
+// hedgeDelay returns the p95 of recently observed attempt latencies.
+func (c *Client) hedgeDelay() time.Duration {
+	c.mu.Lock()
+	sorted := slices.Clone(c.latencies)
+	c.mu.Unlock()
+
+	if len(sorted) < 20 {
+		return c.cfg.InitialHedgeDelay
+	}
+	slices.Sort(sorted)
+	return sorted[len(sorted)*95/100]
+}
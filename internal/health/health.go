@@ -0,0 +1,248 @@
+// Package health serves the liveness and readiness probes, /healthz and
+// /readyz. Middleware answers them before the instrumented handler chain,
+// so probes, which an orchestrator sends every few seconds for the life of
+// the service, create no spans and don't show up in the http.server.*
+// metrics or the startup first-request phase.
+//
+// /healthz is more than a static 200: it reports the service ok, degraded
+// or unhealthy from the signals its SLOs are made of, load shedding and
+// store latency, and from the state of the telemetry exporters. The same
+// state is exported as the health_status gauge, so a dashboard shows when
+// the service was degraded, not just that it is now.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+
+	"payment-service/internal/telemetry"
+)
+
+// Paths of the probes.
+const (
+	LivePath  = "/healthz"
+	ReadyPath = "/readyz"
+)
+
+// States of /healthz, from best to worst.
+const (
+	StatusOK        = "ok"
+	StatusDegraded  = "degraded"
+	StatusUnhealthy = "unhealthy"
+)
+
+// Config configures the probes.
+type Config struct {
+	// Storage checks that the payment store can be reached.
+	Storage func(ctx context.Context) error
+	// Timeout bounds the storage check; defaults to 1s.
+	Timeout time.Duration
+
+	// ShedRate returns the share of recent requests shed for load.
+	ShedRate func() float64
+	// StoreLatency returns the recent latency of the payment store, or 0
+	// if there were no calls to it.
+	StoreLatency func() time.Duration
+	// Thresholds at which the signals degrade the service or make it
+	// unhealthy.
+	Thresholds Thresholds
+}
+
+// Thresholds are the values at which a signal of /healthz turns degraded
+// or unhealthy. Exporter failures only degrade the service: they lose
+// telemetry, not payments.
+type Thresholds struct {
+	// DegradedShedRate defaults to 0.05 and UnhealthyShedRate to 0.5.
+	DegradedShedRate, UnhealthyShedRate float64
+	// DegradedStoreLatency defaults to 100ms and UnhealthyStoreLatency to
+	// 1s.
+	DegradedStoreLatency, UnhealthyStoreLatency time.Duration
+}
+
+// withDefaults returns cfg with the defaults of unset fields.
+func (cfg Config) withDefaults() Config {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	t := &cfg.Thresholds
+	if t.DegradedShedRate <= 0 {
+		t.DegradedShedRate = 0.05
+	}
+	if t.UnhealthyShedRate <= 0 {
+		t.UnhealthyShedRate = 0.5
+	}
+	if t.DegradedStoreLatency <= 0 {
+		t.DegradedStoreLatency = 100 * time.Millisecond
+	}
+	if t.UnhealthyStoreLatency <= 0 {
+		t.UnhealthyStoreLatency = time.Second
+	}
+	return cfg
+}
+
+// Signal is one input of the /healthz state.
+type Signal struct {
+	Name   string  `json:"name"`
+	Status string  `json:"status"`
+	Value  float64 `json:"value"`
+	// DegradedAt and UnhealthyAt are the thresholds of Value; an unset
+	// one doesn't apply.
+	DegradedAt  float64 `json:"degraded_at,omitempty"`
+	UnhealthyAt float64 `json:"unhealthy_at,omitempty"`
+	Detail      string  `json:"detail,omitempty"`
+}
+
+// Health is the body of /healthz: the worst status of its signals.
+type Health struct {
+	Status  string   `json:"status"`
+	Signals []Signal `json:"signals"`
+}
+
+// Check is the result of one readiness check.
+type Check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Readiness is the body of /readyz.
+type Readiness struct {
+	Status  string `json:"status"`
+	Storage Check  `json:"storage"`
+	// Exporters are informational: a collector outage degrades telemetry,
+	// not the service, so it doesn't make the service unready.
+	Exporters []telemetry.ExporterStatus `json:"exporters"`
+}
+
+// Middleware answers GET requests for LivePath and ReadyPath and passes
+// every other request to next. /healthz answers with the Health of the
+// service: 200 while it is ok or degraded, so a liveness probe doesn't
+// restart a service that still serves most requests, and 503 once it is
+// unhealthy. /readyz answers 200 when the payment store can be reached and
+// 503 when it can't, with the status of the store and of the telemetry
+// exporters.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	cfg = cfg.withDefaults()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case LivePath:
+			h := evaluate(cfg)
+			status := http.StatusOK
+			if h.Status == StatusUnhealthy {
+				status = http.StatusServiceUnavailable
+			}
+			writeJSON(w, status, h)
+		case ReadyPath:
+			ready := readiness(r.Context(), cfg)
+			status := http.StatusOK
+			if ready.Status != "ready" {
+				status = http.StatusServiceUnavailable
+			}
+			writeJSON(w, status, ready)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// evaluate returns the Health of the signals of cfg. It only reads values
+// the service keeps up to date, so it is cheap enough for a probe every
+// second and for metric collection.
+func evaluate(cfg Config) Health {
+	h := Health{Status: StatusOK}
+	if cfg.ShedRate != nil {
+		h.add(threshold("shed_rate", cfg.ShedRate(), cfg.Thresholds.DegradedShedRate, cfg.Thresholds.UnhealthyShedRate))
+	}
+	if cfg.StoreLatency != nil {
+		h.add(threshold("store_latency_seconds", cfg.StoreLatency().Seconds(),
+			cfg.Thresholds.DegradedStoreLatency.Seconds(), cfg.Thresholds.UnhealthyStoreLatency.Seconds()))
+	}
+	var failing []string
+	for _, e := range telemetry.ExporterHealth() {
+		if !e.Healthy {
+			failing = append(failing, e.Signal)
+		}
+	}
+	exporters := threshold("exporter_failures", float64(len(failing)), 1, 0)
+	exporters.Detail = strings.Join(failing, ", ")
+	h.add(exporters)
+	return h
+}
+
+// threshold is the signal name with value, degraded from degradedAt and
+// unhealthy from unhealthyAt, if that is set.
+func threshold(name string, value, degradedAt, unhealthyAt float64) Signal {
+	s := Signal{Name: name, Status: StatusOK, Value: value, DegradedAt: degradedAt, UnhealthyAt: unhealthyAt}
+	switch {
+	case unhealthyAt > 0 && value >= unhealthyAt:
+		s.Status = StatusUnhealthy
+	case value >= degradedAt:
+		s.Status = StatusDegraded
+	}
+	return s
+}
+
+// add adds s to h, which is then at least as bad as s.
+func (h *Health) add(s Signal) {
+	h.Signals = append(h.Signals, s)
+	if level(s.Status) > level(h.Status) {
+		h.Status = s.Status
+	}
+}
+
+// level orders the states as health_status exports them: 0 for ok, 1 for
+// degraded and 2 for unhealthy.
+func level(status string) int64 {
+	switch status {
+	case StatusDegraded:
+		return 1
+	case StatusUnhealthy:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// RegisterMetrics exports the /healthz state of cfg as health_status,
+// evaluated at each collection. Call it after telemetry.Setup.
+func RegisterMetrics(cfg Config) error {
+	cfg = cfg.withDefaults()
+	_, err := telemetry.Meter().Int64ObservableGauge(
+		"health_status",
+		metric.WithDescription("State of the service as /healthz reports it: 0 ok, 1 degraded, 2 unhealthy"),
+		metric.WithUnit("{state}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(level(evaluate(cfg).Status))
+			return nil
+		}),
+	)
+	return err
+}
+
+func readiness(ctx context.Context, cfg Config) Readiness {
+	ready := Readiness{Status: "ready", Storage: Check{Status: "ok"}, Exporters: telemetry.ExporterHealth()}
+	if cfg.Storage != nil {
+		ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+		if err := cfg.Storage(ctx); err != nil {
+			ready.Status = "not_ready"
+			ready.Storage = Check{Status: "failed", Error: err.Error()}
+		}
+	}
+	return ready
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,64 @@
+// Package hedge implements hedged requests: if the first attempt of a call
+// has not returned after a delay, a second attempt is sent and whichever
+// finishes first wins, cancelling the other.
+package hedge
+
+import (
+	"context"
+	"time"
+)
+
+// Attempt numbers passed to the call and returned as the winner.
+const (
+	Primary = 1
+	Hedge   = 2
+)
+
+type result[T any] struct {
+	value   T
+	err     error
+	attempt int
+}
+
+// Do calls fn once and, if it is still running after delay, a second time.
+// It returns the first successful result and the attempt that produced it.
+// The losing attempt's context is cancelled. If every started attempt fails
+// the last error is returned. A failure of the primary before delay elapses is
+// returned as is; hedging targets slowness, not errors.
+func Do[T any](ctx context.Context, delay time.Duration, fn func(ctx context.Context, attempt int) (T, error)) (T, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result[T], 2)
+	start := func(attempt int) {
+		go func() {
+			v, err := fn(ctx, attempt)
+			results <- result[T]{value: v, err: err, attempt: attempt}
+		}()
+	}
+
+	start(Primary)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	running := 1
+	hedged := false
+	for {
+		select {
+		case <-timer.C:
+			if !hedged {
+				hedged = true
+				running++
+				start(Hedge)
+			}
+		case r := <-results:
+			running--
+			if r.err == nil || running == 0 {
+				return r.value, r.attempt, r.err
+			}
+		case <-ctx.Done():
+			var zero T
+			return zero, 0, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package hedge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	errPrimary, errHedge := errors.New("primary failed"), errors.New("hedge failed")
+	const delay = 20 * time.Millisecond
+
+	for _, tc := range []struct {
+		name string
+		// primary and hedge run the attempts; a nil hedge fails the test if
+		// it is started.
+		primary, hedge func(ctx context.Context) (string, error)
+		want           string
+		attempt        int
+		err            error
+		// canceled is whether the primary only returns once Do cancels it
+		// for losing.
+		canceled bool
+	}{
+		{
+			name:    "primary in time",
+			primary: func(context.Context) (string, error) { return "primary", nil },
+			want:    "primary",
+			attempt: Primary,
+		},
+		{
+			name:    "primary fails in time",
+			primary: func(context.Context) (string, error) { return "", errPrimary },
+			attempt: Primary,
+			err:     errPrimary,
+		},
+		{
+			name: "hedge wins",
+			primary: func(ctx context.Context) (string, error) {
+				<-ctx.Done()
+				return "", ctx.Err()
+			},
+			hedge:    func(context.Context) (string, error) { return "hedge", nil },
+			want:     "hedge",
+			attempt:  Hedge,
+			canceled: true,
+		},
+		{
+			name: "slow primary wins",
+			primary: func(context.Context) (string, error) {
+				time.Sleep(2 * delay)
+				return "primary", nil
+			},
+			hedge: func(ctx context.Context) (string, error) {
+				<-ctx.Done()
+				return "", ctx.Err()
+			},
+			want:    "primary",
+			attempt: Primary,
+		},
+		{
+			name: "slow primary fails, hedge wins",
+			primary: func(context.Context) (string, error) {
+				time.Sleep(2 * delay)
+				return "", errPrimary
+			},
+			hedge: func(context.Context) (string, error) {
+				time.Sleep(4 * delay)
+				return "hedge", nil
+			},
+			want:    "hedge",
+			attempt: Hedge,
+		},
+		{
+			name: "both fail",
+			primary: func(context.Context) (string, error) {
+				time.Sleep(2 * delay)
+				return "", errPrimary
+			},
+			hedge: func(context.Context) (string, error) {
+				time.Sleep(4 * delay)
+				return "", errHedge
+			},
+			attempt: Hedge,
+			err:     errHedge,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			primaryDone := make(chan struct{})
+			got, attempt, err := Do(context.Background(), delay, func(ctx context.Context, attempt int) (string, error) {
+				if attempt == Primary {
+					defer close(primaryDone)
+					return tc.primary(ctx)
+				}
+				if tc.hedge == nil {
+					t.Error("hedge started")
+					return "", errHedge
+				}
+				return tc.hedge(ctx)
+			})
+			if got != tc.want || attempt != tc.attempt || !errors.Is(err, tc.err) {
+				t.Fatalf("Do() = %q, %d, %v; want %q, %d, %v", got, attempt, err, tc.want, tc.attempt, tc.err)
+			}
+			if tc.canceled {
+				select {
+				case <-primaryDone:
+				case <-time.After(time.Second):
+					t.Error("losing primary not cancelled")
+				}
+			}
+		})
+	}
+}
+
+func TestDoParentCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, attempt, err := Do(ctx, time.Millisecond, func(ctx context.Context, _ int) (int, error) {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		return 0, ctx.Err()
+	})
+	if attempt != 0 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Do() = _, %d, %v; want 0, context.DeadlineExceeded", attempt, err)
+	}
+}
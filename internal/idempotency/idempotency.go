@@ -0,0 +1,372 @@
+// Package idempotency lets clients retry writes safely. A request carrying an
+// Idempotency-Key header is processed once; retries with the same key replay
+// the stored response. Keys are persisted to a Backend, such as the payment
+// database, so they survive restarts, and a cleanup job deletes them once
+// their TTL has passed.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/telemetry"
+)
+
+// Header is the request header carrying the idempotency key.
+const Header = "Idempotency-Key"
+
+// ErrInProgress is returned by Begin while a request with the same key is
+// still being processed.
+var ErrInProgress = telemetry.WithFailureDomain(errors.New("idempotency: request with this key in progress"), telemetry.DomainClient)
+
+// Backend keeps completed records across restarts, one per key, so
+// completing a request writes only its own record.
+type Backend interface {
+	// LoadRecords returns the stored records.
+	LoadRecords(ctx context.Context) ([]Record, error)
+	// SaveRecord stores rec, replacing any record of its key.
+	SaveRecord(ctx context.Context, rec Record) error
+	// DeleteExpired deletes the records that expired by now.
+	DeleteExpired(ctx context.Context, now time.Time) error
+}
+
+// Config controls key retention and persistence.
+type Config struct {
+	// TTL is how long a completed response is kept for replay.
+	TTL time.Duration
+	// CleanupInterval is how often expired keys are deleted.
+	CleanupInterval time.Duration
+	// Backend persists completed keys. Nil keeps them in memory only.
+	Backend Backend
+}
+
+// Record is a stored response.
+type Record struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	// ContentType is the Content-Type of the response; empty for records
+	// stored before it was kept, which were all JSON.
+	ContentType string          `json:"content_type,omitempty"`
+	Body        json.RawMessage `json:"body"`
+	Created     time.Time       `json:"created"`
+	Expires     time.Time       `json:"expires"`
+
+	inProgress bool
+}
+
+// Store holds idempotency keys and their responses.
+type Store struct {
+	cfg Config
+
+	mu      sync.Mutex
+	records map[string]*Record
+
+	lookups  metric.Int64Counter
+	replays  metric.Int64Counter
+	deleted  metric.Int64Counter
+	scanTime metric.Float64Histogram
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates a Store, restores persisted keys and starts the cleanup job.
+func New(cfg Config) (*Store, error) {
+	if cfg.TTL <= 0 {
+		cfg.TTL = 24 * time.Hour
+	}
+	if cfg.CleanupInterval <= 0 {
+		cfg.CleanupInterval = time.Minute
+	}
+	s := &Store{
+		cfg:     cfg,
+		records: make(map[string]*Record),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	meter := telemetry.Meter()
+	var err error
+	s.lookups, err = meter.Int64Counter(
+		"idempotency_lookups_total",
+		metric.WithDescription("Number of idempotency key lookups, by result"),
+		metric.WithUnit("{lookup}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.replays, err = meter.Int64Counter(
+		"idempotent_replays_total",
+		metric.WithDescription("Number of stored responses replayed to retries, by replayed status code"),
+		metric.WithUnit("{response}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.deleted, err = meter.Int64Counter(
+		"idempotency_cleanup_deleted_keys_total",
+		metric.WithDescription("Number of expired idempotency keys deleted by the cleanup job"),
+		metric.WithUnit("{key}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.scanTime, err = meter.Float64Histogram(
+		"idempotency_cleanup_scan_duration_seconds",
+		metric.WithDescription("Time the cleanup job spends scanning for and deleting expired keys"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter.Int64ObservableGauge(
+		"idempotency_stored_keys",
+		metric.WithDescription("Number of idempotency keys currently stored"),
+		metric.WithUnit("{key}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			o.Observe(int64(len(s.records)))
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.cleanupLoop()
+	return s, nil
+}
+
+// Begin claims key for a new request. It returns the stored record if the
+// key was already completed, ErrInProgress if another request holds it, or
+// nil if the caller should process the request and then call Complete or
+// Abort.
+func (s *Store) Begin(ctx context.Context, key string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := "miss"
+	rec, ok := s.records[key]
+	switch {
+	case ok && rec.inProgress:
+		result = "in_progress"
+	case ok && time.Now().Before(rec.Expires):
+		result = "hit"
+	default:
+		s.records[key] = &Record{Key: key, inProgress: true}
+	}
+	s.lookups.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("idempotency.result", result))
+
+	switch result {
+	case "in_progress":
+		return nil, ErrInProgress
+	case "hit":
+		r := *rec
+		return &r, nil
+	}
+	return nil, nil
+}
+
+// Complete stores the response for key. The response has been sent by
+// then, so a failure to persist it is logged rather than returned: the key
+// is still replayed until a restart.
+func (s *Store) Complete(ctx context.Context, key string, status int, contentType string, body []byte) {
+	now := time.Now()
+	rec := &Record{
+		Key:         key,
+		Status:      status,
+		ContentType: contentType,
+		Body:        append(json.RawMessage(nil), body...),
+		Created:     now,
+		Expires:     now.Add(s.cfg.TTL),
+	}
+	s.mu.Lock()
+	s.records[key] = rec
+	s.mu.Unlock()
+
+	if s.cfg.Backend == nil {
+		return
+	}
+	if err := s.cfg.Backend.SaveRecord(ctx, *rec); err != nil {
+		telemetry.LoggerFor(ctx).Error("persisting idempotency key", zap.Error(err))
+	}
+}
+
+// Abort releases key without storing a response, so the request can be
+// retried.
+func (s *Store) Abort(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[key]; ok && rec.inProgress {
+		delete(s.records, key)
+	}
+}
+
+func (s *Store) cleanupLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.cleanup()
+		}
+	}
+}
+
+// cleanup deletes expired keys under its own root span.
+func (s *Store) cleanup() {
+	telemetry.WithSpan(context.Background(), "idempotency.cleanup", func(ctx context.Context) error {
+		start := time.Now()
+		s.mu.Lock()
+		scanned, deleted := len(s.records), 0
+		for key, rec := range s.records {
+			if !rec.inProgress && !start.Before(rec.Expires) {
+				delete(s.records, key)
+				deleted++
+			}
+		}
+		s.mu.Unlock()
+		var err error
+		if s.cfg.Backend != nil {
+			if err = s.cfg.Backend.DeleteExpired(ctx, start); err != nil {
+				telemetry.LoggerFor(ctx).Error("deleting expired idempotency keys", zap.Error(err))
+			}
+		}
+
+		s.scanTime.Record(ctx, time.Since(start).Seconds())
+		s.deleted.Add(ctx, int64(deleted))
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.Int("idempotency.scanned_keys", scanned),
+			attribute.Int("idempotency.deleted_keys", deleted),
+		)
+		return err
+	}, trace.WithNewRoot())
+}
+
+func (s *Store) load() error {
+	if s.cfg.Backend == nil {
+		return nil
+	}
+	records, err := s.cfg.Backend.LoadRecords(context.Background())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range records {
+		s.records[rec.Key] = &rec
+	}
+	telemetry.Logger().Info("restored idempotency keys", zap.Int("count", len(records)))
+	return nil
+}
+
+// Close stops the cleanup job. Stored keys stay in the Backend and are
+// restored by the next New.
+func (s *Store) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+// Middleware makes requests carrying an Idempotency-Key header idempotent.
+// Responses other than 5xx are stored and replayed for retries with the same
+// key; a 5xx releases the key so the retry is processed again. A replay sets
+// idempotency.replayed and idempotency.original_age_seconds on the request
+// span and is counted in idempotent_replays_total. A request that panics,
+// or whose handler writes no response, releases its key too. A nil store
+// passes requests through.
+func Middleware(s *Store, next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key = r.Method + " " + r.URL.Path + " " + key
+
+		rec, err := s.Begin(r.Context(), key)
+		switch {
+		case errors.Is(err, ErrInProgress):
+			telemetry.RecordError(r.Context(), err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Request with this idempotency key in progress"})
+			return
+		case rec != nil:
+			s.replay(r.Context(), rec)
+			contentType := rec.ContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rec.Status)
+			w.Write(rec.Body)
+			return
+		}
+
+		completed := false
+		defer func() {
+			if !completed {
+				s.Abort(key)
+			}
+		}()
+		rw := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		if !rw.wrote || rw.status >= 500 {
+			return
+		}
+		s.Complete(context.WithoutCancel(r.Context()), key, rw.status, w.Header().Get("Content-Type"), rw.body.Bytes())
+		completed = true
+	})
+}
+
+// replay records that rec is served again.
+func (s *Store) replay(ctx context.Context, rec *Record) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Bool("idempotency.replayed", true),
+		attribute.Float64("idempotency.original_age_seconds", time.Since(rec.Created).Seconds()),
+	)
+	s.replays.Add(ctx, 1, metric.WithAttributes(attribute.Int("http.response.status_code", rec.Status)))
+}
+
+// recorder captures the response while passing it through.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// wrote is whether the handler wrote a response at all; the implicit
+	// 200 of one that didn't is not a result to replay.
+	wrote bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status, r.wrote = status, true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.wrote = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
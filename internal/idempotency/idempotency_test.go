@@ -0,0 +1,50 @@
+package idempotency
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareStoresOnlyWrittenResponses(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler func(w http.ResponseWriter)
+		// replayed is whether the retry is answered from the first
+		// response instead of running the handler again.
+		replayed bool
+	}{
+		{"created", func(w http.ResponseWriter) { w.WriteHeader(http.StatusCreated) }, true},
+		{"body without WriteHeader", func(w http.ResponseWriter) { w.Write([]byte(`{}`)) }, true},
+		{"client error", func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadRequest) }, true},
+		{"server error", func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) }, false},
+		{"no response", func(http.ResponseWriter) {}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := New(Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			calls := 0
+			h := Middleware(s, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				calls++
+				tc.handler(w)
+			}))
+
+			var retry *httptest.ResponseRecorder
+			for range 2 {
+				r := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+				r.Header.Set(Header, "key-1")
+				retry = httptest.NewRecorder()
+				h.ServeHTTP(retry, r)
+			}
+			if want := map[bool]int{true: 1, false: 2}[tc.replayed]; calls != want {
+				t.Errorf("handler ran %d times, want %d", calls, want)
+			}
+			if got := retry.Header().Get("Idempotent-Replayed") == "true"; got != tc.replayed {
+				t.Errorf("retry replayed = %v, want %v", got, tc.replayed)
+			}
+		})
+	}
+}
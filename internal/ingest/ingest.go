@@ -0,0 +1,292 @@
+// Package ingest is an experimental OTLP/HTTP logs endpoint: a tiny
+// telemetry gateway. Clients such as the traffic generator post their own
+// measurements as OTLP log records; the service validates each record and
+// re-emits the valid ones through its own logger, so they end up in the same
+// pipeline as the service's logs, tagged with the client that sent them.
+package ingest
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"payment-service/internal/telemetry"
+)
+
+// Path is the route of the endpoint: the OTLP/HTTP logs path under
+// /ingest, so an exporter only needs the service's base URL and this path.
+const Path = "/ingest/v1/logs"
+
+// ContentType is the only body encoding accepted. OTLP/JSON encodes trace
+// and span IDs as hex instead of protobuf JSON's base64, and is not
+// supported.
+const ContentType = "application/x-protobuf"
+
+// Reasons a log record is rejected.
+const (
+	ReasonMissingTime     = "missing_time"
+	ReasonInvalidSeverity = "invalid_severity"
+	ReasonInvalidTraceID  = "invalid_trace_id"
+	ReasonInvalidSpanID   = "invalid_span_id"
+	ReasonEmptyBody       = "empty_body"
+)
+
+// Config configures the endpoint.
+type Config struct {
+	Enabled bool
+	// MaxBodyBytes caps the size of a request body; defaults to 4 MiB.
+	MaxBodyBytes int64
+	// MaxRecords caps the log records of one request; defaults to 1000.
+	MaxRecords int
+}
+
+// Register adds the endpoint to mux if it is enabled.
+func Register(mux *http.ServeMux, cfg Config) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 4 << 20
+	}
+	if cfg.MaxRecords <= 0 {
+		cfg.MaxRecords = 1000
+	}
+	mux.Handle("POST "+Path, handler(cfg))
+}
+
+// handler answers an export request with an OTLP ExportLogsServiceResponse,
+// reporting rejected records as a partial success, as the OTLP spec asks. A
+// request that can't be read at all gets a google.rpc.Status body. The
+// numbers of accepted and rejected records are set on the server span as
+// ingest.log_records.accepted and ingest.log_records.rejected, and counted
+// in ingest_log_records_total by result and, for rejected records, reason.
+func handler(cfg Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != ContentType {
+			writeStatus(w, r, http.StatusUnsupportedMediaType, codes.InvalidArgument, fmt.Sprintf("content type must be %s", ContentType))
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			writeStatus(w, r, http.StatusRequestEntityTooLarge, codes.InvalidArgument, fmt.Sprintf("body is larger than %d bytes", cfg.MaxBodyBytes))
+			return
+		case err != nil:
+			writeStatus(w, r, http.StatusBadRequest, codes.InvalidArgument, err.Error())
+			return
+		}
+		var req collogspb.ExportLogsServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			writeStatus(w, r, http.StatusBadRequest, codes.InvalidArgument, "invalid OTLP logs request: "+err.Error())
+			return
+		}
+		if n := countRecords(&req); n > cfg.MaxRecords {
+			writeStatus(w, r, http.StatusRequestEntityTooLarge, codes.InvalidArgument, fmt.Sprintf("%d log records, more than the limit of %d", n, cfg.MaxRecords))
+			return
+		}
+
+		var accepted, rejected int64
+		var firstReason string
+		for _, rl := range req.GetResourceLogs() {
+			source := sourceOf(rl)
+			for _, sl := range rl.GetScopeLogs() {
+				for _, rec := range sl.GetLogRecords() {
+					if reason := validate(rec); reason != "" {
+						rejected++
+						if firstReason == "" {
+							firstReason = reason
+						}
+						records().Add(ctx, 1, metric.WithAttributes(
+							attribute.String("result", "rejected"),
+							attribute.String("reason", reason),
+						))
+						continue
+					}
+					accepted++
+					records().Add(ctx, 1, metric.WithAttributes(attribute.String("result", "accepted")))
+					emit(source, sl.GetScope().GetName(), rec)
+				}
+			}
+		}
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.Int64("ingest.log_records.accepted", accepted),
+			attribute.Int64("ingest.log_records.rejected", rejected),
+		)
+
+		var resp collogspb.ExportLogsServiceResponse
+		if rejected > 0 {
+			resp.PartialSuccess = &collogspb.ExportLogsPartialSuccess{
+				RejectedLogRecords: rejected,
+				ErrorMessage:       fmt.Sprintf("%d log records rejected, the first for %s", rejected, firstReason),
+			}
+		}
+		out, _ := proto.Marshal(&resp)
+		w.Header().Set("Content-Type", ContentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	})
+}
+
+func countRecords(req *collogspb.ExportLogsServiceRequest) int {
+	n := 0
+	for _, rl := range req.GetResourceLogs() {
+		for _, sl := range rl.GetScopeLogs() {
+			n += len(sl.GetLogRecords())
+		}
+	}
+	return n
+}
+
+// validate returns the reason rec is rejected, or "" if it is valid.
+func validate(rec *logspb.LogRecord) string {
+	switch {
+	case rec.GetTimeUnixNano() == 0 && rec.GetObservedTimeUnixNano() == 0:
+		return ReasonMissingTime
+	case rec.GetSeverityNumber() < 0 || rec.GetSeverityNumber() > logspb.SeverityNumber_SEVERITY_NUMBER_FATAL4:
+		return ReasonInvalidSeverity
+	case len(rec.GetTraceId()) != 0 && len(rec.GetTraceId()) != 16:
+		return ReasonInvalidTraceID
+	case len(rec.GetSpanId()) != 0 && len(rec.GetSpanId()) != 8:
+		return ReasonInvalidSpanID
+	case rec.GetBody() == nil && len(rec.GetAttributes()) == 0:
+		return ReasonEmptyBody
+	}
+	return ""
+}
+
+// sourceOf returns the service.name of the resource that sent rl.
+func sourceOf(rl *logspb.ResourceLogs) string {
+	for _, kv := range rl.GetResource().GetAttributes() {
+		if kv.GetKey() == "service.name" {
+			return kv.GetValue().GetStringValue()
+		}
+	}
+	return "unknown"
+}
+
+// emit logs rec through the service logger under the ingest.source and
+// ingest.scope of its sender. Fatal records are logged as errors: a client's
+// fatal error must not stop the service.
+func emit(source, scope string, rec *logspb.LogRecord) {
+	level := levelOf(rec.GetSeverityNumber())
+	msg := rec.GetBody().GetStringValue()
+	if msg == "" {
+		msg = rec.GetEventName()
+	}
+	ce := telemetry.Logger().Check(level, msg)
+	if ce == nil {
+		return
+	}
+	ts := rec.GetTimeUnixNano()
+	if ts == 0 {
+		ts = rec.GetObservedTimeUnixNano()
+	}
+	fields := []zap.Field{
+		zap.String("ingest.source", source),
+		zap.String("ingest.scope", scope),
+		zap.Time("ingest.time", time.Unix(0, int64(ts))),
+	}
+	if rec.GetBody() != nil && rec.GetBody().GetStringValue() == "" {
+		fields = append(fields, zap.Any("ingest.body", value(rec.GetBody())))
+	}
+	if id := rec.GetTraceId(); len(id) > 0 {
+		fields = append(fields, zap.String("trace_id", hex.EncodeToString(id)))
+	}
+	if id := rec.GetSpanId(); len(id) > 0 {
+		fields = append(fields, zap.String("span_id", hex.EncodeToString(id)))
+	}
+	if attrs := rec.GetAttributes(); len(attrs) > 0 {
+		fields = append(fields, zap.Any("ingest.attributes", values(attrs)))
+	}
+	ce.Write(fields...)
+}
+
+// levelOf maps an OTLP severity number to a log level, at most error.
+func levelOf(s logspb.SeverityNumber) zapcore.Level {
+	switch {
+	case s == logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED:
+		return zapcore.InfoLevel
+	case s < logspb.SeverityNumber_SEVERITY_NUMBER_INFO:
+		return zapcore.DebugLevel
+	case s < logspb.SeverityNumber_SEVERITY_NUMBER_WARN:
+		return zapcore.InfoLevel
+	case s < logspb.SeverityNumber_SEVERITY_NUMBER_ERROR:
+		return zapcore.WarnLevel
+	}
+	return zapcore.ErrorLevel
+}
+
+func values(kvs []*commonpb.KeyValue) map[string]any {
+	m := make(map[string]any, len(kvs))
+	for _, kv := range kvs {
+		m[kv.GetKey()] = value(kv.GetValue())
+	}
+	return m
+}
+
+func value(v *commonpb.AnyValue) any {
+	switch v := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return v.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return hex.EncodeToString(v.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		vs := make([]any, len(v.ArrayValue.GetValues()))
+		for i, e := range v.ArrayValue.GetValues() {
+			vs[i] = value(e)
+		}
+		return vs
+	case *commonpb.AnyValue_KvlistValue:
+		return values(v.KvlistValue.GetValues())
+	}
+	return nil
+}
+
+// writeStatus answers a request that can't be processed with a
+// google.rpc.Status body, as OTLP/HTTP asks, and records the error as the
+// client's.
+func writeStatus(w http.ResponseWriter, r *http.Request, code int, grpcCode codes.Code, message string) {
+	telemetry.RecordError(r.Context(), telemetry.WithFailureDomain(errors.New("ingest: "+message), telemetry.DomainClient))
+	out, _ := proto.Marshal(status.New(grpcCode, message).Proto())
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(code)
+	w.Write(out)
+}
+
+// records creates the counter on first use, after telemetry.Setup.
+var records = sync.OnceValue(func() metric.Int64Counter {
+	c, err := telemetry.Meter().Int64Counter(
+		"ingest_log_records_total",
+		metric.WithDescription("Number of ingested OTLP log records, by result and rejection reason"),
+		metric.WithUnit("{record}"),
+	)
+	if err != nil {
+		c, _ = telemetry.Meter().Int64Counter("ingest_log_records_total")
+	}
+	return c
+})
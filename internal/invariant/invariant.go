@@ -0,0 +1,121 @@
+// Package invariant checks business invariants on payments and refunds and
+// surfaces violations in telemetry, so a broken rule shows up on a dashboard
+// and in the offending trace rather than only in a log line.
+package invariant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// Invariant names, used as the invariant attribute on metrics and events.
+const (
+	RefundPositive       = "refund_positive"
+	RefundWithinCaptured = "refund_within_captured"
+	CurrencyMatch        = "currency_match"
+)
+
+// Violation is the error returned when an invariant does not hold.
+type Violation struct {
+	Invariant string
+	Detail    string
+	Attrs     []attribute.KeyValue
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("invariant %s violated: %s", v.Invariant, v.Detail)
+}
+
+// CheckRefundPositive requires refunds to move a strictly positive amount.
+func CheckRefundPositive(amount float64) error {
+	if amount > 0 {
+		return nil
+	}
+	return &Violation{
+		Invariant: RefundPositive,
+		Detail:    fmt.Sprintf("refund amount %.2f is not positive", amount),
+		Attrs:     []attribute.KeyValue{attribute.Float64("refund.amount", amount)},
+	}
+}
+
+// CheckRefundWithinCaptured requires the total refunded, including this
+// refund, not to exceed the captured amount.
+func CheckRefundWithinCaptured(refund, alreadyRefunded, captured float64) error {
+	if alreadyRefunded+refund <= captured {
+		return nil
+	}
+	return &Violation{
+		Invariant: RefundWithinCaptured,
+		Detail:    fmt.Sprintf("refunding %.2f on top of %.2f exceeds captured %.2f", refund, alreadyRefunded, captured),
+		Attrs: []attribute.KeyValue{
+			attribute.Float64("refund.amount", refund),
+			attribute.Float64("refund.already_refunded", alreadyRefunded),
+			attribute.Float64("payment.captured_amount", captured),
+		},
+	}
+}
+
+// CheckCurrencyMatch requires a refund to use the payment's currency.
+func CheckCurrencyMatch(paymentCurrency, refundCurrency string) error {
+	if paymentCurrency == refundCurrency {
+		return nil
+	}
+	return &Violation{
+		Invariant: CurrencyMatch,
+		Detail:    fmt.Sprintf("refund currency %q does not match payment currency %q", refundCurrency, paymentCurrency),
+		Attrs: []attribute.KeyValue{
+			attribute.String("payment.currency", paymentCurrency),
+			attribute.String("refund.currency", refundCurrency),
+		},
+	}
+}
+
+var (
+	violationsOnce sync.Once
+	violations     metric.Int64Counter
+)
+
+func violationsCounter() metric.Int64Counter {
+	violationsOnce.Do(func() {
+		var err error
+		violations, err = telemetry.Meter().Int64Counter(
+			"invariant_violations_total",
+			metric.WithDescription("Number of business invariant violations"),
+			metric.WithUnit("{violation}"),
+		)
+		if err != nil {
+			violations, _ = telemetry.Meter().Int64Counter("invariant_violations_total")
+		}
+	})
+	return violations
+}
+
+// Record reports err if it is a Violation: it increments
+// invariant_violations_total{invariant} and adds an invariant.violation event
+// with the violation details to the span in ctx. Other errors are ignored.
+// Record returns err unchanged so it can wrap a check:
+//
+//	if err := invariant.Record(ctx, invariant.CheckRefundPositive(amount)); err != nil {
+func Record(ctx context.Context, err error) error {
+	var v *Violation
+	if !errors.As(err, &v) {
+		return err
+	}
+
+	violationsCounter().Add(ctx, 1, metric.WithAttributes(attribute.String("invariant", v.Invariant)))
+
+	attrs := append([]attribute.KeyValue{
+		attribute.String("invariant", v.Invariant),
+		attribute.String("invariant.detail", v.Detail),
+	}, v.Attrs...)
+	trace.SpanFromContext(ctx).AddEvent("invariant.violation", trace.WithAttributes(attrs...))
+	return err
+}
@@ -0,0 +1,324 @@
+// Package lanes routes payment work through separate standard and priority
+// queues, each drained by its own worker pool, so high-value payments don't
+// wait behind bulk traffic.
+package lanes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/budget"
+	"payment-service/internal/payments"
+	"payment-service/internal/telemetry"
+)
+
+// Lane identifies a processing lane.
+type Lane string
+
+const (
+	Standard Lane = "standard"
+	Priority Lane = "priority"
+)
+
+// ErrQueueFull is returned by Do when the selected lane cannot accept more work.
+var ErrQueueFull = telemetry.WithFailureDomain(errors.New("lanes: queue full"), telemetry.DomainInternal)
+
+// ErrClosed is returned by Do after Close.
+var ErrClosed = telemetry.WithFailureDomain(errors.New("lanes: router closed"), telemetry.DomainInternal)
+
+// Config controls lane routing and sizing.
+type Config struct {
+	// Threshold is the amount above which payments use the priority lane.
+	Threshold       float64
+	StandardWorkers int
+	PriorityWorkers int
+	QueueSize       int
+}
+
+type job struct {
+	ctx      context.Context
+	payment  payments.Payment
+	fn       func(context.Context)
+	enqueued time.Time
+	done     chan struct{}
+	// claimed is set by whichever of the worker and Do takes the job first:
+	// a worker to run it, or Do to give up on it while it is still queued.
+	claimed atomic.Bool
+}
+
+type lane struct {
+	name    Lane
+	queue   chan *job
+	attrs   metric.MeasurementOption
+	workers int
+	// processing is a moving average of the time a worker takes for a job,
+	// in nanoseconds.
+	processing atomic.Int64
+}
+
+// queueFullError is the ErrQueueFull of a lane, with the time its queue
+// needs to drain.
+type queueFullError struct {
+	lane       Lane
+	retryAfter time.Duration
+}
+
+func (e *queueFullError) Error() string {
+	return fmt.Sprintf("%v: %s lane, drains in about %v", ErrQueueFull, e.lane, e.retryAfter.Round(time.Millisecond))
+}
+
+func (e *queueFullError) Unwrap() error {
+	return ErrQueueFull
+}
+
+// RetryAfter returns how long a client should wait before retrying work
+// that failed with ErrQueueFull: the time the lane's queue takes to drain at
+// the workers' recent pace, at least a second.
+func RetryAfter(err error) (time.Duration, bool) {
+	var full *queueFullError
+	if !errors.As(err, &full) {
+		return 0, false
+	}
+	return full.retryAfter, true
+}
+
+type instruments struct {
+	depth      metric.Int64UpDownCounter
+	wait       metric.Float64Histogram
+	processing metric.Float64Histogram
+}
+
+// Router assigns work to lanes and runs it on the lane's workers.
+type Router struct {
+	threshold float64
+	lanes     map[Lane]*lane
+	inst      instruments
+	shed      shedWindow
+	wg        sync.WaitGroup
+
+	// mu guards closed. Do holds it for reading while it enqueues, so
+	// Close can't close a queue under it.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewRouter starts the worker pools for both lanes.
+func NewRouter(cfg Config) (*Router, error) {
+	inst, err := newInstruments()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Router{
+		threshold: cfg.Threshold,
+		lanes:     make(map[Lane]*lane),
+		inst:      inst,
+	}
+	r.start(Standard, cfg.StandardWorkers, cfg.QueueSize)
+	r.start(Priority, cfg.PriorityWorkers, cfg.QueueSize)
+	return r, nil
+}
+
+func newInstruments() (instruments, error) {
+	meter := telemetry.Meter()
+	var inst instruments
+	var err error
+
+	inst.depth, err = meter.Int64UpDownCounter(
+		"payment_lane_queue_depth",
+		metric.WithDescription("Number of payments waiting in a lane queue"),
+		metric.WithUnit("{payment}"),
+	)
+	if err != nil {
+		return inst, err
+	}
+
+	inst.wait, err = meter.Float64Histogram(
+		"payment_lane_wait_duration_seconds",
+		metric.WithDescription("Time payments spend queued before a lane worker picks them up"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return inst, err
+	}
+
+	inst.processing, err = meter.Float64Histogram(
+		"payment_lane_processing_duration_seconds",
+		metric.WithDescription("Time lane workers spend processing a payment"),
+		metric.WithUnit("s"),
+	)
+	return inst, err
+}
+
+func (r *Router) start(name Lane, workers, queueSize int) {
+	l := &lane{
+		name:    name,
+		queue:   make(chan *job, queueSize),
+		attrs:   metric.WithAttributes(attribute.String("lane", string(name))),
+		workers: max(workers, 1),
+	}
+	r.lanes[name] = l
+
+	for i := 0; i < l.workers; i++ {
+		r.wg.Add(1)
+		go r.work(l)
+	}
+}
+
+// LaneFor returns the lane a payment of the given amount is routed to.
+func (r *Router) LaneFor(amount float64) Lane {
+	if amount > r.threshold {
+		return Priority
+	}
+	return Standard
+}
+
+// Do runs fn on a worker of the lane selected for p's amount and waits for it
+// to finish. It returns ErrQueueFull without running fn if the lane is saturated,
+// ErrClosed if the router is closed, or ctx.Err() if ctx is done before a
+// worker picks the job up. Once a worker
+// has, Do waits for fn whatever ctx, so a nil error means fn ran and returned.
+func (r *Router) Do(ctx context.Context, p payments.Payment, fn func(context.Context)) (Lane, error) {
+	l := r.lanes[r.LaneFor(p.Amount)]
+	j := &job{ctx: ctx, payment: p, fn: fn, enqueued: time.Now(), done: make(chan struct{})}
+
+	r.mu.RLock()
+	if r.closed {
+		r.mu.RUnlock()
+		return l.name, ErrClosed
+	}
+	select {
+	case l.queue <- j:
+		r.shed.add(false)
+		r.inst.depth.Add(ctx, 1, l.attrs)
+		telemetry.DebugEvent(ctx, "lane.enqueued",
+			attribute.String("payment.lane", string(l.name)),
+			attribute.Int("payment.lane.queue_length", len(l.queue)),
+		)
+	default:
+		r.shed.add(true)
+		drain := time.Duration(int64(len(l.queue)) * l.processing.Load() / int64(l.workers))
+		r.mu.RUnlock()
+		return l.name, &queueFullError{lane: l.name, retryAfter: max(drain, time.Second)}
+	}
+	r.mu.RUnlock()
+
+	select {
+	case <-j.done:
+		return l.name, nil
+	case <-ctx.Done():
+		if j.claimed.CompareAndSwap(false, true) {
+			return l.name, ctx.Err()
+		}
+		<-j.done
+		return l.name, nil
+	}
+}
+
+// ShedRate returns the share of the payments of the last minute, in either
+// lane, that were shed with ErrQueueFull, or 0 if there were none.
+func (r *Router) ShedRate() float64 {
+	return r.shed.rate()
+}
+
+// shedBucket is the resolution of a shedWindow, which spans
+// len(shedWindow.buckets) of them.
+const shedBucket = 10 * time.Second
+
+// shedWindow counts the payments admitted to and shed from the lanes over
+// the last minute. Older buckets are reused as time passes, so a burst of
+// sheds stops counting a minute later even if no payment follows it.
+type shedWindow struct {
+	mu      sync.Mutex
+	buckets [6]struct {
+		start          time.Time
+		admitted, shed int
+	}
+}
+
+func (w *shedWindow) add(shed bool) {
+	start := time.Now().Truncate(shedBucket)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b := &w.buckets[start.Unix()/int64(shedBucket/time.Second)%int64(len(w.buckets))]
+	if !b.start.Equal(start) {
+		b.start, b.admitted, b.shed = start, 0, 0
+	}
+	if shed {
+		b.shed++
+	} else {
+		b.admitted++
+	}
+}
+
+func (w *shedWindow) rate() float64 {
+	since := time.Now().Truncate(shedBucket).Add(-shedBucket * time.Duration(len(w.buckets)-1))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var admitted, shed int
+	for _, b := range w.buckets {
+		if !b.start.Before(since) {
+			admitted += b.admitted
+			shed += b.shed
+		}
+	}
+	if admitted+shed == 0 {
+		return 0
+	}
+	return float64(shed) / float64(admitted+shed)
+}
+
+func (r *Router) work(l *lane) {
+	defer r.wg.Done()
+
+	for j := range l.queue {
+		r.inst.depth.Add(j.ctx, -1, l.attrs)
+		if j.ctx.Err() != nil || !j.claimed.CompareAndSwap(false, true) {
+			// Do has returned, or will, with ctx.Err().
+			continue
+		}
+
+		start := time.Now()
+		wait := start.Sub(j.enqueued)
+		r.inst.wait.Record(j.ctx, wait.Seconds(), l.attrs)
+
+		ctx, span := payments.StartSpan(j.ctx, payments.OpProcess, j.payment,
+			trace.WithAttributes(
+				attribute.String("payment.lane", string(l.name)),
+				attribute.Float64("payment.lane.wait_seconds", wait.Seconds()),
+			),
+		)
+		budget.Annotate(ctx, span)
+		j.fn(ctx)
+		span.End()
+
+		took := time.Since(start)
+		r.inst.processing.Record(j.ctx, took.Seconds(), l.attrs)
+		// Racing workers may lose an update; the average is only a hint.
+		avg := l.processing.Load()
+		l.processing.Store(avg + (int64(took)-avg)/8)
+		close(j.done)
+	}
+}
+
+// Close stops accepting work and waits for queued payments to drain. Do
+// returns ErrClosed from then on.
+func (r *Router) Close() {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		for _, l := range r.lanes {
+			close(l.queue)
+		}
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
@@ -0,0 +1,170 @@
+package lanes
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"payment-service/internal/payments"
+)
+
+func newTestRouter(t *testing.T, cfg Config) *Router {
+	t.Helper()
+	r, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestDoWaitsForRunningJobAfterCancel(t *testing.T) {
+	r := newTestRouter(t, Config{Threshold: 100, StandardWorkers: 1, PriorityWorkers: 1, QueueSize: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	running := make(chan struct{})
+	var result string
+	done := make(chan error)
+	go func() {
+		_, err := r.Do(ctx, payments.Payment{Amount: 10}, func(context.Context) {
+			close(running)
+			time.Sleep(20 * time.Millisecond)
+			result = "stored"
+		})
+		done <- err
+	}()
+
+	<-running
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Do() = %v after the job started, want nil", err)
+	}
+	// Read after Do returned; the race detector flags it if fn is still
+	// writing.
+	if result != "stored" {
+		t.Fatalf("result = %q, want fn to have finished", result)
+	}
+}
+
+func TestDoGivesUpOnQueuedJobAfterCancel(t *testing.T) {
+	r := newTestRouter(t, Config{Threshold: 100, StandardWorkers: 1, PriorityWorkers: 1, QueueSize: 1})
+
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	go r.Do(context.Background(), payments.Payment{Amount: 10}, func(context.Context) {
+		close(busy)
+		<-release
+	})
+	<-busy
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ran := make(chan struct{}, 1)
+	_, err := r.Do(ctx, payments.Payment{Amount: 10}, func(context.Context) { ran <- struct{}{} })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Do() = %v, want context.DeadlineExceeded", err)
+	}
+	release <- struct{}{}
+	select {
+	case <-ran:
+		t.Fatal("fn ran after Do gave up on it")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestLaneFor(t *testing.T) {
+	r := newTestRouter(t, Config{Threshold: 100, StandardWorkers: 1, PriorityWorkers: 1, QueueSize: 1})
+	for _, tc := range []struct {
+		amount float64
+		want   Lane
+	}{
+		{0, Standard},
+		{99.99, Standard},
+		{100, Standard},
+		{100.01, Priority},
+		{1e6, Priority},
+	} {
+		if got := r.LaneFor(tc.amount); got != tc.want {
+			t.Errorf("LaneFor(%v) = %s, want %s", tc.amount, got, tc.want)
+		}
+	}
+}
+
+func TestDoShedsWhenQueueFull(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		amount float64
+		lane   Lane
+	}{
+		{"standard", 10, Standard},
+		{"priority", 1000, Priority},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRouter(t, Config{Threshold: 100, StandardWorkers: 1, PriorityWorkers: 1, QueueSize: 1})
+			p := payments.Payment{Amount: tc.amount}
+
+			// Occupy the lane's worker, then fill its queue.
+			release := make(chan struct{})
+			defer close(release)
+			busy := make(chan struct{})
+			go r.Do(context.Background(), p, func(context.Context) {
+				close(busy)
+				<-release
+			})
+			<-busy
+			go r.Do(context.Background(), p, func(context.Context) {})
+			deadline := time.Now().Add(time.Second)
+			for len(r.lanes[tc.lane].queue) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("queued job never arrived")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			ran := false
+			lane, err := r.Do(context.Background(), p, func(context.Context) { ran = true })
+			if lane != tc.lane || !errors.Is(err, ErrQueueFull) || ran {
+				t.Fatalf("Do() = %s, %v, ran %v; want %s, ErrQueueFull without running", lane, err, ran, tc.lane)
+			}
+			if wait, ok := RetryAfter(err); !ok || wait < time.Second {
+				t.Errorf("RetryAfter() = %v, %v; want at least a second", wait, ok)
+			}
+			// The other lane still admits work.
+			other := payments.Payment{Amount: 1010 - tc.amount}
+			if _, err := r.Do(context.Background(), other, func(context.Context) {}); err != nil {
+				t.Errorf("Do() on the other lane = %v", err)
+			}
+			// One of four payments was shed; the queued one may not have
+			// been counted yet.
+			if rate := r.ShedRate(); rate != 0.25 && rate != 1.0/3 {
+				t.Errorf("ShedRate() = %v, want one shed of three or four", rate)
+			}
+		})
+	}
+}
+
+func TestDoAfterClose(t *testing.T) {
+	r := newTestRouter(t, Config{Threshold: 100, StandardWorkers: 1, PriorityWorkers: 1, QueueSize: 1})
+
+	// Payments racing Close either run or get ErrClosed; none panics by
+	// sending on a closed queue.
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Go(func() {
+			if _, err := r.Do(context.Background(), payments.Payment{Amount: float64(i * 10)}, func(context.Context) {}); err != nil &&
+				!errors.Is(err, ErrClosed) && !errors.Is(err, ErrQueueFull) {
+				t.Errorf("Do() = %v racing Close, want nil, ErrClosed or ErrQueueFull", err)
+			}
+		})
+	}
+	r.Close()
+	wg.Wait()
+
+	ran := false
+	if _, err := r.Do(context.Background(), payments.Payment{Amount: 10}, func(context.Context) { ran = true }); !errors.Is(err, ErrClosed) || ran {
+		t.Fatalf("Do() = %v, ran %v after Close; want ErrClosed without running", err, ran)
+	}
+}
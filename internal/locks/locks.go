@@ -0,0 +1,184 @@
+// Package locks provides a Mutex, an RWMutex and a Weighted semaphore that
+// record how long callers wait for them and hold them, and how often they
+// find them taken, so lock contention shows up in metrics instead of only as
+// unexplained latency. Waits longer than the threshold set with SetSlowWait
+// are also recorded as lock.wait events on the caller's span.
+//
+// Acquiring returns the function that releases, so the hold time is measured
+// per holder, shared holders of an RWMutex included:
+//
+//	unlock := mu.Lock(ctx)
+//	defer unlock()
+package locks
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// Lock modes, recorded as lock.mode.
+const (
+	ModeExclusive = "exclusive"
+	ModeShared    = "shared"
+	ModeWeighted  = "weighted"
+)
+
+var slowWait atomic.Int64
+
+// SetSlowWait sets the wait above which an acquisition adds a lock.wait event
+// to the span in its context. Zero, the default, disables the events.
+func SetSlowWait(d time.Duration) {
+	slowWait.Store(int64(d))
+}
+
+// Mutex is a sync.Mutex that records its waits and holds.
+type Mutex struct {
+	mu  sync.Mutex
+	obs observer
+}
+
+// NewMutex returns a Mutex recorded under lock.name name.
+func NewMutex(name string) *Mutex {
+	return &Mutex{obs: newObserver(name, ModeExclusive)}
+}
+
+// Lock locks m and returns the function that unlocks it.
+func (m *Mutex) Lock(ctx context.Context) (unlock func()) {
+	start := time.Now()
+	contended := !m.mu.TryLock()
+	if contended {
+		m.mu.Lock()
+	}
+	acquired := m.obs.acquired(ctx, start, contended)
+	return func() {
+		m.mu.Unlock()
+		m.obs.released(ctx, acquired)
+	}
+}
+
+// RWMutex is a sync.RWMutex that records its waits and holds, exclusive and
+// shared separately.
+type RWMutex struct {
+	mu     sync.RWMutex
+	write  observer
+	shared observer
+}
+
+// NewRWMutex returns an RWMutex recorded under lock.name name.
+func NewRWMutex(name string) *RWMutex {
+	return &RWMutex{write: newObserver(name, ModeExclusive), shared: newObserver(name, ModeShared)}
+}
+
+// Lock locks m for writing and returns the function that unlocks it.
+func (m *RWMutex) Lock(ctx context.Context) (unlock func()) {
+	start := time.Now()
+	contended := !m.mu.TryLock()
+	if contended {
+		m.mu.Lock()
+	}
+	acquired := m.write.acquired(ctx, start, contended)
+	return func() {
+		m.mu.Unlock()
+		m.write.released(ctx, acquired)
+	}
+}
+
+// RLock locks m for reading and returns the function that unlocks it.
+func (m *RWMutex) RLock(ctx context.Context) (runlock func()) {
+	start := time.Now()
+	contended := !m.mu.TryRLock()
+	if contended {
+		m.mu.RLock()
+	}
+	acquired := m.shared.acquired(ctx, start, contended)
+	return func() {
+		m.mu.RUnlock()
+		m.shared.released(ctx, acquired)
+	}
+}
+
+// observer records the acquisitions of one lock in one mode.
+type observer struct {
+	name  string
+	attrs metric.MeasurementOption
+	event trace.EventOption
+}
+
+func newObserver(name, mode string) observer {
+	attrs := []attribute.KeyValue{attribute.String("lock.name", name), attribute.String("lock.mode", mode)}
+	return observer{name: name, attrs: metric.WithAttributes(attrs...), event: trace.WithAttributes(attrs...)}
+}
+
+// acquired records an acquisition that started waiting at start and returns
+// the time it completed.
+func (o observer) acquired(ctx context.Context, start time.Time, contended bool) time.Time {
+	now := time.Now()
+	wait := now.Sub(start)
+	inst := instruments()
+	inst.wait.Record(ctx, wait.Seconds(), o.attrs)
+	if contended {
+		inst.contentions.Add(ctx, 1, o.attrs)
+	}
+	if threshold := time.Duration(slowWait.Load()); threshold > 0 && wait > threshold {
+		trace.SpanFromContext(ctx).AddEvent("lock.wait", o.event,
+			trace.WithAttributes(attribute.Float64("lock.wait_seconds", wait.Seconds())))
+	}
+	return now
+}
+
+// released records the hold that began at acquired.
+func (o observer) released(ctx context.Context, acquired time.Time) {
+	instruments().hold.Record(ctx, time.Since(acquired).Seconds(), o.attrs)
+}
+
+type lockInstruments struct {
+	wait        metric.Float64Histogram
+	hold        metric.Float64Histogram
+	contentions metric.Int64Counter
+}
+
+// lockBounds suit locks held for microseconds as well as ones that stall.
+var lockBounds = []float64{0.000001, 0.00001, 0.0001, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// instruments creates the instruments on first use, after telemetry.Setup.
+// Locks are often package variables, created before Setup runs.
+var instruments = sync.OnceValue(func() lockInstruments {
+	meter := telemetry.Meter()
+	var inst lockInstruments
+	var err error
+	inst.wait, err = meter.Float64Histogram(
+		"lock_wait_duration_seconds",
+		metric.WithDescription("Time spent waiting to acquire a lock"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(lockBounds...),
+	)
+	if err != nil {
+		inst.wait, _ = meter.Float64Histogram("lock_wait_duration_seconds")
+	}
+	inst.hold, err = meter.Float64Histogram(
+		"lock_hold_duration_seconds",
+		metric.WithDescription("Time a lock was held"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(lockBounds...),
+	)
+	if err != nil {
+		inst.hold, _ = meter.Float64Histogram("lock_hold_duration_seconds")
+	}
+	inst.contentions, err = meter.Int64Counter(
+		"lock_contentions_total",
+		metric.WithDescription("Number of acquisitions that found the lock taken and had to wait"),
+		metric.WithUnit("{acquisition}"),
+	)
+	if err != nil {
+		inst.contentions, _ = meter.Int64Counter("lock_contentions_total")
+	}
+	return inst
+})
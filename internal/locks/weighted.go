@@ -0,0 +1,101 @@
+package locks
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrTooLarge is returned by Acquire for more units than the semaphore has,
+// which it could never grant.
+var ErrTooLarge = errors.New("locks: acquisition larger than the semaphore")
+
+// Weighted is a weighted semaphore that records its waits and holds. Waiters
+// are served in order, so a large acquisition is not starved by small ones.
+type Weighted struct {
+	size int64
+	obs  observer
+
+	mu      sync.Mutex
+	cur     int64
+	waiters list.List
+}
+
+type waiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// NewWeighted returns a semaphore of size size recorded under lock.name name.
+func NewWeighted(name string, size int64) *Weighted {
+	return &Weighted{size: size, obs: newObserver(name, ModeWeighted)}
+}
+
+// Acquire acquires n units, blocking until they are available or ctx is
+// done, and returns the function that releases them. On failure it returns
+// ctx.Err(), or ErrTooLarge if n is more than the semaphore's size, and
+// holds nothing.
+func (s *Weighted) Acquire(ctx context.Context, n int64) (release func(), err error) {
+	start := time.Now()
+	if n > s.size {
+		return nil, fmt.Errorf("%w: %d units of %s, a semaphore of size %d", ErrTooLarge, n, s.obs.name, s.size)
+	}
+
+	s.mu.Lock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return s.releaser(ctx, n, s.obs.acquired(ctx, start, false)), nil
+	}
+	w := waiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaser(ctx, n, s.obs.acquired(ctx, start, true)), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-w.ready:
+			// Acquired while giving up; hand the units back.
+			s.cur -= n
+		default:
+			s.waiters.Remove(elem)
+		}
+		// Removing a waiter at the front can unblock the ones behind it.
+		s.notify()
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Weighted) releaser(ctx context.Context, n int64, acquired time.Time) func() {
+	return func() {
+		s.mu.Lock()
+		s.cur -= n
+		s.notify()
+		s.mu.Unlock()
+		s.obs.released(ctx, acquired)
+	}
+}
+
+// notify grants units to waiters in order while they fit. s.mu must be held.
+func (s *Weighted) notify() {
+	for {
+		front := s.waiters.Front()
+		if front == nil {
+			return
+		}
+		w := front.Value.(waiter)
+		if s.size-s.cur < w.n {
+			return
+		}
+		s.cur += w.n
+		s.waiters.Remove(front)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,150 @@
+package locks
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n acquisitions are waiting on s.
+func waitQueued(t *testing.T, s *Weighted, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		queued := s.waiters.Len()
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type acquisition struct {
+	release func()
+	err     error
+}
+
+// acquire acquires n units of s in the background.
+func acquire(ctx context.Context, s *Weighted, n int64) <-chan acquisition {
+	ch := make(chan acquisition, 1)
+	go func() {
+		release, err := s.Acquire(ctx, n)
+		ch <- acquisition{release, err}
+	}()
+	return ch
+}
+
+func granted(t *testing.T, ch <-chan acquisition) func() {
+	t.Helper()
+	select {
+	case a := <-ch:
+		if a.err != nil {
+			t.Fatalf("Acquire() = %v", a.err)
+		}
+		return a.release
+	case <-time.After(time.Second):
+		t.Fatal("Acquire() still waiting")
+		return nil
+	}
+}
+
+func waiting(t *testing.T, ch <-chan acquisition) {
+	t.Helper()
+	select {
+	case a := <-ch:
+		t.Fatalf("Acquire() returned %v, want it to wait", a.err)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestWeightedFIFOHandoff(t *testing.T) {
+	ctx := context.Background()
+	s := NewWeighted("test", 2)
+	first, err := s.Acquire(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := acquire(ctx, s, 2)
+	waitQueued(t, s, 1)
+	small := acquire(ctx, s, 1)
+	waitQueued(t, s, 2)
+	// A unit is free, but the small acquisition queued behind the large one
+	// mustn't take it.
+	waiting(t, small)
+
+	first()
+	releaseLarge := granted(t, large)
+	waiting(t, small)
+	releaseLarge()
+	granted(t, small)()
+}
+
+func TestWeightedCancelWhileGranted(t *testing.T) {
+	ctx := context.Background()
+	s := NewWeighted("test", 1)
+	// The unit is handed on below without its release func.
+	if _, err := s.Acquire(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	canceled := acquire(cctx, s, 1)
+	waitQueued(t, s, 1)
+	next := acquire(ctx, s, 1)
+	waitQueued(t, s, 2)
+
+	// Cancel, let the waiter see it and block on the lock, then grant it
+	// the unit before it takes the lock to give up.
+	s.mu.Lock()
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	s.cur--
+	s.notify()
+	s.mu.Unlock()
+
+	select {
+	case a := <-canceled:
+		if !errors.Is(a.err, context.Canceled) {
+			t.Fatalf("Acquire() = %v, want context.Canceled", a.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("canceled Acquire() still waiting")
+	}
+	// The unit it was granted goes to the next waiter.
+	granted(t, next)()
+}
+
+func TestWeightedTooLarge(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int64
+		n    int64
+		err  error
+	}{
+		{"fits", 2, 2, nil},
+		{"too large", 2, 3, ErrTooLarge},
+		{"empty semaphore", 0, 1, ErrTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewWeighted("test", tc.size)
+			release, err := s.Acquire(context.Background(), tc.n)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Acquire(%d) on size %d = %v, want %v", tc.n, tc.size, err, tc.err)
+			}
+			if err != nil {
+				if release != nil {
+					t.Fatal("failed Acquire() returned a release func")
+				}
+				return
+			}
+			release()
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Package longpoll parks requests until the resource they watch changes or
+// they time out. The wait runs under its own span, so the time a long poll
+// spends blocked is recorded separately from the work around it instead of
+// inflating the request's latency signal.
+package longpoll
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// Reasons a wait ends.
+const (
+	Changed   = "changed"
+	Timeout   = "timeout"
+	Cancelled = "cancelled"
+)
+
+// Hub tracks the waiters of each key.
+type Hub struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+
+	active   metric.Int64UpDownCounter
+	duration metric.Float64Histogram
+}
+
+// New creates a Hub.
+func New() (*Hub, error) {
+	h := &Hub{waiters: make(map[string]map[chan struct{}]struct{})}
+
+	meter := telemetry.Meter()
+	var err error
+	h.active, err = meter.Int64UpDownCounter(
+		"longpoll_waiters",
+		metric.WithDescription("Number of requests currently blocked in a long poll"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	h.duration, err = meter.Float64Histogram(
+		"longpoll_wait_duration_seconds",
+		metric.WithDescription("Time long polls spend blocked, by wake reason"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.1, 0.5, 1, 2.5, 5, 10, 20, 30, 45, 60),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Notify wakes every waiter of key.
+func (h *Hub) Notify(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.waiters[key] {
+		close(ch)
+	}
+	delete(h.waiters, key)
+}
+
+// Wait blocks until key is notified, timeout passes or ctx is done, and
+// returns the reason it woke. changed is checked after the waiter is
+// registered, so a change that happened just before Wait is not missed; if it
+// reports true, Wait returns Changed immediately.
+func (h *Hub) Wait(ctx context.Context, key string, timeout time.Duration, changed func() bool) string {
+	ctx, span := telemetry.Tracer().Start(ctx, "longpoll.wait", trace.WithAttributes(
+		attribute.Float64("longpoll.timeout_seconds", timeout.Seconds()),
+	))
+	defer span.End()
+
+	ch := make(chan struct{})
+	h.mu.Lock()
+	if h.waiters[key] == nil {
+		h.waiters[key] = make(map[chan struct{}]struct{})
+	}
+	h.waiters[key][ch] = struct{}{}
+	h.mu.Unlock()
+	h.active.Add(ctx, 1)
+
+	start := time.Now()
+	reason := Changed
+	if !changed() {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-ch:
+		case <-timer.C:
+			reason = Timeout
+		case <-ctx.Done():
+			reason = Cancelled
+		}
+		timer.Stop()
+	}
+	waited := time.Since(start)
+
+	h.mu.Lock()
+	delete(h.waiters[key], ch)
+	if len(h.waiters[key]) == 0 {
+		delete(h.waiters, key)
+	}
+	h.mu.Unlock()
+	h.active.Add(ctx, -1)
+
+	reasonAttr := attribute.String("longpoll.wake_reason", reason)
+	span.SetAttributes(reasonAttr, attribute.Float64("longpoll.wait_seconds", waited.Seconds()))
+	h.duration.Record(ctx, waited.Seconds(), metric.WithAttributes(reasonAttr))
+	return reason
+}
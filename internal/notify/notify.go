@@ -0,0 +1,247 @@
+// Package notify tells customers about their payments by email and SMS. It
+// consumes payment events from the bus, renders a template per channel and
+// hands the message to a stub transport that simulates a delivery gateway,
+// with latency and injectable failures. Rendering and sending each get a
+// span, so the traces of an event show a third kind of downstream
+// dependency next to the fraud service and the store.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/outbox"
+	"payment-service/internal/paymentmetrics"
+	"payment-service/internal/telemetry"
+)
+
+// ErrDeliveryFailed is returned when the gateway rejects a message.
+var ErrDeliveryFailed = telemetry.WithFailureDomain(errors.New("notify: delivery failed"), telemetry.DomainGateway)
+
+// Channel is a delivery channel.
+type Channel string
+
+const (
+	Email Channel = "email"
+	SMS   Channel = "sms"
+)
+
+// smsSegment is the number of characters that fit in one SMS.
+const smsSegment = 160
+
+// gateways name the simulated service behind each channel, recorded as
+// peer.service on send spans.
+var gateways = map[Channel]string{Email: "email-gateway", SMS: "sms-gateway"}
+
+// templates holds the message template of each event type per channel.
+var templates = map[string]map[Channel]*template.Template{
+	paymentmetrics.EventCreated: {
+		Email: template.Must(template.New("payment.created/email").Parse(
+			"Subject: Payment {{.ID}} received\n\nWe received your payment of {{printf \"%.2f\" .Amount}} {{.Currency}} on {{.Date}}. It is {{.Status}} and will settle shortly.\n")),
+		SMS: template.Must(template.New("payment.created/sms").Parse(
+			"Payment {{.ID}} of {{printf \"%.2f\" .Amount}} {{.Currency}} received.")),
+	},
+	paymentmetrics.EventDeclined: {
+		Email: template.Must(template.New("payment.declined/email").Parse(
+			"Subject: Payment of {{printf \"%.2f\" .Amount}} {{.Currency}} declined\n\nYour payment of {{printf \"%.2f\" .Amount}} {{.Currency}} was declined by our fraud checks. Contact support if you think this is a mistake.\n")),
+		SMS: template.Must(template.New("payment.declined/sms").Parse(
+			"Your payment of {{printf \"%.2f\" .Amount}} {{.Currency}} was declined.")),
+	},
+}
+
+// Config controls the simulated gateways.
+type Config struct {
+	// Channels are the channels each event is sent on; defaults to email and
+	// SMS.
+	Channels []Channel
+	// MedianLatency is the typical response time of a gateway; defaults to
+	// 30ms.
+	MedianLatency time.Duration
+	// ErrorRate is the fraction of sends that fail.
+	ErrorRate float64
+}
+
+// Message is a rendered notification.
+type Message struct {
+	Channel  Channel
+	Template string
+	To       string
+	Body     string
+}
+
+// Notifier renders and sends payment notifications.
+type Notifier struct {
+	cfg Config
+
+	sent     metric.Int64Counter
+	render   metric.Float64Histogram
+	duration metric.Float64Histogram
+}
+
+// New returns a Notifier.
+func New(cfg Config) (*Notifier, error) {
+	if len(cfg.Channels) == 0 {
+		cfg.Channels = []Channel{Email, SMS}
+	}
+	if cfg.MedianLatency <= 0 {
+		cfg.MedianLatency = 30 * time.Millisecond
+	}
+	n := &Notifier{cfg: cfg}
+
+	meter := telemetry.Meter()
+	var err error
+	n.sent, err = meter.Int64Counter(
+		"notifications_total",
+		metric.WithDescription("Number of notifications sent, by channel, template and result"),
+		metric.WithUnit("{notification}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	n.render, err = meter.Float64Histogram(
+		"notification_render_duration_seconds",
+		metric.WithDescription("Time spent rendering notification templates"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01),
+	)
+	if err != nil {
+		return nil, err
+	}
+	n.duration, err = meter.Float64Histogram(
+		"notification_send_duration_seconds",
+		metric.WithDescription("Duration of notification sends as seen by the caller"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// payment is the part of an event payload notifications show.
+type payment struct {
+	ID       string  `json:"id"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+	Status   string  `json:"status"`
+	Date     string  `json:"date"`
+}
+
+// Consume notifies the customer of a payment event on every channel. It has
+// the signature of a bus handler; events without templates are ignored.
+func (n *Notifier) Consume(ctx context.Context, e outbox.Event) error {
+	byChannel, ok := templates[e.Type]
+	if !ok {
+		return nil
+	}
+	var p payment
+	if err := json.Unmarshal(e.Payload, &p); err != nil {
+		return fmt.Errorf("decode %s: %w", e.ID, err)
+	}
+
+	var errs []error
+	for _, ch := range n.cfg.Channels {
+		tmpl, ok := byChannel[ch]
+		if !ok {
+			continue
+		}
+		msg, err := n.renderMessage(ctx, ch, e.Type, tmpl, p)
+		if err == nil {
+			err = n.send(ctx, msg)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", ch, e.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) renderMessage(ctx context.Context, ch Channel, name string, tmpl *template.Template, p payment) (Message, error) {
+	var msg Message
+	err := telemetry.WithSpan(ctx, "notify.render", func(ctx context.Context) error {
+		start := time.Now()
+		var body bytes.Buffer
+		err := tmpl.Execute(&body, p)
+		n.render.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+			attribute.String("notification.channel", string(ch)),
+			attribute.String("notification.template", name),
+		))
+		if err != nil {
+			return telemetry.WithFailureDomain(fmt.Errorf("render %s: %w", tmpl.Name(), err), telemetry.DomainInternal)
+		}
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int("notification.message.size", body.Len()))
+		msg = Message{Channel: ch, Template: name, To: recipient(ch, p.ID), Body: body.String()}
+		return nil
+	}, trace.WithAttributes(
+		attribute.String("notification.channel", string(ch)),
+		attribute.String("notification.template", name),
+	))
+	return msg, err
+}
+
+// recipient makes up the customer's address; payments carry no customer.
+func recipient(ch Channel, paymentID string) string {
+	if ch == SMS {
+		return "+1555" + paymentID[max(0, len(paymentID)-7):]
+	}
+	return "customer+" + paymentID + "@example.com"
+}
+
+// send hands msg to the channel's simulated gateway under a client span.
+func (n *Notifier) send(ctx context.Context, msg Message) error {
+	attrs := []attribute.KeyValue{
+		attribute.String("notification.channel", string(msg.Channel)),
+		attribute.String("notification.template", msg.Template),
+	}
+	return telemetry.WithSpan(ctx, "notify.send "+string(msg.Channel), func(ctx context.Context) error {
+		telemetry.CountDownstreamCall(ctx)
+		if msg.Channel == SMS {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Int("notification.sms.segments", (len(msg.Body)+smsSegment-1)/smsSegment))
+		}
+
+		start := time.Now()
+		err := n.deliver(ctx, msg)
+		result := "sent"
+		if err != nil {
+			result = "failed"
+		}
+		n.sent.Add(ctx, 1, metric.WithAttributes(append(attrs, attribute.String("result", result))...))
+		n.duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attrs[0], attribute.String("result", result)))
+		return err
+	},
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, attribute.String("peer.service", gateways[msg.Channel]))...),
+	)
+}
+
+// deliver simulates the gateway: a log-normal latency, then success or, at
+// ErrorRate, failure.
+func (n *Notifier) deliver(ctx context.Context, msg Message) error {
+	latency := time.Duration(float64(n.cfg.MedianLatency) * math.Exp(rand.NormFloat64()*0.5))
+	select {
+	case <-time.After(latency):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if rand.Float64() < n.cfg.ErrorRate {
+		return ErrDeliveryFailed
+	}
+	telemetry.LoggerFor(ctx).Debug("notification sent",
+		zap.String("channel", string(msg.Channel)),
+		zap.String("template", msg.Template),
+		zap.String("to", msg.To),
+		zap.String("body", msg.Body))
+	return nil
+}
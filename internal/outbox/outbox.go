@@ -0,0 +1,362 @@
+// Package outbox implements the transactional outbox pattern. Events are
+// stored in the transaction of the write that produced them, so an event is
+// recorded if and only if the write succeeded, and a relay publishes them
+// afterwards. A slow or failing publisher therefore delays events but never
+// loses them or fails the request.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/locks"
+	"payment-service/internal/telemetry"
+)
+
+// Event is an outgoing message. Headers carry the trace context of the
+// publish span to consumers.
+type Event struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	Payload   json.RawMessage   `json:"payload"`
+	CreatedAt time.Time         `json:"created_at"`
+	Attempts  int               `json:"attempts"`
+	Headers   map[string]string `json:"headers,omitempty"`
+
+	// TraceID and SpanID identify the request that committed the event, so
+	// the publish span can link back to it.
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"span_id,omitempty"`
+}
+
+// Publisher delivers events to the bus.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Store keeps the events of an Outbox durably, next to the data of the
+// writes that produce them. A Store doesn't add events: Commit's write
+// stores each event it makes in its own transaction. The Store restores the
+// events on New and records what the relay did with them.
+type Store interface {
+	// LoadEvents returns the pending events, in commit order, and the dead
+	// letters.
+	LoadEvents(ctx context.Context) (pending, dead []Event, err error)
+	// SaveEvent records e's failed attempts, and moves it to the dead
+	// letters if dead.
+	SaveEvent(ctx context.Context, e Event, dead bool) error
+	// DeleteEvent removes the event with id once it is published.
+	DeleteEvent(ctx context.Context, id string) error
+}
+
+// NewEvent makes the event of payload, for Commit's write to store.
+type NewEvent func(payload any) (Event, error)
+
+// Config controls the relay.
+type Config struct {
+	// PollInterval is how often the relay looks for pending events.
+	PollInterval time.Duration
+	// MaxAttempts is the number of failed publishes after which an event is
+	// treated as poison and moved to the dead letters.
+	MaxAttempts int
+	// Store keeps pending and dead-lettered events across restarts. Nil
+	// keeps them in memory only.
+	Store Store
+}
+
+// Outbox holds committed events until the relay publishes them.
+type Outbox struct {
+	cfg       Config
+	publisher Publisher
+
+	mu      *locks.Mutex
+	pending []Event
+	dead    []Event
+	// seq numbers events. It starts from the clock rather than from a
+	// persisted counter, so IDs stay unique across restarts.
+	seq int64
+
+	published metric.Int64Counter
+	poisoned  metric.Int64Counter
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates an Outbox, restores persisted events and starts the relay.
+func New(cfg Config, publisher Publisher) (*Outbox, error) {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	o := &Outbox{cfg: cfg, publisher: publisher, mu: locks.NewMutex("outbox"), stop: make(chan struct{}), done: make(chan struct{})}
+
+	meter := telemetry.Meter()
+	var err error
+	o.published, err = meter.Int64Counter(
+		"outbox_events_published_total",
+		metric.WithDescription("Number of outbox events published by the relay"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	o.poisoned, err = meter.Int64Counter(
+		"outbox_poison_events_total",
+		metric.WithDescription("Number of outbox events moved to the dead letters after repeated publish failures"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	lag, err := meter.Float64ObservableGauge(
+		"outbox_relay_lag_seconds",
+		metric.WithDescription("Age of the oldest event waiting to be published"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := meter.Int64ObservableGauge(
+		"outbox_pending_events",
+		metric.WithDescription("Number of events waiting to be published"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter.RegisterCallback(func(ctx context.Context, obs metric.Observer) error {
+		unlock := o.mu.Lock(ctx)
+		defer unlock()
+		obs.ObserveInt64(pending, int64(len(o.pending)))
+		var age float64
+		if len(o.pending) > 0 {
+			age = time.Since(o.pending[0].CreatedAt).Seconds()
+		}
+		obs.ObserveFloat64(lag, age)
+		return nil
+	}, lag, pending)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	go o.relay()
+	return o, nil
+}
+
+// Commit runs write and, only if it succeeds, queues the events of type
+// eventType that write made with newEvent, atomically with respect to other
+// commits. With a Store, write must store each event it makes in the
+// transaction of the write that produces it, so the write and its events
+// are never observed apart; an error storing one is write's error, and
+// fails the write.
+func (o *Outbox) Commit(ctx context.Context, eventType string, write func(newEvent NewEvent) error) error {
+	unlock := o.mu.Lock(ctx)
+	defer unlock()
+
+	var made []Event
+	err := write(func(payload any) (Event, error) {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return Event{}, err
+		}
+		o.seq = max(o.seq+1, time.Now().UnixNano())
+		e := Event{ID: fmt.Sprintf("evt_%d", o.seq), Type: eventType, Payload: b, CreatedAt: time.Now()}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			e.TraceID, e.SpanID = sc.TraceID().String(), sc.SpanID().String()
+		}
+		made = append(made, e)
+		return e, nil
+	})
+	if err != nil {
+		return err
+	}
+	o.pending = append(o.pending, made...)
+
+	span := trace.SpanFromContext(ctx)
+	for _, e := range made {
+		span.AddEvent("outbox.committed", trace.WithAttributes(
+			attribute.String("messaging.message.id", e.ID),
+			attribute.String("event.type", eventType),
+		))
+	}
+	return nil
+}
+
+// DeadLetters returns the events that were given up on.
+func (o *Outbox) DeadLetters() []Event {
+	unlock := o.mu.Lock(context.Background())
+	defer unlock()
+	return append([]Event(nil), o.dead...)
+}
+
+func (o *Outbox) relay() {
+	defer close(o.done)
+	ticker := time.NewTicker(o.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-ticker.C:
+			o.drain()
+		}
+	}
+}
+
+// drain publishes pending events in commit order. It stops at the first
+// failure so events are never published out of order; an event that keeps
+// failing is dead-lettered after MaxAttempts to unblock the ones behind it.
+func (o *Outbox) drain() {
+	ctx := context.Background()
+	for {
+		unlock := o.mu.Lock(ctx)
+		if len(o.pending) == 0 {
+			unlock()
+			return
+		}
+		e := o.pending[0]
+		unlock()
+
+		err := o.publish(e)
+
+		unlock = o.mu.Lock(ctx)
+		if err == nil {
+			o.pending = o.pending[1:]
+			unlock()
+			o.store(ctx, e.ID, func(st Store) error { return st.DeleteEvent(ctx, e.ID) })
+			continue
+		}
+		o.pending[0].Attempts++
+		failed := o.pending[0]
+		poisoned := failed.Attempts >= o.cfg.MaxAttempts
+		if poisoned {
+			o.dead = append(o.dead, failed)
+			o.pending = o.pending[1:]
+		}
+		unlock()
+		o.store(ctx, e.ID, func(st Store) error { return st.SaveEvent(ctx, failed, poisoned) })
+
+		if !poisoned {
+			return
+		}
+		o.poisoned.Add(ctx, 1, metric.WithAttributes(attribute.String("event.type", e.Type)))
+		telemetry.LoggerFor(ctx).Error("outbox event dead-lettered",
+			zap.String("event_id", e.ID),
+			zap.String("event_type", e.Type),
+			zap.Int("attempts", e.Attempts+1),
+			zap.Error(err))
+	}
+}
+
+// publish sends one event under a producer span that starts a new trace and
+// links to the request that committed it.
+func (o *Outbox) publish(e Event) error {
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.operation.type", "publish"),
+			attribute.String("messaging.message.id", e.ID),
+			attribute.String("event.type", e.Type),
+			attribute.Int("outbox.attempt", e.Attempts+1),
+			attribute.Float64("outbox.lag_seconds", time.Since(e.CreatedAt).Seconds()),
+		),
+	}
+	if link, ok := e.link(); ok {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: link}))
+	}
+	return telemetry.WithSpan(context.Background(), "outbox.publish "+e.Type, func(ctx context.Context) error {
+		e.Headers = make(map[string]string)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(e.Headers))
+
+		if err := o.publisher.Publish(ctx, e); err != nil {
+			return telemetry.WithFailureDomain(err, telemetry.DomainGateway)
+		}
+		trace.SpanFromContext(ctx).SetStatus(codes.Ok, "")
+		o.published.Add(ctx, 1, metric.WithAttributes(attribute.String("event.type", e.Type)))
+		return nil
+	}, opts...)
+}
+
+func (e Event) link() (trace.SpanContext, bool) {
+	traceID, err := trace.TraceIDFromHex(e.TraceID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	spanID, err := trace.SpanIDFromHex(e.SpanID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}), true
+}
+
+func (o *Outbox) load() error {
+	if o.cfg.Store == nil {
+		return nil
+	}
+	pending, dead, err := o.cfg.Store.LoadEvents(context.Background())
+	if err != nil {
+		return err
+	}
+	unlock := o.mu.Lock(context.Background())
+	defer unlock()
+	o.pending, o.dead = pending, dead
+	telemetry.Logger().Info("restored outbox", zap.Int("pending", len(o.pending)), zap.Int("dead", len(o.dead)))
+	return nil
+}
+
+// store records a change to the event with id in the Store, if there is
+// one. The relay has no caller to return a failure to, so it is logged: an
+// event that stays pending is published again after a restart, and
+// consumers already see events at least once.
+func (o *Outbox) store(ctx context.Context, id string, change func(Store) error) {
+	if o.cfg.Store == nil {
+		return
+	}
+	if err := change(o.cfg.Store); err != nil {
+		telemetry.LoggerFor(ctx).Error("persisting outbox event", zap.String("event_id", id), zap.Error(err))
+	}
+}
+
+// Close stops the relay and publishes the events still pending, until one
+// fails. Events left pending stay in the Store and are published after the
+// next New.
+func (o *Outbox) Close() {
+	close(o.stop)
+	<-o.done
+	o.drain()
+}
+
+// LogPublisher logs each event. It can serve as the outbox publisher when
+// there is no bus, or as a bus subscriber.
+type LogPublisher struct{}
+
+// Publish logs e.
+func (LogPublisher) Publish(ctx context.Context, e Event) error {
+	telemetry.LoggerFor(ctx).Info("event published",
+		zap.String("event_id", e.ID),
+		zap.String("event_type", e.Type),
+		zap.ByteString("payload", e.Payload))
+	return nil
+}
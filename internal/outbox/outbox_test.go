@@ -0,0 +1,254 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePublisher records what it publishes and fails the first failures
+// attempts at each event type in failing.
+type fakePublisher struct {
+	mu        sync.Mutex
+	failures  int
+	failing   map[string]bool
+	attempts  map[string]int
+	published []string
+}
+
+var errPublish = errors.New("publish failed")
+
+func (p *fakePublisher) Publish(_ context.Context, e Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failing[e.Type] {
+		if p.attempts == nil {
+			p.attempts = make(map[string]int)
+		}
+		p.attempts[e.ID]++
+		if p.failures < 0 || p.attempts[e.ID] <= p.failures {
+			return errPublish
+		}
+	}
+	p.published = append(p.published, e.Type)
+	return nil
+}
+
+func (p *fakePublisher) types() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.published)
+}
+
+// fakeStore keeps events by ID, as the payment database's outbox table
+// would.
+type fakeStore struct {
+	mu      sync.Mutex
+	pending []Event
+	events  map[string]Event
+	dead    map[string]bool
+}
+
+func (s *fakeStore) LoadEvents(context.Context) (pending, dead []Event, err error) {
+	return s.pending, nil, nil
+}
+
+func (s *fakeStore) SaveEvent(_ context.Context, e Event, dead bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[e.ID] = e
+	s.dead[e.ID] = dead
+	return nil
+}
+
+func (s *fakeStore) DeleteEvent(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.events, id)
+	return nil
+}
+
+func newTestOutbox(t *testing.T, cfg Config, p Publisher) *Outbox {
+	t.Helper()
+	// The relay never ticks; tests drain by hand.
+	cfg.PollInterval = time.Hour
+	o, err := New(cfg, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// commit commits one event of each type, each storing itself in store if
+// not nil.
+func commit(t *testing.T, o *Outbox, store *fakeStore, types ...string) []Event {
+	t.Helper()
+	var made []Event
+	for _, typ := range types {
+		err := o.Commit(context.Background(), typ, func(newEvent NewEvent) error {
+			e, err := newEvent(map[string]string{"type": typ})
+			if err != nil {
+				return err
+			}
+			if store != nil {
+				store.SaveEvent(context.Background(), e, false)
+			}
+			made = append(made, e)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return made
+}
+
+func TestCommit(t *testing.T) {
+	errWrite := errors.New("write failed")
+	for _, tc := range []struct {
+		name     string
+		payloads []any
+		writeErr error
+		fails    bool
+		queued   int
+	}{
+		{name: "one event", payloads: []any{"a"}, queued: 1},
+		{name: "two events", payloads: []any{"a", "b"}, queued: 2},
+		{name: "no event", queued: 0},
+		{name: "write fails", payloads: []any{"a"}, writeErr: errWrite, fails: true},
+		{name: "payload fails to marshal", payloads: []any{"a", make(chan int)}, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newTestOutbox(t, Config{}, &fakePublisher{})
+			defer o.Close()
+
+			err := o.Commit(context.Background(), "test.event", func(newEvent NewEvent) error {
+				for _, payload := range tc.payloads {
+					if _, err := newEvent(payload); err != nil {
+						return err
+					}
+				}
+				return tc.writeErr
+			})
+			if (err != nil) != tc.fails || (tc.writeErr != nil && !errors.Is(err, tc.writeErr)) {
+				t.Fatalf("Commit() = %v, want an error %v", err, tc.fails)
+			}
+			unlock := o.mu.Lock(context.Background())
+			queued := slices.Clone(o.pending)
+			unlock()
+			if len(queued) != tc.queued {
+				t.Fatalf("%d events queued, want %d", len(queued), tc.queued)
+			}
+			ids := make(map[string]bool)
+			for _, e := range queued {
+				if e.Type != "test.event" || ids[e.ID] {
+					t.Errorf("queued %s %s, want unique IDs of test.event", e.Type, e.ID)
+				}
+				ids[e.ID] = true
+			}
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		failures int // -1 fails every attempt
+		drains   int
+		// published, pending and dead are the event types, in order.
+		published []string
+		pending   []string
+		dead      []string
+	}{
+		{
+			name:      "published",
+			drains:    1,
+			published: []string{"bad", "good"},
+		},
+		{
+			name:     "failure blocks the events behind it",
+			failures: 1,
+			drains:   1,
+			pending:  []string{"bad", "good"},
+		},
+		{
+			name:      "retried",
+			failures:  1,
+			drains:    2,
+			published: []string{"bad", "good"},
+		},
+		{
+			name:      "dead-lettered after MaxAttempts",
+			failures:  -1,
+			drains:    3,
+			published: []string{"good"},
+			dead:      []string{"bad"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStore{events: make(map[string]Event), dead: make(map[string]bool)}
+			p := &fakePublisher{failures: tc.failures, failing: map[string]bool{"bad": tc.failures != 0}}
+			o := newTestOutbox(t, Config{MaxAttempts: 3, Store: store}, p)
+			made := commit(t, o, store, "bad", "good")
+			for range tc.drains {
+				o.drain()
+			}
+
+			if got := p.types(); !slices.Equal(got, tc.published) {
+				t.Errorf("published %v, want %v", got, tc.published)
+			}
+			unlock := o.mu.Lock(context.Background())
+			var pending []string
+			for _, e := range o.pending {
+				pending = append(pending, e.Type)
+			}
+			unlock()
+			if !slices.Equal(pending, tc.pending) {
+				t.Errorf("pending %v, want %v", pending, tc.pending)
+			}
+			var dead []string
+			for _, e := range o.DeadLetters() {
+				dead = append(dead, e.Type)
+			}
+			if !slices.Equal(dead, tc.dead) {
+				t.Errorf("dead letters %v, want %v", dead, tc.dead)
+			}
+
+			// The store keeps exactly the events not yet published, with
+			// their attempts and whether they are dead.
+			for _, e := range made {
+				stored, ok := store.events[e.ID]
+				if want := !slices.Contains(tc.published, e.Type); ok != want {
+					t.Errorf("%s stored = %v, want %v", e.Type, ok, want)
+					continue
+				}
+				if ok && e.Type == "bad" {
+					if stored.Attempts != tc.drains || store.dead[e.ID] != (tc.dead != nil) {
+						t.Errorf("stored bad event has %d attempts, dead %v; want %d, %v",
+							stored.Attempts, store.dead[e.ID], tc.drains, tc.dead != nil)
+					}
+				}
+			}
+			o.Close()
+		})
+	}
+}
+
+func TestNewRestoresAndCloseDrains(t *testing.T) {
+	store := &fakeStore{
+		pending: []Event{{ID: "evt_1", Type: "restored", CreatedAt: time.Now()}},
+		events:  make(map[string]Event),
+		dead:    make(map[string]bool),
+	}
+	p := &fakePublisher{}
+	o := newTestOutbox(t, Config{Store: store}, p)
+	commit(t, o, nil, "committed")
+
+	o.Close()
+	if got, want := p.types(), []string{"restored", "committed"}; !slices.Equal(got, want) {
+		t.Fatalf("published %v on Close, want %v", got, want)
+	}
+}
@@ -0,0 +1,161 @@
+// Package paymentmetrics records business metrics for payments: the
+// authorization outcome and rate, and settlement latency. A Recorder can
+// measure inline, called from the request path, or consume payment events
+// from the bus, decoupling measurement from the code that does the work.
+// Both write the same instruments, told apart by measurement.source, so the
+// two approaches can be compared side by side.
+package paymentmetrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"payment-service/internal/outbox"
+	"payment-service/internal/telemetry"
+)
+
+// Measurement sources.
+const (
+	SourceInline = "inline"
+	SourceEvents = "events"
+)
+
+// Payment event types. The consumer derives metrics from the first three,
+// and ignores status changes and refunds.
+const (
+	EventCreated       = "payment.created"
+	EventDeclined      = "payment.declined"
+	EventSettled       = "payment.settled"
+	EventStatusChanged = "payment.status_changed"
+	EventRefunded      = "payment.refunded"
+)
+
+// ratioWindow is the number of recent decisions the authorization ratio is
+// computed over.
+const ratioWindow = 1000
+
+// Recorder records payment metrics for one measurement source.
+type Recorder struct {
+	source attribute.KeyValue
+
+	authorizations metric.Int64Counter
+	settleLatency  metric.Float64Histogram
+
+	mu       sync.Mutex
+	recent   [ratioWindow]bool
+	n, next  int
+	approved int
+}
+
+// New creates a Recorder for source.
+func New(source string) (*Recorder, error) {
+	r := &Recorder{source: attribute.String("measurement.source", source)}
+
+	meter := telemetry.Meter()
+	var err error
+	r.authorizations, err = meter.Int64Counter(
+		"payment_authorizations_total",
+		metric.WithDescription("Number of payment authorization decisions"),
+		metric.WithUnit("{payment}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	r.settleLatency, err = meter.Float64Histogram(
+		"payment_settle_latency_seconds",
+		metric.WithDescription("Time from a payment being created to it settling"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter.Float64ObservableGauge(
+		"payment_authorization_ratio",
+		metric.WithDescription("Share of the last 1000 authorization decisions that approved the payment"),
+		metric.WithUnit("1"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.n > 0 {
+				o.Observe(float64(r.approved)/float64(r.n), metric.WithAttributes(r.source))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Authorization records an authorization decision.
+func (r *Recorder) Authorization(ctx context.Context, approved bool) {
+	outcome := "declined"
+	if approved {
+		outcome = "approved"
+	}
+	r.authorizations.Add(ctx, 1, metric.WithAttributes(r.source, attribute.String("outcome", outcome)))
+	// The ratio gauge is observed from the window rather than recorded, so
+	// the dry-run filter on the counter can't apply to it.
+	if telemetry.DryRun(ctx) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n == ratioWindow {
+		if r.recent[r.next] {
+			r.approved--
+		}
+	} else {
+		r.n++
+	}
+	r.recent[r.next] = approved
+	if approved {
+		r.approved++
+	}
+	r.next = (r.next + 1) % ratioWindow
+}
+
+// Settled records the settlement latency of a payment.
+func (r *Recorder) Settled(ctx context.Context, latency time.Duration) {
+	r.settleLatency.Record(ctx, latency.Seconds(), metric.WithAttributes(r.source))
+}
+
+// payment is the part of an event payload the consumer reads.
+type payment struct {
+	Date      string `json:"date"`
+	SettledAt string `json:"settled_at"`
+}
+
+// Consume derives metrics from a payment event. It has the signature of a
+// bus handler.
+func (r *Recorder) Consume(ctx context.Context, e outbox.Event) error {
+	switch e.Type {
+	case EventCreated:
+		r.Authorization(ctx, true)
+	case EventDeclined:
+		r.Authorization(ctx, false)
+	case EventSettled:
+		var p payment
+		if err := json.Unmarshal(e.Payload, &p); err != nil {
+			return fmt.Errorf("decode %s: %w", e.ID, err)
+		}
+		created, err := time.Parse(time.RFC3339, p.Date)
+		if err != nil {
+			return fmt.Errorf("%s: created date: %w", e.ID, err)
+		}
+		settled, err := time.Parse(time.RFC3339Nano, p.SettledAt)
+		if err != nil {
+			return fmt.Errorf("%s: settled_at: %w", e.ID, err)
+		}
+		r.Settled(ctx, settled.Sub(created))
+	}
+	return nil
+}
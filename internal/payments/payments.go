@@ -0,0 +1,89 @@
+// Package payments starts spans for work on a payment. StartSpan takes the
+// payment itself, so every payment span carries the same business attributes
+// under the same keys, and picks the span kind from the operation instead of
+// leaving it to each call site.
+package payments
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+	"payment-service/internal/tenant"
+)
+
+// DefaultCurrency is the currency of payments that don't specify one.
+const DefaultCurrency = "USD"
+
+// Payment holds the business attributes recorded on payment spans.
+type Payment struct {
+	// ID is empty until the payment is stored.
+	ID       string
+	Amount   float64
+	Currency string
+}
+
+// Attributes returns the standard attributes describing p. payment.id is
+// omitted until the payment has one.
+func (p Payment) Attributes() []attribute.KeyValue {
+	currency := p.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	attrs := []attribute.KeyValue{
+		attribute.Float64("payment.amount", p.Amount),
+		attribute.String("payment.currency", currency),
+	}
+	if p.ID != "" {
+		attrs = append(attrs, attribute.String("payment.id", p.ID))
+	}
+	return attrs
+}
+
+// Operations with a fixed span kind. Other operation names get
+// trace.SpanKindInternal.
+const (
+	OpFraudCheck   = "fraud.check"
+	OpFraudAttempt = "fraud.check attempt"
+	OpProcess      = "payment.process"
+	OpSettle       = "payment.settle"
+	OpRefund       = "payment.refund"
+)
+
+var kinds = map[string]trace.SpanKind{
+	// The check itself only decides on hedging; each attempt is a call to
+	// the fraud service.
+	OpFraudCheck:   trace.SpanKindInternal,
+	OpFraudAttempt: trace.SpanKindClient,
+	// Processing, settlement and refunds run in the service's own workers,
+	// timers and handlers.
+	OpProcess: trace.SpanKindInternal,
+	OpSettle:  trace.SpanKindInternal,
+	OpRefund:  trace.SpanKindInternal,
+}
+
+// StartSpan starts a span named op describing work on p. opts are applied
+// after the defaults, so callers can add attributes or links, or override the
+// kind. Spans of work done for a tenant also carry tenant.id and
+// tenant.plan. Client spans count as downstream calls in the request's cost
+// score.
+func StartSpan(ctx context.Context, op string, p Payment, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	kind, ok := kinds[op]
+	if !ok {
+		kind = trace.SpanKindInternal
+	}
+	defaults := []trace.SpanStartOption{
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(p.Attributes()...),
+	}
+	if _, ok := tenant.FromContext(ctx); ok {
+		defaults = append(defaults, trace.WithAttributes(tenant.Attributes(ctx)...))
+	}
+	opts = append(defaults, opts...)
+	if cfg := trace.NewSpanStartConfig(opts...); cfg.SpanKind() == trace.SpanKindClient {
+		telemetry.CountDownstreamCall(ctx)
+	}
+	return telemetry.Tracer().Start(ctx, op, opts...)
+}
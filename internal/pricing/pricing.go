@@ -0,0 +1,137 @@
+// Package pricing quotes the processing fee and settlement conversion of a
+// payment, with fees set by the tenant's plan. Rates are static,
+// illustrative values: enough for the quote to be traced as part of a
+// payment's decision path, not a real FX source.
+package pricing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	currencies "payment-service/internal/currency"
+	"payment-service/internal/payments"
+	"payment-service/internal/telemetry"
+	"payment-service/internal/tenant"
+)
+
+// SettlementCurrency is the currency payments settle in.
+const SettlementCurrency = "USD"
+
+// fee is a percentage of the amount plus a fixed part in the settlement
+// currency.
+type fee struct {
+	rate  float64
+	fixed float64
+}
+
+// fees are the fees of each tenant plan. Payments without a tenant pay the
+// pro fee, the service's standard rate.
+var fees = map[tenant.Plan]fee{
+	tenant.PlanFree:       {rate: 0.034, fixed: 0.30},
+	tenant.PlanPro:        {rate: 0.029, fixed: 0.30},
+	tenant.PlanEnterprise: {rate: 0.022, fixed: 0.10},
+}
+
+// ErrUnsupportedCurrency is returned for currencies without a rate.
+var ErrUnsupportedCurrency = telemetry.WithFailureDomain(errors.New("pricing: unsupported currency"), telemetry.DomainClient)
+
+// usdRates is the value of one unit of each currency in USD. Every
+// currency is in the ISO 4217 table, which gives its minor units.
+var usdRates = map[string]float64{
+	"USD": 1,
+	"EUR": 1.08,
+	"GBP": 1.27,
+	"JPY": 0.0067,
+	"CAD": 0.73,
+	"AUD": 0.66,
+}
+
+// Quote is the priced form of a payment.
+type Quote struct {
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+	// Plan is the tenant plan the fee was charged at.
+	Plan tenant.Plan `json:"plan"`
+	// Fee is charged in the payment currency.
+	Fee float64 `json:"fee"`
+	// FXRate converts the payment currency to the settlement currency.
+	FXRate             float64 `json:"fx_rate"`
+	SettlementAmount   float64 `json:"settlement_amount"`
+	SettlementCurrency string  `json:"settlement_currency"`
+}
+
+// Supported reports whether payments in currency can be priced. The empty
+// currency means payments.DefaultCurrency.
+func Supported(currency string) bool {
+	if currency == "" {
+		currency = payments.DefaultCurrency
+	}
+	_, ok := usdRates[currency]
+	return ok
+}
+
+// SettlementValue converts amount in currency to the settlement currency at
+// the quote rate, without fees. It reports false for unsupported currencies.
+func SettlementValue(amount float64, currency string) (float64, bool) {
+	if currency == "" {
+		currency = payments.DefaultCurrency
+	}
+	rate, ok := usdRates[currency]
+	if !ok {
+		return 0, false
+	}
+	return amount * rate / usdRates[SettlementCurrency], true
+}
+
+// QuotePayment prices p, at the fee of the plan of the tenant in ctx, under
+// a payment.quote span.
+func QuotePayment(ctx context.Context, p payments.Payment) (Quote, error) {
+	_, span := payments.StartSpan(ctx, "payment.quote", p)
+	defer span.End()
+
+	currency := p.Currency
+	if currency == "" {
+		currency = payments.DefaultCurrency
+	}
+	rate, ok := usdRates[currency]
+	if !ok {
+		err := fmt.Errorf("%w %q", ErrUnsupportedCurrency, currency)
+		telemetry.SpanError(span, err)
+		return Quote{}, err
+	}
+
+	plan := tenant.PlanOf(ctx)
+	f, ok := fees[plan]
+	if !ok {
+		f = fees[tenant.PlanPro]
+	}
+	q := Quote{
+		Amount:             p.Amount,
+		Currency:           currency,
+		Plan:               plan,
+		Fee:                round(p.Amount*f.rate+f.fixed/rate, currency),
+		FXRate:             rate / usdRates[SettlementCurrency],
+		SettlementCurrency: SettlementCurrency,
+	}
+	q.SettlementAmount = round((q.Amount-q.Fee)*q.FXRate, SettlementCurrency)
+
+	span.SetAttributes(
+		attribute.Float64("payment.fee", q.Fee),
+		attribute.Float64("payment.fx_rate", q.FXRate),
+		attribute.Float64("payment.settlement_amount", q.SettlementAmount),
+	)
+	return q, nil
+}
+
+func round(v float64, currency string) float64 {
+	d := 2
+	if c, ok := currencies.Lookup(currency); ok {
+		d = c.MinorUnits
+	}
+	scale := math.Pow10(d)
+	return math.Round(v*scale) / scale
+}
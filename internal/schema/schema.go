@@ -0,0 +1,259 @@
+// Package schema validates request and response bodies against versioned
+// JSON Schema files, kept in schemas/ and named <name>.<version>.json, and
+// records every violation as a span event and in metrics. Contract drift
+// between the service and its clients then shows up in telemetry instead of
+// in a client's bug report.
+package schema
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+//go:embed schemas/*.json
+var files embed.FS
+
+// Validation modes.
+const (
+	// ModeOff skips validation.
+	ModeOff = "off"
+	// ModeReport records violations and lets requests through.
+	ModeReport = "report"
+	// ModeEnforce also rejects invalid requests with 400. Responses can't be
+	// taken back, so their violations are only recorded.
+	ModeEnforce = "enforce"
+)
+
+// maxBody is the largest body validated; larger bodies are skipped.
+const maxBody = 1 << 20
+
+// ErrInvalidRequest is recorded for requests rejected in enforce mode.
+var ErrInvalidRequest = telemetry.WithFailureDomain(errors.New("schema: request body does not match its schema"), telemetry.DomainClient)
+
+// Schema is one loaded schema file.
+type Schema struct {
+	// ID is the schema's $id, <name>.<version>.
+	ID      string
+	Name    string
+	Version string
+
+	root *node
+}
+
+// Validator checks bodies against the embedded schemas.
+type Validator struct {
+	mode    string
+	schemas map[string]*Schema
+}
+
+// New loads the embedded schemas. mode is ModeReport or ModeEnforce.
+func New(mode string) (*Validator, error) {
+	if mode != ModeReport && mode != ModeEnforce {
+		return nil, fmt.Errorf("schema: unknown mode %q", mode)
+	}
+	v := &Validator{mode: mode, schemas: make(map[string]*Schema)}
+
+	paths, err := fs.Glob(files, "schemas/*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		b, err := files.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var root node
+		if err := json.Unmarshal(b, &root); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", path, err)
+		}
+		if err := root.compile(); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", path, err)
+		}
+		name, version, ok := strings.Cut(root.ID, ".")
+		if !ok {
+			return nil, fmt.Errorf("schema %s: $id %q is not <name>.<version>", path, root.ID)
+		}
+		v.schemas[root.ID] = &Schema{ID: root.ID, Name: name, Version: version, root: &root}
+	}
+	return v, nil
+}
+
+// Validate checks body against the schema id.
+func (v *Validator) Validate(id string, body []byte) ([]Violation, error) {
+	s, ok := v.schemas[id]
+	if !ok {
+		return nil, fmt.Errorf("schema: unknown schema %q", id)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return []Violation{{Keyword: "json", Message: err.Error()}}, nil
+	}
+	return s.root.validate(v, doc, "", nil), nil
+}
+
+// Rule names the schemas of one method on a route.
+type Rule struct {
+	// Request is the schema of the request body; empty skips it.
+	Request string
+	// Responses maps response status codes to the schema of their body.
+	Responses map[int]string
+}
+
+// Rules holds the rule of each method of a route.
+type Rules map[string]Rule
+
+// Middleware validates the bodies of requests to next, and of its responses,
+// against the rule for the request's method. A nil Validator passes every
+// request through.
+func (v *Validator) Middleware(rules Rules, next http.Handler) http.Handler {
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := rules[r.Method]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rule.Request != "" && r.Body != nil {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if err == nil && len(body) <= maxBody {
+				violations := v.check(r, rule.Request, "request", body)
+				if len(violations) > 0 && v.mode == ModeEnforce {
+					telemetry.RecordError(r.Context(), ErrInvalidRequest)
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]any{
+						"error":      "Request body does not match schema " + rule.Request,
+						"violations": violations,
+					})
+					return
+				}
+			}
+		}
+
+		if len(rule.Responses) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cw, r)
+		if id, ok := rule.Responses[cw.status]; ok && !cw.truncated {
+			v.check(r, id, "response", cw.body.Bytes())
+		}
+	})
+}
+
+// check validates body and records the result on the request's span and in
+// the schema metrics.
+func (v *Validator) check(r *http.Request, id, direction string, body []byte) []Violation {
+	ctx := r.Context()
+	violations, err := v.Validate(id, body)
+	if err != nil {
+		telemetry.Logger().Error(err.Error())
+		return nil
+	}
+
+	s := v.schemas[id]
+	attrs := []attribute.KeyValue{
+		attribute.String("schema.name", s.Name),
+		attribute.String("schema.version", s.Version),
+		attribute.String("schema.direction", direction),
+	}
+	result := "valid"
+	if len(violations) > 0 {
+		result = "invalid"
+	}
+	inst := instruments()
+	inst.validations.Add(ctx, 1, metric.WithAttributes(append(attrs, attribute.String("result", result))...))
+
+	span := trace.SpanFromContext(ctx)
+	for _, vi := range violations {
+		keyword := attribute.String("schema.keyword", vi.Keyword)
+		inst.violations.Add(ctx, 1, metric.WithAttributes(append(attrs, keyword)...))
+		span.AddEvent("schema.violation", trace.WithAttributes(append(attrs,
+			keyword,
+			attribute.String("schema.path", vi.Path),
+			attribute.String("schema.message", vi.Message),
+		)...))
+	}
+	return violations
+}
+
+// captureWriter keeps a copy of the response body for validation.
+type captureWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	truncated   bool
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	if w.body.Len()+len(b) > maxBody {
+		w.truncated = true
+	} else if !w.truncated {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type schemaInstruments struct {
+	validations metric.Int64Counter
+	violations  metric.Int64Counter
+}
+
+// instruments creates the counters on first use, after telemetry.Setup.
+var instruments = sync.OnceValue(func() schemaInstruments {
+	meter := telemetry.Meter()
+	var inst schemaInstruments
+	var err error
+	inst.validations, err = meter.Int64Counter(
+		"schema_validations_total",
+		metric.WithDescription("Number of bodies validated against a JSON schema, by result"),
+		metric.WithUnit("{body}"),
+	)
+	if err != nil {
+		inst.validations, _ = meter.Int64Counter("schema_validations_total")
+	}
+	inst.violations, err = meter.Int64Counter(
+		"schema_violations_total",
+		metric.WithDescription("Number of JSON schema violations, by failing keyword"),
+		metric.WithUnit("{violation}"),
+	)
+	if err != nil {
+		inst.violations, _ = meter.Int64Counter("schema_violations_total")
+	}
+	return inst
+})
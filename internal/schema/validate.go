@@ -0,0 +1,209 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"unicode/utf8"
+)
+
+// node is the subset of JSON Schema the service's schemas use: type,
+// required, properties, additionalProperties, items, enum, minimum,
+// exclusiveMinimum, maximum, minLength, maxLength, pattern and $ref to
+// another registered schema by $id.
+type node struct {
+	ID                   string           `json:"$id"`
+	Ref                  string           `json:"$ref"`
+	Type                 types            `json:"type"`
+	Required             []string         `json:"required"`
+	Properties           map[string]*node `json:"properties"`
+	AdditionalProperties *bool            `json:"additionalProperties"`
+	Items                *node            `json:"items"`
+	Enum                 []any            `json:"enum"`
+	Minimum              *float64         `json:"minimum"`
+	ExclusiveMinimum     *float64         `json:"exclusiveMinimum"`
+	Maximum              *float64         `json:"maximum"`
+	MinLength            *int             `json:"minLength"`
+	MaxLength            *int             `json:"maxLength"`
+	Pattern              string           `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+// types is the type keyword, a single type name or a list of them.
+type types []string
+
+func (t *types) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = types{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*t = many
+	return nil
+}
+
+// compile prepares n and its children for validation.
+func (n *node) compile() error {
+	if n.Pattern != "" {
+		re, err := regexp.Compile(n.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", n.Pattern, err)
+		}
+		n.pattern = re
+	}
+	for _, child := range n.Properties {
+		if err := child.compile(); err != nil {
+			return err
+		}
+	}
+	if n.Items != nil {
+		return n.Items.compile()
+	}
+	return nil
+}
+
+// Violation is one way a document breaks its schema.
+type Violation struct {
+	// Path is the JSON pointer of the offending value, "" for the root.
+	Path string `json:"path"`
+	// Keyword is the schema keyword that failed, e.g. "required".
+	Keyword string `json:"keyword"`
+	Message string `json:"message"`
+}
+
+// validate appends the violations of v, a value decoded with UseNumber, to
+// out.
+func (n *node) validate(reg *Validator, v any, path string, out []Violation) []Violation {
+	add := func(keyword, format string, args ...any) {
+		out = append(out, Violation{Path: path, Keyword: keyword, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n.Ref != "" {
+		target, ok := reg.schemas[n.Ref]
+		if !ok {
+			add("$ref", "unknown schema %q", n.Ref)
+			return out
+		}
+		return target.root.validate(reg, v, path, out)
+	}
+
+	if len(n.Type) > 0 && !slices.ContainsFunc(n.Type, func(t string) bool { return isType(v, t) }) {
+		add("type", "expected %v, got %s", []string(n.Type), typeOf(v))
+		return out
+	}
+	if len(n.Enum) > 0 && !slices.ContainsFunc(n.Enum, func(e any) bool { return equal(e, v) }) {
+		add("enum", "%v is not one of %v", v, n.Enum)
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range n.Required {
+			if _, ok := v[name]; !ok {
+				add("required", "missing property %q", name)
+			}
+		}
+		for _, name := range sortedKeys(v) {
+			child, ok := n.Properties[name]
+			if !ok {
+				if n.AdditionalProperties != nil && !*n.AdditionalProperties {
+					out = append(out, Violation{Path: path + "/" + name, Keyword: "additionalProperties", Message: fmt.Sprintf("property %q is not allowed", name)})
+				}
+				continue
+			}
+			out = child.validate(reg, v[name], path+"/"+name, out)
+		}
+	case []any:
+		if n.Items != nil {
+			for i, item := range v {
+				out = n.Items.validate(reg, item, path+"/"+strconv.Itoa(i), out)
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if n.Minimum != nil && f < *n.Minimum {
+			add("minimum", "%v is less than %v", f, *n.Minimum)
+		}
+		if n.ExclusiveMinimum != nil && f <= *n.ExclusiveMinimum {
+			add("exclusiveMinimum", "%v is not greater than %v", f, *n.ExclusiveMinimum)
+		}
+		if n.Maximum != nil && f > *n.Maximum {
+			add("maximum", "%v is greater than %v", f, *n.Maximum)
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n.MinLength != nil && length < *n.MinLength {
+			add("minLength", "length %d is less than %d", length, *n.MinLength)
+		}
+		if n.MaxLength != nil && length > *n.MaxLength {
+			add("maxLength", "length %d is greater than %d", length, *n.MaxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(v) {
+			add("pattern", "%q does not match %q", v, n.Pattern)
+		}
+	}
+	return out
+}
+
+func isType(v any, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	default:
+		return typeOf(v) == t
+	}
+}
+
+func typeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// equal compares an enum value from a schema, decoded without UseNumber,
+// with a document value.
+func equal(e, v any) bool {
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		ef, isNum := e.(float64)
+		return err == nil && isNum && f == ef
+	}
+	return reflect.DeepEqual(e, v)
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,258 @@
+// Package settlement simulates the delay between capturing a payment and the
+// funds settling. Each captured payment gets a timer with a randomized delay;
+// timers are persisted to a state file so they survive restarts, which makes
+// settlement latency a long-horizon signal worth graphing.
+package settlement
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/payments"
+	"payment-service/internal/telemetry"
+)
+
+// Config controls settlement delays and timer persistence.
+type Config struct {
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// StatePath is the file timers are persisted to. Empty keeps timers in
+	// memory only.
+	StatePath string
+}
+
+// SettleFunc marks a payment as settled.
+type SettleFunc func(ctx context.Context, paymentID string) error
+
+// timer is the persisted form of a pending settlement. The span context of
+// the request that scheduled it is kept so the settlement span can link back
+// to the original trace, even after a restart.
+type timer struct {
+	PaymentID string    `json:"payment_id"`
+	Amount    float64   `json:"amount"`
+	Currency  string    `json:"currency,omitempty"`
+	Scheduled time.Time `json:"scheduled"`
+	Due       time.Time `json:"due"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	SpanID    string    `json:"span_id,omitempty"`
+
+	t *time.Timer
+}
+
+// Scheduler owns the pending settlement timers.
+type Scheduler struct {
+	cfg    Config
+	settle SettleFunc
+
+	mu     sync.Mutex
+	timers map[string]*timer
+	closed bool
+
+	latency metric.Float64Histogram
+	fired   metric.Int64Counter
+}
+
+// New creates a Scheduler and re-arms any timers persisted by a previous run.
+// Timers that fell due while the service was down fire immediately.
+func New(cfg Config, settle SettleFunc) (*Scheduler, error) {
+	if cfg.MaxDelay < cfg.MinDelay {
+		cfg.MaxDelay = cfg.MinDelay
+	}
+	s := &Scheduler{cfg: cfg, settle: settle, timers: make(map[string]*timer)}
+
+	meter := telemetry.Meter()
+	var err error
+	s.latency, err = meter.Float64Histogram(
+		"payment_settlement_latency_seconds",
+		metric.WithDescription("Time from scheduling a settlement to it firing, including downtime"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.fired, err = meter.Int64Counter(
+		"payment_settlements_total",
+		metric.WithDescription("Number of settlement timers fired"),
+		metric.WithUnit("{settlement}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter.Int64ObservableGauge(
+		"payments_pending_settlement",
+		metric.WithDescription("Number of captured payments waiting to settle"),
+		metric.WithUnit("{payment}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			o.Observe(int64(len(s.timers)))
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Schedule arms a settlement timer for p with a random delay between MinDelay
+// and MaxDelay.
+func (s *Scheduler) Schedule(ctx context.Context, p payments.Payment) {
+	delay := s.cfg.MinDelay
+	if spread := s.cfg.MaxDelay - s.cfg.MinDelay; spread > 0 {
+		delay += rand.N(spread)
+	}
+
+	now := time.Now()
+	t := &timer{PaymentID: p.ID, Amount: p.Amount, Currency: p.Currency, Scheduled: now, Due: now.Add(delay)}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		t.TraceID, t.SpanID = sc.TraceID().String(), sc.SpanID().String()
+	}
+	trace.SpanFromContext(ctx).AddEvent("settlement.scheduled", trace.WithAttributes(
+		attribute.String("payment.id", p.ID),
+		attribute.Float64("settlement.delay_seconds", delay.Seconds()),
+	))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if old, ok := s.timers[p.ID]; ok {
+		old.t.Stop()
+	}
+	s.arm(t)
+	s.persist()
+}
+
+// arm starts t's timer. s.mu must be held.
+func (s *Scheduler) arm(t *timer) {
+	s.timers[t.PaymentID] = t
+	t.t = time.AfterFunc(time.Until(t.Due), func() { s.fire(t) })
+}
+
+func (s *Scheduler) fire(t *timer) {
+	s.mu.Lock()
+	if s.closed || s.timers[t.PaymentID] != t {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.timers, t.PaymentID)
+	s.persist()
+	s.mu.Unlock()
+
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithAttributes(
+			attribute.Float64("settlement.overdue_seconds", time.Since(t.Due).Seconds()),
+		),
+	}
+	if link, ok := t.link(); ok {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: link}))
+	}
+	p := payments.Payment{ID: t.PaymentID, Amount: t.Amount, Currency: t.Currency}
+	ctx, span := payments.StartSpan(context.Background(), payments.OpSettle, p, opts...)
+	defer span.End()
+
+	outcome := "settled"
+	if err := s.settle(ctx, t.PaymentID); err != nil {
+		outcome = "failed"
+		telemetry.RecordError(ctx, err)
+		telemetry.LoggerFor(ctx).Warn("settlement failed", zap.String("payment_id", t.PaymentID), zap.Error(err))
+	}
+
+	attrs := metric.WithAttributes(attribute.String("outcome", outcome))
+	s.latency.Record(ctx, time.Since(t.Scheduled).Seconds(), attrs)
+	s.fired.Add(ctx, 1, attrs)
+}
+
+func (t *timer) link() (trace.SpanContext, bool) {
+	traceID, err := trace.TraceIDFromHex(t.TraceID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	spanID, err := trace.SpanIDFromHex(t.SpanID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}), true
+}
+
+func (s *Scheduler) load() error {
+	if s.cfg.StatePath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.cfg.StatePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var timers []*timer
+	if err := json.Unmarshal(b, &timers); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range timers {
+		s.arm(t)
+	}
+	telemetry.Logger().Info("restored settlement timers", zap.Int("count", len(timers)))
+	return nil
+}
+
+// persist writes all pending timers to the state file. s.mu must be held.
+func (s *Scheduler) persist() {
+	if s.cfg.StatePath == "" {
+		return
+	}
+
+	timers := make([]*timer, 0, len(s.timers))
+	for _, t := range s.timers {
+		timers = append(timers, t)
+	}
+	b, err := json.Marshal(timers)
+	if err == nil {
+		tmp := s.cfg.StatePath + ".tmp"
+		if err = os.WriteFile(tmp, b, 0o600); err == nil {
+			err = os.Rename(tmp, s.cfg.StatePath)
+		}
+	}
+	if err != nil {
+		telemetry.Logger().Error("persisting settlement timers", zap.Error(err))
+	}
+}
+
+// Close stops all timers. Pending timers stay in the state file and are
+// re-armed by the next New.
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, t := range s.timers {
+		t.t.Stop()
+	}
+}
@@ -0,0 +1,194 @@
+// Package spantree snapshots the shape of traces for tests. It writes the
+// spans a test captured as indented trees of names, kinds, statuses and the
+// attributes the test selects, and compares them with a golden file, so a
+// change that adds, drops or moves a span fails the test even if the
+// response it checks didn't change. Run the tests with -update to rewrite
+// the golden files after an intended change, and review their diff.
+//
+// IDs and timestamps differ from run to run and aren't written: traces are
+// numbered, links name the span they point to, and in attribute values
+// trace IDs are replaced with the trace's number, span IDs with <span-id>
+// and timestamps with <time>.
+package spantree
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden span trees instead of comparing with them")
+
+// Options select what Render writes of each span.
+type Options struct {
+	// Attributes are the keys of the attributes written, in this order,
+	// when a span has them. Other attributes are left out, as most hold
+	// values such as amounts or durations that a refactor doesn't change
+	// the meaning of.
+	Attributes []attribute.Key
+	// Events writes the names of span events under their span.
+	Events bool
+	// Normalize, if set, rewrites attribute values after IDs and timestamps
+	// were replaced, such as to hide generated payment IDs.
+	Normalize func(key attribute.Key, value string) string
+}
+
+var (
+	hexID     = regexp.MustCompile(`\b[0-9a-f]{32}\b|\b[0-9a-f]{16}\b`)
+	timestamp = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`)
+)
+
+// Render writes spans as one tree per trace. Spans whose parent wasn't
+// captured are written as roots of their trace. Traces are numbered in the
+// order their first span started, and siblings are sorted by their
+// subtrees, since concurrent spans don't start or end in a stable order.
+func Render(spans []sdktrace.ReadOnlySpan, opts Options) string {
+	sorted := slices.Clone(spans)
+	slices.SortStableFunc(sorted, func(a, b sdktrace.ReadOnlySpan) int {
+		return a.StartTime().Compare(b.StartTime())
+	})
+	r := renderer{
+		opts:     opts,
+		traces:   map[trace.TraceID]int{},
+		names:    map[trace.SpanID]string{},
+		children: map[trace.SpanID][]sdktrace.ReadOnlySpan{},
+	}
+	for _, s := range sorted {
+		sc := s.SpanContext()
+		if _, ok := r.traces[sc.TraceID()]; !ok {
+			r.traces[sc.TraceID()] = len(r.traces) + 1
+		}
+		r.names[sc.SpanID()] = s.Name()
+	}
+	roots := map[int][]string{}
+	for _, s := range sorted {
+		if _, ok := r.names[s.Parent().SpanID()]; ok && s.Parent().IsValid() {
+			r.children[s.Parent().SpanID()] = append(r.children[s.Parent().SpanID()], s)
+		}
+	}
+	for _, s := range sorted {
+		if _, ok := r.names[s.Parent().SpanID()]; ok && s.Parent().IsValid() {
+			continue
+		}
+		t := r.traces[s.SpanContext().TraceID()]
+		roots[t] = append(roots[t], r.subtree(s, 1))
+	}
+
+	var b strings.Builder
+	for t := 1; t <= len(r.traces); t++ {
+		if t > 1 {
+			b.WriteByte('\n')
+		}
+		fmt.Fprintf(&b, "trace%d\n", t)
+		slices.Sort(roots[t])
+		for _, tree := range roots[t] {
+			b.WriteString(tree)
+		}
+	}
+	return b.String()
+}
+
+type renderer struct {
+	opts     Options
+	traces   map[trace.TraceID]int
+	names    map[trace.SpanID]string
+	children map[trace.SpanID][]sdktrace.ReadOnlySpan
+}
+
+// subtree renders s at depth and its children below it.
+func (r renderer) subtree(s sdktrace.ReadOnlySpan, depth int) string {
+	indent := strings.Repeat("  ", depth)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%s (%s)", indent, s.Name(), s.SpanKind())
+	if s.Status().Code == codes.Error {
+		b.WriteString(" error")
+	}
+	attrs := s.Attributes()
+	for _, key := range r.opts.Attributes {
+		for _, kv := range attrs {
+			if kv.Key == key {
+				fmt.Fprintf(&b, " %s=%s", key, r.value(key, kv.Value.Emit()))
+			}
+		}
+	}
+	for _, l := range s.Links() {
+		fmt.Fprintf(&b, " link=%s", r.ref(l.SpanContext))
+	}
+	b.WriteByte('\n')
+	if r.opts.Events {
+		for _, e := range s.Events() {
+			fmt.Fprintf(&b, "%s  - %s\n", indent, e.Name)
+		}
+	}
+	var children []string
+	for _, c := range r.children[s.SpanContext().SpanID()] {
+		children = append(children, r.subtree(c, depth+1))
+	}
+	slices.Sort(children)
+	for _, c := range children {
+		b.WriteString(c)
+	}
+	return b.String()
+}
+
+// ref names the span a link points to by its trace and name, or as
+// <external> if the link leaves the spans captured.
+func (r renderer) ref(sc trace.SpanContext) string {
+	name, ok := r.names[sc.SpanID()]
+	if !ok {
+		return "<external>"
+	}
+	return fmt.Sprintf("trace%d/%q", r.traces[sc.TraceID()], name)
+}
+
+func (r renderer) value(key attribute.Key, v string) string {
+	v = hexID.ReplaceAllStringFunc(v, func(id string) string {
+		if len(id) == 16 {
+			return "<span-id>"
+		}
+		t, _ := trace.TraceIDFromHex(id)
+		if n, ok := r.traces[t]; ok {
+			return fmt.Sprintf("trace%d", n)
+		}
+		return "<trace-id>"
+	})
+	v = timestamp.ReplaceAllString(v, "<time>")
+	if r.opts.Normalize != nil {
+		v = r.opts.Normalize(key, v)
+	}
+	return v
+}
+
+// Compare renders spans and compares them with the golden file at path,
+// conventionally under testdata. With -update it writes the file instead.
+func Compare(t testing.TB, path string, spans []sdktrace.ReadOnlySpan, opts Options) {
+	t.Helper()
+	got := []byte(Render(spans, opts))
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run the test with -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("span tree differs from %s; run the test with -update if the change is intended\n--- want\n%s--- got\n%s", path, want, got)
+	}
+}
@@ -0,0 +1,162 @@
+// Package startup measures how long the service takes from process start to
+// serving its first request, broken down into phases. Once the first request
+// completes, the phases are exported as a startup span tree and gauges.
+package startup
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// Phase names used by the service.
+const (
+	ConfigParse   = "config_parse"
+	ProviderInit  = "provider_init"
+	Dependencies  = "dependencies_init"
+	ListenerReady = "listener_ready"
+	FirstRequest  = "first_request_served"
+)
+
+var phaseKey = attribute.Key("startup.phase")
+
+// processStart approximates the process start time. It is set during
+// package initialization, before main runs.
+var processStart = time.Now()
+
+// Phase is a completed startup phase.
+type Phase struct {
+	Name       string
+	Start, End time.Time
+}
+
+// Tracker collects startup phases. Phases are recorded back to back, each
+// starting where the previous one ended.
+type Tracker struct {
+	mu     sync.Mutex
+	start  time.Time
+	last   time.Time
+	phases []Phase
+	served bool
+}
+
+// New returns a Tracker whose clock starts at process start.
+func New() *Tracker {
+	return &Tracker{start: processStart, last: processStart}
+}
+
+// Mark ends the current phase at the given time.
+func (t *Tracker) Mark(name string, end time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.served {
+		return
+	}
+	t.phases = append(t.phases, Phase{Name: name, Start: t.last, End: end})
+	t.last = end
+}
+
+// MarkSetup records the config parse and provider init phases from the last
+// telemetry.Setup call. Time before Setup started is attributed to config
+// parsing.
+func (t *Tracker) MarkSetup() {
+	timing := telemetry.LastSetupTiming()
+	if !timing.ConfigParsed.IsZero() {
+		t.Mark(ConfigParse, timing.ConfigParsed)
+	}
+	if !timing.ProvidersReady.IsZero() {
+		t.Mark(ProviderInit, timing.ProvidersReady)
+	}
+}
+
+// Phases returns the phases recorded so far.
+func (t *Tracker) Phases() []Phase {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Phase(nil), t.phases...)
+}
+
+// RegisterMetrics exports startup_phase_duration_seconds per phase and
+// startup_duration_seconds up to the latest phase. Call it after
+// telemetry.Setup.
+func (t *Tracker) RegisterMetrics() error {
+	meter := telemetry.Meter()
+
+	phaseDuration, err := meter.Float64ObservableGauge(
+		"startup_phase_duration_seconds",
+		metric.WithDescription("Duration of each startup phase"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return err
+	}
+	total, err := meter.Float64ObservableGauge(
+		"startup_duration_seconds",
+		metric.WithDescription("Time from process start to the end of the latest startup phase"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for _, p := range t.phases {
+			o.ObserveFloat64(phaseDuration, p.End.Sub(p.Start).Seconds(), metric.WithAttributes(phaseKey.String(p.Name)))
+		}
+		if len(t.phases) > 0 {
+			o.ObserveFloat64(total, t.last.Sub(t.start).Seconds())
+		}
+		return nil
+	}, phaseDuration, total)
+	return err
+}
+
+// Middleware records the first_request_served phase when the first request
+// completes and then emits the startup span tree.
+func (t *Tracker) Middleware(next http.Handler) http.Handler {
+	var once sync.Once
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		once.Do(func() {
+			t.Mark(FirstRequest, time.Now())
+			t.mu.Lock()
+			t.served = true
+			t.mu.Unlock()
+			t.emit()
+		})
+	})
+}
+
+// emit writes the recorded phases as a root "startup" span with one child
+// per phase, using the recorded timestamps.
+func (t *Tracker) emit() {
+	phases := t.Phases()
+	if len(phases) == 0 {
+		return
+	}
+	tracer := telemetry.Tracer()
+	end := phases[len(phases)-1].End
+
+	ctx, root := tracer.Start(context.Background(), "startup",
+		trace.WithNewRoot(),
+		trace.WithTimestamp(t.start),
+		trace.WithAttributes(attribute.Float64("startup.duration_seconds", end.Sub(t.start).Seconds())),
+	)
+	for _, p := range phases {
+		_, span := tracer.Start(ctx, "startup."+p.Name,
+			trace.WithTimestamp(p.Start),
+			trace.WithAttributes(phaseKey.String(p.Name)),
+		)
+		span.End(trace.WithTimestamp(p.End))
+	}
+	root.End(trace.WithTimestamp(end))
+}
@@ -0,0 +1,137 @@
+// Package supportcode gives error responses a short support code that a
+// customer can read out to support, and resolves it back to the trace of
+// the failed request. The code is derived from the trace ID and the time of
+// the response, recorded as support.code on the server span and logged with
+// the trace ID, so it can be found in a trace backend, in the logs, or with
+// the lookup endpoint, which keeps the most recent codes.
+package supportcode
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/telemetry"
+)
+
+// Header carries the support code of an error response.
+const Header = "X-Support-Code"
+
+// Path is the lookup endpoint, followed by the code.
+const Path = "/debug/support/"
+
+// maxTickets bounds the codes kept for lookup; the oldest are forgotten
+// first. Older codes can still be found in the logs.
+const maxTickets = 10000
+
+// encoding is Crockford's base32: no I, L, O or U, which read like digits
+// or each other over the phone.
+var encoding = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+// Ticket is what a support code resolves to.
+type Ticket struct {
+	Code    string    `json:"code"`
+	TraceID string    `json:"trace_id"`
+	SpanID  string    `json:"span_id"`
+	Sampled bool      `json:"sampled"`
+	Time    time.Time `json:"time"`
+	Status  int       `json:"status"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+}
+
+var tickets = struct {
+	sync.Mutex
+	byCode map[string]Ticket
+	order  []string
+}{byCode: make(map[string]Ticket)}
+
+// Issue derives the support code of an error response with status to r and
+// keeps it for lookup. It reports false if r isn't traced, since there is
+// no trace to resolve the code to.
+func Issue(r *http.Request, status int) (string, bool) {
+	ctx := r.Context()
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return "", false
+	}
+	now := time.Now()
+	t := Ticket{
+		Code:    code(sc.TraceID(), now),
+		TraceID: sc.TraceID().String(),
+		SpanID:  sc.SpanID().String(),
+		Sampled: sc.IsSampled(),
+		Time:    now,
+		Status:  status,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+	}
+	add(t)
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("support.code", t.Code))
+	telemetry.LoggerFor(ctx).Info("support code issued",
+		zap.String("support_code", t.Code),
+		zap.Int("http.response.status_code", status),
+		zap.String("url.path", t.Path))
+	return t.Code, true
+}
+
+// code hashes the trace ID and time into 40 bits, written as two groups of
+// four characters, e.g. 7K3M-9Q2D. The time keeps two errors of one trace
+// apart.
+func code(id trace.TraceID, at time.Time) string {
+	var b [24]byte
+	copy(b[:16], id[:])
+	binary.BigEndian.PutUint64(b[16:], uint64(at.UnixNano()))
+	sum := sha256.Sum256(b[:])
+	s := encoding.EncodeToString(sum[:5])
+	return s[:4] + "-" + s[4:]
+}
+
+func add(t Ticket) {
+	tickets.Lock()
+	defer tickets.Unlock()
+	if len(tickets.order) >= maxTickets {
+		delete(tickets.byCode, tickets.order[0])
+		tickets.order = tickets.order[1:]
+	}
+	tickets.byCode[t.Code] = t
+	tickets.order = append(tickets.order, t.Code)
+}
+
+// Lookup returns the ticket of code. It accepts lower case and a missing
+// dash, the way codes are typed in from a phone call.
+func Lookup(code string) (Ticket, bool) {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) == 8 {
+		code = code[:4] + "-" + code[4:]
+	}
+	tickets.Lock()
+	defer tickets.Unlock()
+	t, ok := tickets.byCode[code]
+	return t, ok
+}
+
+// Register adds GET Path{code}, which answers the ticket of a code as JSON,
+// or 404 if the code is unknown or was forgotten.
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+Path+"{code}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		t, ok := Lookup(r.PathValue("code"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unknown support code"})
+			return
+		}
+		json.NewEncoder(w).Encode(t)
+	})
+}
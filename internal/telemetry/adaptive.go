@@ -0,0 +1,204 @@
+package telemetry
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdaptiveSamplingConfig raises the sampling ratio of routes whose recent
+// error rate is high, so failures are traced in full while they happen. Error
+// rates are read from the http.server.request.duration histogram, so
+// the boost follows what the metrics pipeline sees.
+type AdaptiveSamplingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often error rates are recomputed; defaults to 10s.
+	Interval time.Duration `yaml:"interval"`
+	// ErrorRateThreshold is the error rate at which a route is boosted;
+	// defaults to 0.05.
+	ErrorRateThreshold float64 `yaml:"error_rate_threshold"`
+	// BoostedRatio is the sampling ratio of a route right after it crossed
+	// the threshold; defaults to 1.
+	BoostedRatio float64 `yaml:"boosted_ratio"`
+	// HalfLife is how fast a boost decays back to the base ratio once the
+	// error rate is below the threshold; defaults to 1m.
+	HalfLife time.Duration `yaml:"half_life"`
+	// MinRequests is the number of requests a route needs in an interval for
+	// its error rate to count; defaults to 10.
+	MinRequests int64 `yaml:"min_requests"`
+}
+
+// RouteSampling is the adaptive sampling state of one route.
+type RouteSampling struct {
+	Method string `json:"method"`
+	Route  string `json:"route"`
+	// ErrorRate is the error rate of the last interval with enough requests.
+	ErrorRate float64 `json:"error_rate"`
+	// Ratio is the sampling ratio applied to new traces of the route.
+	Ratio   float64 `json:"ratio"`
+	Boosted bool    `json:"boosted"`
+}
+
+// AdaptiveSamplingState is the current adaptive sampling state.
+type AdaptiveSamplingState struct {
+	Enabled   bool            `json:"enabled"`
+	BaseRatio float64         `json:"base_ratio,omitempty"`
+	Routes    []RouteSampling `json:"routes,omitempty"`
+}
+
+// adaptive holds the rates of the installed providers, if enabled.
+var adaptive atomic.Pointer[adaptiveRates]
+
+// AdaptiveSampling returns the current adaptive sampling state.
+func AdaptiveSampling() AdaptiveSamplingState {
+	a := adaptive.Load()
+	if a == nil {
+		return AdaptiveSamplingState{}
+	}
+	return a.state()
+}
+
+// routeCounts are the cumulative request and error counts of a route.
+type routeCounts struct {
+	requests, errors uint64
+}
+
+type routeKey struct {
+	method, route string
+}
+
+// adaptiveRates tracks per-route error rates and the boost derived from them.
+type adaptiveRates struct {
+	cfg  AdaptiveSamplingConfig
+	base func() float64
+
+	mu     sync.Mutex
+	routes map[routeKey]*routeRate
+}
+
+type routeRate struct {
+	segments  []string
+	last      routeCounts
+	errorRate float64
+	boost     float64
+}
+
+func newAdaptiveRates(cfg AdaptiveSamplingConfig, base func() float64) *adaptiveRates {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.ErrorRateThreshold <= 0 {
+		cfg.ErrorRateThreshold = 0.05
+	}
+	if cfg.BoostedRatio <= 0 {
+		cfg.BoostedRatio = 1
+	}
+	if cfg.HalfLife <= 0 {
+		cfg.HalfLife = time.Minute
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 10
+	}
+	return &adaptiveRates{cfg: cfg, base: base, routes: make(map[routeKey]*routeRate)}
+}
+
+// update folds one interval's cumulative counts into the rates. Routes at or
+// above the threshold are boosted to BoostedRatio; every other boost decays
+// by one interval's worth of HalfLife.
+func (a *adaptiveRates) update(counts map[routeKey]routeCounts) {
+	decay := math.Pow(0.5, a.cfg.Interval.Seconds()/a.cfg.HalfLife.Seconds())
+	base := a.base()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, c := range counts {
+		r, ok := a.routes[key]
+		if !ok {
+			r = &routeRate{segments: strings.Split(key.route, "/")}
+			a.routes[key] = r
+		}
+		delta := routeCounts{c.requests - r.last.requests, c.errors - r.last.errors}
+		if c.requests < r.last.requests || c.errors < r.last.errors {
+			// The counts were reset; they cover the new interval only.
+			delta = c
+		}
+		r.last = c
+
+		if delta.requests >= uint64(a.cfg.MinRequests) {
+			r.errorRate = float64(delta.errors) / float64(delta.requests)
+			if r.errorRate >= a.cfg.ErrorRateThreshold {
+				r.boost = a.cfg.BoostedRatio
+				continue
+			}
+		}
+		r.boost *= decay
+		if r.boost <= base {
+			r.boost = 0
+		}
+	}
+}
+
+// ratio returns the boosted sampling ratio of a request, if its route is
+// boosted.
+func (a *adaptiveRates) ratio(method, path string) (float64, bool) {
+	segments := strings.Split(path, "/")
+	base := a.base()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	best, bestLen := 0.0, -1
+	for key, r := range a.routes {
+		if key.method != method || r.boost <= base || len(r.segments) <= bestLen || !matchRoute(r.segments, segments) {
+			continue
+		}
+		best, bestLen = r.boost, len(r.segments)
+	}
+	return best, bestLen >= 0
+}
+
+// matchRoute reports whether a path matches a ServeMux route pattern, both
+// split into segments. {name} matches one segment, {name...} the rest, and a
+// trailing slash any suffix.
+func matchRoute(route, path []string) bool {
+	for i, seg := range route {
+		last := i == len(route)-1
+		switch {
+		case strings.HasSuffix(seg, "...}"):
+			return true
+		case last && seg == "" && i > 0:
+			return len(path) >= len(route)
+		case i >= len(path):
+			return false
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+		case seg != path[i]:
+			return false
+		}
+	}
+	return len(path) == len(route)
+}
+
+func (a *adaptiveRates) state() AdaptiveSamplingState {
+	base := a.base()
+	s := AdaptiveSamplingState{Enabled: true, BaseRatio: base}
+
+	a.mu.Lock()
+	for key, r := range a.routes {
+		rs := RouteSampling{Method: key.method, Route: key.route, ErrorRate: r.errorRate, Ratio: base}
+		if r.boost > base {
+			rs.Ratio, rs.Boosted = r.boost, true
+		}
+		s.Routes = append(s.Routes, rs)
+	}
+	a.mu.Unlock()
+
+	sort.Slice(s.Routes, func(i, j int) bool {
+		if s.Routes[i].Route != s.Routes[j].Route {
+			return s.Routes[i].Route < s.Routes[j].Route
+		}
+		return s.Routes[i].Method < s.Routes[j].Method
+	})
+	return s
+}
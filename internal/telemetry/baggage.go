@@ -0,0 +1,32 @@
+package telemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// WithBaggage returns ctx with kvs added to its baggage, replacing entries
+// of the same keys. Baggage travels with the request to every service it
+// calls, so add only what those services need, such as a plan or customer
+// tier, and never secrets. Values are written as strings; entries whose key
+// isn't a valid baggage key are left out.
+func WithBaggage(ctx context.Context, kvs ...attribute.KeyValue) context.Context {
+	bag := baggage.FromContext(ctx)
+	for _, kv := range kvs {
+		m, err := baggage.NewMemberRaw(string(kv.Key), kv.Value.Emit())
+		if err != nil {
+			continue
+		}
+		if b, err := bag.SetMember(m); err == nil {
+			bag = b
+		}
+	}
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+// BaggageValue returns the value of the baggage entry key in ctx, or "".
+func BaggageValue(ctx context.Context, key string) string {
+	return baggage.FromContext(ctx).Member(key).Value()
+}
@@ -0,0 +1,84 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// baggageCopier sets the baggage entries of the keys it was configured
+// with on every span started in their context, as attributes of the same
+// keys, so a tenant or customer tier set by a caller can be queried on
+// each span of the service. "*" copies every entry. Attributes a span
+// started with are left as they are.
+//
+// Server spans start before baggage an untrusted caller sent is filtered,
+// so they are skipped; CopyBaggage sets the filtered entries on them.
+type baggageCopier struct {
+	keys []string
+}
+
+// copier is the baggageCopier of the installed providers, for CopyBaggage.
+var copier atomic.Pointer[baggageCopier]
+
+func newBaggageCopier(keys []string) *baggageCopier {
+	if len(keys) == 0 {
+		return nil
+	}
+	return &baggageCopier{keys: keys}
+}
+
+// attributes returns the entries of bag to copy, leaving out those whose
+// key is among already.
+func (c *baggageCopier) attributes(bag baggage.Baggage, already []attribute.KeyValue) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for _, m := range bag.Members() {
+		if !slices.Contains(c.keys, "*") && !slices.Contains(c.keys, m.Key()) {
+			continue
+		}
+		if slices.ContainsFunc(already, func(kv attribute.KeyValue) bool { return string(kv.Key) == m.Key() }) {
+			continue
+		}
+		attrs = append(attrs, attribute.String(m.Key(), m.Value()))
+	}
+	return attrs
+}
+
+func (c *baggageCopier) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	if s.SpanKind() == trace.SpanKindServer {
+		return
+	}
+	if attrs := c.attributes(baggage.FromContext(ctx), s.Attributes()); len(attrs) > 0 {
+		s.SetAttributes(attrs...)
+	}
+}
+
+func (c *baggageCopier) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (c *baggageCopier) Shutdown(context.Context) error   { return nil }
+func (c *baggageCopier) ForceFlush(context.Context) error { return nil }
+
+// CopyBaggage sets the configured baggage entries of ctx on the span in
+// ctx, for middleware to call on the server span once the request's
+// baggage has been filtered.
+func CopyBaggage(ctx context.Context) {
+	c := copier.Load()
+	if c == nil {
+		return
+	}
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	// The server span is wrapped, so its attributes can't be read; it
+	// starts with none of the baggage keys.
+	if attrs := c.attributes(baggage.FromContext(ctx), nil); len(attrs) > 0 {
+		span.SetAttributes(attrs...)
+	}
+}
@@ -0,0 +1,89 @@
+package telemetry
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type callerInfo struct {
+	spanName  string
+	namespace string
+	function  string
+}
+
+var callers sync.Map // map[uintptr]callerInfo
+
+// StartCallerSpan starts a span named after the function that called it, so
+// store methods don't have to repeat their own name:
+//
+//	func (s *PaymentStore) Create(ctx context.Context, p Payment) error {
+//		ctx, span := telemetry.StartCallerSpan(ctx)
+//		defer span.End()
+//		...
+//	}
+//
+// produces a span named "PaymentStore.Create" carrying the code.namespace,
+// code.function, code.filepath and code.lineno attributes of the call site.
+// Outside a trace, such as in a metric callback, it returns ctx and a
+// non-recording span instead, so frequent untraced calls don't each start a
+// trace of their own.
+func StartCallerSpan(ctx context.Context, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	pc, file, line, ok := runtime.Caller(1)
+	if !ok {
+		return Tracer().Start(ctx, "unknown", opts...)
+	}
+
+	info := lookupCaller(pc)
+	opts = append(opts, trace.WithAttributes(
+		semconv.CodeNamespace(info.namespace),
+		semconv.CodeFunction(info.function),
+		semconv.CodeFilepath(file),
+		semconv.CodeLineNumber(line),
+	))
+	return Tracer().Start(ctx, info.spanName, opts...)
+}
+
+func lookupCaller(pc uintptr) callerInfo {
+	if v, ok := callers.Load(pc); ok {
+		return v.(callerInfo)
+	}
+	info := parseFuncName(runtime.FuncForPC(pc).Name())
+	callers.Store(pc, info)
+	return info
+}
+
+// parseFuncName splits a runtime function name such as
+// "payment-service/internal/store.(*PaymentStore).Create" into a span name
+// ("PaymentStore.Create"), a namespace ("payment-service/internal/store.PaymentStore")
+// and a function ("Create").
+func parseFuncName(full string) callerInfo {
+	slash := strings.LastIndex(full, "/")
+	pkgPath, rest := "", full
+	if dot := strings.Index(full[slash+1:], "."); dot >= 0 {
+		pkgPath = full[:slash+1+dot]
+		rest = full[slash+1+dot+1:]
+	}
+	rest = strings.NewReplacer("(*", "", "(", "", ")", "").Replace(rest)
+
+	receiver, function := "", rest
+	if dot := strings.Index(rest, "."); dot >= 0 {
+		receiver, function = rest[:dot], rest[dot+1:]
+	}
+
+	info := callerInfo{spanName: rest, namespace: pkgPath, function: function}
+	if receiver == "" {
+		pkg := pkgPath[strings.LastIndex(pkgPath, "/")+1:]
+		info.spanName = pkg + "." + function
+	} else {
+		info.namespace = pkgPath + "." + receiver
+	}
+	return info
+}
@@ -0,0 +1,135 @@
+package telemetry
+
+import (
+	"cmp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// CatalogEntry describes an instrument in the metrics catalog.
+type CatalogEntry struct {
+	Name        string `json:"name"`
+	Kind        string `json:"kind"`
+	Unit        string `json:"unit"`
+	Description string `json:"description"`
+	// Scope is the instrumentation scope the instrument belongs to.
+	Scope string `json:"scope"`
+	// Module is the Go package that created the instrument. Instruments of
+	// other libraries are only known from their exported data, so their
+	// module is their scope.
+	Module string `json:"module"`
+	// AttributeKeys are the attribute keys seen on the instrument's
+	// exported data points, sorted.
+	AttributeKeys []string `json:"attribute_keys"`
+	// Exported reports whether the instrument has had data exported. An
+	// instrument that was created but never recorded into has not.
+	Exported bool `json:"exported"`
+}
+
+type catalogKey struct {
+	scope, name string
+}
+
+type catalogEntry struct {
+	CatalogEntry
+	keys map[string]bool
+}
+
+var (
+	catalogMu sync.Mutex
+	catalog   = make(map[catalogKey]*catalogEntry)
+)
+
+// catalogInstrument adds an instrument created through Meter to the catalog,
+// under the name and unit it is exported with. It must be called by
+// checkInstrument, which is called by a checkedMeter method, so the creating
+// package is found three frames up.
+func catalogInstrument(kind, name, unit, description string) {
+	if unit == "ms" && (kind == "Float64Counter" || kind == "Float64Histogram") {
+		name, unit = secondsName(name), "s"
+	}
+	module := ""
+	if pc, _, _, ok := runtime.Caller(3); ok {
+		module = packagePath(runtime.FuncForPC(pc).Name())
+	}
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	key := catalogKey{ScopeName, name}
+	if _, ok := catalog[key]; ok {
+		return
+	}
+	catalog[key] = &catalogEntry{
+		CatalogEntry: CatalogEntry{
+			Name:        name,
+			Kind:        kind,
+			Unit:        unit,
+			Description: description,
+			Scope:       ScopeName,
+			Module:      module,
+		},
+		keys: make(map[string]bool),
+	}
+}
+
+// catalogExported records the exported data of an instrument: its
+// attribute keys and, for instruments not created through Meter, the
+// instrument itself.
+func catalogExported(scope, name, kind, unit, description string, keys []string) {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	key := catalogKey{scope, name}
+	e, ok := catalog[key]
+	if !ok {
+		e = &catalogEntry{
+			CatalogEntry: CatalogEntry{
+				Name:        name,
+				Kind:        kind,
+				Unit:        unit,
+				Description: description,
+				Scope:       scope,
+				Module:      scope,
+			},
+			keys: make(map[string]bool),
+		}
+		catalog[key] = e
+	}
+	e.Exported = true
+	for _, k := range keys {
+		e.keys[k] = true
+	}
+}
+
+// Catalog returns every instrument created through Meter or seen in
+// exported metrics, sorted by scope and name.
+func Catalog() []CatalogEntry {
+	catalogMu.Lock()
+	entries := make([]CatalogEntry, 0, len(catalog))
+	for _, e := range catalog {
+		entry := e.CatalogEntry
+		entry.AttributeKeys = make([]string, 0, len(e.keys))
+		for k := range e.keys {
+			entry.AttributeKeys = append(entry.AttributeKeys, k)
+		}
+		slices.Sort(entry.AttributeKeys)
+		entries = append(entries, entry)
+	}
+	catalogMu.Unlock()
+
+	slices.SortFunc(entries, func(a, b CatalogEntry) int {
+		return cmp.Or(cmp.Compare(a.Scope, b.Scope), cmp.Compare(a.Name, b.Name))
+	})
+	return entries
+}
+
+// packagePath returns the package of a runtime function name such as
+// "payment-service/internal/clientip.init.func1".
+func packagePath(function string) string {
+	slash := strings.LastIndex(function, "/")
+	if dot := strings.Index(function[slash+1:], "."); dot >= 0 {
+		return function[:slash+1+dot]
+	}
+	return function
+}
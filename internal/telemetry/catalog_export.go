@@ -0,0 +1,98 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// catalogingExporter adds the instruments and attribute keys of every
+// export to the metrics catalog.
+type catalogingExporter struct {
+	sdkmetric.Exporter
+}
+
+func (e catalogingExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			kind, sets := exportedKind(m.Data)
+			catalogExported(sm.Scope.Name, m.Name, kind, m.Unit, m.Description, attributeKeys(sets))
+		}
+	}
+	return e.Exporter.Export(ctx, rm)
+}
+
+// exportedKind returns the instrument kind that produces data, as named by
+// Meter's constructors, and the attribute sets of its data points.
+// Asynchronous instruments can't be told from synchronous ones.
+func exportedKind(data metricdata.Aggregation) (string, []attribute.Set) {
+	switch d := data.(type) {
+	case metricdata.Sum[int64]:
+		return sumKind("Int64", d.IsMonotonic), pointSets(d.DataPoints)
+	case metricdata.Sum[float64]:
+		return sumKind("Float64", d.IsMonotonic), pointSets(d.DataPoints)
+	case metricdata.Gauge[int64]:
+		return "Int64Gauge", pointSets(d.DataPoints)
+	case metricdata.Gauge[float64]:
+		return "Float64Gauge", pointSets(d.DataPoints)
+	case metricdata.Histogram[int64]:
+		return "Int64Histogram", histogramSets(d.DataPoints)
+	case metricdata.Histogram[float64]:
+		return "Float64Histogram", histogramSets(d.DataPoints)
+	case metricdata.ExponentialHistogram[int64]:
+		return "Int64Histogram", exponentialSets(d.DataPoints)
+	case metricdata.ExponentialHistogram[float64]:
+		return "Float64Histogram", exponentialSets(d.DataPoints)
+	}
+	return "unknown", nil
+}
+
+func sumKind(number string, monotonic bool) string {
+	if monotonic {
+		return number + "Counter"
+	}
+	return number + "UpDownCounter"
+}
+
+func pointSets[N int64 | float64](points []metricdata.DataPoint[N]) []attribute.Set {
+	sets := make([]attribute.Set, len(points))
+	for i, p := range points {
+		sets[i] = p.Attributes
+	}
+	return sets
+}
+
+func histogramSets[N int64 | float64](points []metricdata.HistogramDataPoint[N]) []attribute.Set {
+	sets := make([]attribute.Set, len(points))
+	for i, p := range points {
+		sets[i] = p.Attributes
+	}
+	return sets
+}
+
+func exponentialSets[N int64 | float64](points []metricdata.ExponentialHistogramDataPoint[N]) []attribute.Set {
+	sets := make([]attribute.Set, len(points))
+	for i, p := range points {
+		sets[i] = p.Attributes
+	}
+	return sets
+}
+
+// attributeKeys returns the distinct keys of sets.
+func attributeKeys(sets []attribute.Set) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, set := range sets {
+		for iter := set.Iter(); iter.Next(); {
+			if k := string(iter.Attribute().Key); !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,236 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ChaosConfig routes OTLP exporters through an in-process TCP proxy that can
+// simulate a collector outage. The proxy forwards bytes unchanged, which
+// works for insecure endpoints; TLS would fail hostname verification.
+type ChaosConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Signals lists the exporters routed through the proxy, "traces" and/or
+	// "metrics"; defaults to traces only, so metrics about the outage keep
+	// flowing.
+	Signals []string `yaml:"signals"`
+}
+
+// Chaos modes.
+const (
+	// ChaosOff forwards traffic to the collector.
+	ChaosOff = "off"
+	// ChaosBlackhole accepts connections and discards everything sent on
+	// them, so exports hang until they time out.
+	ChaosBlackhole = "blackhole"
+	// ChaosDelay forwards traffic after a delay.
+	ChaosDelay = "delay"
+)
+
+// ErrChaosDisabled is returned by SetExporterChaos when exporter_chaos is not
+// enabled in the configuration.
+var ErrChaosDisabled = errors.New("telemetry: exporter chaos is not enabled")
+
+// ChaosState is the current exporter chaos setting.
+type ChaosState struct {
+	Enabled bool          `json:"enabled"`
+	Mode    string        `json:"mode"`
+	Delay   time.Duration `json:"delay_ns,omitempty"`
+	// Proxies maps each proxied signal to its collector endpoint.
+	Proxies map[string]string `json:"proxies,omitempty"`
+}
+
+var chaos = &chaosSwitch{mode: ChaosOff}
+
+// chaosSwitch holds the mode shared by all proxies.
+type chaosSwitch struct {
+	mu      sync.Mutex
+	mode    string
+	delay   time.Duration
+	proxies map[string]*chaosProxy
+}
+
+// proxied reports whether signal's exporter goes through the proxy.
+func (cfg ChaosConfig) proxied(signal string) bool {
+	if !cfg.Enabled {
+		return false
+	}
+	if len(cfg.Signals) == 0 {
+		return signal == "traces"
+	}
+	return slices.Contains(cfg.Signals, signal)
+}
+
+// proxy starts a proxy for signal's exporter to target and returns the
+// address the exporter should dial instead.
+func (c *chaosSwitch) proxy(signal, target string) (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("exporter chaos proxy: %w", err)
+	}
+	p := &chaosProxy{target: target, ln: ln, conns: make(map[net.Conn]struct{})}
+
+	c.mu.Lock()
+	if c.proxies == nil {
+		c.proxies = make(map[string]*chaosProxy)
+	}
+	if old := c.proxies[signal]; old != nil {
+		old.close()
+	}
+	c.proxies[signal] = p
+	c.mu.Unlock()
+
+	go p.serve()
+	return ln.Addr().String(), nil
+}
+
+func (c *chaosSwitch) current() (string, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mode, c.delay
+}
+
+// SetExporterChaos switches the exporter proxies to mode. Open connections
+// are dropped so exporters reconnect under the new mode.
+func SetExporterChaos(mode string, delay time.Duration) error {
+	switch mode {
+	case ChaosOff, ChaosBlackhole:
+		delay = 0
+	case ChaosDelay:
+		if delay <= 0 {
+			return fmt.Errorf("telemetry: chaos mode %q needs a positive delay", mode)
+		}
+	default:
+		return fmt.Errorf("telemetry: unknown chaos mode %q", mode)
+	}
+
+	chaos.mu.Lock()
+	defer chaos.mu.Unlock()
+	if len(chaos.proxies) == 0 {
+		return ErrChaosDisabled
+	}
+	chaos.mode, chaos.delay = mode, delay
+	for _, p := range chaos.proxies {
+		p.dropConns()
+	}
+	Logger().Warn("exporter chaos mode changed", zap.String("mode", mode), zap.Duration("delay", delay))
+	return nil
+}
+
+// ExporterChaos returns the current exporter chaos setting.
+func ExporterChaos() ChaosState {
+	chaos.mu.Lock()
+	defer chaos.mu.Unlock()
+	st := ChaosState{Enabled: len(chaos.proxies) > 0, Mode: chaos.mode, Delay: chaos.delay}
+	if st.Enabled {
+		st.Proxies = make(map[string]string, len(chaos.proxies))
+		for signal, p := range chaos.proxies {
+			st.Proxies[signal] = p.target
+		}
+	}
+	return st
+}
+
+// closeChaos stops all proxies and resets the mode.
+func closeChaos(context.Context) error {
+	chaos.mu.Lock()
+	defer chaos.mu.Unlock()
+	for _, p := range chaos.proxies {
+		p.close()
+	}
+	chaos.proxies, chaos.mode, chaos.delay = nil, ChaosOff, 0
+	return nil
+}
+
+// chaosProxy forwards connections to one collector endpoint, applying the
+// current chaos mode.
+type chaosProxy struct {
+	target string
+	ln     net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (p *chaosProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *chaosProxy) handle(client net.Conn) {
+	p.track(client)
+	defer p.untrack(client)
+
+	mode, delay := chaos.current()
+	if mode == ChaosBlackhole {
+		io.Copy(io.Discard, client)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", p.target, 5*time.Second)
+	if err != nil {
+		return
+	}
+	p.track(upstream)
+	defer p.untrack(upstream)
+
+	go delayedCopy(client, upstream, delay)
+	delayedCopy(upstream, client, delay)
+}
+
+// delayedCopy copies src to dst, holding each chunk for delay.
+func delayedCopy(dst, src net.Conn, delay time.Duration) {
+	defer dst.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			time.Sleep(delay)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *chaosProxy) track(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[c] = struct{}{}
+}
+
+func (p *chaosProxy) untrack(c net.Conn) {
+	c.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, c)
+}
+
+func (p *chaosProxy) dropConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+func (p *chaosProxy) close() {
+	p.ln.Close()
+	p.dropConns()
+}
@@ -0,0 +1,271 @@
+package telemetry
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the telemetry configuration loaded from otel.yaml.
+type Config struct {
+	// DevMode logs fix-it hints for instrument definition problems.
+	DevMode bool `yaml:"dev_mode"`
+	// DebugEndpoints serves the /debug endpoints; defaults to true.
+	DebugEndpoints *bool `yaml:"debug_endpoints"`
+
+	// Propagators name the formats trace context and baggage are read
+	// from and written to requests in: tracecontext, baggage, b3,
+	// b3multi, jaeger or none; defaults to tracecontext and baggage.
+	// WithPropagators overrides it.
+	Propagators []string `yaml:"propagators"`
+
+	Traces  TracesConfig  `yaml:"traces"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	Logs    LogsConfig    `yaml:"logs"`
+
+	PayloadStats PayloadStatsConfig `yaml:"payload_stats"`
+	DiskBuffer   DiskBufferConfig   `yaml:"disk_buffer"`
+	Watchdog     WatchdogConfig     `yaml:"memory_watchdog"`
+	Cost         CostConfig         `yaml:"cost"`
+	Chaos        ChaosConfig        `yaml:"exporter_chaos"`
+
+	// StatusMapping overrides entries of DefaultStatusMapping.
+	StatusMapping StatusMapping `yaml:"http_status_mapping"`
+	// AttributePolicies overrides the policies of DefaultAttributePolicies,
+	// by span kind.
+	AttributePolicies AttributePolicies `yaml:"span_attribute_policies"`
+}
+
+// ExporterConfig selects where a signal is sent.
+type ExporterConfig struct {
+	// Type is one of "otlp", "console" or "none".
+	Type     string `yaml:"type"`
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+}
+
+// TracesConfig configures the TracerProvider.
+type TracesConfig struct {
+	Exporter ExporterConfig `yaml:"exporter"`
+	// SamplingRatio is the fraction of root traces sampled; defaults to 1.
+	SamplingRatio *float64 `yaml:"sampling_ratio"`
+	// QueueSize is the batch span processor queue size; defaults to the SDK's.
+	QueueSize int `yaml:"queue_size"`
+	// SpanBuffer is the number of recently ended spans kept in memory for
+	// the /debug endpoints; defaults to DefaultSpanBufferSize.
+	SpanBuffer int `yaml:"span_buffer"`
+	// AdaptiveSampling boosts sampling of routes with a high error rate.
+	AdaptiveSampling AdaptiveSamplingConfig `yaml:"adaptive_sampling"`
+	// KeepErrors records the root traces that SamplingRatio and adaptive
+	// sampling don't sample, and exports those in which a span ends in an
+	// error.
+	KeepErrors bool `yaml:"keep_errors"`
+	// RouteSampling overrides SamplingRatio for the requests of some routes;
+	// the first matching rule applies.
+	RouteSampling []RouteSamplingRule `yaml:"route_sampling"`
+	// BaggageAttributes are the baggage keys whose entries are set on
+	// every span as attributes; "*" copies every entry.
+	BaggageAttributes []string `yaml:"baggage_attributes"`
+	// MaxAttributeLength cuts longer string attributes of exported spans;
+	// defaults to DefaultMaxAttributeLength, and a negative value keeps
+	// them whole.
+	MaxAttributeLength int `yaml:"max_attribute_length"`
+}
+
+// MetricsConfig configures the MeterProvider.
+type MetricsConfig struct {
+	Exporter ExporterConfig `yaml:"exporter"`
+	Interval time.Duration  `yaml:"interval"`
+	StatsD   StatsDConfig   `yaml:"statsd"`
+	// Prometheus serves the metrics for scraping, next to the exporter;
+	// set the exporter to none to only be scraped.
+	Prometheus PrometheusConfig `yaml:"prometheus"`
+	// Exemplars attaches the sampled span of a measurement to histogram
+	// buckets and sums; defaults to true.
+	Exemplars *bool `yaml:"exemplars"`
+	// ExemplarFilter picks the measurements that may become exemplars:
+	// "trace_based", the default, those made in a sampled span, or
+	// "always_on", every one, with the trace context of unsampled spans.
+	// Exemplars false overrides it.
+	ExemplarFilter string `yaml:"exemplar_filter"`
+	// Runtime exports the Go runtime metrics: goroutines, heap and GC
+	// pauses. WithRuntimeMetrics turns it on too.
+	Runtime bool `yaml:"runtime"`
+	// ServiceGraph counts the calls of client spans to other services in
+	// the traces_service_graph_* metrics, for service map panels.
+	ServiceGraph bool `yaml:"service_graph"`
+	// DryRunExclude lists the instruments, as path.Match patterns, that
+	// ignore measurements made during dry runs; defaults to
+	// DefaultDryRunExclude.
+	DryRunExclude []string `yaml:"dry_run_exclude"`
+	// Instruments are additional instruments created at startup.
+	Instruments []InstrumentConfig `yaml:"instruments"`
+	// Views change the bucket boundaries of histograms, replacing the
+	// DefaultViews of the same instruments. WithViews adds to them.
+	Views []View `yaml:"views"`
+	// Heatmap keeps recent request duration histograms for
+	// /debug/telemetry/heatmap.
+	Heatmap HeatmapConfig `yaml:"heatmap"`
+}
+
+// RouteSamplingRule sets the sampling ratio of the requests to a route,
+// in place of the caller's decision and of sampling_ratio.
+type RouteSamplingRule struct {
+	// Method limits the rule to one HTTP method; empty matches any.
+	Method string `yaml:"method"`
+	// Route is a ServeMux path pattern, such as /api/payment/{id}.
+	Route string `yaml:"route"`
+	// Ratio is the share of the route's requests sampled; 0 samples none.
+	Ratio float64 `yaml:"ratio"`
+	// KeepErrors also exports the requests Ratio doesn't sample if their
+	// server span ends in an error. They are recorded in full to find out,
+	// which costs as much as sampling them until they end.
+	KeepErrors bool `yaml:"keep_errors"`
+}
+
+// LogsConfig configures the service logger.
+type LogsConfig struct {
+	// Level is the minimum log level, e.g. "debug" or "info".
+	Level string `yaml:"level"`
+	// MaxAttributeLength cuts longer string and error fields of log
+	// records; defaults to DefaultMaxAttributeLength, and a negative value
+	// keeps them whole.
+	MaxAttributeLength int `yaml:"max_attribute_length"`
+}
+
+// StatsDConfig configures the legacy statsd pipeline that runs next to the
+// OTLP metrics pipeline for teams that are still migrating dashboards.
+type StatsDConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Address  string        `yaml:"address"`
+	Prefix   string        `yaml:"prefix"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// PrometheusConfig exposes the metrics in the Prometheus exposition format
+// at /metrics on a listener of their own. WithPrometheus turns it on too.
+type PrometheusConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Address is the listen address; defaults to ":9464".
+	Address string `yaml:"address"`
+}
+
+// LoadConfig reads and parses one or more telemetry configuration files,
+// merging each file over the previous ones, e.g. a base otel.yaml followed
+// by an otel.prod.yaml overlay. See mergeConfig for the merge rules, and
+// WithMode for the layer of a run mode.
+func LoadConfig(paths ...string) (*Config, error) {
+	merged := map[string]any{}
+	for _, path := range paths {
+		b, err := readLayer(path)
+		if err != nil {
+			return nil, err
+		}
+		var overlay map[string]any
+		if err := yaml.Unmarshal(b, &overlay); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		mergeConfig(merged, overlay)
+	}
+
+	b, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", strings.Join(paths, ", "), err)
+	}
+	return &cfg, nil
+}
+
+// DumpConfig writes the effective configuration merged from paths as YAML.
+func DumpConfig(w io.Writer, paths ...string) error {
+	cfg, err := LoadConfig(paths...)
+	if err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// mergeConfig merges overlay into base in place. Maps are merged key by key,
+// and scalars and lists in the overlay replace the base value. An explicit
+// null removes the key. An exporter block whose type differs from the base
+// replaces the base block entirely, so settings of the old exporter, such as
+// an OTLP endpoint, don't leak into the new one.
+func mergeConfig(base, overlay map[string]any) {
+	for k, v := range overlay {
+		if v == nil {
+			delete(base, k)
+			continue
+		}
+		src, srcOK := v.(map[string]any)
+		dst, dstOK := base[k].(map[string]any)
+		if !srcOK || !dstOK || (k == "exporter" && src["type"] != nil && src["type"] != dst["type"]) {
+			base[k] = v
+			continue
+		}
+		mergeConfig(dst, src)
+	}
+}
+
+// WatchdogConfig enables memory-pressure driven telemetry degradation.
+type WatchdogConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// RSSThresholdMB is the resident set size above which telemetry degrades.
+	RSSThresholdMB int           `yaml:"rss_threshold_mb"`
+	Interval       time.Duration `yaml:"interval"`
+	// DegradedSamplingRatio is the sampling ratio while degraded.
+	DegradedSamplingRatio float64 `yaml:"degraded_sampling_ratio"`
+	// DegradedQueueSize is the span queue size while degraded.
+	DegradedQueueSize int `yaml:"degraded_queue_size"`
+}
+
+// PayloadStatsConfig enables measurement of OTLP export payload sizes.
+type PayloadStatsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// LogInterval is how often a size summary is logged. Zero disables the
+	// summary; the metrics are still recorded.
+	LogInterval time.Duration `yaml:"log_interval"`
+}
+
+// DiskBufferConfig enables store-and-forward of OTLP exports: batches that
+// can't reach the collector are written to disk and replayed once it is back.
+type DiskBufferConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Dir holds the buffered batches; defaults to "telemetry-buffer".
+	Dir string `yaml:"dir"`
+	// MaxSizeMB caps the buffer; the oldest batches are dropped to make room.
+	// Defaults to 64.
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// MaxAge is how long a batch is kept before it is dropped; defaults to 1h.
+	MaxAge time.Duration `yaml:"max_age"`
+	// RetryInterval is how often replay is attempted while batches are
+	// waiting; defaults to 10s.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+// StatusMapping maps HTTP status codes to the span status a server span
+// should end with: "unset", "error" or "ok". Keys are exact codes ("429") or
+// classes ("4xx"); exact codes win.
+type StatusMapping map[string]string
+
+// AttributePolicies maps span kinds ("server", "client", "producer",
+// "consumer" or "internal") to the attribute policy of their spans.
+type AttributePolicies map[string]AttributePolicy
+
+// AttributePolicy lists the attributes spans of one kind must carry.
+type AttributePolicy struct {
+	// Required are the attributes a span must have when it ends.
+	Required []string `yaml:"required"`
+	// Defaults are set on spans that start without them.
+	Defaults map[string]string `yaml:"defaults"`
+}
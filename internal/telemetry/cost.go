@@ -0,0 +1,182 @@
+package telemetry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap/zapcore"
+)
+
+// CostConfig prices exported telemetry, per million items, to estimate what
+// the service costs in a vendor backend. The defaults are illustrative.
+type CostConfig struct {
+	Currency               string  `yaml:"currency"`
+	PerMillionSpans        float64 `yaml:"per_million_spans"`
+	PerMillionMetricPoints float64 `yaml:"per_million_metric_points"`
+	PerMillionLogRecords   float64 `yaml:"per_million_log_records"`
+}
+
+// Signal names used by the cost estimate.
+const (
+	signalSpans        = "spans"
+	signalMetricPoints = "metric_points"
+	signalLogRecords   = "log_records"
+)
+
+var costSignals = []string{signalSpans, signalMetricPoints, signalLogRecords}
+
+const (
+	costSlot  = 10 * time.Second
+	costSlots = 6 // one minute
+)
+
+// costTracker counts exported items in a sliding one-minute window of
+// ten-second slots.
+type costTracker struct {
+	mu    sync.Mutex
+	cfg   CostConfig
+	slots [costSlots]struct {
+		index  int64
+		counts map[string]int64
+	}
+}
+
+var costs = &costTracker{cfg: CostConfig{
+	Currency:               "USD",
+	PerMillionSpans:        2.00,
+	PerMillionMetricPoints: 0.10,
+	PerMillionLogRecords:   0.50,
+}}
+
+func (t *costTracker) configure(cfg CostConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cfg.Currency != "" {
+		t.cfg.Currency = cfg.Currency
+	}
+	if cfg.PerMillionSpans > 0 {
+		t.cfg.PerMillionSpans = cfg.PerMillionSpans
+	}
+	if cfg.PerMillionMetricPoints > 0 {
+		t.cfg.PerMillionMetricPoints = cfg.PerMillionMetricPoints
+	}
+	if cfg.PerMillionLogRecords > 0 {
+		t.cfg.PerMillionLogRecords = cfg.PerMillionLogRecords
+	}
+}
+
+func (t *costTracker) add(signal string, n int) {
+	index := time.Now().UnixNano() / int64(costSlot)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slot := &t.slots[index%costSlots]
+	if slot.index != index || slot.counts == nil {
+		slot.index = index
+		slot.counts = make(map[string]int64)
+	}
+	slot.counts[signal] += int64(n)
+}
+
+// SignalCost is the estimate for one signal.
+type SignalCost struct {
+	PerMinute          float64 `json:"per_minute"`
+	UnitCostPerMillion float64 `json:"unit_cost_per_million"`
+	CostPerHour        float64 `json:"cost_per_hour"`
+	CostPerMonth       float64 `json:"cost_per_month"`
+}
+
+// CostEstimate extrapolates the last minute of exported telemetry.
+type CostEstimate struct {
+	Window       string                `json:"window"`
+	Currency     string                `json:"currency"`
+	Signals      map[string]SignalCost `json:"signals"`
+	CostPerHour  float64               `json:"cost_per_hour"`
+	CostPerMonth float64               `json:"cost_per_month"`
+}
+
+// EstimateCost returns the estimated cost of the telemetry exported in the
+// last minute, extrapolated to an hour and a 30-day month. Sampling and log
+// level changes show up within a minute.
+func EstimateCost() CostEstimate {
+	now := time.Now().UnixNano() / int64(costSlot)
+	t := costs
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make(map[string]int64)
+	for _, slot := range t.slots {
+		if now-slot.index < costSlots {
+			for signal, n := range slot.counts {
+				counts[signal] += n
+			}
+		}
+	}
+
+	prices := map[string]float64{
+		signalSpans:        t.cfg.PerMillionSpans,
+		signalMetricPoints: t.cfg.PerMillionMetricPoints,
+		signalLogRecords:   t.cfg.PerMillionLogRecords,
+	}
+	est := CostEstimate{Window: "1m", Currency: t.cfg.Currency, Signals: make(map[string]SignalCost)}
+	for _, signal := range costSignals {
+		perMinute := float64(counts[signal])
+		perHour := perMinute * 60 * prices[signal] / 1e6
+		est.Signals[signal] = SignalCost{
+			PerMinute:          perMinute,
+			UnitCostPerMillion: prices[signal],
+			CostPerHour:        perHour,
+			CostPerMonth:       perHour * 24 * 30,
+		}
+		est.CostPerHour += perHour
+		est.CostPerMonth += perHour * 24 * 30
+	}
+	return est
+}
+
+var costMetricsOnce sync.Once
+
+// registerCostMetrics exports the estimate as gauges. Instruments are only
+// registered by the first Setup.
+func registerCostMetrics() (err error) {
+	costMetricsOnce.Do(func() { err = newCostMetrics() })
+	return err
+}
+
+func newCostMetrics() error {
+	m := meter()
+	rate, err := m.Float64ObservableGauge(
+		"telemetry_exported_items_per_minute",
+		metric.WithDescription("Telemetry items exported in the last minute, by signal"),
+		metric.WithUnit("{item}"),
+	)
+	if err != nil {
+		return err
+	}
+	cost, err := m.Float64ObservableGauge(
+		"telemetry_estimated_cost_per_hour",
+		metric.WithDescription("Estimated backend cost per hour of the telemetry exported in the last minute, by signal"),
+		metric.WithUnit("{"+costs.cfg.Currency+"}"),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = m.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		est := EstimateCost()
+		for signal, c := range est.Signals {
+			attrs := metric.WithAttributes(attribute.String("signal", signal))
+			o.ObserveFloat64(rate, c.PerMinute, attrs)
+			o.ObserveFloat64(cost, c.CostPerHour, attrs)
+		}
+		return nil
+	}, rate, cost)
+	return err
+}
+
+// countLogRecord is a zap hook counting written log records.
+func countLogRecord(zapcore.Entry) error {
+	costs.add(signalLogRecords, 1)
+	return nil
+}
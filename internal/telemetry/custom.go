@@ -0,0 +1,146 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.uber.org/zap"
+)
+
+// InstrumentConfig defines an instrument created at startup from
+// metrics.instruments, so exercises can add metrics without recompiling.
+// Code looks it up with Instrument.
+type InstrumentConfig struct {
+	Name string `yaml:"name"`
+	// Kind is "counter" or "histogram".
+	Kind        string `yaml:"kind"`
+	Unit        string `yaml:"unit"`
+	Description string `yaml:"description"`
+	// Attributes lists the attribute keys measurements may carry. Other
+	// attributes are dropped, which keeps the series count bounded.
+	Attributes []string `yaml:"attributes"`
+	// Buckets are explicit bucket boundaries for histograms.
+	Buckets []float64 `yaml:"buckets"`
+}
+
+// CustomInstrument is an instrument defined in the configuration.
+type CustomInstrument struct {
+	name    string
+	kind    string
+	allowed []string
+	counter metric.Float64Counter
+	hist    metric.Float64Histogram
+
+	dropped sync.Map // attribute keys and methods already warned about
+}
+
+var customInstruments atomic.Pointer[map[string]*CustomInstrument]
+
+// Instrument returns the instrument defined as name in metrics.instruments.
+// An unknown name returns a no-op instrument and logs a warning once.
+func Instrument(name string) *CustomInstrument {
+	if m := customInstruments.Load(); m != nil {
+		if inst, ok := (*m)[name]; ok {
+			return inst
+		}
+		if _, warned := unknownInstruments.LoadOrStore(name, true); !warned {
+			Logger().Warn("unknown instrument; define it under metrics.instruments", zap.String("instrument", name))
+		}
+	}
+	return &CustomInstrument{name: name, counter: noop.Float64Counter{}, hist: noop.Float64Histogram{}}
+}
+
+var unknownInstruments sync.Map
+
+// registerInstruments creates the configured instruments, replacing any
+// created before.
+func registerInstruments(cfgs []InstrumentConfig) error {
+	m := make(map[string]*CustomInstrument, len(cfgs))
+	for i, cfg := range cfgs {
+		if cfg.Name == "" {
+			return fmt.Errorf("metrics.instruments[%d]: name is required", i)
+		}
+		if _, ok := m[cfg.Name]; ok {
+			return fmt.Errorf("metrics.instruments[%d] %q: defined twice", i, cfg.Name)
+		}
+
+		inst := &CustomInstrument{name: cfg.Name, kind: cfg.Kind, allowed: cfg.Attributes}
+		var err error
+		switch cfg.Kind {
+		case "counter":
+			inst.counter, err = meter().Float64Counter(cfg.Name,
+				metric.WithDescription(cfg.Description),
+				metric.WithUnit(cfg.Unit),
+			)
+			inst.hist = noop.Float64Histogram{}
+		case "histogram":
+			opts := []metric.Float64HistogramOption{
+				metric.WithDescription(cfg.Description),
+				metric.WithUnit(cfg.Unit),
+			}
+			if len(cfg.Buckets) > 0 {
+				opts = append(opts, metric.WithExplicitBucketBoundaries(cfg.Buckets...))
+			}
+			inst.hist, err = meter().Float64Histogram(cfg.Name, opts...)
+			inst.counter = noop.Float64Counter{}
+		default:
+			err = fmt.Errorf("unknown kind %q, want counter or histogram", cfg.Kind)
+		}
+		if err != nil {
+			return fmt.Errorf("metrics.instruments[%d] %q: %w", i, cfg.Name, err)
+		}
+		m[cfg.Name] = inst
+	}
+	customInstruments.Store(&m)
+	return nil
+}
+
+// Add adds v to a counter. Attributes not listed in the definition are
+// dropped.
+func (c *CustomInstrument) Add(ctx context.Context, v float64, attrs ...attribute.KeyValue) {
+	c.checkKind("counter", "Add")
+	c.counter.Add(ctx, v, metric.WithAttributes(c.filter(attrs)...))
+}
+
+// Record records v in a histogram. Attributes not listed in the definition
+// are dropped.
+func (c *CustomInstrument) Record(ctx context.Context, v float64, attrs ...attribute.KeyValue) {
+	c.checkKind("histogram", "Record")
+	c.hist.Record(ctx, v, metric.WithAttributes(c.filter(attrs)...))
+}
+
+// checkKind warns once when a measurement doesn't fit the instrument's kind;
+// the measurement is dropped.
+func (c *CustomInstrument) checkKind(kind, method string) {
+	if c.kind == "" || c.kind == kind {
+		return
+	}
+	if _, warned := c.dropped.LoadOrStore(method, true); !warned {
+		Logger().Warn("instrument measured with the wrong method for its kind",
+			zap.String("instrument", c.name),
+			zap.String("kind", c.kind),
+			zap.String("method", method))
+	}
+}
+
+func (c *CustomInstrument) filter(attrs []attribute.KeyValue) []attribute.KeyValue {
+	kept := attrs[:0:0]
+	for _, kv := range attrs {
+		if slices.Contains(c.allowed, string(kv.Key)) {
+			kept = append(kept, kv)
+			continue
+		}
+		if _, warned := c.dropped.LoadOrStore(kv.Key, true); !warned {
+			Logger().Warn("dropping attribute not allowed by instrument definition",
+				zap.String("instrument", c.name),
+				zap.String("attribute", string(kv.Key)))
+		}
+	}
+	return kept
+}
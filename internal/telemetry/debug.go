@@ -0,0 +1,107 @@
+package telemetry
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DebugHeader requests verbose tracing for a single request.
+const DebugHeader = "X-Debug-Trace"
+
+// DebugKey marks spans created in debug mode.
+const DebugKey = attribute.Key("debug.trace")
+
+type debugCtxKey struct{}
+
+// WithDebug marks ctx as a debug request: spans started from it are always
+// sampled, DebugEvent records events, and LoggerFor logs at every level.
+func WithDebug(ctx context.Context) context.Context {
+	return context.WithValue(ctx, debugCtxKey{}, true)
+}
+
+// DebugEnabled reports whether ctx belongs to a debug request.
+func DebugEnabled(ctx context.Context) bool {
+	on, _ := ctx.Value(debugCtxKey{}).(bool)
+	return on
+}
+
+// DebugMiddleware enables debug mode for requests that send
+// "X-Debug-Trace: 1" from an address in trusted. The header is ignored from
+// anyone else, so it can't be used to flood the trace backend. Install it
+// before ServerSpanMiddleware so the server span is sampled too.
+func DebugMiddleware(trusted []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(DebugHeader) == "1" && isTrusted(trusted, r.RemoteAddr) {
+			r = r.WithContext(WithDebug(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isTrusted(trusted []netip.Prefix, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// DebugEvent adds an event to the span in ctx, but only for debug requests.
+// Use it for detail too noisy to record on every request.
+func DebugEvent(ctx context.Context, name string, attrs ...attribute.KeyValue) {
+	if DebugEnabled(ctx) {
+		trace.SpanFromContext(ctx).AddEvent(name, trace.WithAttributes(attrs...))
+	}
+}
+
+// LoggerFor returns Logger, tagged with the trace_id and span_id of the span
+// in ctx, so a log line leads to its trace and back, and with the serving
+// instance if there are several. For debug requests every level is logged
+// regardless of LogLevel.
+func LoggerFor(ctx context.Context) *zap.Logger {
+	l := Logger()
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With(zap.String("trace_id", sc.TraceID().String()), zap.String("span_id", sc.SpanID().String()))
+	}
+	if id := Instance(ctx); id != "" {
+		l = l.With(zap.String(string(InstanceKey), id))
+	}
+	if !DebugEnabled(ctx) {
+		return l
+	}
+	return l.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return verboseCore{c}
+	})).With(zap.Bool(string(DebugKey), true))
+}
+
+// verboseCore enables every level of the core it wraps.
+type verboseCore struct {
+	zapcore.Core
+}
+
+func (c verboseCore) Enabled(zapcore.Level) bool { return true }
+
+func (c verboseCore) With(fields []zapcore.Field) zapcore.Core {
+	return verboseCore{c.Core.With(fields)}
+}
+
+func (c verboseCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return ce.AddCore(ent, c)
+}
@@ -0,0 +1,385 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// exportMethods are the OTLP gRPC methods buffered batches are replayed to.
+var exportMethods = map[string]string{
+	"traces":  "/opentelemetry.proto.collector.trace.v1.TraceService/Export",
+	"metrics": "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export",
+}
+
+// diskBuffer stores OTLP export requests that failed because the collector
+// could not be reached and replays them, oldest first, once it can. Batches
+// are kept as one file per request, named <unix nanos>-<signal>.pb, so they
+// survive restarts. The exporter sees a buffered batch as exported, which
+// replaces the SDK's in-memory retries.
+type diskBuffer struct {
+	cfg DiskBufferConfig
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+	files []bufferedBatch
+
+	batches metric.Int64Counter
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type bufferedBatch struct {
+	path    string
+	signal  string
+	created time.Time
+	size    int64
+}
+
+type replayCtxKey struct{}
+
+func newDiskBuffer(cfg DiskBufferConfig) (*diskBuffer, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = "telemetry-buffer"
+	}
+	if cfg.MaxSizeMB <= 0 {
+		cfg.MaxSizeMB = 64
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = time.Hour
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 10 * time.Second
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	b := &diskBuffer{
+		cfg:   cfg,
+		conns: make(map[string]*grpc.ClientConn),
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	b.batches, err = meter().Int64Counter(
+		"telemetry_buffer_batches_total",
+		metric.WithDescription("Number of OTLP export batches buffered to disk, replayed or dropped"),
+		metric.WithUnit("{batch}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter().Int64ObservableGauge(
+		"telemetry_buffer_size_bytes",
+		metric.WithDescription("Size of the OTLP export batches waiting on disk"),
+		metric.WithUnit("By"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for signal, st := range b.stats() {
+				o.Observe(st.size, metric.WithAttributes(attribute.String("signal", signal)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter().Float64ObservableGauge(
+		"telemetry_buffer_oldest_age_seconds",
+		metric.WithDescription("Age of the oldest OTLP export batch waiting on disk"),
+		metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			for signal, st := range b.stats() {
+				o.Observe(time.Since(st.oldest).Seconds(), metric.WithAttributes(attribute.String("signal", signal)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	go b.run()
+	return b, nil
+}
+
+// load picks up the batches a previous run left behind.
+func (b *diskBuffer) load() error {
+	entries, err := os.ReadDir(b.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".pb")
+		nanos, signal, found := strings.Cut(name, "-")
+		if !ok || !found || e.IsDir() {
+			continue
+		}
+		n, err := strconv.ParseInt(nanos, 10, 64)
+		info, infoErr := e.Info()
+		if err != nil || infoErr != nil {
+			continue
+		}
+		b.files = append(b.files, bufferedBatch{
+			path:    filepath.Join(b.cfg.Dir, e.Name()),
+			signal:  signal,
+			created: time.Unix(0, n),
+			size:    info.Size(),
+		})
+	}
+	sort.Slice(b.files, func(i, j int) bool { return b.files[i].created.Before(b.files[j].created) })
+	if len(b.files) > 0 {
+		Logger().Info("restored buffered telemetry batches", zap.Int("count", len(b.files)))
+	}
+	return nil
+}
+
+// interceptor returns a gRPC client interceptor to install on OTLP exporters.
+func (b *diskBuffer) interceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if ctx.Value(replayCtxKey{}) != nil {
+			return err
+		}
+		signal := signalFromMethod(method)
+		b.mu.Lock()
+		b.conns[signal] = cc
+		b.mu.Unlock()
+
+		msg, ok := req.(proto.Message)
+		if err == nil || !ok || !offline(err) {
+			if err == nil {
+				b.trigger()
+			}
+			return err
+		}
+		if err := b.store(ctx, signal, msg); err != nil {
+			Logger().Warn("buffering telemetry batch", zap.String("signal", signal), zap.Error(err))
+			return err
+		}
+		return nil
+	}
+}
+
+// offline reports whether an export failed because the collector could not
+// be reached, as opposed to rejecting the batch.
+func offline(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+func (b *diskBuffer) store(ctx context.Context, signal string, msg proto.Message) error {
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Make room by dropping the oldest batches.
+	for b.total()+int64(len(raw)) > int64(b.cfg.MaxSizeMB)<<20 && len(b.files) > 0 {
+		b.drop(ctx, b.files[0], "dropped_full")
+		b.files = b.files[1:]
+	}
+
+	now := time.Now()
+	f := bufferedBatch{
+		path:    filepath.Join(b.cfg.Dir, fmt.Sprintf("%d-%s.pb", now.UnixNano(), signal)),
+		signal:  signal,
+		created: now,
+		size:    int64(len(raw)),
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+	b.files = append(b.files, f)
+	b.count(ctx, signal, "buffered")
+	return nil
+}
+
+// total returns the size of all buffered batches. b.mu must be held.
+func (b *diskBuffer) total() int64 {
+	var n int64
+	for _, f := range b.files {
+		n += f.size
+	}
+	return n
+}
+
+// drop removes f's file. b.mu must be held.
+func (b *diskBuffer) drop(ctx context.Context, f bufferedBatch, result string) {
+	os.Remove(f.path)
+	b.count(ctx, f.signal, result)
+}
+
+func (b *diskBuffer) count(ctx context.Context, signal, result string) {
+	if b.batches != nil {
+		b.batches.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("signal", signal),
+			attribute.String("result", result),
+		))
+	}
+}
+
+type bufferStats struct {
+	size   int64
+	oldest time.Time
+}
+
+func (b *diskBuffer) stats() map[string]bufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := make(map[string]bufferStats)
+	for _, f := range b.files {
+		st, ok := stats[f.signal]
+		if !ok {
+			st.oldest = f.created
+		}
+		st.size += f.size
+		stats[f.signal] = st
+	}
+	return stats
+}
+
+// trigger asks the replay loop to run now, e.g. after an export got through.
+func (b *diskBuffer) trigger() {
+	b.mu.Lock()
+	pending := len(b.files) > 0
+	b.mu.Unlock()
+	if pending {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *diskBuffer) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.cfg.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.wake:
+		case <-b.stop:
+			return
+		}
+		b.replay()
+	}
+}
+
+// replay sends buffered batches, oldest first, until one fails. Batches
+// older than MaxAge are dropped, and batches of a signal whose exporter has
+// not connected in this run wait for it.
+func (b *diskBuffer) replay() {
+	ctx := context.WithValue(context.Background(), replayCtxKey{}, true)
+	replayed := 0
+	defer func() {
+		if replayed > 0 {
+			Logger().Info("replayed buffered telemetry batches", zap.Int("count", replayed))
+		}
+	}()
+
+	for i := 0; ; {
+		b.mu.Lock()
+		if i >= len(b.files) {
+			b.mu.Unlock()
+			return
+		}
+		f := b.files[i]
+		if time.Since(f.created) > b.cfg.MaxAge {
+			b.drop(ctx, f, "dropped_expired")
+			b.files = append(b.files[:i], b.files[i+1:]...)
+			b.mu.Unlock()
+			continue
+		}
+		cc, method := b.conns[f.signal], exportMethods[f.signal]
+		b.mu.Unlock()
+		if cc == nil || method == "" {
+			i++
+			continue
+		}
+
+		raw, err := os.ReadFile(f.path)
+		if err == nil {
+			callCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err = cc.Invoke(callCtx, method, raw, &discardReply{}, grpc.ForceCodec(rawCodec{}))
+			cancel()
+			if offline(err) {
+				return
+			}
+		}
+		// Rejected or unreadable batches would fail the same way again.
+		result := "replayed"
+		if err != nil {
+			result = "dropped_rejected"
+			Logger().Warn("dropping buffered telemetry batch", zap.String("signal", f.signal), zap.Error(err))
+		} else {
+			replayed++
+		}
+		b.mu.Lock()
+		b.drop(ctx, f, result)
+		for j := range b.files {
+			if b.files[j].path == f.path {
+				b.files = append(b.files[:j], b.files[j+1:]...)
+				break
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *diskBuffer) Shutdown(context.Context) error {
+	close(b.stop)
+	<-b.done
+	return nil
+}
+
+// rawCodec sends buffered batches as the bytes they were stored as, so
+// replaying needs no OTLP message types.
+type rawCodec struct{}
+
+type discardReply struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	raw, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: cannot marshal %T", v)
+	}
+	return raw, nil
+}
+
+func (rawCodec) Unmarshal([]byte, any) error { return nil }
+
+func (rawCodec) Name() string { return "proto" }
@@ -0,0 +1,110 @@
+package telemetry
+
+import (
+	"context"
+	"path"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// DryRunKey marks spans created while handling a dry run.
+const DryRunKey = attribute.Key("dry_run")
+
+// DefaultDryRunExclude are the instruments dry runs don't record into when
+// metrics.dry_run_exclude is not set: the payment business metrics.
+var DefaultDryRunExclude = []string{"payment_*"}
+
+type dryRunCtxKey struct{}
+
+// WithDryRun marks ctx as a dry run: spans started from it carry
+// dry_run=true and excluded instruments ignore measurements made with it.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunCtxKey{}, true)
+}
+
+// DryRun reports whether ctx belongs to a dry run.
+func DryRun(ctx context.Context) bool {
+	on, _ := ctx.Value(dryRunCtxKey{}).(bool)
+	return on
+}
+
+var dryRunExclude atomic.Pointer[[]string]
+
+// setDryRunExclude sets the instrument name patterns, in path.Match syntax,
+// that drop dry-run measurements. Only instruments created afterwards are
+// affected.
+func setDryRunExclude(patterns []string) {
+	if patterns == nil {
+		patterns = DefaultDryRunExclude
+	}
+	dryRunExclude.Store(&patterns)
+}
+
+// excludesDryRun reports whether the instrument name drops dry-run
+// measurements.
+func excludesDryRun(name string) bool {
+	patterns := DefaultDryRunExclude
+	if p := dryRunExclude.Load(); p != nil {
+		patterns = *p
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The dryRun* wrappers act as a view on an instrument, filtering out
+// measurements by the dry-run mark of their context. SDK views can only
+// filter attribute keys, not drop measurements by attribute value.
+
+type dryRunInt64Counter struct{ metric.Int64Counter }
+
+func (c dryRunInt64Counter) Add(ctx context.Context, v int64, opts ...metric.AddOption) {
+	if !DryRun(ctx) {
+		c.Int64Counter.Add(ctx, v, opts...)
+	}
+}
+
+type dryRunFloat64Counter struct{ metric.Float64Counter }
+
+func (c dryRunFloat64Counter) Add(ctx context.Context, v float64, opts ...metric.AddOption) {
+	if !DryRun(ctx) {
+		c.Float64Counter.Add(ctx, v, opts...)
+	}
+}
+
+type dryRunInt64UpDownCounter struct{ metric.Int64UpDownCounter }
+
+func (c dryRunInt64UpDownCounter) Add(ctx context.Context, v int64, opts ...metric.AddOption) {
+	if !DryRun(ctx) {
+		c.Int64UpDownCounter.Add(ctx, v, opts...)
+	}
+}
+
+type dryRunFloat64UpDownCounter struct{ metric.Float64UpDownCounter }
+
+func (c dryRunFloat64UpDownCounter) Add(ctx context.Context, v float64, opts ...metric.AddOption) {
+	if !DryRun(ctx) {
+		c.Float64UpDownCounter.Add(ctx, v, opts...)
+	}
+}
+
+type dryRunInt64Histogram struct{ metric.Int64Histogram }
+
+func (h dryRunInt64Histogram) Record(ctx context.Context, v int64, opts ...metric.RecordOption) {
+	if !DryRun(ctx) {
+		h.Int64Histogram.Record(ctx, v, opts...)
+	}
+}
+
+type dryRunFloat64Histogram struct{ metric.Float64Histogram }
+
+func (h dryRunFloat64Histogram) Record(ctx context.Context, v float64, opts ...metric.RecordOption) {
+	if !DryRun(ctx) {
+		h.Float64Histogram.Record(ctx, v, opts...)
+	}
+}
@@ -0,0 +1,96 @@
+package telemetry
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envConfig builds the configuration from the standard OTEL_* environment
+// variables, for Setup without a config file, e.g. in a container that has
+// none mounted. It reports false if none of the variables that select an
+// exporter or name the service is set, so a plain local run keeps the no-op
+// providers.
+//
+// OTEL_TRACES_EXPORTER and OTEL_METRICS_EXPORTER pick the exporter: otlp
+// (the default), console or none. The OTLP exporters read
+// OTEL_EXPORTER_OTLP_ENDPOINT, _HEADERS, _INSECURE and their per-signal
+// variants themselves, and the metric reader OTEL_METRIC_EXPORT_INTERVAL.
+// OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG set the sampling ratio;
+// parent-based sampling is always on. OTEL_PROPAGATORS lists the
+// propagators.
+func envConfig() (*Config, bool, error) {
+	if !envConfigured() {
+		return nil, false, nil
+	}
+	if p := envValue("OTEL_EXPORTER_OTLP_PROTOCOL"); p != "" && p != "grpc" {
+		return nil, false, fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL=%s: only grpc is supported", p)
+	}
+	var cfg Config
+	var err error
+	if cfg.Traces.Exporter, err = envExporter("OTEL_TRACES_EXPORTER"); err != nil {
+		return nil, false, err
+	}
+	if cfg.Metrics.Exporter, err = envExporter("OTEL_METRICS_EXPORTER"); err != nil {
+		return nil, false, err
+	}
+	if cfg.Traces.SamplingRatio, err = envSamplingRatio(); err != nil {
+		return nil, false, err
+	}
+	if v := envValue("OTEL_PROPAGATORS"); v != "" {
+		cfg.Propagators = strings.Split(v, ",")
+	}
+	return &cfg, true, nil
+}
+
+func envConfigured() bool {
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		switch {
+		case strings.HasPrefix(name, "OTEL_EXPORTER_OTLP_"),
+			name == "OTEL_SERVICE_NAME",
+			name == "OTEL_TRACES_EXPORTER",
+			name == "OTEL_METRICS_EXPORTER":
+			return true
+		}
+	}
+	return false
+}
+
+// envValue returns the trimmed, lower-case value of the variable name.
+func envValue(name string) string {
+	return strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+}
+
+func envExporter(name string) (ExporterConfig, error) {
+	switch v := envValue(name); v {
+	case "", "otlp":
+		// Endpoint and TLS come from OTEL_EXPORTER_OTLP_*.
+		return ExporterConfig{Type: "otlp"}, nil
+	case "console", "none":
+		return ExporterConfig{Type: v}, nil
+	default:
+		return ExporterConfig{}, fmt.Errorf("%s=%s: want otlp, console or none", name, v)
+	}
+}
+
+func envSamplingRatio() (*float64, error) {
+	ratio := 1.0
+	switch sampler := envValue("OTEL_TRACES_SAMPLER"); sampler {
+	case "", "always_on", "parentbased_always_on":
+	case "always_off", "parentbased_always_off":
+		ratio = 0
+	case "traceidratio", "parentbased_traceidratio":
+		if arg := envValue("OTEL_TRACES_SAMPLER_ARG"); arg != "" {
+			r, err := strconv.ParseFloat(arg, 64)
+			if err != nil || r < 0 || r > 1 {
+				return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG=%s: want a ratio between 0 and 1", arg)
+			}
+			ratio = r
+		}
+	default:
+		return nil, fmt.Errorf("OTEL_TRACES_SAMPLER=%s: unsupported sampler", sampler)
+	}
+	return &ratio, nil
+}
@@ -0,0 +1,120 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// exportErrorLogInterval is how often an SDK error of each signal is
+// logged at most. A collector that is down fails every export, so logging
+// each one would flood the logs the errors are meant to stand out in.
+const exportErrorLogInterval = 10 * time.Second
+
+// sdkErrorHandler logs the errors the OTel SDK reports through otel.Handle,
+// such as failed exports and spans dropped by a full queue, which the
+// default handler writes to stderr. Errors are logged through the service
+// logger, at most once per exportErrorLogInterval and signal, with the
+// number left out since the last; all of them are counted in
+// telemetry_export_errors_total{signal}.
+type sdkErrorHandler struct {
+	mu      sync.Mutex
+	logged  map[string]time.Time
+	skipped map[string]int
+}
+
+// sdkErrors is the handler Install sets, shared by every Setup, so the
+// rate limit holds across them.
+var sdkErrors = &sdkErrorHandler{logged: make(map[string]time.Time), skipped: make(map[string]int)}
+
+func (h *sdkErrorHandler) Handle(err error) {
+	if err == nil {
+		return
+	}
+	signal := errorSignal(err)
+	countExportError(signal)
+
+	h.mu.Lock()
+	if time.Since(h.logged[signal]) < exportErrorLogInterval {
+		h.skipped[signal]++
+		h.mu.Unlock()
+		return
+	}
+	skipped := h.skipped[signal]
+	h.logged[signal], h.skipped[signal] = time.Now(), 0
+	h.mu.Unlock()
+
+	// Logger would report a call before Setup in strict mode; the SDK can
+	// fail before then, or after Shutdown.
+	l := globalLogger.Load()
+	if l == nil {
+		return
+	}
+	l.Error("OpenTelemetry SDK error",
+		zap.String("signal", signal),
+		zap.Int("suppressed", skipped),
+		zap.Error(err))
+}
+
+// errorSignal guesses the signal an SDK error is about from its message;
+// the SDK's errors carry no other clue.
+func errorSignal(err error) string {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "span"), strings.Contains(msg, "trace"):
+		return "traces"
+	case strings.Contains(msg, "metric"):
+		return "metrics"
+	case strings.Contains(msg, "log"):
+		return "logs"
+	}
+	return "other"
+}
+
+// exportErrors counts the SDK errors handled, by signal.
+var exportErrors sync.Map
+
+func countExportError(signal string) {
+	n, ok := exportErrors.Load(signal)
+	if !ok {
+		n, _ = exportErrors.LoadOrStore(signal, new(atomic.Int64))
+	}
+	n.(*atomic.Int64).Add(1)
+}
+
+var exportErrorMetricsOnce sync.Once
+
+// registerExportErrorMetrics exports the SDK errors handled as an
+// observable counter: a failing metric export would otherwise measure into
+// the pipeline that is failing. Instruments are only registered by the
+// first Setup.
+func registerExportErrorMetrics() (err error) {
+	exportErrorMetricsOnce.Do(func() {
+		m := meter()
+		var errs metric.Int64ObservableCounter
+		errs, err = m.Int64ObservableCounter(
+			"telemetry_export_errors_total",
+			metric.WithDescription("Number of errors the OpenTelemetry SDK reported, such as failed exports, by signal"),
+			metric.WithUnit("{error}"),
+		)
+		if err != nil {
+			return
+		}
+		_, err = m.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+			exportErrors.Range(func(k, v any) bool {
+				o.ObserveInt64(errs, v.(*atomic.Int64).Load(), metric.WithAttributes(attribute.String("signal", k.(string))))
+				return true
+			})
+			return nil
+		}, errs)
+	})
+	return err
+}
@@ -0,0 +1,125 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// FailureDomainKey is the attribute naming the part of the system an error
+// came from, so error dashboards can break failures down by cause.
+const FailureDomainKey = attribute.Key("failure.domain")
+
+// Failure domains.
+const (
+	DomainStore    = "store"
+	DomainFraud    = "fraud"
+	DomainGateway  = "gateway"
+	DomainInternal = "internal"
+	DomainClient   = "client"
+)
+
+type domainError struct {
+	err    error
+	domain string
+}
+
+func (e *domainError) Error() string         { return e.err.Error() }
+func (e *domainError) Unwrap() error         { return e.err }
+func (e *domainError) FailureDomain() string { return e.domain }
+
+// WithFailureDomain tags err with a failure domain. The result still matches
+// err with errors.Is and errors.As.
+func WithFailureDomain(err error, domain string) error {
+	if err == nil {
+		return nil
+	}
+	return &domainError{err: err, domain: domain}
+}
+
+// FailureDomainOf returns the failure domain of err: the innermost domain it
+// was tagged with, DomainClient for cancellations by the caller, and
+// DomainInternal otherwise.
+func FailureDomainOf(err error) string {
+	var d interface{ FailureDomain() string }
+	if errors.As(err, &d) {
+		return d.FailureDomain()
+	}
+	if errors.Is(err, context.Canceled) {
+		return DomainClient
+	}
+	return DomainInternal
+}
+
+// countedError is an error that was counted in errors_total. It reads as
+// the error it wraps.
+type countedError struct{ error }
+
+func (e countedError) Unwrap() error { return e.error }
+
+// counted reports whether err, or every error it joins, was counted.
+func counted(err error) bool {
+	switch e := err.(type) {
+	case countedError:
+		return true
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			if !counted(err) {
+				return false
+			}
+		}
+		return true
+	case interface{ Unwrap() error }:
+		return counted(e.Unwrap())
+	}
+	return false
+}
+
+// SpanError records err on span, sets its status to Error and tags it with
+// the error's failure domain.
+func SpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.SetAttributes(FailureDomainKey.String(FailureDomainOf(err)))
+}
+
+var (
+	errorsOnce    sync.Once
+	errorsCounter metric.Int64Counter
+)
+
+// RecordError is SpanError for the span in ctx, plus an increment of
+// errors_total{failure.domain}. Call it once per failed operation, where the
+// error is handled rather than passed up, so errors are not counted twice.
+// An error WithSpan returned was counted by it; RecordError only sets it on
+// the span then.
+func RecordError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	SpanError(trace.SpanFromContext(ctx), err)
+	if counted(err) {
+		return
+	}
+
+	errorsOnce.Do(func() {
+		var cerr error
+		errorsCounter, cerr = Meter().Int64Counter(
+			"errors_total",
+			metric.WithDescription("Number of failed operations by failure domain"),
+			metric.WithUnit("{error}"),
+		)
+		if cerr != nil {
+			errorsCounter, _ = meter().Int64Counter("errors_total")
+		}
+	})
+	errorsCounter.Add(ctx, 1, metric.WithAttributes(FailureDomainKey.String(FailureDomainOf(err))))
+}
@@ -0,0 +1,70 @@
+package telemetry
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ExporterStatus is the result of the recent exports of one signal.
+type ExporterStatus struct {
+	Signal string `json:"signal"`
+	// Healthy is false once the last exports failed in a row, at least
+	// ExporterFailureThreshold times.
+	Healthy             bool      `json:"healthy"`
+	LastSuccess         time.Time `json:"last_success,omitzero"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastErrorAt         time.Time `json:"last_error_at,omitzero"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+// ExporterFailureThreshold is the number of failed exports in a row that
+// make an exporter unhealthy. A single failure is often a blip the next
+// export recovers from.
+const ExporterFailureThreshold = 3
+
+// exportResults holds the ExporterStatus of each signal with an exporter.
+var exportResults = struct {
+	sync.Mutex
+	m map[string]*ExporterStatus
+}{m: make(map[string]*ExporterStatus)}
+
+// resetExportResults forgets the results of the previous providers.
+func resetExportResults() {
+	exportResults.Lock()
+	defer exportResults.Unlock()
+	clear(exportResults.m)
+}
+
+// recordExport records the result of an export of signal.
+func recordExport(signal string, err error) {
+	exportResults.Lock()
+	defer exportResults.Unlock()
+	st, ok := exportResults.m[signal]
+	if !ok {
+		st = &ExporterStatus{Signal: signal}
+		exportResults.m[signal] = st
+	}
+	if err == nil {
+		st.LastSuccess = time.Now()
+		st.ConsecutiveFailures = 0
+		return
+	}
+	st.LastError, st.LastErrorAt = err.Error(), time.Now()
+	st.ConsecutiveFailures++
+}
+
+// ExporterHealth returns the status of the exporter of each signal that has
+// exported since Setup, by signal.
+func ExporterHealth() []ExporterStatus {
+	exportResults.Lock()
+	defer exportResults.Unlock()
+	out := make([]ExporterStatus, 0, len(exportResults.m))
+	for _, st := range exportResults.m {
+		s := *st
+		s.Healthy = s.ConsecutiveFailures < ExporterFailureThreshold
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Signal < out[j].Signal })
+	return out
+}
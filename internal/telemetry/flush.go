@@ -0,0 +1,82 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// installed are the providers of the last Install, for Flush.
+var installedProviders atomic.Pointer[Providers]
+
+// FlushResult is the outcome of flushing one signal.
+type FlushResult struct {
+	Signal string `json:"signal"`
+	// Enabled is false if the signal has no provider, e.g. before Setup or
+	// when Setup found no configuration.
+	Enabled    bool    `json:"enabled"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Flush exports everything the installed providers hold: the spans queued
+// in the batch span processors, the metrics of every periodic reader, and
+// the buffered log output. The signals flush in parallel, so a slow one
+// doesn't spend the others' share of ctx. It returns when each export has
+// returned, or ctx is done, with one result per signal.
+func Flush(ctx context.Context) []FlushResult {
+	p := installedProviders.Load()
+	if p == nil {
+		p = &Providers{}
+	}
+	var traces, metrics, logs func(context.Context) error
+	if p.TracerProvider != nil {
+		traces = p.TracerProvider.ForceFlush
+	}
+	if p.MeterProvider != nil {
+		metrics = p.MeterProvider.ForceFlush
+	}
+	if p.Logger != nil {
+		logs = func(context.Context) error { return syncLogger(p) }
+	}
+	signals := []struct {
+		name  string
+		flush func(context.Context) error
+	}{{"traces", traces}, {"metrics", metrics}, {"logs", logs}}
+	results := make([]FlushResult, len(signals))
+	var wg sync.WaitGroup
+	for i, sig := range signals {
+		wg.Go(func() { results[i] = flushSignal(ctx, sig.name, sig.flush) })
+	}
+	wg.Wait()
+	return results
+}
+
+func flushSignal(ctx context.Context, signal string, flush func(context.Context) error) FlushResult {
+	r := FlushResult{Signal: signal, Enabled: flush != nil}
+	if flush == nil {
+		return r
+	}
+	start := time.Now()
+	err := flush(ctx)
+	r.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// syncLogger syncs the logger's output. Stdout can't be synced when it is
+// a terminal or a pipe; there is nothing buffered to lose then.
+func syncLogger(p *Providers) error {
+	err := p.Logger.Sync()
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTTY) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package telemetry
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Instruments from Meter never panic: before Setup they are delegates of the
+// global MeterProvider, and after shutdown the SDK ignores them. Either way
+// their measurements are lost without a trace. The guarded* wrappers make
+// those losses visible: a measurement made before Setup has installed the
+// SDK, or after the Providers it returned have been shut down, is dropped and
+// counted in telemetry_dropped_measurements_total{reason}. In StrictLog mode
+// the first early measurement of each instrument is also logged, which
+// points at the code that records before Setup.
+
+// Reasons a measurement is dropped.
+const (
+	dropBeforeSetup   = "before_setup"
+	dropAfterShutdown = "after_shutdown"
+)
+
+var (
+	shutDown             atomic.Bool
+	droppedBeforeSetup   atomic.Int64
+	droppedAfterShutdown atomic.Int64
+	reportedEarly        sync.Map // map[string]bool
+)
+
+// DroppedMeasurements returns the number of measurements dropped because
+// they were made before Setup or after shutdown. Those made after shutdown
+// can't be exported, so this is the only place they show up.
+func DroppedMeasurements() (beforeSetup, afterShutdown int64) {
+	return droppedBeforeSetup.Load(), droppedAfterShutdown.Load()
+}
+
+// dropped reports whether a measurement of the named instrument must be
+// dropped, and counts it if so.
+func dropped(name string) bool {
+	switch {
+	case shutDown.Load():
+		droppedAfterShutdown.Add(1)
+		return true
+	case !initialized.Load():
+		droppedBeforeSetup.Add(1)
+		if StrictMode(strictMode.Load()) == StrictLog {
+			if _, seen := reportedEarly.LoadOrStore(name, true); !seen {
+				log.Printf("telemetry: measurement of %s before Setup dropped", name)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+var droppedMetricsOnce sync.Once
+
+// registerDroppedMetrics exports the early drops as an observable counter.
+// Drops after shutdown are never collected. Instruments are only registered
+// by the first Setup.
+func registerDroppedMetrics() (err error) {
+	droppedMetricsOnce.Do(func() {
+		m := meter()
+		var drops metric.Int64ObservableCounter
+		drops, err = m.Int64ObservableCounter(
+			"telemetry_dropped_measurements_total",
+			metric.WithDescription("Number of measurements dropped because they were made before telemetry setup or after shutdown, by reason"),
+			metric.WithUnit("{measurement}"),
+		)
+		if err != nil {
+			return
+		}
+		_, err = m.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+			before, after := DroppedMeasurements()
+			o.ObserveInt64(drops, before, metric.WithAttributes(attribute.String("reason", dropBeforeSetup)))
+			o.ObserveInt64(drops, after, metric.WithAttributes(attribute.String("reason", dropAfterShutdown)))
+			return nil
+		}, drops)
+	})
+	return err
+}
+
+type guardedInt64Counter struct {
+	metric.Int64Counter
+	name string
+}
+
+func (c guardedInt64Counter) Add(ctx context.Context, v int64, opts ...metric.AddOption) {
+	if !dropped(c.name) {
+		c.Int64Counter.Add(ctx, v, opts...)
+	}
+}
+
+type guardedFloat64Counter struct {
+	metric.Float64Counter
+	name string
+}
+
+func (c guardedFloat64Counter) Add(ctx context.Context, v float64, opts ...metric.AddOption) {
+	if !dropped(c.name) {
+		c.Float64Counter.Add(ctx, v, opts...)
+	}
+}
+
+type guardedInt64UpDownCounter struct {
+	metric.Int64UpDownCounter
+	name string
+}
+
+func (c guardedInt64UpDownCounter) Add(ctx context.Context, v int64, opts ...metric.AddOption) {
+	if !dropped(c.name) {
+		c.Int64UpDownCounter.Add(ctx, v, opts...)
+	}
+}
+
+type guardedFloat64UpDownCounter struct {
+	metric.Float64UpDownCounter
+	name string
+}
+
+func (c guardedFloat64UpDownCounter) Add(ctx context.Context, v float64, opts ...metric.AddOption) {
+	if !dropped(c.name) {
+		c.Float64UpDownCounter.Add(ctx, v, opts...)
+	}
+}
+
+type guardedInt64Histogram struct {
+	metric.Int64Histogram
+	name string
+}
+
+func (h guardedInt64Histogram) Record(ctx context.Context, v int64, opts ...metric.RecordOption) {
+	if !dropped(h.name) {
+		h.Int64Histogram.Record(ctx, v, opts...)
+	}
+}
+
+type guardedFloat64Histogram struct {
+	metric.Float64Histogram
+	name string
+}
+
+func (h guardedFloat64Histogram) Record(ctx context.Context, v float64, opts ...metric.RecordOption) {
+	if !dropped(h.name) {
+		h.Float64Histogram.Record(ctx, v, opts...)
+	}
+}
+
+type guardedInt64Gauge struct {
+	metric.Int64Gauge
+	name string
+}
+
+func (g guardedInt64Gauge) Record(ctx context.Context, v int64, opts ...metric.RecordOption) {
+	if !dropped(g.name) {
+		g.Int64Gauge.Record(ctx, v, opts...)
+	}
+}
+
+type guardedFloat64Gauge struct {
+	metric.Float64Gauge
+	name string
+}
+
+func (g guardedFloat64Gauge) Record(ctx context.Context, v float64, opts ...metric.RecordOption) {
+	if !dropped(g.name) {
+		g.Float64Gauge.Record(ctx, v, opts...)
+	}
+}
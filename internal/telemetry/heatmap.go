@@ -0,0 +1,178 @@
+package telemetry
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HeatmapMetric is the histogram the latency heatmap is built from.
+const HeatmapMetric = "http.server.request.duration"
+
+// HeatmapConfig keeps recent windows of the request duration histogram in
+// process, so its bucket counts can be drawn as a heatmap: one column per
+// window, one row per bucket. Next to percentiles of the same windows, it
+// shows what percentiles hide, such as a bimodal latency distribution.
+type HeatmapConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Window is the time each column covers; defaults to 10s.
+	Window time.Duration `yaml:"window"`
+	// Windows is the number of columns kept, newest last; defaults to 60.
+	Windows int `yaml:"windows"`
+}
+
+// HeatmapWindow is one column of the latency heatmap.
+type HeatmapWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Count uint64    `json:"count"`
+	// Counts are the number of requests per bucket: Counts[i] took at most
+	// Bounds[i], and more than Bounds[i-1]. The last bucket is above every
+	// bound.
+	Counts []uint64 `json:"counts"`
+	// P50, P95 and P99 are estimated from the bucket counts by linear
+	// interpolation, the way backends compute percentiles from histograms.
+	// They are 0 for a window without requests.
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// LatencyHeatmapState is the latency heatmap of the requests of one route,
+// or of every route.
+type LatencyHeatmapState struct {
+	Enabled bool   `json:"enabled"`
+	Metric  string `json:"metric,omitempty"`
+	Unit    string `json:"unit,omitempty"`
+	// Method and Route are the filter the heatmap was built for; empty
+	// matches every method or route.
+	Method        string  `json:"method,omitempty"`
+	Route         string  `json:"route,omitempty"`
+	WindowSeconds float64 `json:"window_seconds,omitempty"`
+	// Bounds are the upper bounds of the buckets, in seconds.
+	Bounds []float64 `json:"bounds,omitempty"`
+	// Routes lists the method and route of every request in the heatmap's
+	// windows, as "GET /api/payment", to filter by.
+	Routes  []string        `json:"routes,omitempty"`
+	Windows []HeatmapWindow `json:"windows,omitempty"`
+}
+
+// heatmap holds the windows of the installed providers, if enabled.
+var heatmap atomic.Pointer[heatmapWindows]
+
+// LatencyHeatmap returns the latency heatmap of the requests with method and
+// route, either of which may be empty to match all.
+func LatencyHeatmap(method, route string) LatencyHeatmapState {
+	h := heatmap.Load()
+	if h == nil {
+		return LatencyHeatmapState{}
+	}
+	return h.state(method, route)
+}
+
+// heatmapWindow holds the bucket counts of one window, by route.
+type heatmapWindow struct {
+	start, end time.Time
+	counts     map[routeKey][]uint64
+}
+
+// heatmapWindows keeps the most recent windows.
+type heatmapWindows struct {
+	cfg HeatmapConfig
+
+	mu      sync.Mutex
+	bounds  []float64
+	windows []heatmapWindow
+}
+
+func newHeatmapWindows(cfg HeatmapConfig) *heatmapWindows {
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Second
+	}
+	if cfg.Windows <= 0 {
+		cfg.Windows = 60
+	}
+	return &heatmapWindows{cfg: cfg}
+}
+
+// add appends a window. Windows with other bounds are dropped, since their
+// buckets can't be compared.
+func (h *heatmapWindows) add(start, end time.Time, bounds []float64, counts map[routeKey][]uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if bounds != nil && !slices.Equal(bounds, h.bounds) {
+		h.bounds = bounds
+		h.windows = nil
+	}
+	h.windows = append(h.windows, heatmapWindow{start: start, end: end, counts: counts})
+	if over := len(h.windows) - h.cfg.Windows; over > 0 {
+		h.windows = slices.Delete(h.windows, 0, over)
+	}
+}
+
+func (h *heatmapWindows) state(method, route string) LatencyHeatmapState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := LatencyHeatmapState{
+		Enabled:       true,
+		Metric:        HeatmapMetric,
+		Unit:          "s",
+		Method:        method,
+		Route:         route,
+		WindowSeconds: h.cfg.Window.Seconds(),
+		Bounds:        h.bounds,
+		Windows:       make([]HeatmapWindow, 0, len(h.windows)),
+	}
+	routes := make(map[string]bool)
+	for _, w := range h.windows {
+		hw := HeatmapWindow{Start: w.start, End: w.end, Counts: make([]uint64, len(h.bounds)+1)}
+		for key, counts := range w.counts {
+			routes[key.method+" "+key.route] = true
+			if (method != "" && key.method != method) || (route != "" && key.route != route) {
+				continue
+			}
+			for i, c := range counts {
+				hw.Counts[i] += c
+				hw.Count += c
+			}
+		}
+		hw.P50 = bucketQuantile(0.5, h.bounds, hw.Counts, hw.Count)
+		hw.P95 = bucketQuantile(0.95, h.bounds, hw.Counts, hw.Count)
+		hw.P99 = bucketQuantile(0.99, h.bounds, hw.Counts, hw.Count)
+		s.Windows = append(s.Windows, hw)
+	}
+	for r := range routes {
+		s.Routes = append(s.Routes, r)
+	}
+	sort.Strings(s.Routes)
+	return s
+}
+
+// bucketQuantile estimates the q quantile of total values from their bucket
+// counts, interpolating linearly within the bucket it falls in. The first
+// bucket starts at 0; a quantile in the last, unbounded bucket is its lower
+// bound.
+func bucketQuantile(q float64, bounds []float64, counts []uint64, total uint64) float64 {
+	if total == 0 || len(bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var below uint64
+	for i, c := range counts {
+		if c == 0 || float64(below+c) < rank {
+			below += c
+			continue
+		}
+		if i == len(bounds) {
+			return bounds[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = bounds[i-1]
+		}
+		return lower + (bounds[i]-lower)*(rank-float64(below))/float64(c)
+	}
+	return bounds[len(bounds)-1]
+}
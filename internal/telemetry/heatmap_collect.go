@@ -0,0 +1,105 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+)
+
+// newHeatmapReader returns a reader with delta temporality, so each
+// collection holds the requests of one window only.
+func newHeatmapReader() *sdkmetric.ManualReader {
+	return sdkmetric.NewManualReader(sdkmetric.WithTemporalitySelector(func(sdkmetric.InstrumentKind) metricdata.Temporality {
+		return metricdata.DeltaTemporality
+	}))
+}
+
+// heatmapCollector reads the request duration histogram from its own
+// manual reader once per window and adds its bucket counts to windows.
+type heatmapCollector struct {
+	windows *heatmapWindows
+	reader  *sdkmetric.ManualReader
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newHeatmapCollector(windows *heatmapWindows, reader *sdkmetric.ManualReader) *heatmapCollector {
+	c := &heatmapCollector{
+		windows: windows,
+		reader:  reader,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *heatmapCollector) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.windows.cfg.Window)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case end := <-ticker.C:
+			if err := c.collect(start, end); err != nil {
+				Logger().Warn("latency heatmap: reading request durations", zap.Error(err))
+			}
+			start = end
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *heatmapCollector) collect(start, end time.Time) error {
+	var rm metricdata.ResourceMetrics
+	if err := c.reader.Collect(context.Background(), &rm); err != nil {
+		return err
+	}
+
+	var bounds []float64
+	counts := make(map[routeKey][]uint64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			hist, ok := m.Data.(metricdata.Histogram[float64])
+			if m.Name != HeatmapMetric || !ok {
+				continue
+			}
+			for _, dp := range hist.DataPoints {
+				if bounds == nil {
+					bounds = dp.Bounds
+				}
+				if dp.Count == 0 || len(dp.Bounds) != len(bounds) {
+					continue
+				}
+				route, _ := dp.Attributes.Value("http.route")
+				method, _ := dp.Attributes.Value("http.request.method")
+				key := routeKey{method.AsString(), route.AsString()}
+				sum, ok := counts[key]
+				if !ok {
+					sum = make([]uint64, len(dp.BucketCounts))
+					counts[key] = sum
+				}
+				for i, n := range dp.BucketCounts {
+					sum[i] += n
+				}
+			}
+		}
+	}
+	c.windows.add(start, end, bounds, counts)
+	return nil
+}
+
+func (c *heatmapCollector) Shutdown(context.Context) error {
+	close(c.stop)
+	<-c.done
+	return nil
+}
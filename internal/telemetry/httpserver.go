@@ -0,0 +1,298 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultStatusMapping follows the semantic conventions for server spans:
+// only 5xx responses are errors, because 4xx responses are the client's
+// fault and the server handled them correctly.
+var DefaultStatusMapping = StatusMapping{
+	"1xx": "unset",
+	"2xx": "unset",
+	"3xx": "unset",
+	"4xx": "unset",
+	"5xx": "error",
+}
+
+var statusMapping atomic.Pointer[StatusMapping]
+
+func init() {
+	statusMapping.Store(&DefaultStatusMapping)
+}
+
+func setStatusMapping(m StatusMapping) {
+	merged := StatusMapping{}
+	for k, v := range DefaultStatusMapping {
+		merged[k] = v
+	}
+	for k, v := range m {
+		merged[k] = strings.ToLower(v)
+	}
+	statusMapping.Store(&merged)
+}
+
+func (m StatusMapping) expected(status int) codes.Code {
+	code := strconv.Itoa(status)
+	v, ok := m[code]
+	if !ok {
+		v = m[code[:1]+"xx"]
+	}
+	switch v {
+	case "error":
+		return codes.Error
+	case "ok":
+		return codes.Ok
+	default:
+		return codes.Unset
+	}
+}
+
+// ServerSpanMiddleware instruments the service's HTTP server with otelhttp:
+// it extracts the caller's trace context and baggage, starts a server span
+// per request, named after the matched route, and records the semantic
+// convention metrics http.server.request.duration,
+// http.server.request.body.size and http.server.response.body.size.
+//
+// On top of that, it audits the server span's status on the way out.
+// Handlers may set any status on the span in their context, e.g. through
+// RecordError; the middleware holds it back and applies the status the
+// StatusMapping expects for the response code. When the two differ, the
+// correction is recorded as a span.status_corrected event and in
+// span_status_corrections_total, which points at handlers that get the
+// status rules wrong. Each request is also given a cost score, from its
+// duration, downstream calls and body sizes, recorded as
+// http.request.cost_score and ranked by ExpensiveRequests. The requests
+// being served are counted by the http_requests_in_flight UpDownCounter,
+// which goes up when a request starts and down when it ends.
+func ServerSpanMiddleware(next http.Handler) http.Handler {
+	audit := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var inFlightAttrs []attribute.KeyValue
+		if instance := Instance(r.Context()); instance != "" {
+			inFlightAttrs = append(inFlightAttrs, InstanceKey.String(instance))
+		}
+		inFlight().Add(r.Context(), 1, metric.WithAttributes(inFlightAttrs...))
+		defer inFlight().Add(r.Context(), -1, metric.WithAttributes(inFlightAttrs...))
+
+		audited, ok := trace.SpanFromContext(r.Context()).(*auditedSpan)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if instance := Instance(r.Context()); instance != "" {
+			audited.SetAttributes(InstanceKey.String(instance))
+		}
+		if DebugEnabled(r.Context()) {
+			for name, values := range r.Header {
+				audited.SetAttributes(attribute.StringSlice("http.request.header."+strings.ToLower(name), values))
+			}
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		ctx, cost := withRequestCost(r.Context())
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		outer := r
+		r = r.WithContext(ctx)
+		next.ServeHTTP(sw, r)
+		duration := time.Since(start)
+		// otelhttp names the span and labels the metrics from the pattern the
+		// mux set on our copy of the request.
+		outer.Pattern = r.Pattern
+
+		route := strings.TrimPrefix(r.Pattern, r.Method+" ")
+		if route != "" {
+			audited.SetAttributes(attribute.String("http.route", route))
+		}
+		audited.apply(ctx, sw.status)
+
+		calls := cost.calls.Load()
+		score := CostScore(duration, calls, body.n+sw.n)
+		audited.SetAttributes(
+			attribute.Int64("http.request.downstream_calls", calls),
+			attribute.Float64("http.request.cost_score", score),
+		)
+		sc := audited.SpanContext()
+		expensive.add(ExpensiveRequest{
+			Method:          r.Method,
+			Route:           route,
+			Path:            r.URL.Path,
+			Status:          sw.status,
+			Start:           start,
+			DurationMS:      float64(duration) / float64(time.Millisecond),
+			DownstreamCalls: calls,
+			Bytes:           body.n + sw.n,
+			Score:           score,
+			TraceID:         sc.TraceID().String(),
+			SpanID:          sc.SpanID().String(),
+			Sampled:         sc.IsSampled(),
+		})
+	})
+	return otelhttp.NewHandler(audit, "",
+		otelhttp.WithTracerProvider(auditingTracerProvider{otel.GetTracerProvider()}),
+		otelhttp.WithMetricAttributesFn(func(r *http.Request) []attribute.KeyValue {
+			if instance := Instance(r.Context()); instance != "" {
+				return []attribute.KeyValue{InstanceKey.String(instance)}
+			}
+			return nil
+		}),
+	)
+}
+
+// AddServerMetricAttributes adds attrs to the http.server.* metrics of the
+// request being served in ctx. They become metric dimensions, so they must
+// have few distinct values.
+func AddServerMetricAttributes(ctx context.Context, attrs ...attribute.KeyValue) {
+	if l, ok := otelhttp.LabelerFromContext(ctx); ok {
+		l.Add(attrs...)
+	}
+}
+
+// countingBody counts the bytes of a request body read by the handler.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// statusWriter records the response status code and body size.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	n           int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// auditingTracerProvider hands otelhttp tracers whose spans are
+// auditedSpans, which it puts in the request context in their place.
+type auditingTracerProvider struct {
+	trace.TracerProvider
+}
+
+func (p auditingTracerProvider) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return auditingTracer{p.TracerProvider.Tracer(name, opts...)}
+}
+
+type auditingTracer struct {
+	trace.Tracer
+}
+
+func (t auditingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	ctx, span := t.Tracer.Start(ctx, name, opts...)
+	audited := &auditedSpan{Span: span}
+	return trace.ContextWithSpan(ctx, audited), audited
+}
+
+// auditedSpan defers SetStatus calls on a server span until the response
+// status is known. Once apply has set the audited status, later calls, such
+// as otelhttp's own, are ignored.
+type auditedSpan struct {
+	trace.Span
+
+	mu          sync.Mutex
+	applied     bool
+	code        codes.Code
+	description string
+}
+
+func (s *auditedSpan) SetStatus(code codes.Code, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.applied {
+		return
+	}
+	// Same precedence as the SDK: Ok beats Error beats Unset.
+	if code >= s.code {
+		s.code, s.description = code, description
+	}
+}
+
+func (s *auditedSpan) apply(ctx context.Context, status int) {
+	s.mu.Lock()
+	requested, description := s.code, s.description
+	s.applied = true
+	s.mu.Unlock()
+
+	want := statusMapping.Load().expected(status)
+	if requested != want {
+		if want == codes.Error && description == "" {
+			description = http.StatusText(status)
+		}
+		s.Span.AddEvent("span.status_corrected", trace.WithAttributes(
+			attribute.String("span.status.requested", requested.String()),
+			attribute.String("span.status.applied", want.String()),
+			attribute.Int("http.response.status_code", status),
+		))
+		statusCorrections().Add(ctx, 1, metric.WithAttributes(
+			attribute.String("from", requested.String()),
+			attribute.String("to", want.String()),
+		))
+	}
+	s.Span.SetStatus(want, description)
+}
+
+var inFlight = sync.OnceValue(func() metric.Int64UpDownCounter {
+	c, err := Meter().Int64UpDownCounter(
+		"http_requests_in_flight",
+		metric.WithDescription("Number of HTTP requests being served"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		c, _ = meter().Int64UpDownCounter("http_requests_in_flight")
+	}
+	return c
+})
+
+var statusCorrections = sync.OnceValue(func() metric.Int64Counter {
+	c, err := Meter().Int64Counter(
+		"span_status_corrections_total",
+		metric.WithDescription("Number of server spans whose status was corrected to match the HTTP status mapping"),
+		metric.WithUnit("{span}"),
+	)
+	if err != nil {
+		c, _ = meter().Int64Counter("span_status_corrections_total")
+	}
+	return c
+})
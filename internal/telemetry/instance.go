@@ -0,0 +1,36 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// InstanceKey identifies the instance that served a request when several
+// run in one process (-instances). They share one SDK pipeline and Resource,
+// so the ID is recorded on server spans, request metrics and LoggerFor logs
+// instead of on the Resource.
+const InstanceKey = attribute.Key("service.instance.id")
+
+type instanceCtxKey struct{}
+
+// WithInstance records the serving instance's ID in ctx.
+func WithInstance(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, instanceCtxKey{}, id)
+}
+
+// Instance returns the serving instance's ID, or "" when the process runs a
+// single instance.
+func Instance(ctx context.Context) string {
+	id, _ := ctx.Value(instanceCtxKey{}).(string)
+	return id
+}
+
+// InstanceMiddleware marks every request as served by instance id. Install
+// it before ServerSpanMiddleware.
+func InstanceMiddleware(id string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithInstance(r.Context(), id)))
+	})
+}
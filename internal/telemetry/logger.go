@@ -0,0 +1,47 @@
+package telemetry
+
+import (
+	"os"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	globalLogger atomic.Pointer[zap.Logger]
+	logLevel     = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+)
+
+// Logger returns the service logger, or a no-op logger before Setup (see
+// StrictMode).
+func Logger() *zap.Logger {
+	checkInitialized("Logger")
+	if l := globalLogger.Load(); l != nil {
+		return l
+	}
+	return zap.NewNop()
+}
+
+// LogLevel returns the level shared by every logger Setup creates. Changing it
+// takes effect immediately.
+func LogLevel() zap.AtomicLevel {
+	return logLevel
+}
+
+func newLogger(cfg LogsConfig) (*zap.Logger, error) {
+	if cfg.Level != "" {
+		lvl, err := zapcore.ParseLevel(cfg.Level)
+		if err != nil {
+			return nil, err
+		}
+		logLevel.SetLevel(lvl)
+	}
+
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.Lock(os.Stdout),
+		logLevel,
+	)
+	return zap.New(core), nil
+}
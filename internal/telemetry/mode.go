@@ -0,0 +1,69 @@
+package telemetry
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Run modes select a preset of the settings that differ between
+// presenting, teaching and running the service: the sampling ratio, the log
+// level, whether exemplars are exported and whether the /debug endpoints
+// are served. Each preset is a config layer in modes/<mode>.yaml.
+const (
+	ModeDemo       = "demo"
+	ModeWorkshop   = "workshop"
+	ModeProduction = "production"
+)
+
+// Modes lists the run modes.
+var Modes = []string{ModeDemo, ModeWorkshop, ModeProduction}
+
+//go:embed modes/*.yaml
+var modeFiles embed.FS
+
+// modePrefix marks the config layer of a run mode in the paths passed to
+// LoadConfig and Setup.
+const modePrefix = "mode:"
+
+// WithMode returns cfgFiles with the preset of mode layered over the base
+// file, before the overlays, so a preset replaces what otel.yaml sets and an
+// overlay can still change single settings of it. The empty mode leaves
+// cfgFiles as they are.
+func WithMode(mode string, cfgFiles []string) ([]string, error) {
+	if mode == "" {
+		return cfgFiles, nil
+	}
+	if !slices.Contains(Modes, mode) {
+		return nil, fmt.Errorf("telemetry: unknown mode %q, want one of %s", mode, strings.Join(Modes, ", "))
+	}
+	if len(cfgFiles) == 0 {
+		return nil, fmt.Errorf("telemetry: mode %q needs a base config file", mode)
+	}
+	out := slices.Clone(cfgFiles[:1])
+	out = append(out, modePrefix+mode)
+	return append(out, cfgFiles[1:]...), nil
+}
+
+// readLayer reads a config file, or the preset of a run mode.
+func readLayer(path string) ([]byte, error) {
+	if mode, ok := strings.CutPrefix(path, modePrefix); ok {
+		return modeFiles.ReadFile("modes/" + mode + ".yaml")
+	}
+	return os.ReadFile(path)
+}
+
+var debugEndpoints atomic.Bool
+
+func init() {
+	debugEndpoints.Store(true)
+}
+
+// DebugEndpoints reports whether the /debug endpoints should be served, as
+// set by debug_endpoints in the configuration; they are by default.
+func DebugEndpoints() bool {
+	return debugEndpoints.Load()
+}
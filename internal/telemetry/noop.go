@@ -0,0 +1,74 @@
+//go:build notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+var (
+	noopTracer = tracenoop.NewTracerProvider().Tracer(ScopeName)
+	noopMeter  = metricnoop.NewMeterProvider().Meter(ScopeName)
+)
+
+// Tracer returns a no-op tracer.
+func Tracer() trace.Tracer {
+	return noopTracer
+}
+
+// Meter returns a no-op meter.
+func Meter() metric.Meter {
+	return noopMeter
+}
+
+func meter() metric.Meter {
+	return noopMeter
+}
+
+// Providers holds nothing; there is no SDK.
+type Providers struct{}
+
+// Shutdown does nothing.
+func (p *Providers) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Setup installs nothing; the config files are not read.
+func Setup(ctx context.Context, opts ...Option) (*Providers, error) {
+	now := time.Now()
+	lastSetup.Store(&SetupTiming{Start: now, ConfigParsed: now, ProvidersReady: now})
+	initialized.Store(true)
+	return &Providers{}, nil
+}
+
+// FlushResult is the outcome of flushing one signal.
+type FlushResult struct {
+	Signal     string  `json:"signal"`
+	Enabled    bool    `json:"enabled"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Flush reports every signal as disabled; there is nothing to flush.
+func Flush(ctx context.Context) []FlushResult {
+	return []FlushResult{{Signal: "traces"}, {Signal: "metrics"}, {Signal: "logs"}}
+}
+
+// ServerSpanMiddleware returns next unchanged.
+func ServerSpanMiddleware(next http.Handler) http.Handler {
+	return next
+}
+
+// AddServerMetricAttributes does nothing; there are no server metrics.
+func AddServerMetricAttributes(ctx context.Context, attrs ...attribute.KeyValue) {}
+
+// CopyBaggage does nothing.
+func CopyBaggage(ctx context.Context) {}
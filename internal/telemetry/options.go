@@ -0,0 +1,87 @@
+package telemetry
+
+import (
+	"cmp"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Option configures Setup.
+type Option func(*setupOptions)
+
+type setupOptions struct {
+	serviceName    string
+	serviceVersion string
+	cfgFiles       []string
+	attrs          []attribute.KeyValue
+	propagator     propagation.TextMapPropagator
+	runtimeMetrics bool
+	prometheus     string
+	views          []View
+}
+
+func newSetupOptions(opts []Option) setupOptions {
+	o := setupOptions{serviceName: cmp.Or(os.Getenv("OTEL_SERVICE_NAME"), ScopeName)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithServiceName sets service.name on the Resource; defaults to
+// OTEL_SERVICE_NAME, or ScopeName if that isn't set.
+func WithServiceName(name string) Option {
+	return func(o *setupOptions) { o.serviceName = name }
+}
+
+// WithServiceVersion sets service.version on the Resource.
+func WithServiceVersion(version string) Option {
+	return func(o *setupOptions) { o.serviceVersion = version }
+}
+
+// WithConfigFile adds configuration files, merged in order after those of
+// earlier WithConfigFile options. The first is the base file; see Setup.
+func WithConfigFile(paths ...string) Option {
+	return func(o *setupOptions) { o.cfgFiles = append(o.cfgFiles, paths...) }
+}
+
+// WithResourceAttributes adds attrs to the Resource. They don't replace
+// service.name or service.version; use the options for those.
+func WithResourceAttributes(attrs ...attribute.KeyValue) Option {
+	return func(o *setupOptions) { o.attrs = append(o.attrs, attrs...) }
+}
+
+// WithPropagators sets the global propagator, in place of the propagators
+// of the configuration; defaults to TraceContext and Baggage.
+func WithPropagators(p propagation.TextMapPropagator) Option {
+	return func(o *setupOptions) { o.propagator = p }
+}
+
+// WithRuntimeMetrics exports the Go runtime metrics next to the service's:
+// goroutine count, heap and GC pauses. It is the same as runtime: true in
+// the metrics section of the configuration.
+func WithRuntimeMetrics() Option {
+	return func(o *setupOptions) { o.runtimeMetrics = true }
+}
+
+// WithPrometheus serves the metrics for Prometheus to scrape at /metrics on
+// addr, such as ":9464", in addition to the configured exporter. It is the
+// same as the prometheus section of the metrics configuration, with addr
+// replacing its address.
+func WithPrometheus(addr string) Option {
+	return func(o *setupOptions) { o.prometheus = addr }
+}
+
+// WithViews changes the bucket boundaries of the histograms the views
+// match, after the views of the metrics configuration. A view replaces any
+// earlier one of the same instrument, including those of DefaultViews.
+func WithViews(views ...View) Option {
+	return func(o *setupOptions) { o.views = append(o.views, views...) }
+}
+
+// defaultPropagator propagates W3C trace context and baggage.
+func defaultPropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
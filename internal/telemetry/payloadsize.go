@@ -0,0 +1,168 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+type payloadTotals struct {
+	requests uint64
+	raw      uint64
+	gzip     uint64
+	zstd     uint64
+}
+
+// payloadSizer observes every OTLP gRPC export request, recording its size
+// uncompressed and after gzip and zstd compression, so the egress cost of each
+// signal and the value of compression can be compared.
+type payloadSizer struct {
+	size   metric.Int64Histogram
+	zstd   *zstd.Encoder
+	stop   chan struct{}
+	mu     sync.Mutex
+	totals map[string]*payloadTotals
+}
+
+func newPayloadSizer(cfg PayloadStatsConfig) (*payloadSizer, error) {
+	size, err := meter().Int64Histogram(
+		"otlp_payload_size_bytes",
+		metric.WithDescription("Size of OTLP export requests before and after compression"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &payloadSizer{
+		size:   size,
+		zstd:   enc,
+		stop:   make(chan struct{}),
+		totals: make(map[string]*payloadTotals),
+	}
+	if cfg.LogInterval > 0 {
+		go s.logSummaries(cfg.LogInterval)
+	}
+	return s, nil
+}
+
+// interceptor returns a gRPC client interceptor to install on OTLP exporters.
+func (s *payloadSizer) interceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if msg, ok := req.(proto.Message); ok {
+			s.observe(ctx, signalFromMethod(method), msg)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func (s *payloadSizer) observe(ctx context.Context, signal string, msg proto.Message) {
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(raw)
+	w.Close()
+	zs := len(s.zstd.EncodeAll(raw, nil))
+
+	for _, m := range []struct {
+		encoding string
+		size     int
+	}{
+		{"none", len(raw)},
+		{"gzip", gz.Len()},
+		{"zstd", zs},
+	} {
+		s.size.Record(ctx, int64(m.size), metric.WithAttributes(
+			attribute.String("signal", signal),
+			attribute.String("compression", m.encoding),
+		))
+	}
+
+	s.mu.Lock()
+	t, ok := s.totals[signal]
+	if !ok {
+		t = &payloadTotals{}
+		s.totals[signal] = t
+	}
+	t.requests++
+	t.raw += uint64(len(raw))
+	t.gzip += uint64(gz.Len())
+	t.zstd += uint64(zs)
+	s.mu.Unlock()
+}
+
+func (s *payloadSizer) logSummaries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.logSummary(interval)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *payloadSizer) logSummary(interval time.Duration) {
+	s.mu.Lock()
+	totals := s.totals
+	s.totals = make(map[string]*payloadTotals)
+	s.mu.Unlock()
+
+	for signal, t := range totals {
+		if t.raw == 0 {
+			continue
+		}
+		Logger().Info("otlp payload summary",
+			zap.String("signal", signal),
+			zap.Duration("interval", interval),
+			zap.Uint64("requests", t.requests),
+			zap.Uint64("uncompressed_bytes", t.raw),
+			zap.Uint64("gzip_bytes", t.gzip),
+			zap.Uint64("zstd_bytes", t.zstd),
+			zap.Float64("gzip_ratio", float64(t.gzip)/float64(t.raw)),
+			zap.Float64("zstd_ratio", float64(t.zstd)/float64(t.raw)))
+	}
+}
+
+func (s *payloadSizer) Shutdown(context.Context) error {
+	close(s.stop)
+	return s.zstd.Close()
+}
+
+// signalFromMethod maps an OTLP gRPC method such as
+// "/opentelemetry.proto.collector.trace.v1.TraceService/Export" to "traces".
+func signalFromMethod(method string) string {
+	switch {
+	case strings.Contains(method, ".trace."):
+		return "traces"
+	case strings.Contains(method, ".metrics."):
+		return "metrics"
+	case strings.Contains(method, ".logs."):
+		return "logs"
+	default:
+		return method
+	}
+}
@@ -0,0 +1,159 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// DefaultAttributePolicies are the attributes the semantic conventions
+// expect on each span kind. Server spans need their route and response
+// status, client spans the service they call, and messaging spans the
+// in-process bus as their messaging system, which is set by default.
+// http.route is not required on 404 and 405 responses, which match no
+// route.
+var DefaultAttributePolicies = AttributePolicies{
+	"server": {Required: []string{"http.request.method", "http.route", "http.response.status_code"}},
+	"client": {Required: []string{"peer.service"}},
+	"producer": {
+		Required: []string{"messaging.system", "messaging.operation.type", "messaging.message.id"},
+		Defaults: map[string]string{"messaging.system": "bus"},
+	},
+	"consumer": {
+		Required: []string{"messaging.system", "messaging.operation.type", "messaging.message.id"},
+		Defaults: map[string]string{"messaging.system": "bus"},
+	},
+}
+
+var spanKinds = map[string]trace.SpanKind{
+	"internal": trace.SpanKindInternal,
+	"server":   trace.SpanKindServer,
+	"client":   trace.SpanKindClient,
+	"producer": trace.SpanKindProducer,
+	"consumer": trace.SpanKindConsumer,
+}
+
+type kindPolicy struct {
+	required []attribute.Key
+	defaults []attribute.KeyValue
+}
+
+// policyProcessor applies the attribute policy of each span's kind: it sets
+// the defaults a span starts without and, when the span ends, counts every
+// required attribute it lacks in span_attribute_policy_violations_total. In
+// dev mode each violation is also logged as an error, once per span name
+// and attribute, so missing attributes are caught while the code is written
+// rather than in a dashboard that can't group by them.
+type policyProcessor struct {
+	policies map[trace.SpanKind]kindPolicy
+	reported sync.Map // map[violation]bool
+}
+
+type violation struct {
+	name string
+	key  attribute.Key
+}
+
+// newPolicyProcessor returns a processor for DefaultAttributePolicies with
+// the policies of overrides in place of the defaults of their kinds.
+func newPolicyProcessor(overrides AttributePolicies) (*policyProcessor, error) {
+	merged := AttributePolicies{}
+	for k, v := range DefaultAttributePolicies {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		if _, ok := spanKinds[k]; !ok {
+			return nil, fmt.Errorf("span_attribute_policies: unknown span kind %q", k)
+		}
+		merged[k] = v
+	}
+
+	p := &policyProcessor{policies: make(map[trace.SpanKind]kindPolicy)}
+	for name, policy := range merged {
+		var kp kindPolicy
+		for _, key := range policy.Required {
+			kp.required = append(kp.required, attribute.Key(key))
+		}
+		for key, value := range policy.Defaults {
+			kp.defaults = append(kp.defaults, attribute.String(key, value))
+		}
+		p.policies[spanKinds[name]] = kp
+	}
+	return p, nil
+}
+
+func (p *policyProcessor) OnStart(_ context.Context, s sdktrace.ReadWriteSpan) {
+	policy, ok := p.policies[s.SpanKind()]
+	if !ok || len(policy.defaults) == 0 {
+		return
+	}
+	attrs := s.Attributes()
+	for _, kv := range policy.defaults {
+		if !slices.ContainsFunc(attrs, func(a attribute.KeyValue) bool { return a.Key == kv.Key }) {
+			s.SetAttributes(kv)
+		}
+	}
+}
+
+func (p *policyProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	policy, ok := p.policies[s.SpanKind()]
+	if !ok || len(policy.required) == 0 {
+		return
+	}
+	present := make(map[attribute.Key]attribute.Value, len(s.Attributes()))
+	for _, kv := range s.Attributes() {
+		present[kv.Key] = kv.Value
+	}
+	for _, key := range policy.required {
+		if _, ok := present[key]; ok || exempt(s.SpanKind(), key, present) {
+			continue
+		}
+		policyViolations().Add(context.Background(), 1, metric.WithAttributes(
+			attribute.String("span.kind", s.SpanKind().String()),
+			attribute.String("attribute", string(key)),
+		))
+		if !DevMode() {
+			continue
+		}
+		if _, seen := p.reported.LoadOrStore(violation{s.Name(), key}, true); !seen {
+			Logger().Error("span attribute policy violated",
+				zap.String("span", s.Name()),
+				zap.String("span_kind", s.SpanKind().String()),
+				zap.String("missing", string(key)),
+				zap.String("fix", "set the attribute on the span, or give it a default in span_attribute_policies"))
+		}
+	}
+}
+
+// exempt reports whether a span may lack a required attribute.
+func exempt(kind trace.SpanKind, key attribute.Key, present map[attribute.Key]attribute.Value) bool {
+	if kind != trace.SpanKindServer || key != "http.route" {
+		return false
+	}
+	status := present["http.response.status_code"].AsInt64()
+	return status == 404 || status == 405
+}
+
+func (p *policyProcessor) Shutdown(context.Context) error   { return nil }
+func (p *policyProcessor) ForceFlush(context.Context) error { return nil }
+
+var policyViolations = sync.OnceValue(func() metric.Int64Counter {
+	c, err := meter().Int64Counter(
+		"span_attribute_policy_violations_total",
+		metric.WithDescription("Number of required span attributes missing when spans ended, by span kind and attribute"),
+		metric.WithUnit("{attribute}"),
+	)
+	if err != nil {
+		c, _ = meter().Int64Counter("span_attribute_policy_violations_total")
+	}
+	return c
+})
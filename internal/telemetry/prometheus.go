@@ -0,0 +1,75 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.uber.org/zap"
+)
+
+// defaultPrometheusAddress is the port OpenTelemetry reserves for the
+// Prometheus exporter.
+const defaultPrometheusAddress = ":9464"
+
+// prometheusServer serves the metrics of a Prometheus reader for scraping.
+// The reader exports nothing by itself: each scrape collects from the
+// MeterProvider, next to and independently of the periodic readers.
+type prometheusServer struct {
+	server *http.Server
+	done   chan struct{}
+}
+
+// newPrometheusReader returns the reader of the Prometheus pipeline and the
+// server that exposes it at /metrics on cfg.Address. The registry is its
+// own, so nothing but the service's instruments is exposed.
+func newPrometheusReader(cfg PrometheusConfig, producers ...sdkmetric.Producer) (sdkmetric.Reader, *prometheusServer, error) {
+	registry := prometheus.NewRegistry()
+	opts := []otelprometheus.Option{otelprometheus.WithRegisterer(registry)}
+	for _, p := range producers {
+		opts = append(opts, otelprometheus.WithProducer(p))
+	}
+	reader, err := otelprometheus.New(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr := cfg.Address
+	if addr == "" {
+		addr = defaultPrometheusAddress
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, errors.Join(err, reader.Shutdown(context.Background()))
+	}
+	mux := http.NewServeMux()
+	// Exemplars are only part of the OpenMetrics format, which Prometheus
+	// asks for when its exemplar storage is enabled.
+	mux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	s := &prometheusServer{
+		server: &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second},
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		if err := s.server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			Logger().Error("prometheus endpoint stopped", zap.Error(err))
+		}
+	}()
+	return reader, s, nil
+}
+
+// Shutdown stops serving scrapes.
+func (s *prometheusServer) Shutdown(ctx context.Context) error {
+	err := s.server.Shutdown(ctx)
+	<-s.done
+	return err
+}
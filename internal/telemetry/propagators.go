@@ -0,0 +1,62 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/contrib/propagators/jaeger"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Propagator names accepted by the propagators setting, as in
+// OTEL_PROPAGATORS.
+const (
+	PropagatorTraceContext = "tracecontext"
+	PropagatorBaggage      = "baggage"
+	PropagatorB3           = "b3"
+	PropagatorB3Multi      = "b3multi"
+	PropagatorJaeger       = "jaeger"
+	PropagatorNone         = "none"
+)
+
+// newPropagator returns the composite of the named propagators, in order,
+// or the default TraceContext and Baggage if names is empty. Every
+// propagator injects its headers; on extraction a later one overrides the
+// trace context of an earlier one, so list the format callers are most
+// trusted in last. "none" propagates nothing.
+func newPropagator(names []string) (propagation.TextMapPropagator, error) {
+	if len(names) == 0 {
+		return defaultPropagator(), nil
+	}
+	var propagators []propagation.TextMapPropagator
+	for i, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if slices.Contains(names[:i], name) {
+			return nil, fmt.Errorf("propagators: %q is listed twice", name)
+		}
+		switch name {
+		case PropagatorTraceContext:
+			propagators = append(propagators, propagation.TraceContext{})
+		case PropagatorBaggage:
+			propagators = append(propagators, propagation.Baggage{})
+		case PropagatorB3:
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3SingleHeader)))
+		case PropagatorB3Multi:
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		case PropagatorJaeger:
+			propagators = append(propagators, jaeger.Jaeger{})
+		case PropagatorNone:
+			if len(names) > 1 {
+				return nil, fmt.Errorf("propagators: %q can't be combined with others", name)
+			}
+		default:
+			return nil, fmt.Errorf("propagators: unknown propagator %q; want %s, %s, %s, %s, %s or %s", name,
+				PropagatorTraceContext, PropagatorBaggage, PropagatorB3, PropagatorB3Multi, PropagatorJaeger, PropagatorNone)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...), nil
+}
@@ -0,0 +1,35 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer returns the service tracer from the global TracerProvider. Before
+// Setup it returns a tracer that starts forwarding once Setup installs the
+// SDK, or reports the access in strict mode.
+func Tracer() trace.Tracer {
+	checkInitialized("Tracer")
+	return otel.Tracer(ScopeName)
+}
+
+// Meter returns the service meter from the global MeterProvider. Before
+// Setup it returns a meter that starts forwarding once Setup installs the
+// SDK, or reports the access in strict mode.
+//
+// Instruments created through it must use UCUM units and names consistent
+// with them; see checkInstrument. Float instruments in "ms" are converted to
+// seconds.
+func Meter() metric.Meter {
+	checkInitialized("Meter")
+	return meter()
+}
+
+// meter is Meter without the initialization check, for instruments the
+// package creates while Setup is still running.
+func meter() metric.Meter {
+	return checkedMeter{otel.Meter(ScopeName)}
+}
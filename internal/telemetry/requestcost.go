@@ -0,0 +1,114 @@
+package telemetry
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Weights of the request cost score: a request scores one point per
+// millisecond it took, costPerCall per downstream call it made and
+// costPerKiB per KiB of request and response body.
+const (
+	costPerMS   = 1
+	costPerCall = 10
+	costPerKiB  = 1
+)
+
+// maxExpensive is the number of requests kept by the expensive request
+// tracker.
+const maxExpensive = 20
+
+// CostScore is the cost score of a request that took d, made calls
+// downstream calls and transferred bytes of request and response body.
+func CostScore(d time.Duration, calls, bytes int64) float64 {
+	ms := float64(d) / float64(time.Millisecond)
+	return ms*costPerMS + float64(calls)*costPerCall + float64(bytes)/1024*costPerKiB
+}
+
+// ExpensiveRequest is one of the highest scoring requests since start or the
+// last reset.
+type ExpensiveRequest struct {
+	Method          string    `json:"method"`
+	Route           string    `json:"route,omitempty"`
+	Path            string    `json:"path"`
+	Status          int       `json:"status"`
+	Start           time.Time `json:"start"`
+	DurationMS      float64   `json:"duration_ms"`
+	DownstreamCalls int64     `json:"downstream_calls"`
+	Bytes           int64     `json:"bytes"`
+	Score           float64   `json:"score"`
+	TraceID         string    `json:"trace_id"`
+	SpanID          string    `json:"span_id"`
+	// Sampled tells whether the request's trace was exported. Unsampled
+	// requests are ranked too, but have no trace to look up.
+	Sampled bool `json:"sampled"`
+}
+
+// expensiveTracker keeps the highest scoring requests, highest first.
+type expensiveTracker struct {
+	mu       sync.Mutex
+	requests []ExpensiveRequest
+}
+
+var expensive expensiveTracker
+
+func (t *expensiveTracker) add(r ExpensiveRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.requests) == maxExpensive && r.Score <= t.requests[len(t.requests)-1].Score {
+		return
+	}
+	i, _ := slices.BinarySearchFunc(t.requests, r.Score, func(e ExpensiveRequest, score float64) int {
+		// Descending by score.
+		switch {
+		case e.Score > score:
+			return -1
+		case e.Score < score:
+			return 1
+		}
+		return 0
+	})
+	t.requests = slices.Insert(t.requests, i, r)
+	if len(t.requests) > maxExpensive {
+		t.requests = t.requests[:maxExpensive]
+	}
+}
+
+// ExpensiveRequests returns the highest scoring requests served since start
+// or the last ResetExpensiveRequests, highest first.
+func ExpensiveRequests() []ExpensiveRequest {
+	expensive.mu.Lock()
+	defer expensive.mu.Unlock()
+	return append([]ExpensiveRequest{}, expensive.requests...)
+}
+
+// ResetExpensiveRequests forgets the tracked requests.
+func ResetExpensiveRequests() {
+	expensive.mu.Lock()
+	defer expensive.mu.Unlock()
+	expensive.requests = nil
+}
+
+// requestCost counts the downstream calls of a request.
+type requestCost struct {
+	calls atomic.Int64
+}
+
+type requestCostCtxKey struct{}
+
+func withRequestCost(ctx context.Context) (context.Context, *requestCost) {
+	c := &requestCost{}
+	return context.WithValue(ctx, requestCostCtxKey{}, c), c
+}
+
+// CountDownstreamCall adds a downstream call to the cost of the request
+// being served in ctx, if any. Code making client calls calls it once per
+// call, retries and hedged attempts included.
+func CountDownstreamCall(ctx context.Context) {
+	if c, ok := ctx.Value(requestCostCtxKey{}).(*requestCost); ok {
+		c.calls.Add(1)
+	}
+}
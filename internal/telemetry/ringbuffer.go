@@ -0,0 +1,86 @@
+package telemetry
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultSpanBufferSize is the number of ended spans kept by the span buffer
+// unless traces.span_buffer says otherwise.
+const DefaultSpanBufferSize = 1024
+
+// SpanBuffer is a span processor that keeps the most recently ended spans in
+// a ring buffer and tracks the spans still in flight, for local diagnostics
+// that don't need a tracing backend.
+type SpanBuffer struct {
+	mu     sync.Mutex
+	ended  []sdktrace.ReadOnlySpan
+	next   int
+	full   bool
+	active map[trace.SpanID]sdktrace.ReadOnlySpan
+}
+
+var globalSpanBuffer atomic.Pointer[SpanBuffer]
+
+// RecentSpans returns the span buffer installed by Setup, or nil before Setup.
+func RecentSpans() *SpanBuffer {
+	return globalSpanBuffer.Load()
+}
+
+// NewSpanBuffer returns a SpanBuffer holding up to size ended spans.
+func NewSpanBuffer(size int) *SpanBuffer {
+	if size <= 0 {
+		size = DefaultSpanBufferSize
+	}
+	return &SpanBuffer{
+		ended:  make([]sdktrace.ReadOnlySpan, size),
+		active: make(map[trace.SpanID]sdktrace.ReadOnlySpan),
+	}
+}
+
+func (b *SpanBuffer) OnStart(_ context.Context, s sdktrace.ReadWriteSpan) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active[s.SpanContext().SpanID()] = s
+}
+
+func (b *SpanBuffer) OnEnd(s sdktrace.ReadOnlySpan) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.active, s.SpanContext().SpanID())
+	b.ended[b.next] = s
+	b.next = (b.next + 1) % len(b.ended)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Ended returns the buffered ended spans, oldest first.
+func (b *SpanBuffer) Ended() []sdktrace.ReadOnlySpan {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]sdktrace.ReadOnlySpan(nil), b.ended[:b.next]...)
+	}
+	out := make([]sdktrace.ReadOnlySpan, 0, len(b.ended))
+	out = append(out, b.ended[b.next:]...)
+	return append(out, b.ended[:b.next]...)
+}
+
+// Active returns the spans that have started but not ended.
+func (b *SpanBuffer) Active() []sdktrace.ReadOnlySpan {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]sdktrace.ReadOnlySpan, 0, len(b.active))
+	for _, s := range b.active {
+		out = append(out, s)
+	}
+	return out
+}
+
+func (b *SpanBuffer) Shutdown(context.Context) error   { return nil }
+func (b *SpanBuffer) ForceFlush(context.Context) error { return nil }
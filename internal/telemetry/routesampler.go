@@ -0,0 +1,286 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SamplingRuleKey names the route sampling rule that sampled a server span.
+const SamplingRuleKey = attribute.Key("sampling.rule")
+
+// routeRule is a RouteSamplingRule ready for matching.
+type routeRule struct {
+	RouteSamplingRule
+	name     string
+	segments []string
+	sampler  sdktrace.Sampler
+}
+
+// routeSampler applies the first rule matching the method and url.path of
+// a server span that starts a trace or continues one from another service,
+// whatever that service decided, and delegates everything else. A rule
+// that keeps errors records the traces its ratio doesn't sample, for
+// errorTraceProcessor to export if a span ends in an error.
+type routeSampler struct {
+	sdktrace.Sampler
+	rules []routeRule
+}
+
+func newRouteSampler(rules []RouteSamplingRule, next sdktrace.Sampler) (routeSampler, error) {
+	s := routeSampler{Sampler: next}
+	for i, r := range rules {
+		if !strings.HasPrefix(r.Route, "/") {
+			return s, fmt.Errorf("traces.route_sampling[%d]: route %q must start with /", i, r.Route)
+		}
+		if r.Ratio < 0 || r.Ratio > 1 {
+			return s, fmt.Errorf("traces.route_sampling[%d] %q: ratio %g is not between 0 and 1", i, r.Route, r.Ratio)
+		}
+		s.rules = append(s.rules, routeRule{
+			RouteSamplingRule: r,
+			name:              strings.TrimSpace(r.Method + " " + r.Route),
+			segments:          strings.Split(r.Route, "/"),
+			sampler:           sdktrace.TraceIDRatioBased(r.Ratio),
+		})
+	}
+	return s, nil
+}
+
+// keepsErrors reports whether a rule records traces to keep on error.
+func (s routeSampler) keepsErrors() bool {
+	for _, r := range s.rules {
+		if r.KeepErrors {
+			return true
+		}
+	}
+	return false
+}
+
+func (s routeSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	parent := trace.SpanContextFromContext(p.ParentContext)
+	if p.Kind != trace.SpanKindServer || (parent.IsValid() && !parent.IsRemote()) || len(s.rules) == 0 {
+		return s.Sampler.ShouldSample(p)
+	}
+	var method, path string
+	for _, kv := range p.Attributes {
+		switch kv.Key {
+		case "http.request.method":
+			method = kv.Value.AsString()
+		case "url.path":
+			path = kv.Value.AsString()
+		}
+	}
+	segments := strings.Split(path, "/")
+	for _, r := range s.rules {
+		if (r.Method != "" && r.Method != method) || !matchRoute(r.segments, segments) {
+			continue
+		}
+		res := r.sampler.ShouldSample(p)
+		if res.Decision == sdktrace.Drop && r.KeepErrors {
+			res.Decision = sdktrace.RecordOnly
+		}
+		res.Attributes = append(res.Attributes, SamplingRuleKey.String(r.name))
+		return res
+	}
+	return s.Sampler.ShouldSample(p)
+}
+
+func (s routeSampler) Description() string {
+	return fmt.Sprintf("Route{%d rules,%s}", len(s.rules), s.Sampler.Description())
+}
+
+// recordingParent records the spans of a recorded but unsampled local
+// parent, so a trace kept on error is kept in full. sdktrace.ParentBased
+// drops them otherwise.
+type recordingParent struct{}
+
+func (recordingParent) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	parent := trace.SpanFromContext(p.ParentContext)
+	res := sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: parent.SpanContext().TraceState()}
+	if parent.IsRecording() {
+		res.Decision = sdktrace.RecordOnly
+	}
+	return res
+}
+
+func (recordingParent) Description() string { return "RecordingParent" }
+
+// errorBiasedSampler records the traces its Sampler doesn't sample, for
+// errorTraceProcessor to export if a span ends in an error, so keeping a
+// fraction of the traffic doesn't lose the failures among the rest.
+type errorBiasedSampler struct {
+	sdktrace.Sampler
+}
+
+func (s errorBiasedSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	res := s.Sampler.ShouldSample(p)
+	if res.Decision == sdktrace.Drop {
+		res.Decision = sdktrace.RecordOnly
+	}
+	return res
+}
+
+func (s errorBiasedSampler) Description() string {
+	return fmt.Sprintf("ErrorBiased{%s}", s.Sampler.Description())
+}
+
+// Limits of the traces errorTraceProcessor holds on to.
+const (
+	errorTraceMaxTraces = 1000
+	errorTraceMaxSpans  = 512
+	errorTraceMaxAge    = time.Minute
+)
+
+// errorTraceProcessor holds the ended spans of recorded but unsampled
+// traces until their local root span ends. If one of them ended in an
+// error, the spans are passed to export as sampled; otherwise they are
+// dropped. The decision is kept for errorTraceMaxAge, so spans that end
+// after their root, such as those of work the request left running, follow
+// it; a late span that ends in an error is exported either way.
+type errorTraceProcessor struct {
+	export func(sdktrace.ReadOnlySpan)
+
+	mu      sync.Mutex
+	traces  map[trace.TraceID]*heldTrace
+	decided map[trace.TraceID]decidedTrace
+}
+
+type heldTrace struct {
+	spans  []sdktrace.ReadOnlySpan
+	failed bool
+	since  time.Time
+}
+
+type decidedTrace struct {
+	kept bool
+	at   time.Time
+}
+
+func newErrorTraceProcessor(export func(sdktrace.ReadOnlySpan)) *errorTraceProcessor {
+	return &errorTraceProcessor{
+		export:  export,
+		traces:  make(map[trace.TraceID]*heldTrace),
+		decided: make(map[trace.TraceID]decidedTrace),
+	}
+}
+
+func (p *errorTraceProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (p *errorTraceProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	sc := s.SpanContext()
+	if sc.IsSampled() {
+		return
+	}
+	root := !s.Parent().IsValid() || s.Parent().IsRemote()
+	failed := s.Status().Code == codes.Error
+
+	p.mu.Lock()
+	if d, ok := p.decided[sc.TraceID()]; ok && !root {
+		p.mu.Unlock()
+		if d.kept || failed {
+			p.export(sampledSpan{s})
+		}
+		return
+	}
+	t, ok := p.traces[sc.TraceID()]
+	if !ok {
+		if len(p.traces) >= errorTraceMaxTraces {
+			p.evict()
+		}
+		if len(p.traces) >= errorTraceMaxTraces {
+			p.mu.Unlock()
+			if failed {
+				p.export(sampledSpan{s})
+			}
+			return
+		}
+		t = &heldTrace{since: time.Now()}
+	}
+	if len(t.spans) < errorTraceMaxSpans {
+		t.spans = append(t.spans, s)
+	}
+	t.failed = t.failed || failed
+	if !root {
+		p.traces[sc.TraceID()] = t
+		p.mu.Unlock()
+		return
+	}
+	delete(p.traces, sc.TraceID())
+	if len(p.decided) >= errorTraceMaxTraces {
+		p.evict()
+	}
+	if len(p.decided) < errorTraceMaxTraces {
+		p.decided[sc.TraceID()] = decidedTrace{kept: t.failed, at: time.Now()}
+	}
+	p.mu.Unlock()
+
+	if !t.failed {
+		return
+	}
+	for _, span := range t.spans {
+		p.export(sampledSpan{span})
+	}
+	errorTraces().Add(context.Background(), 1, metric.WithAttributes(SamplingRuleKey.String(ruleOf(s))))
+}
+
+// evict drops the traces held, and the decisions kept, longer than
+// errorTraceMaxAge.
+func (p *errorTraceProcessor) evict() {
+	for id, t := range p.traces {
+		if time.Since(t.since) > errorTraceMaxAge {
+			delete(p.traces, id)
+		}
+	}
+	for id, d := range p.decided {
+		if time.Since(d.at) > errorTraceMaxAge {
+			delete(p.decided, id)
+		}
+	}
+}
+
+func (p *errorTraceProcessor) Shutdown(context.Context) error   { return nil }
+func (p *errorTraceProcessor) ForceFlush(context.Context) error { return nil }
+
+// ruleOf returns the sampling.rule of s, empty if it was recorded for
+// traces.keep_errors rather than by a rule.
+func ruleOf(s sdktrace.ReadOnlySpan) string {
+	for _, kv := range s.Attributes() {
+		if kv.Key == SamplingRuleKey {
+			return kv.Value.AsString()
+		}
+	}
+	return ""
+}
+
+// sampledSpan is a recorded span exported as if it had been sampled. The
+// batch processor skips spans that weren't.
+type sampledSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s sampledSpan) SpanContext() trace.SpanContext {
+	sc := s.ReadOnlySpan.SpanContext()
+	return sc.WithTraceFlags(sc.TraceFlags().WithSampled(true))
+}
+
+var errorTraces = sync.OnceValue(func() metric.Int64Counter {
+	c, err := meter().Int64Counter(
+		"trace_sampling_error_traces_total",
+		metric.WithDescription("Number of traces the sampling ratio didn't sample that were exported because a span ended in an error, by sampling rule"),
+		metric.WithUnit("{trace}"),
+	)
+	if err != nil {
+		c, _ = meter().Int64Counter("trace_sampling_error_traces_total")
+	}
+	return c
+})
@@ -0,0 +1,104 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"math"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"time"
+
+	otelruntime "go.opentelemetry.io/contrib/instrumentation/runtime"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// startRuntimeMetrics exports the Go runtime metrics of the contrib
+// runtime instrumentation through mp: go.goroutine.count, go.memory.used,
+// go.memory.allocated, go.memory.allocations, go.memory.gc.goal and the
+// limits and GOGC they work against. GC pauses aren't among them; see
+// gcPauseProducer.
+func startRuntimeMetrics(mp metric.MeterProvider) error {
+	return otelruntime.Start(otelruntime.WithMeterProvider(mp))
+}
+
+// gcPausesMetric is the runtime's histogram of stop-the-world pauses for
+// garbage collection.
+const gcPausesMetric = "/sched/pauses/total/gc:seconds"
+
+// gcPauseBounds are the bucket bounds of go.gc.pause.duration, in seconds.
+// The runtime's own histogram has over a hundred buckets; pauses beyond
+// 100ms are rare enough to share the last.
+var gcPauseBounds = []float64{0.00001, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1}
+
+// gcPauseProducer exports the runtime's GC pause histogram as
+// go.gc.pause.duration. The runtime keeps the histogram itself, so it is
+// read at collection by a producer of the metrics reader rather than
+// recorded into an instrument.
+type gcPauseProducer struct {
+	start time.Time
+
+	mu     sync.Mutex
+	sample []metrics.Sample
+}
+
+func newGCPauseProducer() *gcPauseProducer {
+	return &gcPauseProducer{
+		start:  time.Now(),
+		sample: []metrics.Sample{{Name: gcPausesMetric}},
+	}
+}
+
+func (p *gcPauseProducer) Produce(context.Context) ([]metricdata.ScopeMetrics, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	metrics.Read(p.sample)
+	if p.sample[0].Value.Kind() != metrics.KindFloat64Histogram {
+		return nil, nil
+	}
+	h := p.sample[0].Value.Float64Histogram()
+
+	counts := make([]uint64, len(gcPauseBounds)+1)
+	var count uint64
+	var sum float64
+	for i, c := range h.Counts {
+		if c == 0 {
+			continue
+		}
+		// Runtime bucket i is [Buckets[i], Buckets[i+1]); it goes in the
+		// first of ours whose bound isn't below its end. Like the contrib
+		// producer, the sum counts each pause at its bucket's start, so it
+		// is an underestimate.
+		lo, hi := h.Buckets[i], h.Buckets[i+1]
+		counts[sort.SearchFloat64s(gcPauseBounds, hi)] += c
+		count += c
+		if !math.IsInf(lo, -1) {
+			sum += lo * float64(c)
+		}
+	}
+
+	return []metricdata.ScopeMetrics{{
+		Scope: instrumentation.Scope{Name: ScopeName},
+		Metrics: []metricdata.Metrics{{
+			Name:        "go.gc.pause.duration",
+			Description: "Stop-the-world pauses for garbage collection",
+			Unit:        "s",
+			Data: metricdata.Histogram[float64]{
+				Temporality: metricdata.CumulativeTemporality,
+				DataPoints: []metricdata.HistogramDataPoint[float64]{{
+					Attributes:   *attribute.EmptySet(),
+					StartTime:    p.start,
+					Time:         time.Now(),
+					Count:        count,
+					Sum:          sum,
+					Bounds:       gcPauseBounds,
+					BucketCounts: counts,
+				}},
+			},
+		}},
+	}}, nil
+}
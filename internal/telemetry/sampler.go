@@ -0,0 +1,231 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// ratioSampler is a TraceIDRatioBased sampler whose ratio can be changed at
+// runtime, e.g. by the memory watchdog.
+type ratioSampler struct {
+	ratio   atomic.Uint64 // math.Float64bits of the ratio
+	current atomic.Pointer[sdktrace.Sampler]
+}
+
+func newRatioSampler(ratio float64) *ratioSampler {
+	s := &ratioSampler{}
+	s.SetRatio(ratio)
+	return s
+}
+
+// SetRatio replaces the sampling ratio.
+func (s *ratioSampler) SetRatio(ratio float64) {
+	sampler := sdktrace.TraceIDRatioBased(ratio)
+	s.current.Store(&sampler)
+	s.ratio.Store(math.Float64bits(ratio))
+}
+
+// Ratio returns the current sampling ratio.
+func (s *ratioSampler) Ratio() float64 {
+	return math.Float64frombits(s.ratio.Load())
+}
+
+func (s *ratioSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	return (*s.current.Load()).ShouldSample(p)
+}
+
+func (s *ratioSampler) Description() string {
+	return fmt.Sprintf("AdjustableRatio{%g}", s.Ratio())
+}
+
+// debugSampler samples every span of a debug request or dry run, overriding
+// both the parent's decision and the ratio, and tags it with debug.trace or
+// dry_run. It delegates everything else.
+type debugSampler struct {
+	sdktrace.Sampler
+}
+
+func (s debugSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	var attrs []attribute.KeyValue
+	if DebugEnabled(p.ParentContext) {
+		attrs = append(attrs, DebugKey.Bool(true))
+	}
+	if DryRun(p.ParentContext) {
+		attrs = append(attrs, DryRunKey.Bool(true))
+	}
+	if len(attrs) == 0 {
+		return s.Sampler.ShouldSample(p)
+	}
+	return sdktrace.SamplingResult{
+		Decision:   sdktrace.RecordAndSample,
+		Attributes: attrs,
+		Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+	}
+}
+
+func (s debugSampler) Description() string {
+	return "Debug{" + s.Sampler.Description() + "}"
+}
+
+// adaptiveSampler samples new traces of boosted routes at their boosted
+// ratio, tagging their root spans with sampling.adaptive_ratio, and delegates
+// everything else. The route is matched from the server span's method and
+// url.path, since the route pattern is only known once the mux has run.
+type adaptiveSampler struct {
+	sdktrace.Sampler
+	rates *adaptiveRates
+}
+
+func (s adaptiveSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.Kind == trace.SpanKindServer {
+		var method, path string
+		for _, kv := range p.Attributes {
+			switch kv.Key {
+			case "http.request.method":
+				method = kv.Value.AsString()
+			case "url.path":
+				path = kv.Value.AsString()
+			}
+		}
+		if ratio, ok := s.rates.ratio(method, path); ok {
+			res := sdktrace.TraceIDRatioBased(ratio).ShouldSample(p)
+			res.Attributes = append(res.Attributes, attribute.Float64("sampling.adaptive_ratio", ratio))
+			return res
+		}
+	}
+	return s.Sampler.ShouldSample(p)
+}
+
+func (s adaptiveSampler) Description() string {
+	return "Adaptive{" + s.Sampler.Description() + "}"
+}
+
+// adaptiveCollector periodically reads the request duration histogram from
+// its own manual reader and feeds the per-route error counts to rates. A
+// request is an error when the status mapping makes its server span one.
+type adaptiveCollector struct {
+	rates  *adaptiveRates
+	reader *sdkmetric.ManualReader
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newAdaptiveCollector(rates *adaptiveRates, reader *sdkmetric.ManualReader) (*adaptiveCollector, error) {
+	c := &adaptiveCollector{
+		rates:  rates,
+		reader: reader,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	_, err := meter().Float64ObservableGauge(
+		"trace_sampling_ratio",
+		metric.WithDescription("Sampling ratio applied to new traces, by route"),
+		metric.WithUnit("1"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			for _, r := range rates.state().Routes {
+				o.Observe(r.Ratio, metric.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("http.route", r.Route),
+				))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter().Float64ObservableGauge(
+		"trace_sampling_error_rate",
+		metric.WithDescription("Error rate adaptive sampling last computed, by route"),
+		metric.WithUnit("1"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			for _, r := range rates.state().Routes {
+				o.Observe(r.ErrorRate, metric.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("http.route", r.Route),
+				))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.run()
+	return c, nil
+}
+
+func (c *adaptiveCollector) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.rates.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.collect(); err != nil {
+				Logger().Warn("adaptive sampling: reading error rates", zap.Error(err))
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *adaptiveCollector) collect() error {
+	var rm metricdata.ResourceMetrics
+	if err := c.reader.Collect(context.Background(), &rm); err != nil {
+		return err
+	}
+
+	counts := make(map[routeKey]routeCounts)
+	mapping := statusMapping.Load()
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			hist, ok := m.Data.(metricdata.Histogram[float64])
+			if m.Name != "http.server.request.duration" || !ok {
+				continue
+			}
+			for _, dp := range hist.DataPoints {
+				route, ok := dp.Attributes.Value("http.route")
+				if !ok {
+					continue
+				}
+				method, _ := dp.Attributes.Value("http.request.method")
+				status, _ := dp.Attributes.Value("http.response.status_code")
+				key := routeKey{method.AsString(), route.AsString()}
+				rc := counts[key]
+				rc.requests += dp.Count
+				if mapping.expected(int(status.AsInt64())) == codes.Error {
+					rc.errors += dp.Count
+				}
+				counts[key] = rc
+			}
+		}
+	}
+	c.rates.update(counts)
+	return nil
+}
+
+func (c *adaptiveCollector) Shutdown(context.Context) error {
+	close(c.stop)
+	<-c.done
+	return nil
+}
@@ -0,0 +1,117 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceGraphProcessor counts a request on the edge from the service to
+// the one it called each time a client span ends, under the names and
+// labels of Tempo's service graph metrics, so a service map panel works
+// without the collector's servicegraph connector. The server is the
+// span's peer.service, else its server.address or the host of its
+// url.full. As with the connector, only recorded spans are counted, so the
+// edges carry the sampling ratio; dry runs are left out.
+type serviceGraphProcessor struct{}
+
+func (serviceGraphProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (serviceGraphProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanKind() != trace.SpanKindClient {
+		return
+	}
+	var peer, address, fullURL string
+	var database bool
+	for _, kv := range s.Attributes() {
+		switch kv.Key {
+		case "peer.service":
+			peer = kv.Value.AsString()
+		case "server.address":
+			address = kv.Value.AsString()
+		case "url.full":
+			fullURL = kv.Value.AsString()
+		case "db.system", "db.system.name":
+			database = true
+		case DryRunKey:
+			if kv.Value.AsBool() {
+				return
+			}
+		}
+	}
+	server := peer
+	if server == "" {
+		server = address
+	}
+	if server == "" {
+		if u, err := url.Parse(fullURL); err == nil {
+			server = u.Hostname()
+		}
+	}
+	if server == "" {
+		server = "unknown"
+	}
+	client, _ := s.Resource().Set().Value("service.name")
+	attrs := []attribute.KeyValue{attribute.String("client", client.AsString()), attribute.String("server", server)}
+	if database {
+		attrs = append(attrs, attribute.String("connection_type", "database"))
+	}
+	opt := metric.WithAttributes(attrs...)
+
+	ctx := context.Background()
+	in := serviceGraphInstruments()
+	in.requests.Add(ctx, 1, opt)
+	if s.Status().Code == codes.Error {
+		in.failed.Add(ctx, 1, opt)
+	}
+	in.clientSeconds.Record(ctx, s.EndTime().Sub(s.StartTime()).Seconds(), opt)
+}
+
+func (serviceGraphProcessor) Shutdown(context.Context) error   { return nil }
+func (serviceGraphProcessor) ForceFlush(context.Context) error { return nil }
+
+type serviceGraph struct {
+	requests      metric.Int64Counter
+	failed        metric.Int64Counter
+	clientSeconds metric.Float64Histogram
+}
+
+var serviceGraphInstruments = sync.OnceValue(func() serviceGraph {
+	var g serviceGraph
+	var err error
+	m := meter()
+	g.requests, err = m.Int64Counter(
+		"traces_service_graph_request_total",
+		metric.WithDescription("Number of requests between two services, by client and server"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		g.requests, _ = m.Int64Counter("traces_service_graph_request_total")
+	}
+	g.failed, err = m.Int64Counter(
+		"traces_service_graph_request_failed_total",
+		metric.WithDescription("Number of failed requests between two services, by client and server"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		g.failed, _ = m.Int64Counter("traces_service_graph_request_failed_total")
+	}
+	g.clientSeconds, err = m.Float64Histogram(
+		"traces_service_graph_request_client_seconds",
+		metric.WithDescription("Duration of requests between two services as seen by the client, by client and server"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+	)
+	if err != nil {
+		g.clientSeconds, _ = m.Float64Histogram("traces_service_graph_request_client_seconds")
+	}
+	return g
+})
@@ -0,0 +1,523 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/exemplar"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// Providers holds the SDK providers built from a Config.
+type Providers struct {
+	TracerProvider *sdktrace.TracerProvider
+	MeterProvider  *sdkmetric.MeterProvider
+	Logger         *zap.Logger
+	SpanBuffer     *SpanBuffer
+
+	spanExporter sdktrace.SpanExporter
+	payloadSizer *payloadSizer
+	diskBuffer   *diskBuffer
+	watchdog     *watchdog
+	adaptive     *adaptiveCollector
+	heatmap      *heatmapCollector
+	prometheus   *prometheusServer
+	chaos        bool
+	baggage      *baggageCopier
+	// propagator is installed by Install; built from the propagators
+	// setting unless WithPropagators replaces it.
+	propagator propagation.TextMapPropagator
+	// installed marks providers made global by Install, whose shutdown
+	// makes later measurements count as dropped.
+	installed bool
+}
+
+// Shutdown shuts down all providers, returning the joined errors.
+func (p *Providers) Shutdown(ctx context.Context) error {
+	if p.installed {
+		// Measurements from here on can't be exported; count them instead.
+		shutDown.Store(true)
+	}
+	var errs []error
+	if p.watchdog != nil {
+		errs = append(errs, p.watchdog.Shutdown(ctx))
+	}
+	if p.adaptive != nil {
+		errs = append(errs, p.adaptive.Shutdown(ctx))
+	}
+	if p.heatmap != nil {
+		errs = append(errs, p.heatmap.Shutdown(ctx))
+	}
+	if p.TracerProvider != nil {
+		errs = append(errs, p.TracerProvider.Shutdown(ctx))
+	}
+	if p.spanExporter != nil {
+		errs = append(errs, p.spanExporter.Shutdown(ctx))
+	}
+	if p.prometheus != nil {
+		errs = append(errs, p.prometheus.Shutdown(ctx))
+	}
+	if p.MeterProvider != nil {
+		errs = append(errs, p.MeterProvider.Shutdown(ctx))
+	}
+	if p.payloadSizer != nil {
+		errs = append(errs, p.payloadSizer.Shutdown(ctx))
+	}
+	if p.diskBuffer != nil {
+		errs = append(errs, p.diskBuffer.Shutdown(ctx))
+	}
+	if p.chaos {
+		errs = append(errs, closeChaos(ctx))
+	}
+	if p.Logger != nil {
+		p.Logger.Sync()
+	}
+	return errors.Join(errs...)
+}
+
+// Setup loads the configuration files of WithConfigFile, merged in order,
+// builds the SDK providers and installs them as the global providers. The
+// returned Providers can also be used directly instead of the globals, and
+// their Shutdown flushes and shuts down everything Setup started. If no
+// file is given or the first (base) file does not exist, the configuration
+// comes from the OTEL_* environment variables instead (see envConfig), and
+// without those the global no-op providers are left in place and the
+// returned Providers are empty. A missing overlay is an error.
+func Setup(ctx context.Context, opts ...Option) (*Providers, error) {
+	o := newSetupOptions(opts)
+	timing := SetupTiming{Start: time.Now()}
+	defer func() { lastSetup.Store(&timing) }()
+
+	var cfg *Config
+	var err error
+	fromEnv := len(o.cfgFiles) == 0 || !exists(o.cfgFiles[0])
+	if fromEnv {
+		var ok bool
+		cfg, ok, err = envConfig()
+		timing.ConfigParsed = time.Now()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			initialized.Store(true)
+			return &Providers{}, nil
+		}
+	} else {
+		cfg, err = LoadConfig(o.cfgFiles...)
+		timing.ConfigParsed = time.Now()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.runtimeMetrics {
+		cfg.Metrics.Runtime = true
+	}
+	if o.prometheus != "" {
+		cfg.Metrics.Prometheus = PrometheusConfig{Enabled: true, Address: o.prometheus}
+	}
+	cfg.Metrics.Views = append(cfg.Metrics.Views, o.views...)
+	if cfg.DevMode {
+		devMode.Store(true)
+	}
+	debugEndpoints.Store(cfg.DebugEndpoints == nil || *cfg.DebugEndpoints)
+	setStatusMapping(cfg.StatusMapping)
+	setDryRunExclude(cfg.Metrics.DryRunExclude)
+
+	attrs := append([]attribute.KeyValue{semconv.ServiceName(o.serviceName)}, o.attrs...)
+	if o.serviceVersion != "" {
+		attrs = append(attrs, semconv.ServiceVersion(o.serviceVersion))
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attrs...))
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := ProvidersFromConfig(ctx, cfg, res)
+	if err != nil {
+		return nil, err
+	}
+	if o.propagator != nil {
+		p.propagator = o.propagator
+	}
+	timing.ProvidersReady = time.Now()
+
+	p.Install()
+	if err := registerInstruments(cfg.Metrics.Instruments); err != nil {
+		return nil, errors.Join(err, p.Shutdown(ctx))
+	}
+	if fromEnv {
+		Logger().Info("telemetry configured from OTEL_* environment variables; no config file found",
+			zap.Strings("config_files", o.cfgFiles),
+			zap.String("traces_exporter", cfg.Traces.Exporter.Type),
+			zap.String("metrics_exporter", cfg.Metrics.Exporter.Type))
+	}
+	return p, nil
+}
+
+// Install makes p the global providers and logger, with the propagator of
+// WithPropagators, else of the propagators setting, else the TraceContext
+// and Baggage propagators. Setup calls it; tests can use it to install
+// providers with in-memory exporters.
+func (p *Providers) Install() {
+	globalLogger.Store(p.Logger)
+	resetExportResults()
+	globalSpanBuffer.Store(p.SpanBuffer)
+	if p.adaptive != nil {
+		adaptive.Store(p.adaptive.rates)
+	} else {
+		adaptive.Store(nil)
+	}
+	if p.heatmap != nil {
+		heatmap.Store(p.heatmap.windows)
+	} else {
+		heatmap.Store(nil)
+	}
+	copier.Store(p.baggage)
+	otel.SetTracerProvider(p.TracerProvider)
+	otel.SetMeterProvider(p.MeterProvider)
+	shutDown.Store(false)
+	propagator := p.propagator
+	if propagator == nil {
+		propagator = defaultPropagator()
+	}
+	otel.SetTextMapPropagator(propagator)
+	otel.SetErrorHandler(sdkErrors)
+	p.installed = true
+	installedProviders.Store(p)
+	initialized.Store(true)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// ProvidersFromConfig builds the logger and the tracer and meter providers
+// described by cfg.
+func ProvidersFromConfig(ctx context.Context, cfg *Config, res *resource.Resource) (*Providers, error) {
+	p := &Providers{}
+
+	propagator, err := newPropagator(cfg.Propagators)
+	if err != nil {
+		return nil, err
+	}
+	p.propagator = propagator
+
+	logger, err := newLogger(cfg.Logs)
+	if err != nil {
+		return nil, fmt.Errorf("logger: %w", err)
+	}
+	p.Logger = truncatingLogger(logger, attributeLimit(cfg.Logs.MaxAttributeLength)).WithOptions(zap.Hooks(countLogRecord))
+	costs.configure(cfg.Cost)
+
+	var dialOpts []grpc.DialOption
+	if cfg.PayloadStats.Enabled {
+		sizer, err := newPayloadSizer(cfg.PayloadStats)
+		if err != nil {
+			return nil, fmt.Errorf("payload stats: %w", err)
+		}
+		p.payloadSizer = sizer
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(sizer.interceptor()))
+	}
+	if cfg.DiskBuffer.Enabled {
+		buffer, err := newDiskBuffer(cfg.DiskBuffer)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("disk buffer: %w", err), p.Shutdown(ctx))
+		}
+		p.diskBuffer = buffer
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(buffer.interceptor()))
+	}
+
+	ratio := 1.0
+	if cfg.Traces.SamplingRatio != nil {
+		ratio = *cfg.Traces.SamplingRatio
+	}
+	pipeline := &spanPipeline{
+		sampler:   newRatioSampler(ratio),
+		ratio:     ratio,
+		queueSize: cfg.Traces.QueueSize,
+	}
+	if pipeline.queueSize <= 0 {
+		pipeline.queueSize = sdktrace.DefaultMaxQueueSize
+	}
+
+	if cfg.Chaos.Enabled {
+		p.chaos = true
+		// Let the SDK report its own queue sizes, drops and export results,
+		// which is what an outage is observed through.
+		if os.Getenv("OTEL_GO_X_OBSERVABILITY") == "" {
+			os.Setenv("OTEL_GO_X_OBSERVABILITY", "true")
+		}
+	}
+	tracesExporter, err := chaosExporter(cfg.Chaos, "traces", cfg.Traces.Exporter)
+	if err != nil {
+		return nil, errors.Join(err, p.Shutdown(ctx))
+	}
+	spanExporter, err := newSpanExporter(ctx, tracesExporter, dialOpts)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("traces exporter: %w", err), p.Shutdown(ctx))
+	}
+	var root sdktrace.Sampler = pipeline.sampler
+	var rates *adaptiveRates
+	if cfg.Traces.AdaptiveSampling.Enabled {
+		rates = newAdaptiveRates(cfg.Traces.AdaptiveSampling, pipeline.sampler.Ratio)
+		root = adaptiveSampler{Sampler: root, rates: rates}
+	}
+	if cfg.Traces.KeepErrors {
+		root = errorBiasedSampler{root}
+	}
+	routes, err := newRouteSampler(cfg.Traces.RouteSampling,
+		sdktrace.ParentBased(root, sdktrace.WithLocalParentNotSampled(recordingParent{})))
+	if err != nil {
+		return nil, errors.Join(err, p.Shutdown(ctx))
+	}
+	policies, err := newPolicyProcessor(cfg.AttributePolicies)
+	if err != nil {
+		return nil, errors.Join(err, p.Shutdown(ctx))
+	}
+	p.SpanBuffer = NewSpanBuffer(cfg.Traces.SpanBuffer)
+	p.TracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(debugSampler{routes}),
+		// First, so the other processors and the exporters see the defaults.
+		sdktrace.WithSpanProcessor(policies),
+		sdktrace.WithSpanProcessor(p.SpanBuffer),
+	)
+	pipeline.provider = p.TracerProvider
+	if p.baggage = newBaggageCopier(cfg.Traces.BaggageAttributes); p.baggage != nil {
+		p.TracerProvider.RegisterSpanProcessor(p.baggage)
+	}
+	if cfg.Metrics.ServiceGraph {
+		p.TracerProvider.RegisterSpanProcessor(serviceGraphProcessor{})
+	}
+	if cfg.Traces.KeepErrors || routes.keepsErrors() {
+		p.TracerProvider.RegisterSpanProcessor(newErrorTraceProcessor(pipeline.export))
+	}
+	if spanExporter != nil {
+		spanExporter = countingSpanExporter{newTruncatingSpanExporter(spanExporter, attributeLimit(cfg.Traces.MaxAttributeLength))}
+		// Batch processors only borrow the exporter, so they can be swapped
+		// at runtime; Providers.Shutdown shuts it down.
+		p.spanExporter = spanExporter
+		pipeline.exporter = borrowedExporter{spanExporter}
+		pipeline.setQueueSize(pipeline.queueSize)
+	}
+
+	meterOpts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+	for _, v := range mergeViews(DefaultViews, cfg.Metrics.Views) {
+		if err := v.validate(); err != nil {
+			return nil, errors.Join(err, p.Shutdown(ctx))
+		}
+		meterOpts = append(meterOpts, sdkmetric.WithView(newView(v)))
+	}
+	switch {
+	case cfg.Metrics.Exemplars != nil && !*cfg.Metrics.Exemplars:
+		meterOpts = append(meterOpts, sdkmetric.WithExemplarFilter(exemplar.AlwaysOffFilter))
+	case cfg.Metrics.ExemplarFilter == "always_on":
+		meterOpts = append(meterOpts, sdkmetric.WithExemplarFilter(exemplar.AlwaysOnFilter))
+	case cfg.Metrics.ExemplarFilter == "", cfg.Metrics.ExemplarFilter == "trace_based":
+		// The SDK's default.
+	default:
+		return nil, errors.Join(fmt.Errorf("unknown exemplar filter %q, want trace_based or always_on", cfg.Metrics.ExemplarFilter), p.Shutdown(ctx))
+	}
+	metricsExporter, err := chaosExporter(cfg.Chaos, "metrics", cfg.Metrics.Exporter)
+	if err != nil {
+		return nil, errors.Join(err, p.Shutdown(ctx))
+	}
+	metricExporter, err := newMetricExporter(ctx, metricsExporter, dialOpts)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("metrics exporter: %w", err), p.Shutdown(ctx))
+	}
+	var producers []sdkmetric.Producer
+	if cfg.Metrics.Runtime {
+		producers = append(producers, newGCPauseProducer())
+	}
+	if metricExporter != nil {
+		readerOpts := intervalOption(cfg.Metrics.Interval)
+		for _, producer := range producers {
+			readerOpts = append(readerOpts, sdkmetric.WithProducer(producer))
+		}
+		meterOpts = append(meterOpts, sdkmetric.WithReader(
+			sdkmetric.NewPeriodicReader(catalogingExporter{countingMetricExporter{metricExporter}}, readerOpts...),
+		))
+	}
+	if cfg.Metrics.Prometheus.Enabled {
+		reader, server, err := newPrometheusReader(cfg.Metrics.Prometheus, producers...)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("prometheus endpoint: %w", err), p.Shutdown(ctx))
+		}
+		p.prometheus = server
+		meterOpts = append(meterOpts, sdkmetric.WithReader(reader))
+	}
+	if cfg.Metrics.StatsD.Enabled {
+		statsd, err := newStatsDExporter(cfg.Metrics.StatsD)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("statsd exporter: %w", err), p.Shutdown(ctx))
+		}
+		meterOpts = append(meterOpts, sdkmetric.WithReader(
+			sdkmetric.NewPeriodicReader(statsd, intervalOption(cfg.Metrics.StatsD.Interval)...),
+		))
+	}
+	var adaptiveReader *sdkmetric.ManualReader
+	if rates != nil {
+		adaptiveReader = sdkmetric.NewManualReader()
+		meterOpts = append(meterOpts, sdkmetric.WithReader(adaptiveReader))
+	}
+	var heatmapReader *sdkmetric.ManualReader
+	if cfg.Metrics.Heatmap.Enabled {
+		heatmapReader = newHeatmapReader()
+		meterOpts = append(meterOpts, sdkmetric.WithReader(heatmapReader))
+	}
+	p.MeterProvider = sdkmetric.NewMeterProvider(meterOpts...)
+	if err := registerCostMetrics(); err != nil {
+		return nil, errors.Join(fmt.Errorf("cost metrics: %w", err), p.Shutdown(ctx))
+	}
+	if err := registerDroppedMetrics(); err != nil {
+		return nil, errors.Join(fmt.Errorf("dropped measurement metrics: %w", err), p.Shutdown(ctx))
+	}
+	if err := registerTruncationMetrics(); err != nil {
+		return nil, errors.Join(fmt.Errorf("truncation metrics: %w", err), p.Shutdown(ctx))
+	}
+	if err := registerExportErrorMetrics(); err != nil {
+		return nil, errors.Join(fmt.Errorf("export error metrics: %w", err), p.Shutdown(ctx))
+	}
+	if cfg.Metrics.Runtime {
+		if err := startRuntimeMetrics(p.MeterProvider); err != nil {
+			return nil, errors.Join(fmt.Errorf("runtime metrics: %w", err), p.Shutdown(ctx))
+		}
+	}
+
+	if cfg.Watchdog.Enabled {
+		w, err := newWatchdog(cfg.Watchdog, pipeline)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("memory watchdog: %w", err), p.Shutdown(ctx))
+		}
+		p.watchdog = w
+	}
+	if rates != nil {
+		c, err := newAdaptiveCollector(rates, adaptiveReader)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("adaptive sampling: %w", err), p.Shutdown(ctx))
+		}
+		p.adaptive = c
+	}
+	if heatmapReader != nil {
+		p.heatmap = newHeatmapCollector(newHeatmapWindows(cfg.Metrics.Heatmap), heatmapReader)
+	}
+
+	return p, nil
+}
+
+// borrowedExporter shields an exporter from Shutdown calls made by the span
+// processors using it.
+type borrowedExporter struct {
+	sdktrace.SpanExporter
+}
+
+func (borrowedExporter) Shutdown(context.Context) error { return nil }
+
+// chaosExporter points an OTLP exporter of signal at a chaos proxy for its
+// endpoint if cfg routes the signal through one.
+func chaosExporter(cfg ChaosConfig, signal string, e ExporterConfig) (ExporterConfig, error) {
+	if e.Type != "otlp" || !cfg.proxied(signal) {
+		return e, nil
+	}
+	target := e.Endpoint
+	if target == "" {
+		target = "localhost:4317"
+	}
+	addr, err := chaos.proxy(signal, target)
+	if err != nil {
+		return e, err
+	}
+	e.Endpoint = addr
+	return e, nil
+}
+
+func newSpanExporter(ctx context.Context, cfg ExporterConfig, dialOpts []grpc.DialOption) (sdktrace.SpanExporter, error) {
+	switch cfg.Type {
+	case "", "none":
+		return nil, nil
+	case "console":
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithDialOption(dialOpts...)}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown exporter type %q", cfg.Type)
+	}
+}
+
+func newMetricExporter(ctx context.Context, cfg ExporterConfig, dialOpts []grpc.DialOption) (sdkmetric.Exporter, error) {
+	switch cfg.Type {
+	case "", "none":
+		return nil, nil
+	case "console":
+		return stdoutmetric.New(stdoutmetric.WithPrettyPrint())
+	case "otlp":
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithDialOption(dialOpts...)}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlpmetricgrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown exporter type %q", cfg.Type)
+	}
+}
+
+// newView returns the SDK view of v. It leaves instruments other than
+// histograms alone, since a wildcard may match a counter too and the SDK
+// would make it a histogram. Each bucket of the view keeps an exemplar of
+// its own, the latest measurement in it the exemplar filter let through,
+// so every latency band links to a trace of it.
+func newView(v View) sdkmetric.View {
+	view := sdkmetric.NewView(
+		sdkmetric.Instrument{Name: v.Instrument},
+		sdkmetric.Stream{
+			Aggregation: sdkmetric.AggregationExplicitBucketHistogram{Boundaries: v.Buckets},
+			ExemplarReservoirProviderSelector: func(sdkmetric.Aggregation) exemplar.ReservoirProvider {
+				return exemplar.HistogramReservoirProvider(v.Buckets)
+			},
+		},
+	)
+	return func(i sdkmetric.Instrument) (sdkmetric.Stream, bool) {
+		if i.Kind != sdkmetric.InstrumentKindHistogram {
+			return sdkmetric.Stream{}, false
+		}
+		return view(i)
+	}
+}
+
+func intervalOption(d time.Duration) []sdkmetric.PeriodicReaderOption {
+	if d <= 0 {
+		return nil
+	}
+	return []sdkmetric.PeriodicReaderOption{sdkmetric.WithInterval(d)}
+}
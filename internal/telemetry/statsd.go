@@ -0,0 +1,184 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// maxPacketSize keeps statsd datagrams below the typical Ethernet MTU.
+const maxPacketSize = 1432
+
+// statsdExporter is a metric exporter that mirrors the service's instruments
+// as DogStatsD-style lines over UDP. It runs on its own PeriodicReader so the
+// OTLP pipeline is unaffected by it.
+//
+// Counters and histograms are exported with delta temporality so each
+// collection maps to statsd increments; up-down counters and gauges are
+// exported as absolute gauges.
+type statsdExporter struct {
+	prefix string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newStatsDExporter(cfg StatsDConfig) (*statsdExporter, error) {
+	addr := cfg.Address
+	if addr == "" {
+		addr = "localhost:8125"
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdExporter{prefix: cfg.Prefix, conn: conn}, nil
+}
+
+func (e *statsdExporter) Temporality(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+	switch kind {
+	case sdkmetric.InstrumentKindUpDownCounter, sdkmetric.InstrumentKindObservableUpDownCounter:
+		return metricdata.CumulativeTemporality
+	default:
+		return metricdata.DeltaTemporality
+	}
+}
+
+func (e *statsdExporter) Aggregation(kind sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(kind)
+}
+
+func (e *statsdExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	var lines []string
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			lines = e.appendLines(lines, m)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > maxPacketSize {
+			if _, err := e.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		_, err := e.conn.Write(buf.Bytes())
+		return err
+	}
+	return nil
+}
+
+func (e *statsdExporter) appendLines(lines []string, m metricdata.Metrics) []string {
+	name := e.metricName(m.Name)
+
+	switch data := m.Data.(type) {
+	case metricdata.Sum[int64]:
+		for _, dp := range data.DataPoints {
+			lines = append(lines, sumLine(name, float64(dp.Value), data.IsMonotonic, dp.Attributes))
+		}
+	case metricdata.Sum[float64]:
+		for _, dp := range data.DataPoints {
+			lines = append(lines, sumLine(name, dp.Value, data.IsMonotonic, dp.Attributes))
+		}
+	case metricdata.Gauge[int64]:
+		for _, dp := range data.DataPoints {
+			lines = append(lines, statsdLine(name, float64(dp.Value), "g", dp.Attributes))
+		}
+	case metricdata.Gauge[float64]:
+		for _, dp := range data.DataPoints {
+			lines = append(lines, statsdLine(name, dp.Value, "g", dp.Attributes))
+		}
+	case metricdata.Histogram[int64]:
+		for _, dp := range data.DataPoints {
+			lines = appendHistogram(lines, name, dp.Count, float64(dp.Sum), dp.Min, dp.Max, dp.Attributes)
+		}
+	case metricdata.Histogram[float64]:
+		for _, dp := range data.DataPoints {
+			lines = appendHistogram(lines, name, dp.Count, dp.Sum, dp.Min, dp.Max, dp.Attributes)
+		}
+	}
+	return lines
+}
+
+func (e *statsdExporter) metricName(name string) string {
+	if e.prefix == "" {
+		return name
+	}
+	return e.prefix + "." + name
+}
+
+func sumLine(name string, v float64, monotonic bool, attrs attribute.Set) string {
+	if monotonic {
+		return statsdLine(name, v, "c", attrs)
+	}
+	return statsdLine(name, v, "g", attrs)
+}
+
+func appendHistogram[N int64 | float64](lines []string, name string, count uint64, sum float64, lo, hi metricdata.Extrema[N], attrs attribute.Set) []string {
+	if count == 0 {
+		return lines
+	}
+	lines = append(lines,
+		statsdLine(name+".count", float64(count), "c", attrs),
+		statsdLine(name+".sum", sum, "c", attrs),
+	)
+	if v, ok := lo.Value(); ok {
+		lines = append(lines, statsdLine(name+".min", float64(v), "g", attrs))
+	}
+	if v, ok := hi.Value(); ok {
+		lines = append(lines, statsdLine(name+".max", float64(v), "g", attrs))
+	}
+	return lines
+}
+
+func statsdLine(name string, v float64, typ string, attrs attribute.Set) string {
+	line := fmt.Sprintf("%s:%s|%s", name, strconv.FormatFloat(v, 'f', -1, 64), typ)
+	if attrs.Len() == 0 {
+		return line
+	}
+
+	tags := make([]string, 0, attrs.Len())
+	for _, kv := range attrs.ToSlice() {
+		tags = append(tags, string(kv.Key)+":"+kv.Value.Emit())
+	}
+	return line + "|#" + strings.Join(tags, ",")
+}
+
+func (e *statsdExporter) ForceFlush(context.Context) error {
+	return nil
+}
+
+func (e *statsdExporter) Shutdown(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		return nil
+	}
+	err := e.conn.Close()
+	e.conn = nil
+	return err
+}
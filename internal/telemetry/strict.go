@@ -0,0 +1,94 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// StrictMode controls what happens when Logger, Meter or Tracer are called
+// before Setup. Such calls silently get fallbacks by default, which hides
+// initialization-order bugs: instruments created that way work, but a logger
+// fetched early stays a no-op forever.
+type StrictMode int32
+
+const (
+	// StrictOff returns fallbacks silently.
+	StrictOff StrictMode = iota
+	// StrictLog returns fallbacks and logs the access with a stack trace.
+	StrictLog
+	// StrictPanic panics with a *NotInitializedError.
+	StrictPanic
+)
+
+// StrictEnv is the environment variable read at startup to select the strict
+// mode: "log" or "panic". Anything else leaves strict mode off.
+const StrictEnv = "TELEMETRY_STRICT"
+
+// ErrNotInitialized matches, via errors.Is, every *NotInitializedError.
+var ErrNotInitialized = errors.New("telemetry: not initialized")
+
+// NotInitializedError reports an accessor called before Setup.
+type NotInitializedError struct {
+	Accessor string
+	Stack    []byte
+}
+
+func (e *NotInitializedError) Error() string {
+	return fmt.Sprintf("telemetry: %s called before Setup", e.Accessor)
+}
+
+func (e *NotInitializedError) Is(target error) bool {
+	return target == ErrNotInitialized
+}
+
+var (
+	initialized atomic.Bool
+	strictMode  atomic.Int32
+)
+
+func init() {
+	switch os.Getenv(StrictEnv) {
+	case "log":
+		strictMode.Store(int32(StrictLog))
+	case "panic":
+		strictMode.Store(int32(StrictPanic))
+	}
+}
+
+// SetStrictMode changes how pre-Setup accessor calls are reported.
+func SetStrictMode(m StrictMode) {
+	strictMode.Store(int32(m))
+}
+
+// IsInitialized reports whether Setup has completed successfully.
+func IsInitialized() bool {
+	return initialized.Load()
+}
+
+// MustSetup is like Setup but panics if Setup fails.
+func MustSetup(ctx context.Context, opts ...Option) *Providers {
+	p, err := Setup(ctx, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func checkInitialized(accessor string) {
+	if initialized.Load() {
+		return
+	}
+
+	switch StrictMode(strictMode.Load()) {
+	case StrictLog:
+		err := &NotInitializedError{Accessor: accessor, Stack: debug.Stack()}
+		log.Printf("%v\n%s", err, err.Stack)
+	case StrictPanic:
+		panic(&NotInitializedError{Accessor: accessor, Stack: debug.Stack()})
+	}
+}
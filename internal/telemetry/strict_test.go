@@ -0,0 +1,173 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/metric"
+)
+
+// resetInit puts the package back into its pre-Setup state for one test.
+func resetInit(t *testing.T, mode StrictMode) {
+	t.Helper()
+	prev := StrictMode(strictMode.Load())
+	initialized.Store(false)
+	SetStrictMode(mode)
+	t.Cleanup(func() {
+		initialized.Store(false)
+		shutDown.Store(false)
+		globalLogger.Store(nil)
+		SetStrictMode(prev)
+	})
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "otel.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAccessorsBeforeSetupReturnFallbacks(t *testing.T) {
+	resetInit(t, StrictOff)
+
+	if IsInitialized() {
+		t.Fatal("IsInitialized() = true before Setup")
+	}
+	if Logger() == nil || Meter() == nil || Tracer() == nil {
+		t.Fatal("accessor returned nil before Setup")
+	}
+}
+
+func TestStrictPanicBeforeSetup(t *testing.T) {
+	for name, access := range map[string]func(){
+		"Logger": func() { Logger() },
+		"Meter":  func() { Meter() },
+		"Tracer": func() { Tracer() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			resetInit(t, StrictPanic)
+
+			defer func() {
+				err, ok := recover().(error)
+				if !ok || !errors.Is(err, ErrNotInitialized) {
+					t.Fatalf("recovered %v, want ErrNotInitialized", err)
+				}
+				var nie *NotInitializedError
+				if !errors.As(err, &nie) || nie.Accessor != name {
+					t.Fatalf("recovered %v, want NotInitializedError for %s", err, name)
+				}
+			}()
+			access()
+		})
+	}
+}
+
+func TestStrictLogBeforeSetup(t *testing.T) {
+	resetInit(t, StrictLog)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	Meter()
+
+	out := buf.String()
+	if !strings.Contains(out, "Meter called before Setup") {
+		t.Fatalf("log output %q does not report the access", out)
+	}
+	if !strings.Contains(out, "TestStrictLogBeforeSetup") {
+		t.Fatalf("log output does not contain the caller's stack:\n%s", out)
+	}
+}
+
+func TestSetupInitializes(t *testing.T) {
+	resetInit(t, StrictPanic)
+
+	p, err := Setup(context.Background(), WithServiceVersion("test"), WithConfigFile(writeConfig(t, "logs:\n  level: info\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+
+	if !IsInitialized() {
+		t.Fatal("IsInitialized() = false after Setup")
+	}
+	// Must not panic now that Setup has run.
+	Logger().Info("initialized")
+	Tracer()
+	Meter()
+}
+
+func TestMeasurementsOutsideSetupAreDropped(t *testing.T) {
+	resetInit(t, StrictOff)
+	ctx := context.Background()
+
+	counter, err := Meter().Int64Counter("test_guarded_total", metric.WithUnit("{item}"), metric.WithDescription("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, after := DroppedMeasurements()
+	counter.Add(ctx, 1)
+	if b, _ := DroppedMeasurements(); b != before+1 {
+		t.Fatalf("dropped before Setup = %d, want %d", b, before+1)
+	}
+
+	p, err := Setup(ctx, WithServiceVersion("test"), WithConfigFile(writeConfig(t, "logs:\n  level: info\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.Add(ctx, 1)
+	if b, a := DroppedMeasurements(); b != before+1 || a != after {
+		t.Fatalf("dropped after Setup = %d, %d; want %d, %d", b, a, before+1, after)
+	}
+
+	p.Shutdown(ctx)
+	counter.Add(ctx, 1)
+	if _, a := DroppedMeasurements(); a != after+1 {
+		t.Fatalf("dropped after shutdown = %d, want %d", a, after+1)
+	}
+}
+
+func TestSetupWithoutConfigFileInitializes(t *testing.T) {
+	resetInit(t, StrictPanic)
+
+	p := MustSetup(context.Background(), WithServiceVersion("test"), WithConfigFile(filepath.Join(t.TempDir(), "missing.yaml")))
+	defer p.Shutdown(context.Background())
+
+	if !IsInitialized() {
+		t.Fatal("IsInitialized() = false after Setup without a config file")
+	}
+}
+
+func TestFailedSetupLeavesUninitialized(t *testing.T) {
+	resetInit(t, StrictOff)
+
+	if _, err := Setup(context.Background(), WithConfigFile(writeConfig(t, "traces: ["))); err == nil {
+		t.Fatal("Setup succeeded with an invalid config")
+	}
+	if IsInitialized() {
+		t.Fatal("IsInitialized() = true after a failed Setup")
+	}
+}
+
+func TestMustSetupPanicsOnError(t *testing.T) {
+	resetInit(t, StrictOff)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MustSetup did not panic on an invalid config")
+		}
+	}()
+	MustSetup(context.Background(), WithConfigFile(writeConfig(t, "traces: [")))
+}
@@ -0,0 +1,9 @@
+// Package telemetry holds the OpenTelemetry plumbing shared by the payment service.
+//
+// Building with the notelemetry tag swaps the SDK-backed parts for no-ops,
+// leaving an uninstrumented binary for measuring instrumentation overhead.
+package telemetry
+
+// ScopeName is the instrumentation scope used for every tracer and meter the
+// service creates.
+const ScopeName = "payment-service"
@@ -0,0 +1,25 @@
+package telemetry
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetupTiming records when the phases of a Setup call finished. Zero
+// times mean the phase was not reached.
+type SetupTiming struct {
+	Start          time.Time
+	ConfigParsed   time.Time
+	ProvidersReady time.Time
+}
+
+var lastSetup atomic.Pointer[SetupTiming]
+
+// LastSetupTiming returns the phase timings of the most recent Setup call,
+// or the zero value if Setup has not run.
+func LastSetupTiming() SetupTiming {
+	if t := lastSetup.Load(); t != nil {
+		return *t
+	}
+	return SetupTiming{}
+}
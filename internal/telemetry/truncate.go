@@ -0,0 +1,283 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DefaultMaxAttributeLength is the length, in characters, string attributes
+// of spans and log fields are cut to when max_attribute_length isn't set.
+// Collectors and backends reject or drop oversized values, often the whole
+// span or batch with them, once free-text fields such as notes or metadata
+// reach an attribute.
+const DefaultMaxAttributeLength = 256
+
+// TruncationIndicator ends a value that was cut, so readers can tell it
+// from one that really ends there. It counts towards the limit.
+const TruncationIndicator = "…"
+
+// attributeLimit returns the limit of a max_attribute_length setting: the
+// default for 0 and none, reported as 0, for a negative one.
+func attributeLimit(n int) int {
+	switch {
+	case n == 0:
+		return DefaultMaxAttributeLength
+	case n < 0:
+		return 0
+	}
+	return n
+}
+
+// truncate returns s cut to limit characters, the last of them being
+// TruncationIndicator, and whether it was cut. It cuts between runes, so
+// the result is still valid UTF-8.
+func truncate(s string, limit int) (string, bool) {
+	if len(s) <= limit || utf8.RuneCountInString(s) <= limit {
+		return s, false
+	}
+	n := 0
+	for i := range s {
+		if n == limit-1 {
+			return s[:i] + TruncationIndicator, true
+		}
+		n++
+	}
+	return s, false
+}
+
+// truncateAttributes returns attrs with their string values, and the
+// elements of string slices, cut to limit, counting each attribute cut
+// under signal. It returns attrs itself if nothing was cut.
+func truncateAttributes(signal string, attrs []attribute.KeyValue, limit int) ([]attribute.KeyValue, bool) {
+	var out []attribute.KeyValue
+	for i, kv := range attrs {
+		v, cut := truncateValue(kv.Value, limit)
+		if !cut {
+			continue
+		}
+		if out == nil {
+			out = append([]attribute.KeyValue(nil), attrs...)
+		}
+		out[i] = attribute.KeyValue{Key: kv.Key, Value: v}
+		countTruncation(signal, string(kv.Key))
+	}
+	if out == nil {
+		return attrs, false
+	}
+	return out, true
+}
+
+func truncateValue(v attribute.Value, limit int) (attribute.Value, bool) {
+	switch v.Type() {
+	case attribute.STRING:
+		s, cut := truncate(v.AsString(), limit)
+		return attribute.StringValue(s), cut
+	case attribute.STRINGSLICE:
+		ss := v.AsStringSlice()
+		var cut bool
+		for i, s := range ss {
+			var c bool
+			if ss[i], c = truncate(s, limit); c {
+				cut = true
+			}
+		}
+		return attribute.StringSliceValue(ss), cut
+	}
+	return v, false
+}
+
+// truncatingSpanExporter cuts the string attributes of spans, their events
+// and their links to limit before passing the spans on. Spans are cut on
+// export rather than when attributes are set, so the span buffer behind
+// /debug/tracez keeps the full values for local debugging.
+type truncatingSpanExporter struct {
+	sdktrace.SpanExporter
+	limit int
+}
+
+// newTruncatingSpanExporter returns e cutting attributes to limit, or e
+// itself if limit is 0.
+func newTruncatingSpanExporter(e sdktrace.SpanExporter, limit int) sdktrace.SpanExporter {
+	if limit <= 0 {
+		return e
+	}
+	return truncatingSpanExporter{SpanExporter: e, limit: limit}
+}
+
+func (e truncatingSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	var out []sdktrace.ReadOnlySpan
+	for i, s := range spans {
+		t, cut := e.truncateSpan(s)
+		if !cut {
+			continue
+		}
+		if out == nil {
+			out = append([]sdktrace.ReadOnlySpan(nil), spans...)
+		}
+		out[i] = t
+	}
+	if out == nil {
+		out = spans
+	}
+	return e.SpanExporter.ExportSpans(ctx, out)
+}
+
+func (e truncatingSpanExporter) truncateSpan(s sdktrace.ReadOnlySpan) (sdktrace.ReadOnlySpan, bool) {
+	t := truncatedSpan{ReadOnlySpan: s, events: s.Events(), links: s.Links()}
+	attrs, cut := truncateAttributes("traces", s.Attributes(), e.limit)
+	t.attrs = attrs
+
+	var ok, eventsCopied, linksCopied bool
+	for i, ev := range t.events {
+		if ev.Attributes, ok = truncateAttributes("traces", ev.Attributes, e.limit); !ok {
+			continue
+		}
+		if !eventsCopied {
+			t.events, eventsCopied = append([]sdktrace.Event(nil), t.events...), true
+		}
+		t.events[i], cut = ev, true
+	}
+	for i, l := range t.links {
+		if l.Attributes, ok = truncateAttributes("traces", l.Attributes, e.limit); !ok {
+			continue
+		}
+		if !linksCopied {
+			t.links, linksCopied = append([]sdktrace.Link(nil), t.links...), true
+		}
+		t.links[i], cut = l, true
+	}
+	return t, cut
+}
+
+// truncatedSpan is a span with cut attributes.
+type truncatedSpan struct {
+	sdktrace.ReadOnlySpan
+	attrs  []attribute.KeyValue
+	events []sdktrace.Event
+	links  []sdktrace.Link
+}
+
+func (s truncatedSpan) Attributes() []attribute.KeyValue { return s.attrs }
+func (s truncatedSpan) Events() []sdktrace.Event         { return s.events }
+func (s truncatedSpan) Links() []sdktrace.Link           { return s.links }
+
+// truncatingLogger returns l cutting the string and error fields of log
+// records to limit, or l itself if limit is 0.
+func truncatingLogger(l *zap.Logger, limit int) *zap.Logger {
+	if limit <= 0 {
+		return l
+	}
+	return l.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return truncatingCore{Core: c, limit: limit}
+	}))
+}
+
+// truncatingCore cuts the fields of the records it writes, and of those
+// added by With.
+type truncatingCore struct {
+	zapcore.Core
+	limit int
+}
+
+func (c truncatingCore) With(fields []zapcore.Field) zapcore.Core {
+	return truncatingCore{Core: c.Core.With(c.truncate(fields)), limit: c.limit}
+}
+
+func (c truncatingCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c truncatingCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(e, c.truncate(fields))
+}
+
+// truncate returns fields with long string values cut. Errors are
+// rendered to strings first, so a verbose error loses its errorVerbose
+// field once it is cut.
+func (c truncatingCore) truncate(fields []zapcore.Field) []zapcore.Field {
+	var out []zapcore.Field
+	for i, f := range fields {
+		var s string
+		switch f.Type {
+		case zapcore.StringType:
+			s = f.String
+		case zapcore.ErrorType:
+			s = f.Interface.(error).Error()
+		default:
+			continue
+		}
+		cut, ok := truncate(s, c.limit)
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = append([]zapcore.Field(nil), fields...)
+		}
+		out[i] = zap.String(f.Key, cut)
+		countTruncation("logs", f.Key)
+	}
+	if out == nil {
+		return fields
+	}
+	return out
+}
+
+// truncations counts the values cut, by truncationKey.
+var truncations sync.Map
+
+type truncationKey struct{ signal, attribute string }
+
+func countTruncation(signal, attribute string) {
+	key := truncationKey{signal, attribute}
+	n, ok := truncations.Load(key)
+	if !ok {
+		n, _ = truncations.LoadOrStore(key, new(atomic.Int64))
+	}
+	n.(*atomic.Int64).Add(1)
+}
+
+var truncationMetricsOnce sync.Once
+
+// registerTruncationMetrics exports the values cut as an observable
+// counter, since they are cut inside exporters and loggers, where
+// measuring into an instrument could recurse. Instruments are only
+// registered by the first Setup.
+func registerTruncationMetrics() (err error) {
+	truncationMetricsOnce.Do(func() {
+		m := meter()
+		var truncated metric.Int64ObservableCounter
+		truncated, err = m.Int64ObservableCounter(
+			"telemetry_attributes_truncated_total",
+			metric.WithDescription("Number of span attributes and log fields cut to the maximum attribute length, by signal and attribute"),
+			metric.WithUnit("{attribute}"),
+		)
+		if err != nil {
+			return
+		}
+		_, err = m.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+			truncations.Range(func(k, v any) bool {
+				key := k.(truncationKey)
+				o.ObserveInt64(truncated, v.(*atomic.Int64).Load(), metric.WithAttributes(
+					attribute.String("signal", key.signal),
+					attribute.String("attribute", key.attribute),
+				))
+				return true
+			})
+			return nil
+		}, truncated)
+	})
+	return err
+}
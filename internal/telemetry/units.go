@@ -0,0 +1,365 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidInstrument is wrapped by the errors returned when an instrument
+// definition is rejected.
+var ErrInvalidInstrument = errors.New("telemetry: invalid instrument definition")
+
+// DevEnv enables dev mode, in which instrument definition problems are logged
+// with a suggested fix.
+const DevEnv = "TELEMETRY_DEV"
+
+var devMode atomic.Bool
+
+func init() {
+	devMode.Store(os.Getenv(DevEnv) == "1")
+}
+
+// DevMode reports whether dev mode is on, via TELEMETRY_DEV=1 or dev_mode in
+// the config file.
+func DevMode() bool {
+	return devMode.Load()
+}
+
+// ucumUnits is the subset of UCUM case-sensitive units the service uses or
+// is likely to need.
+var ucumUnits = map[string]bool{
+	"1": true, "%": true,
+	"ns": true, "us": true, "ms": true, "s": true, "min": true, "h": true, "d": true,
+	"bit": true, "By": true, "KiBy": true, "MiBy": true, "GiBy": true, "By/s": true,
+	"Hz": true, "Cel": true,
+}
+
+// annotation matches UCUM curly-brace annotations such as "{payment}" or
+// "{USD}", which count things or name a currency.
+var annotation = regexp.MustCompile(`^\{[A-Za-z0-9_.\-]+\}(/s)?$`)
+
+// unitHints maps common non-UCUM spellings to their UCUM unit.
+var unitHints = map[string]string{
+	"seconds": "s", "second": "s", "sec": "s",
+	"milliseconds": "ms", "millis": "ms",
+	"bytes": "By", "byte": "By", "B": "By",
+	"percent": "%", "count": "{count}", "requests": "{request}",
+}
+
+func validUnit(unit string) bool {
+	return ucumUnits[unit] || annotation.MatchString(unit)
+}
+
+type instrumentDef struct {
+	kind, unit, description string
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]instrumentDef)
+)
+
+// checkInstrument enforces unit and naming conventions on an instrument
+// definition. Problems that can't be fixed automatically are returned as
+// errors; in dev mode every problem is also logged with a fix-it hint.
+func checkInstrument(kind, name, unit, description string) error {
+	var problems, hints []string
+	addProblem := func(problem, hint string) {
+		problems = append(problems, problem)
+		hints = append(hints, hint)
+	}
+
+	switch {
+	case unit == "":
+		fixIt(name, "instrument has no unit", `set metric.WithUnit, e.g. "1" or an annotation like "{item}"`)
+	case !validUnit(unit):
+		hint := `use a UCUM unit such as "s" or "By", or an annotation like "{payment}"`
+		if u, ok := unitHints[unit]; ok {
+			hint = fmt.Sprintf("use %q", u)
+		} else if strings.Contains(strings.ToLower(unit), "currency") {
+			hint = `use the ISO 4217 code as an annotation, e.g. "{USD}"`
+		}
+		addProblem(fmt.Sprintf("unit %q is not a UCUM unit", unit), hint)
+	}
+
+	for suffix, want := range map[string]string{"_seconds": "s", "_bytes": "By"} {
+		if strings.HasSuffix(name, suffix) && unit != "" && unit != want && unit != "ms" {
+			addProblem(fmt.Sprintf("name ends in %s but unit is %q", suffix, unit), fmt.Sprintf("use unit %q", want))
+		}
+	}
+	if strings.HasSuffix(name, "_total") && !strings.Contains(kind, "Counter") {
+		fixIt(name, kind+" name ends in _total", "reserve _total for counters")
+	}
+	if description == "" {
+		fixIt(name, "instrument has no description", "set metric.WithDescription")
+	}
+
+	registryMu.Lock()
+	def := instrumentDef{kind: kind, unit: unit, description: description}
+	if prev, ok := registry[name]; ok && prev != def {
+		addProblem(
+			fmt.Sprintf("redefined as %s %q %q, previously %s %q %q", kind, unit, description, prev.kind, prev.unit, prev.description),
+			"give every definition of an instrument the same kind, unit and description",
+		)
+	} else if !ok {
+		registry[name] = def
+	}
+	registryMu.Unlock()
+
+	if len(problems) == 0 {
+		catalogInstrument(kind, name, unit, description)
+		return nil
+	}
+	for i := range problems {
+		fixIt(name, problems[i], hints[i])
+	}
+	return fmt.Errorf("%w %s: %s", ErrInvalidInstrument, name, strings.Join(problems, "; "))
+}
+
+func fixIt(name, problem, hint string) {
+	if DevMode() {
+		Logger().Warn("metric instrument fix-it",
+			zap.String("instrument", name),
+			zap.String("problem", problem),
+			zap.String("fix", hint))
+	}
+}
+
+// secondsName renames a millisecond instrument to its seconds equivalent.
+func secondsName(name string) string {
+	for _, suffix := range []string{"_milliseconds", "_ms"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix) + "_seconds"
+		}
+	}
+	return name
+}
+
+// checkedMeter wraps a Meter, validating every instrument definition with
+// checkInstrument and converting millisecond float instruments to seconds.
+// Counters and histograms matching metrics.dry_run_exclude ignore dry runs,
+// and synchronous instruments drop and count measurements made before Setup
+// or after shutdown; see guard.go.
+// Rejected instruments are returned as no-ops together with the error, so
+// callers that ignore the error keep working.
+type checkedMeter struct {
+	metric.Meter
+}
+
+var fallback = noop.NewMeterProvider().Meter(ScopeName)
+
+func (m checkedMeter) Int64Counter(name string, opts ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	cfg := metric.NewInt64CounterConfig(opts...)
+	if err := checkInstrument("Int64Counter", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Int64Counter(name)
+		return i, err
+	}
+	c, err := m.Meter.Int64Counter(name, opts...)
+	c = guardedInt64Counter{c, name}
+	if excludesDryRun(name) {
+		return dryRunInt64Counter{c}, err
+	}
+	return c, err
+}
+
+func (m checkedMeter) Int64UpDownCounter(name string, opts ...metric.Int64UpDownCounterOption) (metric.Int64UpDownCounter, error) {
+	cfg := metric.NewInt64UpDownCounterConfig(opts...)
+	if err := checkInstrument("Int64UpDownCounter", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Int64UpDownCounter(name)
+		return i, err
+	}
+	c, err := m.Meter.Int64UpDownCounter(name, opts...)
+	c = guardedInt64UpDownCounter{c, name}
+	if excludesDryRun(name) {
+		return dryRunInt64UpDownCounter{c}, err
+	}
+	return c, err
+}
+
+func (m checkedMeter) Int64Histogram(name string, opts ...metric.Int64HistogramOption) (metric.Int64Histogram, error) {
+	cfg := metric.NewInt64HistogramConfig(opts...)
+	err := checkInstrument("Int64Histogram", name, cfg.Unit(), cfg.Description())
+	if err == nil && cfg.Unit() == "ms" {
+		fixIt(name, "integer histogram in ms", "use a Float64Histogram in s, which is converted automatically")
+	}
+	if err != nil {
+		i, _ := fallback.Int64Histogram(name)
+		return i, err
+	}
+	h, err := m.Meter.Int64Histogram(name, opts...)
+	h = guardedInt64Histogram{h, name}
+	if excludesDryRun(name) {
+		return dryRunInt64Histogram{h}, err
+	}
+	return h, err
+}
+
+func (m checkedMeter) Int64Gauge(name string, opts ...metric.Int64GaugeOption) (metric.Int64Gauge, error) {
+	cfg := metric.NewInt64GaugeConfig(opts...)
+	if err := checkInstrument("Int64Gauge", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Int64Gauge(name)
+		return i, err
+	}
+	g, err := m.Meter.Int64Gauge(name, opts...)
+	return guardedInt64Gauge{g, name}, err
+}
+
+func (m checkedMeter) Int64ObservableCounter(name string, opts ...metric.Int64ObservableCounterOption) (metric.Int64ObservableCounter, error) {
+	cfg := metric.NewInt64ObservableCounterConfig(opts...)
+	if err := checkInstrument("Int64ObservableCounter", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Int64ObservableCounter(name)
+		return i, err
+	}
+	return m.Meter.Int64ObservableCounter(name, opts...)
+}
+
+func (m checkedMeter) Int64ObservableUpDownCounter(name string, opts ...metric.Int64ObservableUpDownCounterOption) (metric.Int64ObservableUpDownCounter, error) {
+	cfg := metric.NewInt64ObservableUpDownCounterConfig(opts...)
+	if err := checkInstrument("Int64ObservableUpDownCounter", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Int64ObservableUpDownCounter(name)
+		return i, err
+	}
+	return m.Meter.Int64ObservableUpDownCounter(name, opts...)
+}
+
+func (m checkedMeter) Int64ObservableGauge(name string, opts ...metric.Int64ObservableGaugeOption) (metric.Int64ObservableGauge, error) {
+	cfg := metric.NewInt64ObservableGaugeConfig(opts...)
+	if err := checkInstrument("Int64ObservableGauge", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Int64ObservableGauge(name)
+		return i, err
+	}
+	return m.Meter.Int64ObservableGauge(name, opts...)
+}
+
+func (m checkedMeter) Float64Counter(name string, opts ...metric.Float64CounterOption) (metric.Float64Counter, error) {
+	cfg := metric.NewFloat64CounterConfig(opts...)
+	if err := checkInstrument("Float64Counter", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Float64Counter(name)
+		return i, err
+	}
+	var c metric.Float64Counter
+	var err error
+	if cfg.Unit() != "ms" {
+		c, err = m.Meter.Float64Counter(name, opts...)
+	} else {
+		seconds := secondsName(name)
+		fixIt(name, `unit "ms"`, fmt.Sprintf("converted to %s in s; record seconds directly", seconds))
+		c, err = m.Meter.Float64Counter(seconds, append(opts, metric.WithUnit("s"))...)
+		c = msCounter{c}
+	}
+	c = guardedFloat64Counter{c, name}
+	if excludesDryRun(name) {
+		return dryRunFloat64Counter{c}, err
+	}
+	return c, err
+}
+
+func (m checkedMeter) Float64UpDownCounter(name string, opts ...metric.Float64UpDownCounterOption) (metric.Float64UpDownCounter, error) {
+	cfg := metric.NewFloat64UpDownCounterConfig(opts...)
+	if err := checkInstrument("Float64UpDownCounter", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Float64UpDownCounter(name)
+		return i, err
+	}
+	c, err := m.Meter.Float64UpDownCounter(name, opts...)
+	c = guardedFloat64UpDownCounter{c, name}
+	if excludesDryRun(name) {
+		return dryRunFloat64UpDownCounter{c}, err
+	}
+	return c, err
+}
+
+func (m checkedMeter) Float64Histogram(name string, opts ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	cfg := metric.NewFloat64HistogramConfig(opts...)
+	if err := checkInstrument("Float64Histogram", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Float64Histogram(name)
+		return i, err
+	}
+	var h metric.Float64Histogram
+	var err error
+	if cfg.Unit() != "ms" {
+		h, err = m.Meter.Float64Histogram(name, opts...)
+	} else {
+		seconds := secondsName(name)
+		fixIt(name, `unit "ms"`, fmt.Sprintf("converted to %s in s; record seconds directly", seconds))
+		opts = append(opts, metric.WithUnit("s"))
+		if bounds := cfg.ExplicitBucketBoundaries(); len(bounds) > 0 {
+			scaled := make([]float64, len(bounds))
+			for i, b := range bounds {
+				scaled[i] = b / 1000
+			}
+			opts = append(opts, metric.WithExplicitBucketBoundaries(scaled...))
+		}
+		h, err = m.Meter.Float64Histogram(seconds, opts...)
+		h = msHistogram{h}
+	}
+	h = guardedFloat64Histogram{h, name}
+	if excludesDryRun(name) {
+		return dryRunFloat64Histogram{h}, err
+	}
+	return h, err
+}
+
+func (m checkedMeter) Float64Gauge(name string, opts ...metric.Float64GaugeOption) (metric.Float64Gauge, error) {
+	cfg := metric.NewFloat64GaugeConfig(opts...)
+	if err := checkInstrument("Float64Gauge", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Float64Gauge(name)
+		return i, err
+	}
+	g, err := m.Meter.Float64Gauge(name, opts...)
+	return guardedFloat64Gauge{g, name}, err
+}
+
+func (m checkedMeter) Float64ObservableCounter(name string, opts ...metric.Float64ObservableCounterOption) (metric.Float64ObservableCounter, error) {
+	cfg := metric.NewFloat64ObservableCounterConfig(opts...)
+	if err := checkInstrument("Float64ObservableCounter", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Float64ObservableCounter(name)
+		return i, err
+	}
+	return m.Meter.Float64ObservableCounter(name, opts...)
+}
+
+func (m checkedMeter) Float64ObservableUpDownCounter(name string, opts ...metric.Float64ObservableUpDownCounterOption) (metric.Float64ObservableUpDownCounter, error) {
+	cfg := metric.NewFloat64ObservableUpDownCounterConfig(opts...)
+	if err := checkInstrument("Float64ObservableUpDownCounter", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Float64ObservableUpDownCounter(name)
+		return i, err
+	}
+	return m.Meter.Float64ObservableUpDownCounter(name, opts...)
+}
+
+func (m checkedMeter) Float64ObservableGauge(name string, opts ...metric.Float64ObservableGaugeOption) (metric.Float64ObservableGauge, error) {
+	cfg := metric.NewFloat64ObservableGaugeConfig(opts...)
+	if err := checkInstrument("Float64ObservableGauge", name, cfg.Unit(), cfg.Description()); err != nil {
+		i, _ := fallback.Float64ObservableGauge(name)
+		return i, err
+	}
+	return m.Meter.Float64ObservableGauge(name, opts...)
+}
+
+// msHistogram records millisecond values into a seconds histogram.
+type msHistogram struct {
+	metric.Float64Histogram
+}
+
+func (h msHistogram) Record(ctx context.Context, ms float64, opts ...metric.RecordOption) {
+	h.Float64Histogram.Record(ctx, ms/1000, opts...)
+}
+
+// msCounter adds millisecond values to a seconds counter.
+type msCounter struct {
+	metric.Float64Counter
+}
+
+func (c msCounter) Add(ctx context.Context, ms float64, opts ...metric.AddOption) {
+	c.Float64Counter.Add(ctx, ms/1000, opts...)
+}
@@ -0,0 +1,69 @@
+package telemetry
+
+import (
+	"errors"
+	"fmt"
+)
+
+// View changes how the instruments it matches are aggregated, without
+// changing the code that creates them. Only the bucket boundaries of
+// histograms can be changed so far.
+type View struct {
+	// Instrument is the name of the instruments the view applies to, and
+	// may contain the wildcards * and ?.
+	Instrument string `yaml:"instrument"`
+	// Buckets replace the bucket boundaries of a histogram, in the unit of
+	// the instrument.
+	Buckets []float64 `yaml:"buckets"`
+}
+
+// DefaultViews are the views applied unless metrics.views or WithViews
+// replace them. otelhttp's request duration buckets start at 5ms and have
+// six below 100ms, where most of the service's requests are, and payment
+// amounts would otherwise get the SDK's default buckets, 0 to 10000.
+var DefaultViews = []View{
+	{
+		Instrument: "http.server.request.duration",
+		Buckets:    []float64{0.0005, 0.001, 0.0025, 0.005, 0.0075, 0.01, 0.015, 0.025, 0.035, 0.05, 0.075, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	},
+	{
+		Instrument: "payment_amount",
+		Buckets:    []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 50000, 100000, 1000000},
+	},
+}
+
+// mergeViews returns base with each of overrides replacing the view of
+// base for the same instrument, or added after them if there is none, so
+// no instrument ends up with two views and two streams.
+func mergeViews(base []View, overrides ...[]View) []View {
+	merged := append([]View(nil), base...)
+	for _, views := range overrides {
+	next:
+		for _, v := range views {
+			for i := range merged {
+				if merged[i].Instrument == v.Instrument {
+					merged[i] = v
+					continue next
+				}
+			}
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
+
+// validate checks that v names its instruments and that its buckets rise.
+func (v View) validate() error {
+	if v.Instrument == "" {
+		return errors.New("metrics view: instrument is required")
+	}
+	if len(v.Buckets) == 0 {
+		return fmt.Errorf("metrics view %q: buckets are required", v.Instrument)
+	}
+	for i := 1; i < len(v.Buckets); i++ {
+		if v.Buckets[i] <= v.Buckets[i-1] {
+			return fmt.Errorf("metrics view %q: buckets must be in ascending order, %g follows %g", v.Instrument, v.Buckets[i], v.Buckets[i-1])
+		}
+	}
+	return nil
+}
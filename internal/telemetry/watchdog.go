@@ -0,0 +1,212 @@
+//go:build !notelemetry
+
+package telemetry
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// degradation steps, applied one per check interval while RSS stays above
+// the threshold, and undone together once it falls back below it.
+const (
+	stepNone = iota
+	stepNoDebugLogs
+	stepReducedSampling
+	stepSmallQueue
+)
+
+var stepNames = map[int]string{
+	stepNone:            "none",
+	stepNoDebugLogs:     "debug logs disabled",
+	stepReducedSampling: "sampling reduced",
+	stepSmallQueue:      "span queue shrunk",
+}
+
+// spanPipeline is the part of the tracing pipeline the watchdog adjusts.
+type spanPipeline struct {
+	provider  *sdktrace.TracerProvider
+	exporter  sdktrace.SpanExporter
+	sampler   *ratioSampler
+	ratio     float64
+	queueSize int
+
+	mu        sync.Mutex
+	processor sdktrace.SpanProcessor
+}
+
+// setQueueSize swaps the batch processor for one with the given queue size.
+// The old processor is flushed by UnregisterSpanProcessor.
+func (p *spanPipeline) setQueueSize(size int) {
+	if p.exporter == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bsp := sdktrace.NewBatchSpanProcessor(p.exporter, sdktrace.WithMaxQueueSize(size))
+	p.provider.RegisterSpanProcessor(bsp)
+	if p.processor != nil {
+		p.provider.UnregisterSpanProcessor(p.processor)
+	}
+	p.processor = bsp
+}
+
+// export passes s to the batch processor in use, for spans that didn't
+// reach it when they ended.
+func (p *spanPipeline) export(s sdktrace.ReadOnlySpan) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.processor != nil {
+		p.processor.OnEnd(s)
+	}
+}
+
+type watchdog struct {
+	cfg       WatchdogConfig
+	pipeline  *spanPipeline
+	threshold uint64
+
+	mu        sync.Mutex
+	step      int
+	baseLevel zapcore.Level
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newWatchdog(cfg WatchdogConfig, pipeline *spanPipeline) (*watchdog, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.DegradedSamplingRatio <= 0 {
+		cfg.DegradedSamplingRatio = pipeline.ratio / 10
+	}
+	if cfg.DegradedQueueSize <= 0 {
+		cfg.DegradedQueueSize = 256
+	}
+
+	w := &watchdog{
+		cfg:       cfg,
+		pipeline:  pipeline,
+		threshold: uint64(cfg.RSSThresholdMB) << 20,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	_, err := meter().Int64ObservableGauge(
+		"telemetry_degradation_level",
+		metric.WithDescription("Current memory-pressure degradation step (0 is normal)"),
+		metric.WithUnit("1"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			o.Observe(int64(w.step))
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+func (w *watchdog) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.check(rss())
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *watchdog) check(rss uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case rss > w.threshold && w.step < stepSmallQueue:
+		w.step++
+		w.apply(w.step)
+		Logger().Warn("memory pressure: degrading telemetry",
+			zap.String("step", stepNames[w.step]),
+			zap.Uint64("rss_bytes", rss),
+			zap.Uint64("threshold_bytes", w.threshold))
+	case rss < w.threshold*8/10 && w.step > stepNone:
+		w.restore()
+		Logger().Info("memory pressure relieved: telemetry restored",
+			zap.Uint64("rss_bytes", rss),
+			zap.Uint64("threshold_bytes", w.threshold))
+	}
+}
+
+func (w *watchdog) apply(step int) {
+	switch step {
+	case stepNoDebugLogs:
+		w.baseLevel = logLevel.Level()
+		if w.baseLevel < zapcore.InfoLevel {
+			logLevel.SetLevel(zapcore.InfoLevel)
+		}
+	case stepReducedSampling:
+		w.pipeline.sampler.SetRatio(w.cfg.DegradedSamplingRatio)
+	case stepSmallQueue:
+		w.pipeline.setQueueSize(w.cfg.DegradedQueueSize)
+	}
+}
+
+func (w *watchdog) restore() {
+	if w.step >= stepSmallQueue {
+		w.pipeline.setQueueSize(w.pipeline.queueSize)
+	}
+	if w.step >= stepReducedSampling {
+		w.pipeline.sampler.SetRatio(w.pipeline.ratio)
+	}
+	logLevel.SetLevel(w.baseLevel)
+	w.step = stepNone
+}
+
+func (w *watchdog) Shutdown(context.Context) error {
+	close(w.stop)
+	<-w.done
+	return nil
+}
+
+// rss returns the process resident set size, falling back to the memory the
+// Go runtime has mapped on platforms without /proc.
+func rss() uint64 {
+	if f, err := os.Open("/proc/self/statm"); err == nil {
+		defer f.Close()
+		line, _ := bufio.NewReader(f).ReadString('\n')
+		if fields := strings.Fields(line); len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
@@ -0,0 +1,31 @@
+package telemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithSpan runs fn under a span named name, started with opts as a child
+// of the span in ctx, and ends the span when fn returns:
+//
+//	err := telemetry.WithSpan(ctx, "store.compact", func(ctx context.Context) error {
+//		_, err := paymentStore.Rewrite(ctx, compact)
+//		return err
+//	}, trace.WithNewRoot())
+//
+// An error from fn is recorded with RecordError, which sets the span's
+// status to Error, tags it with the failure domain and counts it in
+// errors_total. It is returned marked as counted, reading and matching as
+// before, so a caller can pass it up to a span of its own, which records it
+// again, without counting it twice.
+func WithSpan(ctx context.Context, name string, fn func(ctx context.Context) error, opts ...trace.SpanStartOption) error {
+	ctx, span := Tracer().Start(ctx, name, opts...)
+	defer span.End()
+	err := fn(ctx)
+	if err == nil {
+		return nil
+	}
+	RecordError(ctx, err)
+	return countedError{err}
+}
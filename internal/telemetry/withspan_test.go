@@ -0,0 +1,38 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWithSpanErrorsCountOnce(t *testing.T) {
+	errFailed := errors.New("failed")
+	recorded := WithSpan(context.Background(), "test", func(context.Context) error {
+		return WithFailureDomain(errFailed, DomainGateway)
+	})
+	other := WithSpan(context.Background(), "test", func(context.Context) error { return errors.New("other") })
+
+	if !errors.Is(recorded, errFailed) || recorded.Error() != "failed" || FailureDomainOf(recorded) != DomainGateway {
+		t.Fatalf("WithSpan() = %v (%s), want the error of fn with its failure domain", recorded, FailureDomainOf(recorded))
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"returned by WithSpan", recorded, true},
+		{"wrapped", fmt.Errorf("send: %w", recorded), true},
+		{"joined", errors.Join(recorded, other), true},
+		{"joined with an uncounted error", errors.Join(recorded, errFailed), false},
+		{"not from WithSpan", errFailed, false},
+	} {
+		if got := counted(tc.err); got != tc.want {
+			t.Errorf("%s: counted() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if err := WithSpan(context.Background(), "test", func(context.Context) error { return nil }); err != nil {
+		t.Errorf("WithSpan() = %v for a nil error", err)
+	}
+}
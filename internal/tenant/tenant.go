@@ -0,0 +1,270 @@
+// Package tenant identifies the tenant behind a request from its X-Tenant-ID
+// header and applies the rate limit of the tenant's plan. The tenant and plan
+// are recorded on the server span, on the http.server.* metrics and, through
+// the context, on the spans of the work done for the tenant, so dashboards
+// can segment latency, errors and throttling by plan. The plan is also added
+// to the baggage, for the services the request calls.
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// Header carries the tenant ID of a request.
+const Header = "X-Tenant-ID"
+
+// Attribute keys of the tenant on spans and metrics. tenant.id is set on
+// spans only; metrics are segmented by tenant.plan, which has few values.
+const (
+	IDKey   = attribute.Key("tenant.id")
+	PlanKey = attribute.Key("tenant.plan")
+)
+
+// Plan is a pricing tier. It sets the tenant's rate limit and, in package
+// pricing, its fees.
+type Plan string
+
+const (
+	PlanFree       Plan = "free"
+	PlanPro        Plan = "pro"
+	PlanEnterprise Plan = "enterprise"
+	// PlanNone is recorded for requests without a tenant, which are not
+	// rate limited.
+	PlanNone Plan = "none"
+)
+
+// Limit is a token bucket rate limit: Burst requests at once, refilled at
+// Rate per second. A zero Rate is unlimited.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Limits are the rate limits of each plan, per tenant. They are low enough
+// for the traffic generator to hit with a few tenants.
+var Limits = map[Plan]Limit{
+	PlanFree:       {Rate: 2, Burst: 5},
+	PlanPro:        {Rate: 20, Burst: 40},
+	PlanEnterprise: {},
+}
+
+// ErrRateLimited is recorded for requests rejected by their plan's rate
+// limit.
+var ErrRateLimited = telemetry.WithFailureDomain(errors.New("tenant: rate limit exceeded"), telemetry.DomainClient)
+
+// Config assigns plans to tenants.
+type Config struct {
+	// Plans maps tenant IDs to their plan. Tenants not listed are on
+	// PlanFree.
+	Plans map[string]Plan
+}
+
+// ParsePlans parses a comma-separated list of tenant=plan pairs, such as
+// "acme=enterprise,globex=pro".
+func ParsePlans(s string) (map[string]Plan, error) {
+	plans := make(map[string]Plan)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, plan, ok := strings.Cut(pair, "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("tenant plan %q: want tenant=plan", pair)
+		}
+		if _, known := Limits[Plan(plan)]; !known {
+			return nil, fmt.Errorf("tenant plan %q: unknown plan %q (want free, pro or enterprise)", pair, plan)
+		}
+		plans[id] = Plan(plan)
+	}
+	return plans, nil
+}
+
+// Tenant is the tenant of a request.
+type Tenant struct {
+	ID   string
+	Plan Plan
+}
+
+type ctxKey struct{}
+
+// FromContext returns the tenant resolved by Middleware. It reports false
+// for requests without a tenant.
+func FromContext(ctx context.Context) (Tenant, bool) {
+	t, ok := ctx.Value(ctxKey{}).(Tenant)
+	return t, ok
+}
+
+// PlanOf returns the plan of the tenant in ctx, or PlanNone.
+func PlanOf(ctx context.Context) Plan {
+	if t, ok := FromContext(ctx); ok {
+		return t.Plan
+	}
+	return PlanNone
+}
+
+// Attributes returns tenant.id and tenant.plan for the tenant in ctx, or
+// just tenant.plan=none without one.
+func Attributes(ctx context.Context) []attribute.KeyValue {
+	t, ok := FromContext(ctx)
+	if !ok {
+		return []attribute.KeyValue{PlanKey.String(string(PlanNone))}
+	}
+	return []attribute.KeyValue{IDKey.String(t.ID), PlanKey.String(string(t.Plan))}
+}
+
+// Middleware resolves the tenant of each request, stores it in the context
+// and records it on the current span, which should be the server span, and
+// on the request's http.server.* metrics. API requests over the rate limit
+// of their tenant's plan are rejected with 429 and a Retry-After header.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	buckets := &buckets{m: make(map[string]*limiter)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if id := r.Header.Get(Header); id != "" {
+			plan, ok := cfg.Plans[id]
+			if !ok {
+				plan = PlanFree
+			}
+			ctx = context.WithValue(ctx, ctxKey{}, Tenant{ID: id, Plan: plan})
+			// The plan is resolved here, so the services the request
+			// calls learn it from the baggage.
+			ctx = telemetry.WithBaggage(ctx, PlanKey.String(string(plan)))
+		}
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(Attributes(ctx)...)
+		plan := PlanKey.String(string(PlanOf(ctx)))
+		telemetry.AddServerMetricAttributes(ctx, plan)
+
+		if t, ok := FromContext(ctx); ok && strings.HasPrefix(r.URL.Path, "/api/") {
+			if ok, wait := buckets.allow(t, time.Now()); !ok {
+				span.AddEvent("tenant.rate_limited", trace.WithAttributes(
+					attribute.Float64("tenant.retry_after_seconds", wait.Seconds()),
+				))
+				telemetry.RecordError(ctx, ErrRateLimited)
+				instruments().limited.Add(ctx, 1, metric.WithAttributes(plan))
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Rate limit exceeded for plan " + string(t.Plan)})
+				return
+			}
+		}
+
+		inner := r.WithContext(ctx)
+		next.ServeHTTP(w, inner)
+		// Pass the matched route back for the server span, as
+		// clientip.Middleware does.
+		r.Pattern = inner.Pattern
+	})
+}
+
+// maxBuckets bounds the rate limiter state kept for tenants. Tenant IDs come
+// from a header, so a client could otherwise grow it without limit.
+const maxBuckets = 10000
+
+// buckets holds a token bucket per tenant.
+type buckets struct {
+	mu sync.Mutex
+	m  map[string]*limiter
+}
+
+// allow takes a token from t's bucket if one is available. Otherwise it
+// returns how long until the next one is.
+func (b *buckets) allow(t Tenant, now time.Time) (bool, time.Duration) {
+	limit := Limits[t.Plan]
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	b.mu.Lock()
+	l, ok := b.m[t.ID]
+	if !ok || l.limit != limit {
+		if len(b.m) >= maxBuckets {
+			b.evictFull(now)
+		}
+		l = &limiter{limit: limit, tokens: float64(limit.Burst)}
+		b.m[t.ID] = l
+	}
+	b.mu.Unlock()
+	return l.allow(now)
+}
+
+// evictFull drops the buckets that have refilled completely, which behave
+// the same as new ones. b.mu must be held.
+func (b *buckets) evictFull(now time.Time) {
+	for id, l := range b.m {
+		if l.full(now) {
+			delete(b.m, id)
+		}
+	}
+}
+
+// limiter is a token bucket.
+type limiter struct {
+	limit Limit
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens = math.Min(float64(l.limit.Burst), l.tokens+now.Sub(l.last).Seconds()*l.limit.Rate)
+	}
+	l.last = now
+}
+
+func (l *limiter) allow(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+func (l *limiter) full(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	return l.tokens >= float64(l.limit.Burst)
+}
+
+type tenantInstruments struct {
+	limited metric.Int64Counter
+}
+
+// instruments creates the counter on first use, after telemetry.Setup.
+var instruments = sync.OnceValue(func() tenantInstruments {
+	meter := telemetry.Meter()
+	var inst tenantInstruments
+	var err error
+	inst.limited, err = meter.Int64Counter(
+		"tenant_rate_limited_requests_total",
+		metric.WithDescription("Number of requests rejected by their tenant's plan rate limit, by plan"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		inst.limited, _ = meter.Int64Counter("tenant_rate_limited_requests_total")
+	}
+	return inst
+})
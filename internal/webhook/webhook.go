@@ -0,0 +1,262 @@
+// Package webhook delivers bus events to an HTTP endpoint, retrying failed
+// deliveries with exponential backoff. It is the service's demonstration of
+// span links against parent/child spans. Each delivery has a webhook.deliver
+// span, a child of the bus.process span, that stays open until the delivery
+// is done. The first attempt is its child, in the same trace. Each retry
+// starts a trace of its own that links to the webhook.deliver span and to the
+// previous attempt, since a retry may happen long after the event's trace
+// has ended and isn't part of the work that produced it. A summary event on
+// the webhook.deliver span lists the attempts, so the chain can be followed
+// from the event's trace.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/outbox"
+	"payment-service/internal/telemetry"
+)
+
+// Headers of a delivery, besides the trace context.
+const (
+	IDHeader      = "Webhook-Id"
+	AttemptHeader = "Webhook-Attempt"
+)
+
+// linkTypeKey says what a link of a retry points to: "origin", the
+// webhook.deliver span, or "previous_attempt".
+const linkTypeKey = attribute.Key("webhook.link.type")
+
+// Config controls deliveries.
+type Config struct {
+	// URL receives each event as a JSON POST.
+	URL string
+	// MaxAttempts is the number of attempts before a delivery fails;
+	// defaults to 5.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled before each
+	// further one, with up to 20% jitter; defaults to 500ms.
+	Backoff time.Duration
+	// Timeout bounds one attempt; defaults to 5s.
+	Timeout time.Duration
+}
+
+// Dispatcher delivers events to the webhook URL.
+type Dispatcher struct {
+	cfg    Config
+	client *http.Client
+
+	deliveries metric.Int64Counter
+	attempts   metric.Int64Histogram
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a Dispatcher for cfg.URL.
+func New(cfg Config) (*Dispatcher, error) {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 500 * time.Millisecond
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	d := &Dispatcher{cfg: cfg, client: &http.Client{}, stop: make(chan struct{})}
+
+	meter := telemetry.Meter()
+	var err error
+	d.deliveries, err = meter.Int64Counter(
+		"webhook_deliveries_total",
+		metric.WithDescription("Number of webhook deliveries finished, by result"),
+		metric.WithUnit("{delivery}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	d.attempts, err = meter.Int64Histogram(
+		"webhook_delivery_attempts",
+		metric.WithDescription("Number of attempts a webhook delivery took, by result"),
+		metric.WithUnit("{attempt}"),
+		metric.WithExplicitBucketBoundaries(1, 2, 3, 4, 5, 10),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Consume starts the delivery of e and returns without waiting for it, so
+// retries don't hold up the events behind it. It has the signature of a bus
+// handler.
+func (d *Dispatcher) Consume(ctx context.Context, e outbox.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		telemetry.WithSpan(ctx, "webhook.deliver "+e.Type, func(ctx context.Context) error {
+			return d.deliver(ctx, e, body)
+		}, trace.WithAttributes(
+			attribute.String("messaging.message.id", e.ID),
+			attribute.String("event.type", e.Type),
+			attribute.Int("webhook.max_attempts", d.cfg.MaxAttempts),
+		))
+	}()
+	return nil
+}
+
+// deliver makes up to MaxAttempts attempts under the webhook.deliver span
+// in ctx, then adds a webhook.delivery.summary event to it. It returns the
+// last attempt's error unless one was delivered.
+func (d *Dispatcher) deliver(ctx context.Context, e outbox.Event, body []byte) error {
+	span := trace.SpanFromContext(ctx)
+	var (
+		prev   trace.SpanContext
+		traces []string
+		err    error
+	)
+	result := "failed"
+	backoff := d.cfg.Backoff
+attempts:
+	for n := 1; n <= d.cfg.MaxAttempts; n++ {
+		if n > 1 {
+			wait := backoff + rand.N(backoff/5+1)
+			backoff *= 2
+			select {
+			case <-time.After(wait):
+			case <-d.stop:
+				result = "abandoned"
+				break attempts
+			}
+		}
+		prev, err = d.attempt(ctx, prev, e, body, n)
+		traces = append(traces, prev.TraceID().String())
+		if err == nil {
+			result = "delivered"
+			break
+		}
+	}
+
+	span.AddEvent("webhook.delivery.summary", trace.WithAttributes(
+		attribute.Int("webhook.attempts", len(traces)),
+		attribute.String("webhook.result", result),
+		attribute.StringSlice("webhook.attempt.trace_ids", traces),
+	))
+	span.SetAttributes(attribute.Int("webhook.attempts", len(traces)), attribute.String("webhook.result", result))
+	attrs := metric.WithAttributes(attribute.String("event.type", e.Type), attribute.String("result", result))
+	d.deliveries.Add(ctx, 1, attrs)
+	d.attempts.Record(ctx, int64(len(traces)), attrs)
+	if result == "delivered" {
+		return nil
+	}
+	telemetry.LoggerFor(ctx).Warn("webhook delivery "+result,
+		zap.String("event_id", e.ID),
+		zap.String("event_type", e.Type),
+		zap.Int("attempts", len(traces)),
+		zap.Error(err))
+	return err
+}
+
+// attempt POSTs body under a webhook.send client span and returns the
+// span's context, for the next attempt to link to. The first attempt is a
+// child of the webhook.deliver span in ctx; later ones start a new trace
+// linked to it and to prev.
+func (d *Dispatcher) attempt(ctx context.Context, prev trace.SpanContext, e outbox.Event, body []byte, n int) (trace.SpanContext, error) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", http.MethodPost),
+			attribute.String("url.full", d.cfg.URL),
+			attribute.String("messaging.message.id", e.ID),
+			attribute.String("event.type", e.Type),
+			attribute.Int("webhook.attempt", n),
+		),
+	}
+	if n > 1 {
+		opts = append(opts, trace.WithNewRoot(), trace.WithLinks(
+			trace.Link{
+				SpanContext: trace.SpanContextFromContext(ctx),
+				Attributes:  []attribute.KeyValue{linkTypeKey.String("origin")},
+			},
+			trace.Link{
+				SpanContext: prev,
+				Attributes:  []attribute.KeyValue{linkTypeKey.String("previous_attempt")},
+			},
+		))
+	}
+	var sent trace.SpanContext
+	err := telemetry.WithSpan(ctx, "webhook.send", func(ctx context.Context) error {
+		span := trace.SpanFromContext(ctx)
+		sent = span.SpanContext()
+		ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.cfg.URL, bytes.NewReader(body))
+		if err != nil {
+			return telemetry.WithFailureDomain(err, telemetry.DomainInternal)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IDHeader, e.ID)
+		req.Header.Set(AttemptHeader, strconv.Itoa(n))
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return telemetry.WithFailureDomain(err, telemetry.DomainGateway)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= http.StatusMultipleChoices {
+			return telemetry.WithFailureDomain(fmt.Errorf("webhook: %s answered %d", d.cfg.URL, resp.StatusCode), telemetry.DomainGateway)
+		}
+		return nil
+	}, opts...)
+	return sent, err
+}
+
+// Close abandons the retries that are waiting and waits for the attempts
+// in progress. Close the bus first, so no delivery starts after it.
+func (d *Dispatcher) Close() {
+	close(d.stop)
+	d.wg.Wait()
+}
+
+// Sink is a webhook receiver for demos. It answers 503 to errorRate of the
+// deliveries, so some need retries, and 204 to the rest, and records the
+// attempt on the server span, which continues the trace of the attempt.
+func Sink(errorRate float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		attempt, _ := strconv.Atoi(r.Header.Get(AttemptHeader))
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			attribute.String("messaging.message.id", r.Header.Get(IDHeader)),
+			attribute.Int("webhook.attempt", attempt),
+		)
+		if rand.Float64() < errorRate {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
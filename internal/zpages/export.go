@@ -0,0 +1,136 @@
+package zpages
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// exportFields are the fields of an exported span, the JSON names of
+// Sample's fields.
+var exportFields = []string{
+	"name", "trace_id", "span_id", "parent_span_id", "kind", "start",
+	"duration_ms", "status", "status_description", "attributes", "events",
+}
+
+// Export rate limit: a burst of exportBurst streams, refilled at one per
+// exportEvery. Each stream serializes and compresses the whole buffer, so an
+// unthrottled loop of exports would show up in the service's own latency.
+const (
+	exportBurst = 3
+	exportEvery = 5 * time.Second
+)
+
+var exportLimit = &limiter{burst: exportBurst, every: exportEvery, tokens: exportBurst}
+
+// limiter is a token bucket.
+type limiter struct {
+	burst float64
+	every time.Duration
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is available. Otherwise it returns how long
+// until the next one is.
+func (l *limiter) allow(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+float64(now.Sub(l.last))/float64(l.every))
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) * float64(l.every))
+}
+
+// exportHandler streams the buffered ended spans, oldest first, as
+// gzip-compressed NDJSON: one Sample per line, for offline analysis with jq.
+// ?fields=name,duration_ms keeps only the listed fields, ?name= and
+// ?trace_id= keep only spans of one name or trace, and ?limit=N keeps only
+// the newest N spans.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var fields []string
+	if f := q.Get("fields"); f != "" {
+		fields = strings.Split(f, ",")
+		for _, field := range fields {
+			if !slices.Contains(exportFields, field) {
+				http.Error(w, "unknown field "+strconv.Quote(field)+"; fields are "+strings.Join(exportFields, ","), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			http.Error(w, "invalid limit "+strconv.Quote(l), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if ok, wait := exportLimit.allow(time.Now()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "span export rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	buf := buffer(w)
+	if buf == nil {
+		return
+	}
+	spans := buf.Ended()
+	if name := q.Get("name"); name != "" {
+		spans = slices.DeleteFunc(spans, func(s sdktrace.ReadOnlySpan) bool { return s.Name() != name })
+	}
+	if traceID := q.Get("trace_id"); traceID != "" {
+		spans = slices.DeleteFunc(spans, func(s sdktrace.ReadOnlySpan) bool { return s.SpanContext().TraceID().String() != traceID })
+	}
+	if limit > 0 && len(spans) > limit {
+		spans = spans[len(spans)-limit:]
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Encoding", "gzip")
+	zw := gzip.NewWriter(w)
+	defer zw.Close()
+	enc := json.NewEncoder(zw)
+	for _, s := range spans {
+		var record any = toSample(s)
+		if fields != nil {
+			record = selectFields(record.(Sample), fields)
+		}
+		if err := enc.Encode(record); err != nil {
+			// The client went away; the status is already sent.
+			return
+		}
+	}
+}
+
+// selectFields returns the named fields of sample, keyed by their JSON names.
+func selectFields(sample Sample, fields []string) map[string]json.RawMessage {
+	b, _ := json.Marshal(sample)
+	var all map[string]json.RawMessage
+	json.Unmarshal(b, &all)
+	out := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if v, ok := all[f]; ok {
+			out[f] = v
+		}
+	}
+	return out
+}
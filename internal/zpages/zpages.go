@@ -0,0 +1,316 @@
+// Package zpages serves tracez-style local diagnostics from the in-memory
+// span buffer: per-span-name latency distributions, active spans and error
+// samples, for quick diagnosis without a tracing backend, and an NDJSON export
+// of the buffer for offline analysis. It also serves the most expensive
+// requests, the telemetry cost estimate, the adaptive sampling state, the
+// latency heatmap, the exporter chaos switch and the catalog of metric
+// instruments.
+package zpages
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// maxSamples caps the number of spans returned by the samples endpoint.
+const maxSamples = 20
+
+// latencyBounds are the upper bounds of the tracez latency buckets; the last
+// bucket is unbounded.
+var latencyBounds = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+	100 * time.Second,
+}
+
+var bucketLabels = []string{"<10µs", "<100µs", "<1ms", "<10ms", "<100ms", "<1s", "<10s", "<100s", ">=100s"}
+
+// Summary aggregates the buffered spans of one name.
+type Summary struct {
+	Name    string   `json:"name"`
+	Active  int      `json:"active"`
+	Ended   int      `json:"ended"`
+	Errors  int      `json:"errors"`
+	Latency []int    `json:"latency"`
+	Buckets []string `json:"latency_buckets"`
+}
+
+// Sample is a JSON view of one span.
+type Sample struct {
+	Name         string            `json:"name"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Kind         string            `json:"kind"`
+	Start        time.Time         `json:"start"`
+	DurationMS   float64           `json:"duration_ms"`
+	Status       string            `json:"status"`
+	Description  string            `json:"status_description,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Events       []string          `json:"events,omitempty"`
+}
+
+// Register adds the diagnostics endpoints to mux:
+//
+//	GET /debug/tracez                  summary by span name (?format=text for a table)
+//	GET /debug/tracez/samples?name=... &type=active|error|latency&bucket=N
+//	GET /debug/tracez/export?fields=...&name=...&trace_id=...&limit=N  ended spans as gzipped NDJSON
+//	GET /debug/tracez/expensive        highest cost scoring requests (DELETE resets them)
+//	GET /debug/telemetry/cost          estimated telemetry cost of the last minute
+//	GET /debug/telemetry/sampling      adaptive sampling ratios and error rates by route
+//	GET /debug/telemetry/heatmap?method=...&route=...  request duration bucket counts per window
+//	GET /debug/telemetry/chaos         current exporter chaos mode
+//	POST /debug/telemetry/chaos?mode=off|blackhole|delay&delay=2s
+//	GET /debug/metrics-catalog         every metric instrument, with its unit, attribute keys and creator
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/tracez", summaryHandler)
+	mux.HandleFunc("GET /debug/tracez/samples", samplesHandler)
+	mux.HandleFunc("GET /debug/tracez/export", exportHandler)
+	mux.HandleFunc("GET /debug/tracez/expensive", expensiveHandler)
+	mux.HandleFunc("DELETE /debug/tracez/expensive", resetExpensiveHandler)
+	mux.HandleFunc("GET /debug/telemetry/cost", costHandler)
+	mux.HandleFunc("GET /debug/telemetry/sampling", samplingHandler)
+	mux.HandleFunc("GET /debug/telemetry/heatmap", heatmapHandler)
+	mux.HandleFunc("GET /debug/telemetry/chaos", chaosHandler)
+	mux.HandleFunc("POST /debug/telemetry/chaos", setChaosHandler)
+	mux.HandleFunc("GET /debug/metrics-catalog", catalogHandler)
+}
+
+func catalogHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(telemetry.Catalog())
+}
+
+func chaosHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(telemetry.ExporterChaos())
+}
+
+func setChaosHandler(w http.ResponseWriter, r *http.Request) {
+	var delay time.Duration
+	if d := r.URL.Query().Get("delay"); d != "" {
+		var err error
+		if delay, err = time.ParseDuration(d); err != nil {
+			http.Error(w, "invalid delay: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err := telemetry.SetExporterChaos(r.URL.Query().Get("mode"), delay)
+	switch {
+	case errors.Is(err, telemetry.ErrChaosDisabled):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chaosHandler(w, r)
+}
+
+func samplingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(telemetry.AdaptiveSampling())
+}
+
+func heatmapHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	q := r.URL.Query()
+	json.NewEncoder(w).Encode(telemetry.LatencyHeatmap(q.Get("method"), q.Get("route")))
+}
+
+// Expensive is a tracked expensive request. TraceLink exports the spans of
+// its trace still in the span buffer.
+type Expensive struct {
+	telemetry.ExpensiveRequest
+	TraceLink string `json:"trace_link,omitempty"`
+}
+
+func expensiveHandler(w http.ResponseWriter, r *http.Request) {
+	requests := []Expensive{}
+	for _, req := range telemetry.ExpensiveRequests() {
+		e := Expensive{ExpensiveRequest: req}
+		if req.Sampled {
+			e.TraceLink = "/debug/tracez/export?trace_id=" + req.TraceID
+		}
+		requests = append(requests, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+func resetExpensiveHandler(w http.ResponseWriter, r *http.Request) {
+	telemetry.ResetExpensiveRequests()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func costHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(telemetry.EstimateCost())
+}
+
+func bucketOf(d time.Duration) int {
+	for i, b := range latencyBounds {
+		if d < b {
+			return i
+		}
+	}
+	return len(latencyBounds)
+}
+
+func isError(s sdktrace.ReadOnlySpan) bool {
+	return s.Status().Code == codes.Error
+}
+
+func buffer(w http.ResponseWriter) *telemetry.SpanBuffer {
+	buf := telemetry.RecentSpans()
+	if buf == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Tracing is not configured"})
+	}
+	return buf
+}
+
+func summaryHandler(w http.ResponseWriter, r *http.Request) {
+	buf := buffer(w)
+	if buf == nil {
+		return
+	}
+
+	byName := make(map[string]*Summary)
+	get := func(name string) *Summary {
+		s, ok := byName[name]
+		if !ok {
+			s = &Summary{Name: name, Latency: make([]int, len(bucketLabels)), Buckets: bucketLabels}
+			byName[name] = s
+		}
+		return s
+	}
+	for _, s := range buf.Active() {
+		get(s.Name()).Active++
+	}
+	for _, s := range buf.Ended() {
+		sum := get(s.Name())
+		sum.Ended++
+		sum.Latency[bucketOf(s.EndTime().Sub(s.StartTime()))]++
+		if isError(s) {
+			sum.Errors++
+		}
+	}
+
+	summaries := make([]*Summary, 0, len(byName))
+	for _, s := range byName {
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+
+	if r.URL.Query().Get("format") == "text" {
+		writeText(w, summaries)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+func writeText(w http.ResponseWriter, summaries []*Summary) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "NAME\tACTIVE\tERRORS\t")
+	for _, l := range bucketLabels {
+		fmt.Fprintf(tw, "%s\t", l)
+	}
+	fmt.Fprintln(tw)
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t", s.Name, s.Active, s.Errors)
+		for _, n := range s.Latency {
+			fmt.Fprintf(tw, "%d\t", n)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
+
+func samplesHandler(w http.ResponseWriter, r *http.Request) {
+	buf := buffer(w)
+	if buf == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	name := q.Get("name")
+	var match func(sdktrace.ReadOnlySpan) bool
+	spans := buf.Ended()
+	switch q.Get("type") {
+	case "active":
+		spans = buf.Active()
+		match = func(sdktrace.ReadOnlySpan) bool { return true }
+	case "error":
+		match = isError
+	default:
+		bucket, err := strconv.Atoi(q.Get("bucket"))
+		if err != nil || bucket < 0 || bucket >= len(bucketLabels) {
+			bucket = -1
+		}
+		match = func(s sdktrace.ReadOnlySpan) bool {
+			return bucket < 0 || bucketOf(s.EndTime().Sub(s.StartTime())) == bucket
+		}
+	}
+
+	samples := []Sample{}
+	// Newest first.
+	for i := len(spans) - 1; i >= 0 && len(samples) < maxSamples; i-- {
+		s := spans[i]
+		if (name == "" || s.Name() == name) && match(s) {
+			samples = append(samples, toSample(s))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples)
+}
+
+func toSample(s sdktrace.ReadOnlySpan) Sample {
+	end := s.EndTime()
+	if end.IsZero() {
+		end = time.Now()
+	}
+	sample := Sample{
+		Name:        s.Name(),
+		TraceID:     s.SpanContext().TraceID().String(),
+		SpanID:      s.SpanContext().SpanID().String(),
+		Kind:        s.SpanKind().String(),
+		Start:       s.StartTime(),
+		DurationMS:  float64(end.Sub(s.StartTime())) / float64(time.Millisecond),
+		Status:      s.Status().Code.String(),
+		Description: s.Status().Description,
+	}
+	if p := s.Parent(); p.IsValid() {
+		sample.ParentSpanID = p.SpanID().String()
+	}
+	if attrs := s.Attributes(); len(attrs) > 0 {
+		sample.Attributes = make(map[string]string, len(attrs))
+		for _, kv := range attrs {
+			sample.Attributes[string(kv.Key)] = kv.Value.Emit()
+		}
+	}
+	for _, e := range s.Events() {
+		sample.Events = append(sample.Events, e.Name)
+	}
+	return sample
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	paymentspan "payment-service/internal/payments"
+)
+
+// Page size limits of GET /api/payment.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listQuery is the filter, sort order and page of GET /api/payment.
+type listQuery struct {
+	Limit, Offset int
+	Status        string
+	Currency      string
+	// Since keeps payments dated at or after it; zero keeps all.
+	Since time.Time
+	// AsOf lists the payments as they were at that time, rebuilt from the
+	// store's history; zero lists the current ones.
+	AsOf time.Time
+	// Sort is the field payments are sorted by, or "" for the order they
+	// were stored in, oldest first.
+	Sort string
+	Desc bool
+}
+
+// listSorts are the fields payments can be sorted by.
+var listSorts = map[string]func(a, b Payment) int{
+	"id":     func(a, b Payment) int { return cmp.Compare(a.ID, b.ID) },
+	"amount": func(a, b Payment) int { return cmp.Compare(a.Amount, b.Amount) },
+	"status": func(a, b Payment) int { return cmp.Compare(a.Status, b.Status) },
+	"date":   func(a, b Payment) int { return paymentTime(a).Compare(paymentTime(b)) },
+}
+
+// parseListQuery parses the query parameters of GET /api/payment: limit
+// (default 100, at most 1000), offset, status, currency, since and as_of
+// (RFC 3339 times) and sort, a field name prefixed with "-" to sort
+// descending, such as sort=-amount.
+func parseListQuery(v url.Values) (listQuery, error) {
+	q := listQuery{
+		Limit:    defaultListLimit,
+		Status:   v.Get("status"),
+		Currency: strings.ToUpper(v.Get("currency")),
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("limit %q: want a positive integer", s)
+		}
+		q.Limit = min(n, maxListLimit)
+	}
+	if s := v.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("offset %q: want a non-negative integer", s)
+		}
+		q.Offset = n
+	}
+	if s := v.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("since %q: want an RFC 3339 time", s)
+		}
+		q.Since = t
+	}
+	if s := v.Get("as_of"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("as_of %q: want an RFC 3339 time", s)
+		}
+		q.AsOf = t
+	}
+	if s := v.Get("sort"); s != "" {
+		q.Sort, q.Desc = strings.CutPrefix(s, "-")
+		if _, ok := listSorts[q.Sort]; !ok {
+			return q, fmt.Errorf("sort %q: want id, amount, status or date, optionally prefixed with -", s)
+		}
+	}
+	return q, nil
+}
+
+// apply returns the page of ps that q selects, and the number of payments
+// that match its filters.
+func (q listQuery) apply(ps []Payment) ([]Payment, int) {
+	matched := make([]Payment, 0, min(len(ps), q.Offset+q.Limit))
+	for _, p := range ps {
+		if q.matches(p) {
+			matched = append(matched, p)
+		}
+	}
+	if compare, ok := listSorts[q.Sort]; ok {
+		slices.SortStableFunc(matched, func(a, b Payment) int {
+			if q.Desc {
+				return compare(b, a)
+			}
+			return compare(a, b)
+		})
+	}
+	total := len(matched)
+	start := min(q.Offset, total)
+	return matched[start:min(start+q.Limit, total)], total
+}
+
+func (q listQuery) matches(p Payment) bool {
+	switch {
+	case q.Status != "" && p.Status != q.Status:
+		return false
+	case q.Currency != "" && cmp.Or(p.Currency, paymentspan.DefaultCurrency) != q.Currency:
+		return false
+	case !q.Since.IsZero() && paymentTime(p).Before(q.Since):
+		return false
+	}
+	return true
+}
+
+// attributes returns the span attributes describing q. Filters that are not
+// set are left out.
+func (q listQuery) attributes() []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Int("payment.list.limit", q.Limit),
+		attribute.Int("payment.list.offset", q.Offset),
+	}
+	if q.Status != "" {
+		attrs = append(attrs, attribute.String("payment.list.status", q.Status))
+	}
+	if q.Currency != "" {
+		attrs = append(attrs, attribute.String("payment.list.currency", q.Currency))
+	}
+	if !q.Since.IsZero() {
+		attrs = append(attrs, attribute.String("payment.list.since", q.Since.Format(time.RFC3339)))
+	}
+	if !q.AsOf.IsZero() {
+		attrs = append(attrs, attribute.String("payment.list.as_of", q.AsOf.Format(time.RFC3339)))
+	}
+	if q.Sort != "" {
+		sort := q.Sort
+		if q.Desc {
+			sort = "-" + sort
+		}
+		attrs = append(attrs, attribute.String("payment.list.sort", sort))
+	}
+	return attrs
+}
+
+// paymentTime returns the date of p, or the zero time if it doesn't parse.
+func paymentTime(p Payment) time.Time {
+	t, _ := time.Parse(time.RFC3339, p.Date)
+	return t
+}
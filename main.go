@@ -1,62 +1,1006 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"payment-service/internal/api"
+	"payment-service/internal/backoff"
+	"payment-service/internal/baggageguard"
+	"payment-service/internal/budget"
+	"payment-service/internal/bus"
+	"payment-service/internal/clientip"
+	"payment-service/internal/connstats"
+	"payment-service/internal/fault"
+	"payment-service/internal/fraud"
+	"payment-service/internal/health"
+	"payment-service/internal/idempotency"
+	"payment-service/internal/ingest"
+	"payment-service/internal/lanes"
+	"payment-service/internal/locks"
+	"payment-service/internal/longpoll"
+	"payment-service/internal/notify"
+	"payment-service/internal/outbox"
+	"payment-service/internal/paymentmetrics"
+	paymentspan "payment-service/internal/payments"
+	"payment-service/internal/pricing"
+	"payment-service/internal/schema"
+	"payment-service/internal/settlement"
+	"payment-service/internal/startup"
+	"payment-service/internal/supportcode"
+	"payment-service/internal/telemetry"
+	"payment-service/internal/tenant"
+	"payment-service/internal/tuning"
+	"payment-service/internal/webhook"
+	"payment-service/internal/zpages"
 )
 
+// version is stamped at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 type Payment struct {
-	ID     string  `json:"id"`
-	Amount float64 `json:"amount"`
-	Status string  `json:"status"`
-	Date   string  `json:"date"`
+	ID       string  `json:"id"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency,omitempty"`
+	Status   string  `json:"status"`
+	Date     string  `json:"date"`
+	// TraceID and SpanID identify the span that created the payment, so
+	// later work on it, such as a refund, can link back to it. Payments the
+	// service didn't create have none.
+	TraceID string `json:"-"`
+	SpanID  string `json:"-"`
 }
 
-var payments []Payment
+// ref returns the attributes payment spans record for p.
+func (p Payment) ref() paymentspan.Payment {
+	return paymentspan.Payment{ID: p.ID, Amount: p.Amount, Currency: p.Currency}
+}
+
+// paymentStore holds the payments of every instance. It keeps them in
+// memory until main opens -db. An empty memory store can't fail to start.
+var paymentStore, _ = NewPaymentStore(context.Background(), "store.payments", nil)
+
+var (
+	router          *lanes.Router
+	fraudClient     *fraud.Client
+	events          *outbox.Outbox
+	idempotencyKeys *idempotency.Store
+	// schemas validates payment bodies; nil when -schema-validation=off.
+	schemas *schema.Validator
+	// statusWaits wakes long polls on a payment, keyed by payment ID, when
+	// its status changes.
+	statusWaits *longpoll.Hub
+	// settlements settles captured payments after a simulated delay; see
+	// settlePayment.
+	settlements *settlement.Scheduler
+	// inlineMetrics records payment metrics from the request path; nil when
+	// disabled with -inline-metrics=false.
+	inlineMetrics *paymentmetrics.Recorder
+	// ingestLogs configures the experimental OTLP logs endpoint, enabled
+	// with -ingest-logs.
+	ingestLogs ingest.Config
+)
+
+// requestBudget is the latency budget for creating a payment. The fraud check
+// may use at most fraudBudget of it; storing gets whatever is left.
+var requestBudget = 2 * time.Second
+
+const fraudBudget = 500 * time.Millisecond
+
+// webhookSinkErrorRate is the fraction of webhook deliveries the demo
+// receiver fails, so deliveries to it need retries.
+var webhookSinkErrorRate = 0.3
+
+var errInvalidPayment = telemetry.WithFailureDomain(errors.New("invalid payment"), telemetry.DomainClient)
+
+var errFraudRejected = telemetry.WithFailureDomain(errors.New("payment rejected by fraud check"), telemetry.DomainClient)
 
 func main() {
-	http.HandleFunc("/api/payment", paymentHandler)
-	
-	fmt.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	addr := flag.String("addr", ":8080", "HTTP listen address")
+	cfgFile := flag.String("config", "otel.yaml", "comma-separated telemetry configuration files, merged in order (base first, then overlays)")
+	dumpConfig := flag.Bool("dump-config", false, "print the merged telemetry configuration and exit")
+	prometheusAddr := flag.String("prometheus", "", "also serve the metrics for Prometheus to scrape at /metrics on this address, e.g. :9464 (empty keeps the metrics.prometheus config)")
+	mode := flag.String("mode", "", "run mode preset layered over the base -config file: "+strings.Join(telemetry.Modes, ", ")+" (empty uses the config files as they are)")
+	priorityThreshold := flag.Float64("priority-threshold", 1000, "payments above this amount use the priority lane")
+	flag.Float64Var(&maxAmount, "max-amount", maxAmount, "payments worth more than this in the settlement currency (USD) are rejected as invalid")
+	faultSuffix := flag.String("fault-trace-suffix", "", "fail requests whose incoming trace ID ends with this hex suffix")
+	fraudHedge := flag.Bool("fraud-hedge", true, "hedge slow fraud checks with a second attempt after the observed p95")
+	debugTrusted := flag.String("debug-trusted", "127.0.0.0/8,::1/128", "comma-separated CIDRs allowed to request verbose tracing with X-Debug-Trace: 1")
+	flag.DurationVar(&requestBudget, "request-budget", requestBudget, "latency budget for creating a payment, shared by its fraud check and store write")
+	dbDSN := flag.String("db", "payments.db", "payment database: a SQLite file, or a postgres:// URL (empty keeps payments in memory)")
+	dbSlowQuery := flag.Duration("db-slow-query", 100*time.Millisecond, "store statements slower than this add a db.query.slow event with their plan to their span (0 disables the events)")
+	inlineMetricsFlag := flag.Bool("inline-metrics", true, "record payment business metrics from the request path")
+	eventMetricsFlag := flag.Bool("event-metrics", true, "derive payment business metrics from payment events on the bus")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated CIDRs of proxies whose X-Forwarded-For header is trusted")
+	tenantPlans := flag.String("tenant-plans", "", "comma-separated tenant=plan pairs (free, pro or enterprise); tenants not listed are on free")
+	baggageAllow := flag.String("baggage-allow", strings.Join(baggageguard.DefaultAllow, ","), "comma-separated baggage keys kept on incoming requests; other entries are stripped")
+	baggageMaxEntryBytes := flag.Int("baggage-max-entry-bytes", 256, "baggage entries larger than this are stripped (0 is unlimited)")
+	baggageMaxEntries := flag.Int("baggage-max-entries", 8, "at most this many baggage entries are kept (0 is unlimited)")
+	apiTokens := flag.String("api-tokens", "", "comma-separated bearer tokens the write and admin endpoints require (empty leaves them open)")
+	allowClients := flag.String("allow-clients", "", "comma-separated CIDRs of clients allowed to use the service (empty allows all)")
+	settleMinDelay := flag.Duration("settle-min-delay", 5*time.Second, "shortest simulated delay between capturing a payment and it settling")
+	settleMaxDelay := flag.Duration("settle-max-delay", 30*time.Second, "longest simulated delay between capturing a payment and it settling")
+	settlementState := flag.String("settlement-state", "", "file pending settlement timers are persisted to (empty keeps them in memory)")
+	idempotencyTTL := flag.Duration("idempotency-ttl", 24*time.Hour, "how long responses are kept for replay to retries with the same Idempotency-Key")
+	faultStatus := flag.Int("fault-status", http.StatusInternalServerError, "HTTP status returned by injected faults")
+	autoMaxProcs := flag.Bool("automaxprocs", false, "set GOMAXPROCS from the container CPU quota (GOMAXPROCS in the environment wins)")
+	ballastMB := flag.Int("ballast-mb", 0, "size of a heap ballast in MiB that makes the GC run less often (0 disables it)")
+	schemaMode := flag.String("schema-validation", schema.ModeReport, "validate payment bodies against their JSON schemas: off, report (record violations) or enforce (also reject invalid requests)")
+	compactionInterval := flag.Duration("compaction-interval", time.Minute, "how often the payment store is compacted (0 disables compaction)")
+	retention := flag.Duration("payment-retention", 0, "compaction prunes payments older than this (0 keeps them forever)")
+	compactionStall := flag.Duration("compaction-stall", 0, "extra time compaction holds the store lock, to make its pauses visible")
+	notifyFlag := flag.Bool("notify", true, "send email and SMS notifications of payment events through simulated gateways")
+	notifyErrorRate := flag.Float64("notify-error-rate", 0.02, "fraction of notification sends that fail")
+	webhookURL := flag.String("webhook-url", "", "POST every payment event to this URL, retrying failures (empty disables webhooks; try http://localhost:8080/debug/webhook-sink)")
+	flag.Float64Var(&webhookSinkErrorRate, "webhook-sink-error-rate", webhookSinkErrorRate, "fraction of deliveries the demo receiver at /debug/webhook-sink fails with 503")
+	lockSlowWait := flag.Duration("lock-slow-wait", 0, "lock waits longer than this add a lock.wait event to the waiting span (0 disables the events)")
+	flag.BoolVar(&ingestLogs.Enabled, "ingest-logs", false, "accept OTLP/HTTP log records at "+ingest.Path+" and re-emit them through the service logger (experimental)")
+	batchCapacity := flag.Int64("batch-capacity", 1000, "most batch and import items processed at once; larger batches are rejected with 413")
+	instances := flag.Int("instances", 1, "number of in-process instances sharing one store, on consecutive ports from -addr (port 0 picks free ports)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "how long shutdown waits for in-flight requests before closing their connections")
+	flag.Parse()
+	// A failure that still runs the deferred teardown sets exitCode. This
+	// defer runs last, after every other one has flushed its state.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+	locks.SetSlowWait(*lockSlowWait)
+	batchAdmission = locks.NewWeighted("batch.admission", *batchCapacity)
+
+	tuned, err := tuning.Apply(tuning.Config{AutoMaxProcs: *autoMaxProcs, BallastMB: *ballastMB})
+	if err != nil {
+		log.Fatal(err)
+	}
+	boot := startup.New()
+
+	cfgFiles, err := telemetry.WithMode(*mode, strings.Split(*cfgFile, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dumpConfig {
+		if err := telemetry.DumpConfig(os.Stdout, cfgFiles...); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	setupOpts := []telemetry.Option{
+		telemetry.WithServiceVersion(version),
+		telemetry.WithConfigFile(cfgFiles...),
+		telemetry.WithRuntimeMetrics(),
+	}
+	if *prometheusAddr != "" {
+		setupOpts = append(setupOpts, telemetry.WithPrometheus(*prometheusAddr))
+	}
+	providers, err := telemetry.Setup(context.Background(), setupOpts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer providers.Shutdown(context.Background())
+	boot.MarkSetup()
+	if err := boot.RegisterMetrics(); err != nil {
+		log.Fatal(err)
+	}
+	if err := tuning.RegisterMetrics(tuned); err != nil {
+		log.Fatal(err)
+	}
+	telemetry.Logger().Info("runtime tuning",
+		zap.Int("gomaxprocs", tuned.MaxProcs),
+		zap.String("gomaxprocs_source", tuned.MaxProcsSource),
+		zap.Int("ballast_bytes", tuned.BallastBytes))
+
+	// Outbox events and idempotency keys are kept with the payments, in
+	// memory or in the database.
+	var eventStore outbox.Store
+	var keyBackend idempotency.Backend
+	// A script that passes -db '' through a variable hands over the quotes
+	// themselves; they mean in memory, not a SQLite file named ''.
+	if *dbDSN == "''" || *dbDSN == `""` {
+		*dbDSN = ""
+	}
+	if *dbDSN != "" {
+		payments, err := openPayments(context.Background(), *dbDSN, *dbSlowQuery)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer payments.Close()
+		paymentStore, err = NewPaymentStore(context.Background(), "store.payments", payments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		eventStore, keyBackend = payments, payments
+	}
+	if err := registerStoreMetrics(); err != nil {
+		log.Fatal(err)
+	}
+
+	router, err = lanes.NewRouter(lanes.Config{
+		Threshold:       *priorityThreshold,
+		StandardWorkers: 4,
+		PriorityWorkers: 2,
+		QueueSize:       100,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fraudClient, err = fraud.NewClient(fraud.Config{
+		MedianLatency: 20 * time.Millisecond,
+		SlowRate:      0.05,
+		ErrorRate:     0.01,
+		Hedge:         *fraudHedge,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *inlineMetricsFlag {
+		inlineMetrics, err = paymentmetrics.New(paymentmetrics.SourceInline)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	eventBus, err := bus.New(0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	eventBus.Subscribe("log", outbox.LogPublisher{}.Publish)
+	if *eventMetricsFlag {
+		eventMetrics, err := paymentmetrics.New(paymentmetrics.SourceEvents)
+		if err != nil {
+			log.Fatal(err)
+		}
+		eventBus.Subscribe("payment-metrics", eventMetrics.Consume)
+	}
+	if *notifyFlag {
+		notifier, err := notify.New(notify.Config{ErrorRate: *notifyErrorRate})
+		if err != nil {
+			log.Fatal(err)
+		}
+		eventBus.Subscribe("notifications", notifier.Consume)
+	}
+	if *webhookURL != "" {
+		hooks, err := webhook.New(webhook.Config{URL: *webhookURL})
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Deferred before the bus's Close, so it runs after it.
+		defer hooks.Close()
+		eventBus.Subscribe("webhooks", hooks.Consume)
+	}
+	defer eventBus.Close()
+
+	events, err = outbox.New(outbox.Config{Store: eventStore}, eventBus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer events.Close()
+
+	settlements, err = settlement.New(settlement.Config{
+		MinDelay:  *settleMinDelay,
+		MaxDelay:  *settleMaxDelay,
+		StatePath: *settlementState,
+	}, settlePayment)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer settlements.Close()
+
+	idempotencyKeys, err = idempotency.New(idempotency.Config{TTL: *idempotencyTTL, Backend: keyBackend})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer idempotencyKeys.Close()
+
+	statusWaits, err = longpoll.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *compactionInterval > 0 {
+		compaction, err := startCompaction(compactionConfig{
+			Interval:  *compactionInterval,
+			Retention: *retention,
+			Stall:     *compactionStall,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer compaction.Close()
+	}
+
+	if *schemaMode != schema.ModeOff {
+		schemas, err = schema.New(*schemaMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	boot.Mark(startup.Dependencies, time.Now())
+
+	trusted, err := parsePrefixes(*debugTrusted)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var clients clientip.Config
+	if clients.TrustedProxies, err = parsePrefixes(*trustedProxies); err != nil {
+		log.Fatal(err)
+	}
+	if clients.Allow, err = parsePrefixes(*allowClients); err != nil {
+		log.Fatal(err)
+	}
+	if *apiTokens != "" {
+		api.SetTokens(strings.Split(*apiTokens, ","))
+	}
+	var tenants tenant.Config
+	if tenants.Plans, err = tenant.ParsePlans(*tenantPlans); err != nil {
+		log.Fatal(err)
+	}
+
+	bags := baggageguard.Config{
+		Allow:         baggageguard.ParseAllow(*baggageAllow),
+		MaxEntryBytes: *baggageMaxEntryBytes,
+		MaxEntries:    *baggageMaxEntries,
+	}
+
+	handler, err := newHandler(fault.Config{
+		TraceIDSuffix: *faultSuffix,
+		Status:        *faultStatus,
+	}, trusted, bags, clients, tenants)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Probes are answered before boot and the instrumented chain, so they
+	// don't count as requests. /healthz degrades once store calls take as
+	// long as a slow query.
+	probes := health.Config{
+		Storage:      paymentStore.Ping,
+		ShedRate:     router.ShedRate,
+		StoreLatency: paymentStore.Latency,
+		Thresholds:   health.Thresholds{DegradedStoreLatency: *dbSlowQuery},
+	}
+	if err := health.RegisterMetrics(probes); err != nil {
+		log.Fatal(err)
+	}
+	var listeners []net.Listener
+	var servers []*http.Server
+	if *instances <= 1 {
+		ln, err := net.Listen("tcp", *addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Server %s starting on %s\n", version, *addr)
+		listeners = []net.Listener{ln}
+		servers = []*http.Server{{Handler: health.Middleware(probes, boot.Middleware(handler))}}
+	} else {
+		listeners, err = listenInstances(*addr, *instances)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, ln := range listeners {
+			id := fmt.Sprintf("instance-%d", i+1)
+			fmt.Printf("Server %s instance %s starting on %s\n", version, id, ln.Addr())
+			servers = append(servers, &http.Server{Handler: health.Middleware(probes, boot.Middleware(telemetry.InstanceMiddleware(id, handler)))})
+		}
+	}
+	conns, err := connstats.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, srv := range servers {
+		srv.ConnState = conns.ConnState
+	}
+	boot.Mark(startup.ListenerReady, time.Now())
+
+	if err := serve(servers, listeners, *shutdownTimeout); err != nil {
+		telemetry.Logger().Error("server failed", zap.Error(err))
+		exitCode = 1
+	}
+}
+
+// serve serves each of servers on its listener until SIGINT or SIGTERM
+// arrives or one of them fails, then shuts them all down. Shutdown stops
+// accepting connections and waits up to timeout for in-flight requests;
+// connections still busy after that are closed. serve returns once every
+// server has stopped, so the deferred teardown in main, which ends with the
+// telemetry closer, flushes the spans and metrics of the drained requests.
+func serve(servers []*http.Server, listeners []net.Listener, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func() {
+			if err := srv.Serve(listeners[i]); !errors.Is(err, http.ErrServerClosed) {
+				errc <- err
+			}
+		}()
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		telemetry.Logger().Info("shutting down", zap.Duration("timeout", timeout))
+	case serveErr = <-errc:
+	}
+	stop()
+
+	start := time.Now()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Go(func() {
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				telemetry.Logger().Warn("in-flight requests did not finish in time; closing their connections", zap.Error(err))
+				srv.Close()
+			}
+		})
+	}
+	wg.Wait()
+	telemetry.Logger().Info("server stopped", zap.Duration("drain", time.Since(start)))
+	return serveErr
+}
+
+// listenInstances opens n listeners on consecutive ports starting at addr's
+// port, or on free ports if it is 0.
+func listenInstances(addr string, n int) ([]net.Listener, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("port %q: %w", portStr, err)
+	}
+
+	var listeners []net.Listener
+	for i := range n {
+		p := port
+		if p != 0 {
+			p += i
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(p)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// parsePrefixes parses a comma-separated list of CIDRs.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// newHandler returns the service's routes wrapped in its middleware chain.
+func newHandler(faults fault.Config, debugTrusted []netip.Prefix, bags baggageguard.Config, clients clientip.Config, tenants tenant.Config) (http.Handler, error) {
+	mux := http.NewServeMux()
+	api.Register(mux,
+		api.GET("/api/payment", listPaymentsHandler,
+			api.WithTimeout(readTimeout),
+			validated(http.MethodGet, schema.Rule{Responses: map[int]string{http.StatusOK: "payment-list.v2"}})),
+		api.POST("/api/payment", createPaymentHandler,
+			api.WithAuth(),
+			validated(http.MethodPost, schema.Rule{Request: "payment-request.v1", Responses: map[int]string{http.StatusCreated: "payment.v2"}})),
+		api.GET("/api/payment/{id}", getPaymentHandler,
+			api.WithTimeout(readTimeout),
+			api.WithPathAttribute("id", paymentIDKey),
+			validated(http.MethodGet, schema.Rule{Responses: map[int]string{http.StatusOK: "payment.v2"}})),
+		api.PUT("/api/payment/{id}/status", updateStatusHandler,
+			api.WithAuth(),
+			api.WithPathAttribute("id", paymentIDKey),
+			validated(http.MethodPut, schema.Rule{Request: "payment-status-request.v1", Responses: map[int]string{http.StatusOK: "payment.v2"}})),
+		api.POST("/api/payment/{id}/refund", refundHandler,
+			api.WithAuth(),
+			api.WithPathAttribute("id", paymentIDKey),
+			validated(http.MethodPost, schema.Rule{Request: "refund-request.v1", Responses: map[int]string{http.StatusCreated: "refund.v1"}})),
+		api.GET("/api/payment/{id}/wait", waitPaymentHandler,
+			api.WithPathAttribute("id", paymentIDKey)),
+		api.POST("/api/payment/batch", batchHandler, api.WithAuth()),
+		api.POST("/api/payment/import", importHandler, api.WithAuth()),
+	)
+	if telemetry.DebugEndpoints() {
+		api.Register(mux,
+			api.POST("/debug/store/seed", seedHandler, api.WithAuth()),
+			api.POST("/admin/flush", flushHandler, api.WithAuth()),
+			// The webhook sender has no token to present.
+			api.POST("/debug/webhook-sink", webhook.Sink(webhookSinkErrorRate)),
+		)
+		zpages.Register(mux)
+		supportcode.Register(mux)
+	}
+	ingest.Register(mux, ingestLogs)
+	routed := api.Handler(mux, func(w http.ResponseWriter, r *http.Request, status int, message string) {
+		writeError(w, r, status, message, nil)
+	})
+
+	return fault.Middleware(faults, telemetry.DebugMiddleware(debugTrusted, telemetry.ServerSpanMiddleware(baggageguard.Middleware(bags, clientip.Middleware(clients, backoff.Middleware(tenant.Header, tenant.Middleware(tenants, routed)))))))
 }
 
-func paymentHandler(w http.ResponseWriter, r *http.Request) {
+// readTimeout bounds the requests that only read the store.
+const readTimeout = 5 * time.Second
+
+// paymentIDKey is the span attribute of the payment a request is about.
+const paymentIDKey = attribute.Key("payment.id")
+
+// validated validates the bodies of an endpoint's requests and responses
+// against rule.
+func validated(method string, rule schema.Rule) api.Option {
+	return api.WithMiddleware(func(next http.Handler) http.Handler {
+		return schemas.Middleware(schema.Rules{method: rule}, next)
+	})
+}
+
+// listPaymentsHandler lists payments. The server span is started by
+// telemetry.ServerSpanMiddleware and carried in r.Context(); handlers don't
+// start their own, and pass r.Context() to everything they call, so store
+// reads, fraud checks and lane work become children of the server span.
+func listPaymentsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	
-	switch r.Method {
-	case http.MethodGet:
-		handleGetPayments(w, r)
-	case http.MethodPost:
-		handleCreatePayment(w, r)
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	handleGetPayments(w, r)
+}
+
+// createPaymentHandler creates a payment, or validates it without storing
+// it with ?dry_run=true. A payment without a currency is in
+// payments.DefaultCurrency (USD); a currency that is given but unknown is
+// rejected with 400.
+func createPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("dry_run") == "true" {
+		handleDryRun(w, r)
+		return
 	}
+	idempotency.Middleware(idempotencyKeys, http.HandlerFunc(handleCreatePayment)).ServeHTTP(w, r)
 }
 
+// handleGetPayments lists a page of the payments, filtered and sorted as
+// the query parameters ask; see parseListQuery. The applied query and the
+// number of matching payments are recorded on the server span.
 func handleGetPayments(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(payments)
+	q, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error(), telemetry.WithFailureDomain(err, telemetry.DomainClient))
+		return
+	}
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(q.attributes()...)
+
+	var ps []Payment
+	if q.AsOf.IsZero() {
+		ps, err = paymentStore.All(r.Context())
+	} else {
+		ps, err = paymentStore.AsOf(r.Context(), q.AsOf)
+	}
+	switch {
+	case errors.Is(err, errBeforeHistory):
+		// The replay span recorded the error already.
+		writeError(w, r, http.StatusBadRequest, "as_of "+err.Error(), nil)
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, "Payment store unavailable", err)
+		return
+	}
+	page, matched := q.apply(ps)
+	span.SetAttributes(
+		attribute.Int("payment.list.matched", matched),
+		attribute.Int("payment.list.returned", len(page)),
+	)
+	json.NewEncoder(w).Encode(page)
+}
+
+func getPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p, ok, err := paymentStore.Find(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Payment store unavailable", err)
+		return
+	}
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "Payment not found", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(p)
+}
+
+// maxWait caps the timeout of a status long poll.
+const maxWait = 60 * time.Second
+
+// waitPaymentHandler long-polls a payment's status. It returns as soon as the
+// status differs from the status query parameter (by default, the status when
+// the request arrived), or with the unchanged payment after timeout (30s by
+// default, at most maxWait). X-Wait-Result says which.
+func waitPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id := r.PathValue("id")
+	current, ok, err := paymentStore.Find(r.Context(), id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Payment store unavailable", err)
+		return
+	}
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "Payment not found", nil)
+		return
+	}
+
+	timeout := 30 * time.Second
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			writeError(w, r, http.StatusBadRequest, "Invalid timeout", telemetry.WithFailureDomain(fmt.Errorf("timeout %q", t), telemetry.DomainClient))
+			return
+		}
+		timeout = min(d, maxWait)
+	}
+	known := r.URL.Query().Get("status")
+	if known == "" {
+		known = current.Status
+	}
+
+	// A failed read counts as unchanged, leaving the payment as last read.
+	reread := func() {
+		if p, ok, err := paymentStore.Find(r.Context(), id); err == nil && ok {
+			current = p
+		}
+	}
+	reason := statusWaits.Wait(r.Context(), id, timeout, func() bool {
+		reread()
+		return current.Status != known
+	})
+	if reason == longpoll.Cancelled {
+		return
+	}
+	reread()
+	w.Header().Set("X-Wait-Result", reason)
+	json.NewEncoder(w).Encode(current)
 }
 
 func handleCreatePayment(w http.ResponseWriter, r *http.Request) {
 	var payment Payment
-	
+
 	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		writeError(w, r, http.StatusBadRequest, "Invalid JSON", telemetry.WithFailureDomain(err, telemetry.DomainClient))
+		return
+	}
+
+	payment, err := createPayment(r.Context(), payment)
+	if writePaymentError(w, r, err) {
 		return
 	}
-	
-	payment.ID = fmt.Sprintf("pay_%d", time.Now().Unix())
-	payment.Date = time.Now().Format(time.RFC3339)
-	payment.Status = "pending"
-	
-	payments = append(payments, payment)
-	
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(payment)
-}
\ No newline at end of file
+}
+
+// DryRunResult is the response to POST /api/payment?dry_run=true: the
+// decision and quote a real creation would get, without storing anything.
+type DryRunResult struct {
+	DryRun     bool          `json:"dry_run"`
+	Approved   bool          `json:"approved"`
+	FraudScore float64       `json:"fraud_score"`
+	Lane       lanes.Lane    `json:"lane"`
+	Quote      pricing.Quote `json:"quote"`
+}
+
+// handleDryRun runs the decision path of creating a payment. Its spans carry
+// dry_run=true and business metrics ignore it.
+func handleDryRun(w http.ResponseWriter, r *http.Request) {
+	var payment Payment
+
+	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid JSON", telemetry.WithFailureDomain(err, telemetry.DomainClient))
+		return
+	}
+
+	ctx := telemetry.WithDryRun(r.Context())
+	trace.SpanFromContext(ctx).SetAttributes(telemetry.DryRunKey.Bool(true))
+	result, err := dryRunPayment(ctx, payment)
+	if writePaymentError(w, r, err) {
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// writePaymentError writes the response for an error from creating a
+// payment and reports whether there was one. An error it has no better
+// answer for, such as the request's context ending, is a 500, so an
+// idempotency key releases it rather than storing an empty response.
+func writePaymentError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var invalid *validationError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &invalid):
+		writeValidationError(w, r, invalid)
+	case errors.Is(err, errInvalidPayment):
+		writeError(w, r, http.StatusBadRequest, err.Error(), err)
+	case errors.Is(err, lanes.ErrQueueFull):
+		if wait, ok := lanes.RetryAfter(err); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+		writeError(w, r, http.StatusServiceUnavailable, "Too many pending payments", err)
+	case errors.Is(err, lanes.ErrClosed):
+		writeError(w, r, http.StatusServiceUnavailable, "Server shutting down", err)
+	case errors.Is(err, budget.ErrExhausted):
+		writeError(w, r, http.StatusGatewayTimeout, "Payment timed out", err)
+	case errors.Is(err, errFraudRejected):
+		writeError(w, r, http.StatusUnprocessableEntity, "Payment rejected", err)
+	case errors.Is(err, fraud.ErrUnavailable):
+		writeError(w, r, http.StatusBadGateway, "Fraud check unavailable", err)
+	case errors.Is(err, errStore):
+		writeError(w, r, http.StatusInternalServerError, "Payment store unavailable", err)
+	default:
+		writeError(w, r, http.StatusInternalServerError, "Payment failed", err)
+	}
+	return true
+}
+
+// writeError writes a JSON error response with a support code; see
+// writeSupportCode. A non-nil err is recorded, with its failure domain, on
+// the request span and in errors_total.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string, err error) {
+	if err != nil {
+		telemetry.RecordError(r.Context(), err)
+	}
+	body := map[string]string{"error": message}
+	if code := writeSupportCode(w, r, status); code != "" {
+		body["support_code"] = code
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeSupportCode issues the support code of an error response to r and
+// sets it as the X-Support-Code header. It returns the code, or "" if r
+// isn't traced.
+func writeSupportCode(w http.ResponseWriter, r *http.Request, status int) string {
+	code, ok := supportcode.Issue(r, status)
+	if !ok {
+		return ""
+	}
+	w.Header().Set(supportcode.Header, code)
+	return code
+}
+
+// createPayment checks a payment for fraud and stores it as pending on the
+// lane chosen for its amount, within requestBudget. An ID supplied by the
+// caller, such as the shard router, is kept; otherwise one is generated. A
+// payment.created event is committed to the outbox with the payment, or
+// payment.declined if the fraud check rejects it.
+func createPayment(ctx context.Context, payment Payment) (Payment, error) {
+	ctx, cancel := budget.New(ctx, requestBudget)
+	defer cancel()
+
+	verdict, err := authorize(ctx, payment)
+	if err != nil {
+		return payment, err
+	}
+	if !verdict.Approved {
+		if err := events.Commit(ctx, paymentmetrics.EventDeclined, func(newEvent outbox.NewEvent) error {
+			return paymentStore.AddEvent(ctx, payment, newEvent)
+		}); err != nil {
+			return payment, err
+		}
+		return payment, errFraudRejected
+	}
+
+	var commitErr error
+	storeCtx, end := budget.Spend(ctx, telemetry.DomainStore, 0)
+	_, err = router.Do(storeCtx, payment.ref(), func(ctx context.Context) {
+		if payment.ID == "" {
+			payment.ID = fmt.Sprintf("pay_%d", time.Now().UnixNano())
+		}
+		payment.Date = time.Now().Format(time.RFC3339)
+		payment.Status = "pending"
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			payment.TraceID, payment.SpanID = sc.TraceID().String(), sc.SpanID().String()
+		}
+
+		commitErr = events.Commit(ctx, paymentmetrics.EventCreated, func(newEvent outbox.NewEvent) error {
+			return paymentStore.Create(ctx, payment, newEvent)
+		})
+	})
+	if err = end(err); err != nil {
+		return payment, err
+	}
+	if commitErr == nil {
+		telemetry.LoggerFor(ctx).Debug("payment created",
+			zap.String("payment_id", payment.ID),
+			zap.Float64("amount", payment.Amount))
+		if value, ok := pricing.SettlementValue(payment.Amount, payment.Currency); ok {
+			paymentAmounts().Record(ctx, value)
+		}
+	}
+	return payment, commitErr
+}
+
+// paymentAmounts creates the payment amount histogram on first use, after
+// telemetry.Setup. Its buckets are set by a view; see
+// telemetry.DefaultViews.
+var paymentAmounts = sync.OnceValue(func() metric.Float64Histogram {
+	meter := telemetry.Meter()
+	h, err := meter.Float64Histogram(
+		"payment_amount",
+		metric.WithDescription("Value of the payments created, in the settlement currency"),
+		metric.WithUnit("{USD}"),
+	)
+	if err != nil {
+		h, _ = meter.Float64Histogram("payment_amount")
+	}
+	return h
+})
+
+// authorize validates payment and checks it for fraud within fraudBudget.
+// It is the decision path of createPayment.
+func authorize(ctx context.Context, payment Payment) (fraud.Verdict, error) {
+	if err := validate(ctx, payment); err != nil {
+		return fraud.Verdict{}, err
+	}
+	return checkFraud(ctx, payment)
+}
+
+// validate validates payment and records its problems on the span in ctx.
+func validate(ctx context.Context, payment Payment) error {
+	err := validatePayment(payment)
+	recordValidation(ctx, err)
+	return err
+}
+
+// checkFraud checks payment for fraud within fraudBudget.
+func checkFraud(ctx context.Context, payment Payment) (fraud.Verdict, error) {
+	fraudCtx, end := budget.Spend(ctx, telemetry.DomainFraud, fraudBudget)
+	verdict, err := fraudClient.Check(fraudCtx, payment.ref())
+	if err = end(err); err != nil {
+		return verdict, err
+	}
+	if inlineMetrics != nil {
+		inlineMetrics.Authorization(ctx, verdict.Approved)
+	}
+	return verdict, nil
+}
+
+// dryRunPayment authorizes and prices payment and picks its lane, within
+// requestBudget, without storing it or committing events. The fraud check
+// and the quote don't depend on each other, so they run in parallel under a
+// payment.dry_run span, each in a child span of its own; see dryRunTask.
+// The first of them to fail cancels the other, and the error that caused it
+// is recorded on the payment.dry_run span as parallel.cancel_cause.
+func dryRunPayment(ctx context.Context, payment Payment) (DryRunResult, error) {
+	ctx, cancel := budget.New(ctx, requestBudget)
+	defer cancel()
+
+	if err := validate(ctx, payment); err != nil {
+		return DryRunResult{}, err
+	}
+	var (
+		verdict fraud.Verdict
+		quote   pricing.Quote
+	)
+	groupCtx, span := telemetry.Tracer().Start(ctx, "payment.dry_run",
+		trace.WithAttributes(attribute.String("parallel.group", "payment.dry_run")))
+	groupCtx, cancelGroup := context.WithCancelCause(groupCtx)
+	var g errgroup.Group
+	g.Go(func() error {
+		return dryRunTask(groupCtx, cancelGroup, "payment.dry_run.fraud", func(ctx context.Context) (err error) {
+			verdict, err = checkFraud(ctx, payment)
+			return err
+		})
+	})
+	g.Go(func() error {
+		return dryRunTask(groupCtx, cancelGroup, "payment.dry_run.fx", func(ctx context.Context) (err error) {
+			quote, err = pricing.QuotePayment(ctx, payment.ref())
+			return err
+		})
+	})
+	err := g.Wait()
+	if err != nil {
+		span.SetAttributes(attribute.String("parallel.cancel_cause", context.Cause(groupCtx).Error()))
+		telemetry.SpanError(span, err)
+	}
+	cancelGroup(nil)
+	span.End()
+	if err != nil {
+		return DryRunResult{}, err
+	}
+	lane := router.LaneFor(payment.Amount)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Bool("payment.approved", verdict.Approved),
+		attribute.String("payment.lane", string(lane)),
+	)
+	return DryRunResult{
+		DryRun:     true,
+		Approved:   verdict.Approved,
+		FraudScore: verdict.Score,
+		Lane:       lane,
+		Quote:      quote,
+	}, nil
+}
+
+// dryRunTask runs fn, one task of a dry run, under a span named name. An
+// error from fn cancels the dry run's other task, with the error as the
+// cause. The task's parallel.outcome is ok, failed, or cancelled when the
+// other task failed first, and its duration is recorded in
+// parallel_task_duration_seconds by group, task and outcome.
+func dryRunTask(ctx context.Context, cancel context.CancelCauseFunc, name string, fn func(ctx context.Context) error) error {
+	attrs := []attribute.KeyValue{
+		attribute.String("parallel.group", "payment.dry_run"),
+		attribute.String("parallel.task", name),
+	}
+	taskCtx, span := telemetry.Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+	defer span.End()
+
+	start := time.Now()
+	err := fn(taskCtx)
+	outcome := "ok"
+	switch {
+	case err != nil && ctx.Err() != nil && errors.Is(err, context.Canceled):
+		// The other task failed first; its error is the reason.
+		outcome = "cancelled"
+		span.SetAttributes(attribute.String("parallel.cancel_cause", context.Cause(ctx).Error()))
+		telemetry.SpanError(span, err)
+	case err != nil:
+		outcome = "failed"
+		telemetry.SpanError(span, err)
+		cancel(err)
+	}
+	outcomeAttr := attribute.String("parallel.outcome", outcome)
+	span.SetAttributes(outcomeAttr)
+	dryRunTaskDuration().Record(taskCtx, time.Since(start).Seconds(), metric.WithAttributes(append(attrs, outcomeAttr)...))
+	return err
+}
+
+// dryRunTaskDuration creates the histogram on first use, after
+// telemetry.Setup.
+var dryRunTaskDuration = sync.OnceValue(func() metric.Float64Histogram {
+	h, err := telemetry.Meter().Float64Histogram(
+		"parallel_task_duration_seconds",
+		metric.WithDescription("Time tasks of parallel groups take, by group, task and outcome"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		h, _ = telemetry.Meter().Float64Histogram("parallel_task_duration_seconds")
+	}
+	return h
+})
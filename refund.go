@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/invariant"
+	"payment-service/internal/outbox"
+	"payment-service/internal/paymentmetrics"
+	paymentspan "payment-service/internal/payments"
+	"payment-service/internal/telemetry"
+)
+
+// Refund is a refund of part or all of a captured payment.
+type Refund struct {
+	ID        string  `json:"id"`
+	PaymentID string  `json:"payment_id"`
+	Amount    float64 `json:"amount"`
+	Currency  string  `json:"currency"`
+	Date      string  `json:"date"`
+}
+
+// refundRequest is the body of POST /api/payment/{id}/refund. Without an
+// amount, what is left of the payment is refunded; without a currency, the
+// payment's is used.
+type refundRequest struct {
+	Amount   *float64 `json:"amount"`
+	Currency string   `json:"currency"`
+}
+
+// errNotRefundable is returned for refunds of payments that are not
+// captured.
+var errNotRefundable = telemetry.WithFailureDomain(errors.New("payment is not refundable"), telemetry.DomainClient)
+
+// refundHandler refunds a captured payment and answers with the refund
+// record. The work runs under a payment.refund span that links to the span
+// that created the payment, so the refund's trace leads back to the
+// original one even though it is a different request, possibly days later.
+// The refund invariants are checked with package invariant, and a violation
+// is answered with 422. A refund that brings the total refunded to the
+// payment amount moves the payment to refunded. The refund is committed with
+// a payment.refunded event. Attempts are counted in payments_refunds_total
+// by result (refunded or rejected).
+func refundHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+	id := r.PathValue("id")
+
+	var req refundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid JSON", telemetry.WithFailureDomain(err, telemetry.DomainClient))
+		return
+	}
+
+	original, ok, err := paymentStore.Find(ctx, id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Payment store unavailable", err)
+		return
+	}
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "Payment not found", nil)
+		return
+	}
+	var opts []trace.SpanStartOption
+	if link, ok := original.creationSpan(); ok {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: link}))
+	}
+	ctx, span := paymentspan.StartSpan(ctx, paymentspan.OpRefund, original.ref(), opts...)
+	defer span.End()
+
+	var from string
+	decide := func(p Payment, refunds []Refund) (Payment, Refund, error) {
+		from = p.Status
+		if p.Status != "captured" {
+			return p, Refund{}, fmt.Errorf("%w: payment is %s, not captured", errNotRefundable, p.Status)
+		}
+		var refunded float64
+		for _, r := range refunds {
+			refunded += r.Amount
+		}
+		amount := p.Amount - refunded
+		if req.Amount != nil {
+			amount = *req.Amount
+		}
+		currency := p.Currency
+		if currency == "" {
+			currency = paymentspan.DefaultCurrency
+		}
+		refundCurrency := currency
+		if req.Currency != "" {
+			refundCurrency = req.Currency
+		}
+		for _, err := range []error{
+			invariant.CheckCurrencyMatch(currency, refundCurrency),
+			invariant.CheckRefundPositive(amount),
+			invariant.CheckRefundWithinCaptured(amount, refunded, p.Amount),
+		} {
+			if err != nil {
+				return p, Refund{}, invariant.Record(ctx, err)
+			}
+		}
+
+		if refunded+amount >= p.Amount {
+			p.Status = "refunded"
+		}
+		return p, Refund{
+			ID:        fmt.Sprintf("ref_%d", time.Now().UnixNano()),
+			PaymentID: id,
+			Amount:    amount,
+			Currency:  refundCurrency,
+			Date:      time.Now().Format(time.RFC3339),
+		}, nil
+	}
+	var p Payment
+	var refund Refund
+	err = events.Commit(ctx, paymentmetrics.EventRefunded, func(newEvent outbox.NewEvent) error {
+		var err error
+		p, refund, ok, err = paymentStore.Refund(ctx, id, decide, newEvent)
+		return err
+	})
+	var violation *invariant.Violation
+	switch {
+	case errors.As(err, &violation):
+		err = telemetry.WithFailureDomain(err, telemetry.DomainClient)
+		telemetry.SpanError(span, err)
+		refundMetrics().Add(ctx, 1, metric.WithAttributes(attribute.String("result", "rejected")))
+		writeError(w, r, http.StatusUnprocessableEntity, violation.Detail, err)
+		return
+	case errors.Is(err, errNotRefundable):
+		telemetry.SpanError(span, err)
+		refundMetrics().Add(ctx, 1, metric.WithAttributes(attribute.String("result", "rejected")))
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("Cannot refund a %s payment", from), err)
+		return
+	case err != nil:
+		telemetry.SpanError(span, err)
+		writeError(w, r, http.StatusInternalServerError, "Payment store unavailable", err)
+		return
+	case !ok:
+		// Compaction dropped the payment since it was found.
+		writeError(w, r, http.StatusNotFound, "Payment not found", nil)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("refund.id", refund.ID),
+		attribute.Float64("refund.amount", refund.Amount),
+	)
+	refundMetrics().Add(ctx, 1, metric.WithAttributes(attribute.String("result", "refunded")))
+	if p.Status != from {
+		transition := []attribute.KeyValue{
+			attribute.String("payment.status.from", from),
+			attribute.String("payment.status.to", p.Status),
+		}
+		trace.SpanFromContext(r.Context()).AddEvent("payment.status_changed", trace.WithAttributes(transition...))
+		statusMetrics().Add(ctx, 1, metric.WithAttributes(append(transition, attribute.String("result", "applied"))...))
+		statusWaits.Notify(id)
+	}
+	telemetry.LoggerFor(ctx).Debug("payment refunded",
+		zap.String("payment_id", id),
+		zap.String("refund_id", refund.ID),
+		zap.Float64("amount", refund.Amount))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(refund)
+}
+
+// creationSpan returns the span context of the span that created p, for
+// linking to it.
+func (p Payment) creationSpan() (trace.SpanContext, bool) {
+	traceID, err := trace.TraceIDFromHex(p.TraceID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	spanID, err := trace.SpanIDFromHex(p.SpanID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}), true
+}
+
+// refundMetrics creates the refund counter on first use, after
+// telemetry.Setup.
+var refundMetrics = sync.OnceValue(func() metric.Int64Counter {
+	meter := telemetry.Meter()
+	c, err := meter.Int64Counter(
+		"payments_refunds_total",
+		metric.WithDescription("Number of payment refunds requested, by result"),
+		metric.WithUnit("{refund}"),
+	)
+	if err != nil {
+		c, _ = meter.Int64Counter("payments_refunds_total")
+	}
+	return c
+})
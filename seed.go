@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"payment-service/internal/telemetry"
+)
+
+// seedStatuses are the statuses a seeded payment may have: pending, or one
+// of the settlement outcomes.
+var seedStatuses = []string{"pending", "settled", "failed"}
+
+// seedHandler stores the historical payments of an NDJSON body as they are,
+// IDs, dates and statuses included. Unlike an import, it skips the fraud
+// check, the lanes and the outbox, so cmd/seed can fill the store with
+// thousands of payments in seconds. Nothing is stored if any line is invalid.
+func seedHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var seeded []Payment
+	scanner := bufio.NewScanner(r.Body)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var p Payment
+		err := json.Unmarshal(scanner.Bytes(), &p)
+		if err == nil {
+			err = validateSeed(p)
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("line %d: %v", line, err), telemetry.WithFailureDomain(err, telemetry.DomainClient))
+			return
+		}
+		seeded = append(seeded, p)
+	}
+	if err := scanner.Err(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid NDJSON", telemetry.WithFailureDomain(err, telemetry.DomainClient))
+		return
+	}
+
+	if err := paymentStore.Add(r.Context(), seeded...); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Payment store unavailable", err)
+		return
+	}
+	total, err := paymentStore.Len(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Payment store unavailable", err)
+		return
+	}
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.Int("seed.payments", len(seeded)),
+		attribute.Int("store.payments", total),
+	)
+	json.NewEncoder(w).Encode(map[string]int{"seeded": len(seeded), "payments": total})
+}
+
+func validateSeed(p Payment) error {
+	switch {
+	case !strings.HasPrefix(p.ID, "pay_"):
+		return fmt.Errorf("id %q does not start with pay_", p.ID)
+	case p.Amount <= 0:
+		return errors.New("amount must be positive")
+	case !slices.Contains(seedStatuses, p.Status):
+		return fmt.Errorf("status %q is not one of %v", p.Status, seedStatuses)
+	}
+	if _, err := time.Parse(time.RFC3339, p.Date); err != nil {
+		return fmt.Errorf("date: %w", err)
+	}
+	return nil
+}
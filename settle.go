@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"payment-service/internal/outbox"
+	"payment-service/internal/paymentmetrics"
+	"payment-service/internal/telemetry"
+)
+
+// errNotSettleable is returned when a settlement timer fires for a payment
+// that is no longer captured, such as one refunded in the meantime.
+var errNotSettleable = telemetry.WithFailureDomain(errors.New("payment is not settleable"), telemetry.DomainInternal)
+
+// settledPayment is the payload of payment.settled: the payment, and when
+// it settled, which paymentmetrics measures settlement latency from.
+type settledPayment struct {
+	Payment
+	SettledAt string `json:"settled_at"`
+}
+
+// settlePayment moves a captured payment to settled and commits a
+// payment.settled event with it. It is the settlement scheduler's
+// SettleFunc.
+func settlePayment(ctx context.Context, id string) error {
+	return events.Commit(ctx, paymentmetrics.EventSettled, func(newEvent outbox.NewEvent) error {
+		var settled settledPayment
+		_, ok, err := paymentStore.Update(ctx, id, func(p Payment) (Payment, error) {
+			if p.Status != "captured" {
+				return p, fmt.Errorf("%w: payment is %s", errNotSettleable, p.Status)
+			}
+			p.Status = "settled"
+			settled = settledPayment{Payment: p, SettledAt: time.Now().Format(time.RFC3339Nano)}
+			return p, nil
+		}, func(any) (outbox.Event, error) {
+			return newEvent(settled)
+		})
+		if err == nil && !ok {
+			// Compaction dropped the payment since it was captured.
+			err = fmt.Errorf("%w: payment %s not found", errNotSettleable, id)
+		}
+		if err == nil {
+			statusWaits.Notify(id)
+		}
+		return err
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"payment-service/internal/outbox"
+	"payment-service/internal/paymentmetrics"
+	"payment-service/internal/telemetry"
+)
+
+// statusTransitions is the payment state machine: the statuses each status
+// may change to. A payment is authorized or fails, an authorized payment is
+// captured or fails, and a captured payment may be refunded. Other statuses,
+// such as seeded settled payments, are final.
+var statusTransitions = map[string][]string{
+	"pending":    {"authorized", "failed"},
+	"authorized": {"captured", "failed"},
+	"captured":   {"refunded"},
+}
+
+// paymentStatuses are all the statuses a payment may have.
+var paymentStatuses = []string{"pending", "authorized", "captured", "settled", "failed", "refunded"}
+
+// errInvalidTransition is returned for status changes the state machine
+// doesn't allow.
+var errInvalidTransition = telemetry.WithFailureDomain(errors.New("invalid payment status transition"), telemetry.DomainClient)
+
+// statusRequest is the body of PUT /api/payment/{id}/status.
+type statusRequest struct {
+	Status string `json:"status"`
+}
+
+// statusChange is the payload of payment.status_changed: the payment as the
+// change left it, and the status it had before.
+type statusChange struct {
+	Payment
+	From string `json:"from_status"`
+}
+
+// updateStatusHandler moves a payment to the requested status if the state
+// machine allows it, and answers 409 Conflict if not, even for a status no
+// payment may change to, such as pending. A string that is no status at all
+// gets 400. Every transition adds a payment.status_changed event to the
+// server span, commits one to the outbox with the payment and wakes long
+// polls on the payment, and a captured payment is scheduled to settle.
+// Attempts are counted in payments_status_transitions_total by from and to
+// status and result (applied or rejected).
+func updateStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+	id := r.PathValue("id")
+	span := trace.SpanFromContext(ctx)
+
+	var req statusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid JSON", telemetry.WithFailureDomain(err, telemetry.DomainClient))
+		return
+	}
+	if !slices.Contains(paymentStatuses, req.Status) {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown status %q", req.Status),
+			telemetry.WithFailureDomain(fmt.Errorf("unknown payment status %q", req.Status), telemetry.DomainClient))
+		return
+	}
+
+	var from string
+	var p Payment
+	var ok bool
+	err := events.Commit(ctx, paymentmetrics.EventStatusChanged, func(newEvent outbox.NewEvent) error {
+		var err error
+		p, ok, err = paymentStore.Update(ctx, id, func(p Payment) (Payment, error) {
+			from = p.Status
+			if !slices.Contains(statusTransitions[p.Status], req.Status) {
+				return p, fmt.Errorf("%w from %s to %s", errInvalidTransition, p.Status, req.Status)
+			}
+			p.Status = req.Status
+			return p, nil
+		}, func(changed any) (outbox.Event, error) {
+			return newEvent(statusChange{Payment: changed.(Payment), From: from})
+		})
+		return err
+	})
+	transition := []attribute.KeyValue{
+		attribute.String("payment.status.from", from),
+		attribute.String("payment.status.to", req.Status),
+	}
+	switch {
+	case errors.Is(err, errInvalidTransition):
+		statusMetrics().Add(ctx, 1, metric.WithAttributes(append(transition, attribute.String("result", "rejected"))...))
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("Cannot change status from %s to %s", from, req.Status), err)
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, "Payment store unavailable", err)
+		return
+	case !ok:
+		writeError(w, r, http.StatusNotFound, "Payment not found", nil)
+		return
+	}
+
+	span.AddEvent("payment.status_changed", trace.WithAttributes(transition...))
+	statusMetrics().Add(ctx, 1, metric.WithAttributes(append(transition, attribute.String("result", "applied"))...))
+	statusWaits.Notify(id)
+	if p.Status == "captured" {
+		settlements.Schedule(ctx, p.ref())
+	}
+	telemetry.LoggerFor(ctx).Debug("payment status changed",
+		zap.String("payment_id", id),
+		zap.String("from", from),
+		zap.String("to", p.Status))
+	json.NewEncoder(w).Encode(p)
+}
+
+// statusMetrics creates the transition counter on first use, after
+// telemetry.Setup.
+var statusMetrics = sync.OnceValue(func() metric.Int64Counter {
+	meter := telemetry.Meter()
+	c, err := meter.Int64Counter(
+		"payments_status_transitions_total",
+		metric.WithDescription("Number of payment status changes requested, by from and to status and result"),
+		metric.WithUnit("{transition}"),
+	)
+	if err != nil {
+		c, _ = meter.Int64Counter("payments_status_transitions_total")
+	}
+	return c
+})
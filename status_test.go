@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"payment-service/internal/baggageguard"
+	"payment-service/internal/clientip"
+	"payment-service/internal/fault"
+	"payment-service/internal/tenant"
+)
+
+func TestUpdateStatus(t *testing.T) {
+	initDependencies()
+	h, err := newHandler(fault.Config{}, nil, baggageguard.Config{}, clientip.Config{}, tenant.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		from, to string
+		status   int
+	}{
+		{"pending", "authorized", http.StatusOK},
+		{"authorized", "pending", http.StatusConflict},
+		{"pending", "pending", http.StatusConflict},
+		{"failed", "settled", http.StatusConflict},
+		{"authorized", "refunded", http.StatusConflict},
+		{"pending", "approved", http.StatusBadRequest},
+		{"pending", "", http.StatusBadRequest},
+	} {
+		id := "pay_status_" + tc.from + "_" + tc.to
+		if err := paymentStore.Add(context.Background(), Payment{ID: id, Amount: 10, Currency: "USD", Status: tc.from}); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/payment/"+id+"/status", strings.NewReader(`{"status": "`+tc.to+`"}`)))
+		if w.Code != tc.status {
+			t.Errorf("%s to %q: status %d, want %d: %s", tc.from, tc.to, w.Code, tc.status, w.Body)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+
+	"payment-service/internal/locks"
+	"payment-service/internal/outbox"
+	"payment-service/internal/telemetry"
+)
+
+// errStore is wrapped by the errors of a payment store backend.
+var errStore = errors.New("payment store failed")
+
+// storeError tags err as a failure of the payment store.
+func storeError(err error) error {
+	return telemetry.WithFailureDomain(fmt.Errorf("%w: %w", errStore, err), telemetry.DomainStore)
+}
+
+// paymentBackend keeps the payments of a PaymentStore, oldest first.
+// PaymentStore serializes writes, so backends only have to allow concurrent
+// reads.
+type paymentBackend interface {
+	all(ctx context.Context) ([]Payment, error)
+	find(ctx context.Context, id string) (Payment, bool, error)
+	count(ctx context.Context) (int, error)
+	add(ctx context.Context, ps []Payment) error
+	create(ctx context.Context, p Payment, e LedgerEntry, newEvent outbox.NewEvent) error
+	event(ctx context.Context, payload any, newEvent outbox.NewEvent) error
+	update(ctx context.Context, id string, update func(Payment) (Payment, error), newEvent outbox.NewEvent) (Payment, bool, error)
+	refund(ctx context.Context, id string, refund refundFunc, newEvent outbox.NewEvent) (Payment, Refund, bool, error)
+	rewrite(ctx context.Context, rewrite func([]Payment) []Payment) error
+	ping(ctx context.Context) error
+}
+
+// PaymentStore is the service's payment store, shared by every handler and
+// instance. It is safe for concurrent use. Payments are kept in memory or,
+// with -db, in a SQL database; see db.go. Each method call is a span named
+// after it, such as PaymentStore.Find, which parents the waits for the
+// store lock and the backend's statements.
+type PaymentStore struct {
+	mu      *locks.RWMutex
+	backend paymentBackend
+	history *paymentHistory
+
+	// latency is a moving average of the time calls take, waiting for the
+	// lock included, in nanoseconds, and latencyAt the Unix time in
+	// nanoseconds of the last call.
+	latency, latencyAt atomic.Int64
+}
+
+// NewPaymentStore returns a store whose lock is recorded as name, and whose
+// history starts from the payments backend already holds. A nil backend
+// keeps payments in memory.
+func NewPaymentStore(ctx context.Context, name string, backend paymentBackend) (*PaymentStore, error) {
+	if backend == nil {
+		backend = &memoryPayments{}
+	}
+	ps, err := backend.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentStore{mu: locks.NewRWMutex(name), backend: backend, history: newPaymentHistory(ps)}, nil
+}
+
+// All returns the stored payments, oldest first. Callers must not modify
+// the returned slice.
+func (s *PaymentStore) All(ctx context.Context) ([]Payment, error) {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	defer s.observe(time.Now())
+	runlock := s.mu.RLock(ctx)
+	defer runlock()
+	return s.backend.all(ctx)
+}
+
+// Ping checks that the backend can be reached. It doesn't take the store
+// lock, so a long write doesn't make the store look down.
+func (s *PaymentStore) Ping(ctx context.Context) error {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	return s.backend.ping(ctx)
+}
+
+// Latency returns the moving average of the time the store's calls took,
+// or 0 if there was none in the last minute, so a slow spell is forgotten
+// once traffic stops.
+func (s *PaymentStore) Latency() time.Duration {
+	if time.Since(time.Unix(0, s.latencyAt.Load())) > time.Minute {
+		return 0
+	}
+	return time.Duration(s.latency.Load())
+}
+
+// observe adds the call that started at start to the store's latency.
+func (s *PaymentStore) observe(start time.Time) {
+	now := time.Now()
+	// Racing calls may lose an update; the average is only a health signal.
+	avg := s.latency.Load()
+	s.latency.Store(avg + (int64(now.Sub(start))-avg)/8)
+	s.latencyAt.Store(now.UnixNano())
+}
+
+// registerStoreMetrics registers the store_payments gauge, observed from
+// paymentStore at each collection rather than updated on every write.
+func registerStoreMetrics() error {
+	_, err := telemetry.Meter().Int64ObservableGauge(
+		"store_payments",
+		metric.WithDescription("Number of payments in the store"),
+		metric.WithUnit("{payment}"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			n, err := paymentStore.Len(ctx)
+			if err != nil {
+				return err
+			}
+			o.Observe(int64(n))
+			return nil
+		}),
+	)
+	return err
+}
+
+// Len returns the number of stored payments.
+func (s *PaymentStore) Len(ctx context.Context) (int, error) {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	defer s.observe(time.Now())
+	runlock := s.mu.RLock(ctx)
+	defer runlock()
+	return s.backend.count(ctx)
+}
+
+// Find returns the first payment with id.
+func (s *PaymentStore) Find(ctx context.Context, id string) (Payment, bool, error) {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	defer s.observe(time.Now())
+	runlock := s.mu.RLock(ctx)
+	defer runlock()
+	return s.backend.find(ctx, id)
+}
+
+// Add appends ps to the store under one lock.
+func (s *PaymentStore) Add(ctx context.Context, ps ...Payment) error {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	defer s.observe(time.Now())
+	unlock := s.mu.Lock(ctx)
+	defer unlock()
+	if err := s.backend.add(ctx, ps); err != nil {
+		return err
+	}
+	for _, p := range ps {
+		s.history.record(historyCreated, p)
+	}
+	return nil
+}
+
+// LedgerEntry is a movement of a payment's money. Entries are only ever
+// added while the payment is stored, and are dropped with it by compaction.
+type LedgerEntry struct {
+	PaymentID string
+	Kind      string
+	Amount    float64
+	Currency  string
+	Date      string
+}
+
+// ledgerAuthorization is the kind of the entry that holds the amount of a
+// payment when it is created.
+const ledgerAuthorization = "authorization"
+
+// Create stores p with its authorization ledger entry and the outbox event
+// newEvent makes of it, all or none, under one lock.
+func (s *PaymentStore) Create(ctx context.Context, p Payment, newEvent outbox.NewEvent) error {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	defer s.observe(time.Now())
+	unlock := s.mu.Lock(ctx)
+	defer unlock()
+	err := s.backend.create(ctx, p, LedgerEntry{
+		PaymentID: p.ID,
+		Kind:      ledgerAuthorization,
+		Amount:    p.Amount,
+		Currency:  p.Currency,
+		Date:      p.Date,
+	}, newEvent)
+	if err != nil {
+		return err
+	}
+	s.history.record(historyCreated, p)
+	return nil
+}
+
+// AddEvent stores the outbox event newEvent makes of payload, for an event
+// that comes with no write of its own, such as a declined payment.
+func (s *PaymentStore) AddEvent(ctx context.Context, payload any, newEvent outbox.NewEvent) error {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	defer s.observe(time.Now())
+	unlock := s.mu.Lock(ctx)
+	defer unlock()
+	return s.backend.event(ctx, payload, newEvent)
+}
+
+// Update replaces the payment with id by what update returns for it, under
+// the store lock, and returns the new payment. If newEvent isn't nil, the
+// outbox event it makes of the new payment is stored with it. It reports
+// false if there is no such payment. An error from update leaves the
+// payment unchanged and is returned as is.
+func (s *PaymentStore) Update(ctx context.Context, id string, update func(Payment) (Payment, error), newEvent outbox.NewEvent) (Payment, bool, error) {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	defer s.observe(time.Now())
+	unlock := s.mu.Lock(ctx)
+	defer unlock()
+	p, ok, err := s.backend.update(ctx, id, update, newEvent)
+	if ok && err == nil {
+		s.history.record(historyUpdated, p)
+	}
+	return p, ok, err
+}
+
+// refundFunc decides on a refund of p, given its earlier refunds, and
+// returns the refund and the payment as the refund leaves it.
+type refundFunc func(p Payment, refunds []Refund) (Payment, Refund, error)
+
+// Refund stores the refund that refund returns for the payment with id,
+// together with the payment it returns and the outbox event newEvent makes
+// of the refund, under the store lock. It reports false if there is no such
+// payment. An error from refund stores nothing and is returned as is.
+func (s *PaymentStore) Refund(ctx context.Context, id string, refund refundFunc, newEvent outbox.NewEvent) (Payment, Refund, bool, error) {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	defer s.observe(time.Now())
+	unlock := s.mu.Lock(ctx)
+	defer unlock()
+	p, r, ok, err := s.backend.refund(ctx, id, refund, newEvent)
+	if ok && err == nil {
+		s.history.record(historyRefunded, p)
+	}
+	return p, r, ok, err
+}
+
+// Rewrite replaces the stored payments with what rewrite returns, holding
+// the lock exclusively while it runs. It isn't recorded in the history.
+// rewrite must not modify its argument. Rewrite returns how long it held
+// the lock, from acquiring it to releasing it, the backend's writes
+// included: the longest any other call was kept waiting.
+func (s *PaymentStore) Rewrite(ctx context.Context, rewrite func([]Payment) []Payment) (time.Duration, error) {
+	ctx, span := telemetry.StartCallerSpan(ctx)
+	defer span.End()
+	defer s.observe(time.Now())
+	unlock := s.mu.Lock(ctx)
+	locked := time.Now()
+	err := s.backend.rewrite(ctx, rewrite)
+	held := time.Since(locked)
+	unlock()
+	return held, err
+}
+
+// memoryPayments keeps payments in a slice, which is lost on restart. It
+// doesn't store events: the outbox keeps them in memory too.
+// Readers get the slice itself rather than a copy: writers only append to it
+// or, in update and rewrite, replace it with a new one, so a slice returned by
+// all stays valid after the store lock is released.
+type memoryPayments struct {
+	payments []Payment
+	refunds  map[string][]Refund
+	ledger   []LedgerEntry
+}
+
+func (m *memoryPayments) all(context.Context) ([]Payment, error) {
+	return m.payments, nil
+}
+
+func (m *memoryPayments) find(_ context.Context, id string) (Payment, bool, error) {
+	for _, p := range m.payments {
+		if p.ID == id {
+			return p, true, nil
+		}
+	}
+	return Payment{}, false, nil
+}
+
+func (m *memoryPayments) count(context.Context) (int, error) {
+	return len(m.payments), nil
+}
+
+func (m *memoryPayments) add(_ context.Context, ps []Payment) error {
+	m.payments = append(m.payments, ps...)
+	return nil
+}
+
+func (m *memoryPayments) create(_ context.Context, p Payment, e LedgerEntry, newEvent outbox.NewEvent) error {
+	if _, err := newEvent(p); err != nil {
+		return err
+	}
+	m.payments = append(m.payments, p)
+	m.ledger = append(m.ledger, e)
+	return nil
+}
+
+func (m *memoryPayments) event(_ context.Context, payload any, newEvent outbox.NewEvent) error {
+	_, err := newEvent(payload)
+	return err
+}
+
+// update replaces every payment with id, so a duplicate that compaction has
+// not dropped yet doesn't shadow the change.
+func (m *memoryPayments) update(_ context.Context, id string, update func(Payment) (Payment, error), newEvent outbox.NewEvent) (Payment, bool, error) {
+	i := slices.IndexFunc(m.payments, func(p Payment) bool { return p.ID == id })
+	if i < 0 {
+		return Payment{}, false, nil
+	}
+	p, err := update(m.payments[i])
+	if err != nil {
+		return Payment{}, true, err
+	}
+	if newEvent != nil {
+		if _, err := newEvent(p); err != nil {
+			return Payment{}, true, err
+		}
+	}
+	// Readers may hold the current slice, so the change goes into a copy.
+	ps := slices.Clone(m.payments)
+	for j := i; j < len(ps); j++ {
+		if ps[j].ID == id {
+			ps[j] = p
+		}
+	}
+	m.payments = ps
+	return p, true, nil
+}
+
+func (m *memoryPayments) refund(ctx context.Context, id string, refund refundFunc, newEvent outbox.NewEvent) (Payment, Refund, bool, error) {
+	var r Refund
+	p, ok, err := m.update(ctx, id, func(p Payment) (Payment, error) {
+		var err error
+		p, r, err = refund(p, m.refunds[id])
+		return p, err
+	}, func(any) (outbox.Event, error) {
+		return newEvent(r)
+	})
+	if !ok || err != nil {
+		return Payment{}, Refund{}, ok, err
+	}
+	if m.refunds == nil {
+		m.refunds = make(map[string][]Refund)
+	}
+	m.refunds[id] = append(m.refunds[id], r)
+	return p, r, true, nil
+}
+
+func (m *memoryPayments) rewrite(_ context.Context, rewrite func([]Payment) []Payment) error {
+	m.payments = rewrite(m.payments)
+	kept := make(map[string]bool, len(m.payments))
+	for _, p := range m.payments {
+		kept[p.ID] = true
+	}
+	m.ledger = slices.DeleteFunc(m.ledger, func(e LedgerEntry) bool { return !kept[e.PaymentID] })
+	maps.DeleteFunc(m.refunds, func(id string, _ []Refund) bool { return !kept[id] })
+	return nil
+}
+
+func (m *memoryPayments) ping(context.Context) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+//go:build !notelemetry
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+
+	"payment-service/internal/baggageguard"
+	"payment-service/internal/clientip"
+	"payment-service/internal/fault"
+	"payment-service/internal/spantree"
+	"payment-service/internal/telemetry"
+	"payment-service/internal/tenant"
+)
+
+// TestTraceTopology compares the span tree of each request with its golden
+// file under testdata/spantree, so a change that adds, drops or reparents a
+// span shows up in review. Rewrite the files after an intended change with
+//
+//	go test -run TestTraceTopology . -update
+func TestTraceTopology(t *testing.T) {
+	spans := tracetest.NewInMemoryExporter()
+	p := &telemetry.Providers{
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)),
+		MeterProvider:  sdkmetric.NewMeterProvider(),
+		Logger:         zap.NewNop(),
+	}
+	p.Install()
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+	initDependencies()
+	paymentStore.Add(context.Background(), Payment{ID: "pay_topology", Amount: 10, Status: "pending"})
+	memory := paymentStore
+	db, err := openPayments(context.Background(), filepath.Join(t.TempDir(), "payments.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	h, err := newHandler(fault.Config{}, nil, baggageguard.Config{}, clientip.Config{}, tenant.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := spantree.Options{
+		Attributes: []attribute.Key{"http.route", "http.response.status_code", "payment.lane", "fraud.outcome", "hedge.attempt", "db.transaction.name"},
+		Events:     true,
+	}
+	for _, tc := range []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		// db stores payments in SQLite rather than in memory, to show
+		// the spans of the store's transactions.
+		db bool
+	}{
+		{"create_payment", http.MethodPost, "/api/payment", `{"amount": 42}`, http.StatusCreated, false},
+		{"create_payment_db", http.MethodPost, "/api/payment", `{"amount": 42}`, http.StatusCreated, true},
+		{"create_payment_invalid", http.MethodPost, "/api/payment", `{"amount": -1}`, http.StatusBadRequest, false},
+		{"get_payment", http.MethodGet, "/api/payment/pay_topology", "", http.StatusOK, false},
+		{"get_payment_missing", http.MethodGet, "/api/payment/pay_missing", "", http.StatusNotFound, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			paymentStore = memory
+			if tc.db {
+				paymentStore, err = NewPaymentStore(context.Background(), "store.payments", db)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { paymentStore = memory })
+			}
+			spans.Reset()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+			if w.Code != tc.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			spantree.Compare(t, filepath.Join("testdata", "spantree", tc.name+".golden"), spans.GetSpans().Snapshots(), opts)
+		})
+	}
+}
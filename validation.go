@@ -0,0 +1,167 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	currencies "payment-service/internal/currency"
+	paymentspan "payment-service/internal/payments"
+	"payment-service/internal/pricing"
+	"payment-service/internal/telemetry"
+)
+
+// maxAmount caps the value of a payment, in the settlement currency. main
+// sets it from -max-amount.
+var maxAmount = 1_000_000.0
+
+// Reasons a payment is invalid.
+const (
+	reasonAmountNotPositive   = "amount_not_positive"
+	reasonAmountTooLarge      = "amount_too_large"
+	reasonCurrencyUnsupported = "currency_unsupported"
+	reasonCurrencyUnknown     = "currency_unknown"
+)
+
+// fieldProblem is one reason a payment is invalid.
+type fieldProblem struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail"`
+}
+
+// validationError is returned for invalid payments. It lists every problem
+// of the payment, not just the first, and wraps errInvalidPayment.
+type validationError struct {
+	problems []fieldProblem
+	// unknownCurrency is the currency of the payment if it isn't an ISO
+	// 4217 code.
+	unknownCurrency string
+}
+
+func (e *validationError) Error() string {
+	details := make([]string, len(e.problems))
+	for i, p := range e.problems {
+		details[i] = p.Detail
+	}
+	return "invalid payment: " + strings.Join(details, "; ")
+}
+
+func (e *validationError) Unwrap() error {
+	return errInvalidPayment
+}
+
+// validatePayment rejects payments that can't be priced or are worth more
+// than maxAmount. Currencies are the ISO 4217 codes pricing has rates for;
+// a code that isn't in ISO 4217 is rejected as unknown, not priced as
+// payments.DefaultCurrency. An empty currency is not rejected: it means
+// payments.DefaultCurrency.
+func validatePayment(p Payment) error {
+	invalid := &validationError{}
+	if !(p.Amount > 0) {
+		invalid.problems = append(invalid.problems, fieldProblem{"amount", reasonAmountNotPositive, "amount must be a positive number"})
+	}
+	value, priced := pricing.SettlementValue(p.Amount, p.Currency)
+	_, known := currencies.Lookup(cmp.Or(p.Currency, paymentspan.DefaultCurrency))
+	switch {
+	case !known:
+		invalid.unknownCurrency = p.Currency
+		invalid.problems = append(invalid.problems, fieldProblem{"currency", reasonCurrencyUnknown,
+			fmt.Sprintf("%q is not an ISO 4217 currency code", p.Currency)})
+	case !priced:
+		invalid.problems = append(invalid.problems, fieldProblem{"currency", reasonCurrencyUnsupported, fmt.Sprintf("unsupported currency %q", p.Currency)})
+	case value > maxAmount:
+		invalid.problems = append(invalid.problems, fieldProblem{"amount", reasonAmountTooLarge,
+			fmt.Sprintf("amount is worth %.2f %s, more than the maximum of %.2f", value, pricing.SettlementCurrency, maxAmount)})
+	}
+	if len(invalid.problems) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// recordValidation records the problems of an invalid payment on the span
+// in ctx: their reasons as payment.validation.reasons, and a
+// payment.validation_failed event for each. They are counted in
+// payment_validation_failures_total by field and reason, and an unknown
+// currency also in currency_unknown_total.
+func recordValidation(ctx context.Context, err error) {
+	var invalid *validationError
+	if !errors.As(err, &invalid) {
+		return
+	}
+	if invalid.unknownCurrency != "" {
+		currencies.RecordUnknown(ctx, invalid.unknownCurrency)
+	}
+	span := trace.SpanFromContext(ctx)
+	reasons := make([]string, len(invalid.problems))
+	for i, p := range invalid.problems {
+		reasons[i] = p.Reason
+		attrs := []attribute.KeyValue{
+			attribute.String("validation.field", p.Field),
+			attribute.String("validation.reason", p.Reason),
+		}
+		span.AddEvent("payment.validation_failed", trace.WithAttributes(append(attrs,
+			attribute.String("validation.detail", p.Detail),
+		)...))
+		validationMetrics().Add(ctx, 1, metric.WithAttributes(attrs...))
+	}
+	span.SetAttributes(attribute.StringSlice("payment.validation.reasons", reasons))
+}
+
+// problem is an RFC 7807 problem details body. Errors and SupportCode are
+// extension members.
+type problem struct {
+	Type     string         `json:"type"`
+	Title    string         `json:"title"`
+	Status   int            `json:"status"`
+	Detail   string         `json:"detail,omitempty"`
+	Instance string         `json:"instance,omitempty"`
+	Errors   []fieldProblem `json:"errors,omitempty"`
+	// SupportCode resolves to the trace of the request; see
+	// writeSupportCode.
+	SupportCode string `json:"support_code,omitempty"`
+}
+
+// writeValidationError writes an invalid payment as an
+// application/problem+json 400 response and records the error and issues a
+// support code like writeError.
+func writeValidationError(w http.ResponseWriter, r *http.Request, err *validationError) {
+	telemetry.RecordError(r.Context(), err)
+	w.Header().Set("Content-Type", "application/problem+json")
+	code := writeSupportCode(w, r, http.StatusBadRequest)
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(problem{
+		Type:        "/problems/invalid-payment",
+		Title:       "Invalid payment",
+		Status:      http.StatusBadRequest,
+		Detail:      err.Error(),
+		Instance:    r.URL.Path,
+		Errors:      err.problems,
+		SupportCode: code,
+	})
+}
+
+// validationMetrics creates the validation failure counter on first use,
+// after telemetry.Setup.
+var validationMetrics = sync.OnceValue(func() metric.Int64Counter {
+	meter := telemetry.Meter()
+	c, err := meter.Int64Counter(
+		"payment_validation_failures_total",
+		metric.WithDescription("Number of problems found in invalid payments, by field and reason"),
+		metric.WithUnit("{problem}"),
+	)
+	if err != nil {
+		c, _ = meter.Int64Counter("payment_validation_failures_total")
+	}
+	return c
+})
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestValidatePaymentCurrency(t *testing.T) {
+	for _, tc := range []struct {
+		currency string
+		// reasons are the problems of the payment; none means it is valid.
+		reasons []string
+	}{
+		{"USD", nil},
+		{"EUR", nil},
+		// An empty currency is USD, not rejected.
+		{"", nil},
+		{"XYZ", []string{reasonCurrencyUnknown}},
+		{"usd", []string{reasonCurrencyUnknown}},
+		{"CHF", []string{reasonCurrencyUnsupported}},
+	} {
+		err := validatePayment(Payment{Amount: 10, Currency: tc.currency})
+		var reasons []string
+		var invalid *validationError
+		if errors.As(err, &invalid) {
+			for _, p := range invalid.problems {
+				reasons = append(reasons, p.Reason)
+			}
+		} else if err != nil {
+			t.Fatalf("validatePayment(%q) = %v, want a validation error", tc.currency, err)
+		}
+		if !slices.Equal(reasons, tc.reasons) {
+			t.Errorf("validatePayment(%q) reasons = %v, want %v", tc.currency, reasons, tc.reasons)
+		}
+	}
+}